@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -43,12 +44,110 @@ type Config struct {
 	Max429Count       int     `json:"max_429_count"`        // 最大429次数阈值
 	RecoveryBonus     int     `json:"recovery_bonus"`        // 成功恢复的健康分数奖励
 	PenaltyFactor     float64 `json:"penalty_factor"`       // 429惩罚系数
+	MaxConcurrentPerKey int   `json:"max_concurrent_per_key"` // 单个Key的最大并发请求数，0 表示不限制
+
+	// 按模型熔断配置
+	CircuitBreakerEnabled   bool          // 是否启用按模型熔断
+	CircuitFailureThreshold float64       // 窗口内 5xx/超时 比例达到该值时熔断
+	CircuitMinRequests      int           // 窗口内至少有多少请求才进行熔断判断
+	CircuitWindow           time.Duration // 失败率统计窗口
+	CircuitOpenDuration     time.Duration // 熔断打开后多久进入半开状态
+	CircuitHalfOpenProbes   int           // 半开状态下同时放行的探测请求数
+
+	// 模型回退链，原始格式如 "gemini-2.5-pro->gemini-2.5-flash->gemini-2.0-flash;gemini-x->gemini-y"
+	ModelFallbacksSpec string
+	ModelFallbacks     map[string][]string // 请求模型 -> 按顺序尝试的回退模型
+
+	ThinkingBudgetsSpec string
+	ThinkingBudgets     map[string]int // 模型 -> 默认思考预算，同时是客户端可请求的上限 (-1 表示动态预算，不设上限)
+
+	ModelCatalogueTTL time.Duration // 上游模型列表缓存的有效期
+
+	// 响应缓存
+	ResponseCacheEnabled       bool
+	ResponseCacheBackend       string // memory 或 sqlite，需重启生效
+	ResponseCacheSQLitePath    string
+	ResponseCacheTTL           time.Duration
+	ResponseCacheMaxEntries    int
+	ResponseCacheMaxBytes      int // 缓存总大小上限
+	ResponseCacheMaxEntryBytes int // 单条响应大小上限，超过的响应不缓存
+
+	RequestCoalescingEnabled bool // 合并并发的相同 countTokens / temperature=0 请求
+
+	// Batch API
+	BatchFilesDir     string  // 上传文件和批处理结果文件的保存目录，需重启生效
+	BatchPoolFraction float64 // 批处理最多占用的 Key 池容量比例
+	BatchMaxFileBytes int64   // 单个上传文件的大小上限
+	BatchMaxRequests  int     // 单个批处理最多包含的请求数
+
+	// 图片生成
+	ImageDefaultModel string        // /v1/images/generations 未指定模型或使用 OpenAI 模型名时的默认模型
+	ImageEditModel    string        // /v1/images/edits 的默认模型，必须是支持图片输入的 Gemini 图片模型
+	ImageFilesDir     string        // response_format=url 时图片的保存目录，需重启生效
+	ImageURLTTL       time.Duration // 图片链接的有效期
+	PublicBaseURL     string        // 对外访问本服务的地址，用于拼接图片链接；为空时使用请求的 Host
+
+	// 语音
+	AudioTTSModel           string // /v1/audio/speech 未指定模型或使用 OpenAI 模型名时的默认 TTS 模型
+	AudioTranscriptionModel string // /v1/audio/transcriptions 的默认转写模型
+	AudioFFmpegPath         string // 输出 mp3/opus/aac/flac 时使用的 ffmpeg 可执行文件
+
+	// 多模态消息中的远程媒体
+	MediaFetchEnabled      bool          // 下载 image_url / input_audio / file 中的 http(s) 地址并转换为内联数据
+	MediaFetchMaxBytes     int64         // 单个远程媒体的大小上限
+	MediaFetchMaxParts     int           // 单个请求中最多下载的远程媒体数量
+	MediaFetchMaxTotal     int64         // 单个请求中所有远程媒体的总大小上限
+	MediaFetchTimeout      time.Duration // 单个远程媒体的下载超时
+	MediaFetchAllowedHosts string        // 允许下载的主机，逗号分隔，支持 *.example.com；为空时允许所有公网主机
+
+	// Live API (WebSocket)
+	LiveMaxSession   time.Duration // 单个 Live 会话的最长时长，到期后由代理关闭
+	LiveSetupTimeout time.Duration // 等待客户端 setup 消息和上游 setupComplete 的超时
+
+	// 多选项 (n > 1)
+	ChatMaxN              int // chat/completions 允许的最大 n
+	ChatCandidatesPerCall int // 单次上游调用请求的候选数上限，超过时拆分为多个并行请求
+
+	// 请求策略，转发前应用于 OpenAI 和 Gemini 接口的请求
+	PolicySafetySettingsSpec string
+	PolicySafetySettings     []SafetySetting // 请求未指定的类别使用的默认 safetySettings
+	PolicySystemPrompt       string          // 全局系统提示词，客户端配置了自己的提示词时以客户端为准
+	PolicyMaxOutputTokens    int             // max_tokens / maxOutputTokens 的上限，0 表示不限制
+	PolicyMaxTemperature     float64         // temperature 的上限，小于 0 表示不限制
+	PolicyDisallowedTools    string          // 转发前移除的工具，逗号分隔 (code_execution、google_search、url_context、function 等)
+	PolicyMaxBodyBytes       int64           // JSON 请求体的大小上限，0 表示不限制
+
+	// 内容脱敏: 转发前检查请求中的消息文本，并对日志中的请求内容进行同样的处理
+	RedactionMode      string // off、log_only (只记录)、redact (替换后转发)、block (拒绝请求)
+	RedactionDetectors string // 启用的内置检测器，逗号分隔: email、phone、credit_card、api_key
+	RedactionPatterns  string // 自定义正则表达式，多个表达式以 ;; 分隔
+
+	// 会话线程 (/v1/threads): 服务端保存的对话历史超过上下文窗口时的处理
+	ThreadContextTokens    int    // 发送给模型的历史的 token 上限，0 表示使用模型的 inputTokenLimit
+	ThreadOverflowStrategy string // summarize (早期消息合并为摘要) 或 truncate (直接丢弃早期消息)
+	ThreadSummaryModel     string // 生成摘要使用的模型，为空时使用线程本身的模型
+
+	// 上下文缓存: 重复出现的大段请求前缀自动创建为上游 cachedContents
+	ContextCacheEnabled   bool
+	ContextCacheMinTokens int           // 前缀的估算 token 数达到该值时才缓存
+	ContextCacheTTL       time.Duration // 上游缓存的有效期
+
+	// Token 上限检查: 请求上游之前用本地估算拒绝明显超出模型上下文窗口的请求
+	TokenLimitCheckEnabled bool
+	TokenLimitTolerance    int // 估算误差的容忍度 (百分比)，估算值超过上限的 (100+该值)% 才拒绝
+}
+
+// SafetySetting 是 Gemini safetySettings 中的一项
+type SafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
 }
 
 // Manager 结构体用于管理全局配置，并支持热重载
 type Manager struct {
-	mu     sync.RWMutex
-	config *Config
+	mu      sync.RWMutex
+	config  *Config
+	version atomic.Uint64 // 每次重载配置后加一，供缓存了由配置编译出的规则的组件判断配置是否变化
 }
 
 // 全局配置管理器实例
@@ -84,13 +183,20 @@ func (m *Manager) ReloadAndUpdate() error {
 	}
 
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	m.config = newCfg
+	m.version.Add(1)
+	m.mu.Unlock()
 
+	// 日志在释放锁之后输出: 日志脱敏函数可能需要读取新配置
 	logger.Infoln("配置已成功热重载！")
 	return nil
 }
 
+// Version 返回配置的版本号，每次重载后变化。不加锁，可以在日志输出等不能等待配置锁的地方调用。
+func (m *Manager) Version() uint64 {
+	return m.version.Load()
+}
+
 // loadFromFile 是实际从 .env 加载配置的私有函数
 func loadFromFile() (*Config, error) {
 	if err := godotenv.Load(); err != nil {
@@ -160,6 +266,12 @@ func loadFromFile() (*Config, error) {
 		penaltyFactor = 1.5
 	}
 
+	maxConcurrentPerKey, err := strconv.Atoi(getEnv("MAX_CONCURRENT_PER_KEY", "0"))
+	if err != nil || maxConcurrentPerKey < 0 {
+		fmt.Printf("警告: MAX_CONCURRENT_PER_KEY 值无效, 使用默认值 0 (不限制)。错误: %v\n", err)
+		maxConcurrentPerKey = 0
+	}
+
 	cfg := &Config{
 		Port:              getEnv("SERVER_PORT", "8080"),
 		AdminAPIKey:       getEnv("ADMIN_API_KEY", "fallback-admin-key"),
@@ -184,7 +296,80 @@ func loadFromFile() (*Config, error) {
 		Max429Count:       max429Count,
 		RecoveryBonus:     recoveryBonus,
 		PenaltyFactor:     penaltyFactor,
+		MaxConcurrentPerKey: maxConcurrentPerKey,
+
+		CircuitBreakerEnabled:   getEnvBool("CIRCUIT_BREAKER_ENABLED", true),
+		CircuitFailureThreshold: getEnvFloat("CIRCUIT_FAILURE_THRESHOLD", 0.5),
+		CircuitMinRequests:      getEnvInt("CIRCUIT_MIN_REQUESTS", 10),
+		CircuitWindow:           time.Duration(getEnvInt("CIRCUIT_WINDOW_SECONDS", 60)) * time.Second,
+		CircuitOpenDuration:     time.Duration(getEnvInt("CIRCUIT_OPEN_SECONDS", 30)) * time.Second,
+		CircuitHalfOpenProbes:   getEnvInt("CIRCUIT_HALF_OPEN_PROBES", 1),
+
+		ModelFallbacksSpec: getEnv("MODEL_FALLBACKS", ""),
+
+		ThinkingBudgetsSpec: getEnv("THINKING_BUDGETS", ""),
+
+		ModelCatalogueTTL: time.Duration(getEnvInt("MODEL_CATALOGUE_TTL_SECONDS", 3600)) * time.Second,
+
+		ResponseCacheEnabled:       getEnvBool("RESPONSE_CACHE_ENABLED", false),
+		ResponseCacheBackend:       getEnv("RESPONSE_CACHE_BACKEND", "memory"),
+		ResponseCacheSQLitePath:    getEnv("RESPONSE_CACHE_SQLITE_PATH", "./data/response_cache.db"),
+		ResponseCacheTTL:           time.Duration(getEnvInt("RESPONSE_CACHE_TTL_SECONDS", 3600)) * time.Second,
+		ResponseCacheMaxEntries:    getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 10000),
+		ResponseCacheMaxBytes:      getEnvInt("RESPONSE_CACHE_MAX_SIZE_MB", 256) * 1024 * 1024,
+		ResponseCacheMaxEntryBytes: getEnvInt("RESPONSE_CACHE_MAX_ENTRY_KB", 1024) * 1024,
+
+		RequestCoalescingEnabled: getEnvBool("REQUEST_COALESCING_ENABLED", true),
+
+		BatchFilesDir:     getEnv("BATCH_FILES_DIR", "./data/batch_files"),
+		BatchPoolFraction: getEnvFloat("BATCH_POOL_FRACTION", 0.5),
+		BatchMaxFileBytes: int64(getEnvInt("BATCH_MAX_FILE_MB", 200)) * 1024 * 1024,
+		BatchMaxRequests:  getEnvInt("BATCH_MAX_REQUESTS", 50000),
+
+		ImageDefaultModel: getEnv("IMAGE_DEFAULT_MODEL", "imagen-4.0-generate-001"),
+		ImageEditModel:    getEnv("IMAGE_EDIT_MODEL", "gemini-2.5-flash-image"),
+		ImageFilesDir:     getEnv("IMAGE_FILES_DIR", "./data/images"),
+		ImageURLTTL:       time.Duration(getEnvInt("IMAGE_URL_TTL_MINUTES", 60)) * time.Minute,
+		PublicBaseURL:     getEnv("PUBLIC_BASE_URL", ""),
+
+		AudioTTSModel:           getEnv("AUDIO_TTS_MODEL", "gemini-2.5-flash-preview-tts"),
+		AudioTranscriptionModel: getEnv("AUDIO_TRANSCRIPTION_MODEL", "gemini-2.5-flash"),
+		AudioFFmpegPath:         getEnv("AUDIO_FFMPEG_PATH", "ffmpeg"),
+
+		MediaFetchEnabled:      getEnvBool("MEDIA_FETCH_ENABLED", true),
+		MediaFetchMaxBytes:     int64(getEnvInt("MEDIA_FETCH_MAX_MB", 20)) * 1024 * 1024,
+		MediaFetchMaxParts:     getEnvInt("MEDIA_FETCH_MAX_PARTS", 16),
+		MediaFetchMaxTotal:     int64(getEnvInt("MEDIA_FETCH_MAX_TOTAL_MB", 50)) * 1024 * 1024,
+		MediaFetchTimeout:      time.Duration(getEnvInt("MEDIA_FETCH_TIMEOUT_SECONDS", 15)) * time.Second,
+		MediaFetchAllowedHosts: getEnv("MEDIA_FETCH_ALLOWED_HOSTS", ""),
+
+		LiveMaxSession:   time.Duration(getEnvInt("LIVE_MAX_SESSION_MINUTES", 15)) * time.Minute,
+		LiveSetupTimeout: time.Duration(getEnvInt("LIVE_SETUP_TIMEOUT_SECONDS", 30)) * time.Second,
+
+		ChatMaxN:              getEnvInt("CHAT_MAX_N", 8),
+		ChatCandidatesPerCall: getEnvInt("CHAT_CANDIDATES_PER_CALL", 1),
+
+		PolicySafetySettingsSpec: getEnv("POLICY_SAFETY_SETTINGS", ""),
+		PolicySystemPrompt:       getEnv("POLICY_SYSTEM_PROMPT", ""),
+		PolicyMaxOutputTokens:    getEnvInt("POLICY_MAX_OUTPUT_TOKENS", 0),
+		PolicyMaxTemperature:     getEnvFloat("POLICY_MAX_TEMPERATURE", -1),
+		PolicyDisallowedTools:    getEnv("POLICY_DISALLOWED_TOOLS", ""),
+		PolicyMaxBodyBytes:       int64(getEnvInt("POLICY_MAX_BODY_KB", 0)) * 1024,
+		RedactionMode:            getEnv("REDACTION_MODE", "off"),
+		RedactionDetectors:       getEnv("REDACTION_DETECTORS", "email,phone,credit_card,api_key"),
+		RedactionPatterns:        getEnv("REDACTION_PATTERNS", ""),
+		ThreadContextTokens:      getEnvInt("THREAD_CONTEXT_TOKENS", 0),
+		ThreadOverflowStrategy:   getEnv("THREAD_OVERFLOW_STRATEGY", "summarize"),
+		ThreadSummaryModel:       getEnv("THREAD_SUMMARY_MODEL", ""),
+		ContextCacheEnabled:      getEnvBool("CONTEXT_CACHE_ENABLED", false),
+		ContextCacheMinTokens:    getEnvInt("CONTEXT_CACHE_MIN_TOKENS", 32768),
+		ContextCacheTTL:          time.Duration(getEnvInt("CONTEXT_CACHE_TTL_SECONDS", 600)) * time.Second,
+		TokenLimitCheckEnabled:   getEnvBool("TOKEN_LIMIT_CHECK_ENABLED", true),
+		TokenLimitTolerance:      getEnvInt("TOKEN_LIMIT_TOLERANCE_PERCENT", 20),
 	}
+	cfg.ModelFallbacks = ParseModelFallbacks(cfg.ModelFallbacksSpec)
+	cfg.ThinkingBudgets = ParseThinkingBudgets(cfg.ThinkingBudgetsSpec)
+	cfg.PolicySafetySettings = ParseSafetySettings(cfg.PolicySafetySettingsSpec)
 
 	if cfg.DBDriver == "mysql" {
 		cfg.MySQLDSN = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
@@ -203,6 +388,107 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// ParseModelFallbacks 解析模型回退链配置。
+// 每条链以 ';' 分隔，链内模型以 "->" 分隔，第一个模型为请求模型，其余为按顺序尝试的回退模型。
+func ParseModelFallbacks(spec string) map[string][]string {
+	fallbacks := make(map[string][]string)
+	for _, chain := range strings.Split(spec, ";") {
+		var models []string
+		for _, name := range strings.Split(chain, "->") {
+			if name = strings.TrimSpace(name); name != "" {
+				models = append(models, name)
+			}
+		}
+		if len(models) < 2 {
+			if len(models) == 1 {
+				fmt.Printf("警告: MODEL_FALLBACKS 中的回退链 '%s' 没有回退模型，已忽略。\n", strings.TrimSpace(chain))
+			}
+			continue
+		}
+		fallbacks[models[0]] = models[1:]
+	}
+	return fallbacks
+}
+
+// ParseThinkingBudgets 解析按模型配置的思考预算，格式为 "模型=预算"，多个模型以 ',' 分隔
+func ParseThinkingBudgets(spec string) map[string]int {
+	budgets := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(item, "=")
+		budget, err := strconv.Atoi(strings.TrimSpace(raw))
+		if !ok || strings.TrimSpace(name) == "" || err != nil || budget < -1 {
+			fmt.Printf("警告: THINKING_BUDGETS 中的配置 '%s' 无效，已忽略。\n", item)
+			continue
+		}
+		budgets[strings.TrimSpace(name)] = budget
+	}
+	return budgets
+}
+
+// ParseSafetySettings 解析默认安全设置，格式为 "类别=阈值"，多个类别以 ',' 分隔，
+// 例如 "HARM_CATEGORY_HARASSMENT=BLOCK_ONLY_HIGH, HARM_CATEGORY_HATE_SPEECH=BLOCK_NONE"
+func ParseSafetySettings(spec string) []SafetySetting {
+	var settings []SafetySetting
+	for _, item := range splitList(spec) {
+		category, threshold, ok := strings.Cut(item, "=")
+		category, threshold = strings.TrimSpace(category), strings.TrimSpace(threshold)
+		if !ok || category == "" || threshold == "" {
+			fmt.Printf("警告: POLICY_SAFETY_SETTINGS 中的配置 '%s' 无效，已忽略。\n", item)
+			continue
+		}
+		settings = append(settings, SafetySetting{Category: category, Threshold: threshold})
+	}
+	return settings
+}
+
+// splitList 把逗号分隔的配置拆分为去掉空白的非空项
+func splitList(spec string) []string {
+	var items []string
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvInt 读取整数类型的环境变量，值无效时打印警告并使用默认值
+func getEnvInt(key string, fallback int) int {
+	raw := getEnv(key, strconv.Itoa(fallback))
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		fmt.Printf("警告: %s 值无效, 使用默认值 %d。错误: %v\n", key, fallback, err)
+		return fallback
+	}
+	return value
+}
+
+// getEnvFloat 读取浮点类型的环境变量，值无效时打印警告并使用默认值
+func getEnvFloat(key string, fallback float64) float64 {
+	raw := getEnv(key, strconv.FormatFloat(fallback, 'f', -1, 64))
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		fmt.Printf("警告: %s 值无效, 使用默认值 %v。错误: %v\n", key, fallback, err)
+		return fallback
+	}
+	return value
+}
+
+// getEnvBool 读取布尔类型的环境变量，值无效时打印警告并使用默认值
+func getEnvBool(key string, fallback bool) bool {
+	raw := getEnv(key, strconv.FormatBool(fallback))
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		fmt.Printf("警告: %s 值无效, 使用默认值 %v。错误: %v\n", key, fallback, err)
+		return fallback
+	}
+	return value
+}
+
 func UpdateEnvFile(updates map[string]string) error {
 	// ...
 	envFilePath := ".env"
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTranscriptionBytes 是 /v1/audio/transcriptions 上传音频的大小上限，音频以内联数据发送，受 Gemini 20MB 请求上限限制
+const maxTranscriptionBytes = 20 * 1024 * 1024
+
+// audioMimeTypes 按扩展名推断上传音频的 MIME 类型
+var audioMimeTypes = map[string]string{
+	".mp3":  "audio/mp3",
+	".mpga": "audio/mp3",
+	".mpeg": "audio/mp3",
+	".wav":  "audio/wav",
+	".m4a":  "audio/mp4",
+	".mp4":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".aac":  "audio/aac",
+	".aiff": "audio/aiff",
+	".webm": "audio/webm",
+}
+
+// AudioHandler 提供 OpenAI 兼容的 /v1/audio/speech 和 /v1/audio/transcriptions 接口
+type AudioHandler struct {
+	audio    *service.AudioService
+	registry *service.ModelRegistry
+}
+
+func NewAudioHandler(audio *service.AudioService, registry *service.ModelRegistry) *AudioHandler {
+	return &AudioHandler{audio: audio, registry: registry}
+}
+
+// Speech 将文本合成为语音，直接返回音频数据
+func (h *AudioHandler) Speech(c *gin.Context) {
+	var req model.SpeechRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	resolved, ok := h.resolveModel(c, req.Model, true)
+	if !ok {
+		return
+	}
+	req.Model = resolved
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	audio, contentType, err := h.audio.Speech(ctx, &req)
+	meta.ApplyHeaders(c.Writer.Header())
+	if err != nil {
+		respondAudioError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, contentType, audio)
+}
+
+// Transcribe 转写上传的音频 (multipart: file 以及 model、language、prompt、response_format、temperature)
+func (h *AudioHandler) Transcribe(c *gin.Context) {
+	var req model.TranscriptionRequest
+	if err := c.ShouldBind(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	audio, err := readAudioUpload(c)
+	if err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "file", err.Error())
+		return
+	}
+	resolved, ok := h.resolveModel(c, req.Model, false)
+	if !ok {
+		return
+	}
+	req.Model = resolved
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	result, err := h.audio.Transcribe(ctx, &req, audio)
+	meta.ApplyHeaders(c.Writer.Header())
+	if err != nil {
+		respondAudioError(c, err)
+		return
+	}
+
+	switch req.ResponseFormat {
+	case "text":
+		c.String(http.StatusOK, "%s", result.Text)
+	case "srt":
+		c.String(http.StatusOK, "%s", formatSubtitles(result.Segments, false))
+	case "vtt":
+		c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(formatSubtitles(result.Segments, true)))
+	case "verbose_json":
+		c.JSON(http.StatusOK, result)
+	default:
+		c.JSON(http.StatusOK, gin.H{"text": result.Text})
+	}
+}
+
+// resolveModel 使用默认模型补全空的 model，并按模型目录解析别名和检查白名单
+func (h *AudioHandler) resolveModel(c *gin.Context, requested string, speech bool) (string, bool) {
+	if requested == "" {
+		requested = h.audio.DefaultModel(speech)
+	}
+	return resolveRequestModel(c, h.registry, requested, true)
+}
+
+// readAudioUpload 读取上传的音频文件，MIME 类型优先按扩展名推断
+func readAudioUpload(c *gin.Context) (service.AudioInput, error) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		return service.AudioInput{}, fmt.Errorf("缺少音频文件: %w", err)
+	}
+	if header.Size > maxTranscriptionBytes {
+		return service.AudioInput{}, fmt.Errorf("音频文件超过 %dMB 上限", maxTranscriptionBytes/(1024*1024))
+	}
+	src, err := header.Open()
+	if err != nil {
+		return service.AudioInput{}, fmt.Errorf("读取音频文件失败: %w", err)
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return service.AudioInput{}, fmt.Errorf("读取音频文件失败: %w", err)
+	}
+
+	mimeType, ok := audioMimeTypes[strings.ToLower(filepath.Ext(header.Filename))]
+	if !ok {
+		mimeType = header.Header.Get("Content-Type")
+		if !strings.HasPrefix(mimeType, "audio/") {
+			mimeType = http.DetectContentType(data)
+		}
+	}
+	if !strings.HasPrefix(mimeType, "audio/") && !strings.HasPrefix(mimeType, "video/") {
+		return service.AudioInput{}, fmt.Errorf("不支持的音频格式: %s (%s)", header.Filename, mimeType)
+	}
+	return service.AudioInput{Data: data, MimeType: mimeType}, nil
+}
+
+// formatSubtitles 将分段转换为 SRT 或 WebVTT 字幕
+func formatSubtitles(segments []model.TranscriptionSegment, vtt bool) string {
+	var b strings.Builder
+	if vtt {
+		b.WriteString("WEBVTT\n\n")
+	}
+	for i, seg := range segments {
+		if !vtt {
+			fmt.Fprintf(&b, "%d\n", i+1)
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n", subtitleTimestamp(seg.Start, vtt), subtitleTimestamp(seg.End, vtt), seg.Text)
+	}
+	return b.String()
+}
+
+// subtitleTimestamp 格式化字幕时间戳: SRT 为 00:01:02,345，WebVTT 为 00:01:02.345
+func subtitleTimestamp(seconds float64, vtt bool) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	ms := int64(seconds*1000 + 0.5)
+	sep := ","
+	if vtt {
+		sep = "."
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// respondAudioError 将音频服务的错误转换为 OpenAI 格式的错误响应
+func respondAudioError(c *gin.Context, err error) {
+	logger.Error("音频请求失败: %v", err)
+	var reqErr *service.AudioRequestError
+	switch {
+	case errors.As(err, &reqErr):
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", reqErr.Param, reqErr.Message)
+	case errors.Is(err, service.ErrNoAudioGenerated):
+		respondOpenAIError(c, http.StatusBadGateway, "api_error", nil, err.Error())
+	default:
+		respondUpstreamFailure(c, err)
+	}
+}
@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"gemini_polling/logger"
+	"gemini_polling/middleware"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchHandler 提供 OpenAI 兼容的 /v1/files 和 /v1/batches 接口，以及批处理的管理接口
+type BatchHandler struct {
+	runner *service.BatchRunner
+}
+
+func NewBatchHandler(runner *service.BatchRunner) *BatchHandler {
+	return &BatchHandler{runner: runner}
+}
+
+// UploadFile 上传批处理输入文件 (multipart: file, purpose)
+func (h *BatchHandler) UploadFile(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "file", "缺少上传文件: "+err.Error())
+		return
+	}
+	src, err := header.Open()
+	if err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "file", "读取上传文件失败: "+err.Error())
+		return
+	}
+	defer src.Close()
+
+	file, err := h.runner.SaveFile(currentClientID(c), header.Filename, c.PostForm("purpose"), src)
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, fileObject(file))
+}
+
+func (h *BatchHandler) ListFiles(c *gin.Context) {
+	files, err := h.runner.ListFiles(currentClientID(c), c.Query("purpose"))
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	data := make([]gin.H, 0, len(files))
+	for i := range files {
+		data = append(data, fileObject(&files[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
+
+func (h *BatchHandler) GetFile(c *gin.Context) {
+	file, err := h.runner.GetFile(currentClientID(c), c.Param("id"))
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, fileObject(file))
+}
+
+// GetFileContent 下载文件内容
+func (h *BatchHandler) GetFileContent(c *gin.Context) {
+	file, err := h.runner.GetFile(currentClientID(c), c.Param("id"))
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.Header("Content-Type", "application/jsonl")
+	c.FileAttachment(file.Path, file.Filename)
+}
+
+func (h *BatchHandler) DeleteFile(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.runner.DeleteFile(currentClientID(c), id); err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+}
+
+// CreateBatch 创建批处理
+func (h *BatchHandler) CreateBatch(c *gin.Context) {
+	var req service.BatchCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	batch, err := h.runner.CreateBatch(middleware.CurrentClient(c), &req)
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batchObject(batch))
+}
+
+func (h *BatchHandler) GetBatch(c *gin.Context) {
+	clientID := currentClientID(c)
+	batch, err := h.runner.GetBatch(&clientID, c.Param("id"))
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batchObject(batch))
+}
+
+// ListBatches 按创建时间倒序分页列出批处理 (after, limit)
+func (h *BatchHandler) ListBatches(c *gin.Context) {
+	clientID := currentClientID(c)
+	h.listBatches(c, &clientID)
+}
+
+func (h *BatchHandler) CancelBatch(c *gin.Context) {
+	clientID := currentClientID(c)
+	batch, err := h.runner.CancelBatch(&clientID, c.Param("id"))
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batchObject(batch))
+}
+
+// AdminListBatches 列出所有客户端的批处理
+func (h *BatchHandler) AdminListBatches(c *gin.Context) {
+	h.listBatches(c, nil)
+}
+
+// AdminCancelBatch 取消任意客户端的批处理
+func (h *BatchHandler) AdminCancelBatch(c *gin.Context) {
+	batch, err := h.runner.CancelBatch(nil, c.Param("id"))
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batchObject(batch))
+}
+
+// GetProgress 获取当前批处理的执行进度
+func (h *BatchHandler) GetProgress(c *gin.Context) {
+	c.JSON(http.StatusOK, h.runner.GetProgress())
+}
+
+func (h *BatchHandler) listBatches(c *gin.Context, clientID *uint) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "limit", "limit 必须是 1 到 100 之间的整数")
+		return
+	}
+	// 多取一条用于判断是否还有下一页
+	batches, err := h.runner.ListBatches(clientID, c.Query("after"), limit+1)
+	if err != nil {
+		respondBatchError(c, err)
+		return
+	}
+	hasMore := len(batches) > limit
+	if hasMore {
+		batches = batches[:limit]
+	}
+
+	data := make([]gin.H, 0, len(batches))
+	for i := range batches {
+		data = append(data, batchObject(&batches[i]))
+	}
+	resp := gin.H{"object": "list", "data": data, "has_more": hasMore, "first_id": nil, "last_id": nil}
+	if len(batches) > 0 {
+		resp["first_id"] = batches[0].ID
+		resp["last_id"] = batches[len(batches)-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// currentClientID 返回本次请求的客户端 ID，全局公共密钥对应 0
+func currentClientID(c *gin.Context) uint {
+	if client := middleware.CurrentClient(c); client != nil {
+		return client.ID
+	}
+	return 0
+}
+
+// fileObject 将文件转换为 OpenAI 的 file 对象
+func fileObject(f *model.BatchFile) gin.H {
+	return gin.H{
+		"id":         f.ID,
+		"object":     "file",
+		"bytes":      f.Bytes,
+		"created_at": f.CreatedAt.Unix(),
+		"filename":   f.Filename,
+		"purpose":    f.Purpose,
+	}
+}
+
+// batchObject 将批处理转换为 OpenAI 的 batch 对象
+func batchObject(b *model.Batch) gin.H {
+	unix := func(t *time.Time) interface{} {
+		if t == nil {
+			return nil
+		}
+		return t.Unix()
+	}
+	nullable := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+
+	var errorsObj interface{}
+	if b.Errors != "" {
+		var data []service.BatchLineError
+		if json.Unmarshal([]byte(b.Errors), &data) == nil {
+			errorsObj = gin.H{"object": "list", "data": data}
+		}
+	}
+	var metadata interface{}
+	if b.Metadata != "" {
+		var m map[string]string
+		if json.Unmarshal([]byte(b.Metadata), &m) == nil {
+			metadata = m
+		}
+	}
+
+	return gin.H{
+		"id":                b.ID,
+		"object":            "batch",
+		"endpoint":          b.Endpoint,
+		"errors":            errorsObj,
+		"input_file_id":     b.InputFileID,
+		"completion_window": b.CompletionWindow,
+		"status":            b.Status,
+		"output_file_id":    nullable(b.OutputFileID),
+		"error_file_id":     nullable(b.ErrorFileID),
+		"created_at":        b.CreatedAt.Unix(),
+		"in_progress_at":    unix(b.InProgressAt),
+		"expires_at":        unix(b.ExpiresAt),
+		"finalizing_at":     unix(b.FinalizingAt),
+		"completed_at":      unix(b.CompletedAt),
+		"failed_at":         unix(b.FailedAt),
+		"expired_at":        unix(b.ExpiredAt),
+		"cancelling_at":     unix(b.CancellingAt),
+		"cancelled_at":      unix(b.CancelledAt),
+		"request_counts": gin.H{
+			"total":     b.TotalCount,
+			"completed": b.CompletedCount,
+			"failed":    b.FailedCount,
+		},
+		"metadata": metadata,
+	}
+}
+
+// respondBatchError 将批处理服务的错误转换为 OpenAI 格式的错误响应
+func respondBatchError(c *gin.Context, err error) {
+	var reqErr *service.BatchRequestError
+	switch {
+	case errors.As(err, &reqErr):
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", reqErr.Param, reqErr.Message)
+	case errors.Is(err, service.ErrBatchNotFound), errors.Is(err, service.ErrBatchFileNotFound):
+		respondOpenAIError(c, http.StatusNotFound, "invalid_request_error", nil, err.Error())
+	default:
+		logger.Error("批处理请求失败: %v", err)
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", nil, err.Error())
+	}
+}
+
+// respondOpenAIError 返回 OpenAI 格式的错误响应
+func respondOpenAIError(c *gin.Context, status int, errType string, param interface{}, message string) {
+	c.JSON(status, model.OpenAIErrorResponse{
+		Error: model.ErrorDetail{
+			Message: message,
+			Type:    errType,
+			Param:   param,
+		},
+	})
+}
@@ -2,20 +2,27 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"gemini_polling/logger"
+	"gemini_polling/middleware"
 	"gemini_polling/model"
 	"gemini_polling/service"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 type ChatHandler struct {
-	genaiService *service.GenAIService
+	genaiService  *service.GenAIService
+	registry      *service.ModelRegistry
+	geminiBatches *service.GeminiBatchProxy
+	policy        *service.PolicyEngine
+	templates     *service.PromptTemplates
 }
 
-func NewChatHandler(s *service.GenAIService) *ChatHandler {
-	return &ChatHandler{genaiService: s}
+func NewChatHandler(s *service.GenAIService, registry *service.ModelRegistry, geminiBatches *service.GeminiBatchProxy, policy *service.PolicyEngine, templates *service.PromptTemplates) *ChatHandler {
+	return &ChatHandler{genaiService: s, registry: registry, geminiBatches: geminiBatches, policy: policy, templates: templates}
 }
 
 // HandleChatCompletions 是一个新的、统一的handler，取代了旧的 ChatStream
@@ -30,6 +37,16 @@ func (h *ChatHandler) HandleChatCompletions(c *gin.Context) {
 		})
 		return
 	}
+	if !h.applyTemplate(c, &req) {
+		return
+	}
+	resolved, ok := h.resolveModel(c, req.Model, true)
+	if !ok {
+		return
+	}
+	req.Model = resolved
+	h.policy.ApplyChat(middleware.CurrentClient(c), &req)
+
 	// 根据请求中的 stream 参数决定处理逻辑
 	if req.Stream {
 		h.handleStream(c, &req)
@@ -51,20 +68,19 @@ func (h *ChatHandler) ChatStream(c *gin.Context) {
 		return
 	}
 
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Header().Set("Access-Control-Allow-Origin", "*") // 可选，用于CORS
-
-	// 将请求上下文、响应写入器和请求体传递给服务层
-	err := h.genaiService.StreamChat(c.Request.Context(), c.Writer, &req)
-	if err != nil {
-		// 如果流已经开始，就不能再写JSON错误了
-		// 只能通过日志记录错误，因为HTTP头已经发送
-		logger.Error("Error during streaming chat: %v", err)
-		// 可以在流中发送一个错误消息
-		c.SSEvent("error", gin.H{"message": err.Error()})
+	// 模板和模型的校验错误以 JSON 返回，必须在 handleStream 设置 SSE 响应头之前处理
+	if !h.applyTemplate(c, &req) {
+		return
+	}
+	resolved, ok := h.resolveModel(c, req.Model, true)
+	if !ok {
+		return
 	}
+	req.Model = resolved
+	h.policy.ApplyChat(middleware.CurrentClient(c), &req)
+
+	// 与 /v1/chat/completions 的流式请求共用响应头和错误处理 (熔断、token 上限、请求参数错误在开始输出前以 JSON 返回)
+	h.handleStream(c, &req)
 }
 
 // Model 定义了 OpenAI 兼容的模型结构体
@@ -90,6 +106,9 @@ func (h *ChatHandler) handleStream(c *gin.Context, req *model.ChatCompletionRequ
 	err := h.genaiService.StreamChat(c.Request.Context(), c.Writer, req)
 	if err != nil {
 		logger.Error("Error during streaming chat: %v", err)
+		if !c.Writer.Written() && (respondCircuitOpen(c, err, true) || respondTokenLimitError(c, err, true) || respondMediaFetchError(c, err) || respondChatRequestError(c, err)) {
+			return
+		}
 		// 如果流已经开始，无法发送JSON错误。
 		// 可以在流中发送一个错误事件，但注意这并非标准OpenAI行为。
 		// OpenAI标准做法是在流的某个chunk中包含error字段。
@@ -106,9 +125,14 @@ func (h *ChatHandler) handleStream(c *gin.Context, req *model.ChatCompletionRequ
 
 // handleNonStream 处理非流式请求
 func (h *ChatHandler) handleNonStream(c *gin.Context, req *model.ChatCompletionRequest) {
-	response, err := h.genaiService.NonStreamChat(c.Request.Context(), req)
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	response, err := h.genaiService.NonStreamChat(ctx, req)
+	meta.ApplyHeaders(c.Writer.Header())
 	if err != nil {
 		logger.Error("Error during non-streaming chat: %v", err)
+		if respondCircuitOpen(c, err, true) || respondTokenLimitError(c, err, true) || respondMediaFetchError(c, err) || respondChatRequestError(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, model.OpenAIErrorResponse{
 			Error: model.ErrorDetail{
 				Message: err.Error(),
@@ -137,44 +161,90 @@ func (h *ChatHandler) handleNonStream(c *gin.Context, req *model.ChatCompletionR
 	}
 }
 
-// ListModels 从 Google API 获取并返回支持的模型列表
+// ListModels 返回当前客户端可见的模型列表 (OpenAI 格式)，数据来自模型目录缓存
 func (h *ChatHandler) ListModels(c *gin.Context) {
-	// 调用服务层来获取模型列表
-	body, statusCode, err := h.genaiService.ListOpenAICompatibleModels(c.Request.Context())
-	if err != nil {
-		// 如果服务层返回错误，记录日志并向客户端返回错误信息
+	models, err := h.registry.ListModels(c.Request.Context(), middleware.CurrentClient(c))
+	if err != nil && len(models) == 0 {
 		logger.Error("获取模型列表时发生错误: %v", err)
-		// 使用服务层返回的状态码，或者如果它不可用，则使用500
-		if statusCode == 0 {
-			statusCode = http.StatusInternalServerError
-		}
-		c.JSON(statusCode, gin.H{"error": "Failed to fetch models from upstream: " + err.Error()})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to fetch models from upstream: " + err.Error()})
 		return
 	}
-	// 直接将从 Google API 收到的响应体和状态码转发给客户端
-	// 设置正确的 Content-Type
-	c.Data(statusCode, "application/json; charset=utf-8", body)
+
+	resp := ModelListResponse{Object: "list", Data: make([]Model, 0, len(models))}
+	for _, m := range models {
+		resp.Data = append(resp.Data, Model{ID: m.ID, Object: "model", OwnedBy: m.OwnedBy})
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
-// ListModels 从 Google API 获取并返回支持的模型列表(Gemini Api 格式)
+// ListModels2 返回当前客户端可见的模型列表 (Gemini Api 格式)，支持 pageSize/pageToken 分页
 func (h *ChatHandler) ListModels2(c *gin.Context) {
-
-	queryParams := c.Request.URL.Query()
-	// 调用服务层来获取模型列表
-	body, statusCode, err := h.genaiService.ListGeminiCompatibleModels(c.Request.Context(), queryParams)
-	if err != nil {
-		// 如果服务层返回错误，记录日志并向客户端返回错误信息
+	models, err := h.registry.ListModels(c.Request.Context(), middleware.CurrentClient(c))
+	if err != nil && len(models) == 0 {
 		logger.Error("获取模型列表时发生错误: %v", err)
-		// 使用服务层返回的状态码，或者如果它不可用，则使用500
-		if statusCode == 0 {
-			statusCode = http.StatusInternalServerError
-		}
-		c.JSON(statusCode, gin.H{"error": "Failed to fetch models from upstream: " + err.Error()})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to fetch models from upstream: " + err.Error()})
 		return
 	}
-	// 直接将从 Google API 收到的响应体和状态码转发给客户端
-	// 设置正确的 Content-Type
-	c.Data(statusCode, "application/json; charset=utf-8", body)
+
+	// pageToken 是下一页的起始下标
+	start, _ := strconv.Atoi(c.Query("pageToken"))
+	if start < 0 || start > len(models) {
+		start = len(models)
+	}
+	end := len(models)
+	if pageSize, _ := strconv.Atoi(c.Query("pageSize")); pageSize > 0 && start+pageSize < end {
+		end = start + pageSize
+	}
+
+	page := make([]map[string]interface{}, 0, end-start)
+	for _, m := range models[start:end] {
+		page = append(page, m.Gemini)
+	}
+	resp := gin.H{"models": page}
+	if end < len(models) {
+		resp["nextPageToken"] = strconv.Itoa(end)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// resolveModel 按模型目录解析别名并检查客户端的模型白名单。
+// 模型被隐藏或不允许使用时直接写出错误响应并返回 false。
+func (h *ChatHandler) resolveModel(c *gin.Context, requested string, openAIFormat bool) (string, bool) {
+	return resolveRequestModel(c, h.registry, requested, openAIFormat)
+}
+
+// resolveRequestModel 是 resolveModel 的实现，供其他需要解析模型的 handler 共用
+func resolveRequestModel(c *gin.Context, registry *service.ModelRegistry, requested string, openAIFormat bool) (string, bool) {
+	resolved, err := registry.Resolve(middleware.CurrentClient(c), requested)
+	if err == nil {
+		return resolved, true
+	}
+
+	status, code, geminiStatus := http.StatusNotFound, "model_not_found", "NOT_FOUND"
+	var notAllowed *service.ModelNotAllowedError
+	if errors.As(err, &notAllowed) {
+		status, code, geminiStatus = http.StatusForbidden, "model_not_allowed", "PERMISSION_DENIED"
+	}
+	logger.Warn("拒绝模型 %s 的请求: %v", requested, err)
+	if openAIFormat {
+		c.JSON(status, model.OpenAIErrorResponse{
+			Error: model.ErrorDetail{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Param:   "model",
+				Code:    code,
+			},
+		})
+	} else {
+		c.JSON(status, gin.H{
+			"error": gin.H{
+				"code":    status,
+				"message": err.Error(),
+				"status":  geminiStatus,
+			},
+		})
+	}
+	return "", false
 }
 
 // +++ 新增: 统一处理 Gemini 原生 API 请求的 Handler +++
@@ -188,7 +258,10 @@ func (h *ChatHandler) HandleGeminiAction(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL format. Expected 'model:action'."})
 		return
 	}
-	modelName := parts[0]
+	modelName, ok := h.resolveModel(c, parts[0], false)
+	if !ok {
+		return
+	}
 	action := parts[1]
 
 	// 读取请求体
@@ -201,12 +274,14 @@ func (h *ChatHandler) HandleGeminiAction(c *gin.Context) {
 	// 根据动作分发
 	switch action {
 	case "generateContent":
-		h.proxyGeminiGenerateContent(c, modelName, requestBody)
+		h.proxyGeminiGenerateContent(c, modelName, h.policy.ApplyGemini(middleware.CurrentClient(c), modelName, requestBody))
 	case "streamGenerateContent":
-		h.proxyGeminiStreamGenerateContent(c, modelName, requestBody)
+		h.proxyGeminiStreamGenerateContent(c, modelName, h.policy.ApplyGemini(middleware.CurrentClient(c), modelName, requestBody))
 		// +++ 新增 case +++
 	case "countTokens":
 		h.proxyGeminiCountTokens(c, modelName, requestBody)
+	case "batchGenerateContent":
+		h.proxyGeminiBatchGenerateContent(c, modelName, h.policy.ApplyGeminiBatch(middleware.CurrentClient(c), modelName, requestBody))
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported action: " + action})
 	}
@@ -214,9 +289,14 @@ func (h *ChatHandler) HandleGeminiAction(c *gin.Context) {
 
 // proxyGeminiGenerateContent 是 HandleGeminiAction 的一个辅助函数，处理非流式代理
 func (h *ChatHandler) proxyGeminiGenerateContent(c *gin.Context, modelName string, requestBody []byte) {
-	respBody, statusCode, err := h.genaiService.GenerateContent(c.Request.Context(), modelName, requestBody)
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	respBody, statusCode, err := h.genaiService.GenerateContent(ctx, modelName, requestBody)
+	meta.ApplyHeaders(c.Writer.Header())
 	if err != nil {
 		logger.Error("Error proxying GenerateContent for model %s: %v", modelName, err)
+		if respondCircuitOpen(c, err, false) || respondTokenLimitError(c, err, false) {
+			return
+		}
 		if statusCode == 0 {
 			statusCode = http.StatusServiceUnavailable
 		}
@@ -242,14 +322,137 @@ func (h *ChatHandler) proxyGeminiStreamGenerateContent(c *gin.Context, modelName
 	err := h.genaiService.StreamGenerateContent(c.Request.Context(), c.Writer, modelName, requestBody)
 	if err != nil {
 		logger.Error("Error proxying StreamGenerateContent for model %s: %v", modelName, err)
+		if !c.Writer.Written() && !respondCircuitOpen(c, err, false) {
+			respondTokenLimitError(c, err, false)
+		}
+	}
+}
+
+// respondCircuitOpen 在模型熔断时返回带 Retry-After 的 503 响应。
+// openAIFormat 决定错误体使用 OpenAI 还是 Gemini 格式；err 不是熔断错误时返回 false。
+func respondCircuitOpen(c *gin.Context, err error, openAIFormat bool) bool {
+	var circuitErr *service.CircuitOpenError
+	if !errors.As(err, &circuitErr) {
+		return false
+	}
+
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Header("Retry-After", strconv.Itoa(circuitErr.RetryAfterSeconds()))
+	if openAIFormat {
+		c.JSON(http.StatusServiceUnavailable, model.OpenAIErrorResponse{
+			Error: model.ErrorDetail{
+				Message: circuitErr.Error(),
+				Type:    "api_error",
+				Code:    "model_circuit_open",
+			},
+		})
+	} else {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": gin.H{
+				"code":    http.StatusServiceUnavailable,
+				"message": circuitErr.Error(),
+				"status":  "UNAVAILABLE",
+			},
+		})
+	}
+	return true
+}
+
+// respondTokenLimitError 在请求明显超出模型的 token 上限时返回 400 响应。
+// openAIFormat 决定错误体使用 OpenAI 还是 Gemini 格式；err 不是该错误时返回 false。
+func respondTokenLimitError(c *gin.Context, err error, openAIFormat bool) bool {
+	var limitErr *service.TokenLimitError
+	if !errors.As(err, &limitErr) {
+		return false
+	}
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	if openAIFormat {
+		c.JSON(http.StatusBadRequest, model.OpenAIErrorResponse{
+			Error: model.ErrorDetail{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Param:   limitErr.Param,
+				Code:    "context_length_exceeded",
+			},
+		})
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"code":    http.StatusBadRequest,
+				"message": err.Error(),
+				"status":  "INVALID_ARGUMENT",
+			},
+		})
+	}
+	return true
+}
+
+// respondMediaFetchError 在消息中的远程媒体无法下载时返回 400 响应；err 不是该错误时返回 false
+func respondMediaFetchError(c *gin.Context, err error) bool {
+	var fetchErr *service.MediaFetchError
+	if !errors.As(err, &fetchErr) {
+		return false
 	}
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.JSON(http.StatusBadRequest, model.OpenAIErrorResponse{
+		Error: model.ErrorDetail{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Param:   "messages",
+			Code:    "invalid_media_url",
+		},
+	})
+	return true
+}
+
+// applyTemplate 渲染请求指定的提示词模板，并在响应头中返回使用的模板版本；请求无效时写入错误响应并返回 false
+func (h *ChatHandler) applyTemplate(c *gin.Context, req *model.ChatCompletionRequest) bool {
+	template, err := h.templates.Apply(req)
+	if err != nil {
+		logger.Error("渲染提示词模板失败: %v", err)
+		if !respondChatRequestError(c, err) {
+			respondOpenAIError(c, http.StatusInternalServerError, "api_error", nil, err.Error())
+		}
+		return false
+	}
+	if template != nil {
+		c.Header(service.HeaderPromptTemplate, template.Name+"@"+strconv.Itoa(template.Version))
+	}
+	return true
+}
+
+// respondChatRequestError 在请求参数无效 (如 n 超出范围) 时返回 400 响应；err 不是该错误时返回 false
+func respondChatRequestError(c *gin.Context, err error) bool {
+	var reqErr *service.ChatRequestError
+	if !errors.As(err, &reqErr) {
+		return false
+	}
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", reqErr.Param, reqErr.Message)
+	return true
 }
 
 // +++ 新增: 代理 Gemini countTokens 请求的辅助函数 +++
+// 请求头 X-Token-Estimate: local 时直接返回本地估算的结果，不调用上游
 func (h *ChatHandler) proxyGeminiCountTokens(c *gin.Context, modelName string, requestBody []byte) {
-	respBody, statusCode, err := h.genaiService.CountTokens(c.Request.Context(), modelName, requestBody)
+	if strings.EqualFold(c.GetHeader(service.HeaderTokenEstimate), "local") {
+		respBody, err := h.genaiService.EstimateTokens(requestBody)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"code": http.StatusBadRequest, "message": err.Error(), "status": "INVALID_ARGUMENT"}})
+			return
+		}
+		c.Header(service.HeaderTokenEstimate, "local")
+		c.Data(http.StatusOK, "application/json; charset=utf-8", respBody)
+		return
+	}
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	respBody, statusCode, err := h.genaiService.CountTokens(ctx, modelName, requestBody)
+	meta.ApplyHeaders(c.Writer.Header())
 	if err != nil {
 		logger.Error("Error proxying CountTokens for model %s: %v", modelName, err)
+		if respondCircuitOpen(c, err, false) {
+			return
+		}
 		if statusCode == 0 {
 			statusCode = http.StatusServiceUnavailable
 		}
@@ -264,3 +467,22 @@ func (h *ChatHandler) proxyGeminiCountTokens(c *gin.Context, modelName string, r
 	}
 	c.Data(statusCode, "application/json; charset=utf-8", respBody)
 }
+
+// proxyGeminiBatchGenerateContent 创建 Gemini 原生批处理，并记录创建它的 Key 以便之后使用同一个 Key 访问
+func (h *ChatHandler) proxyGeminiBatchGenerateContent(c *gin.Context, modelName string, requestBody []byte) {
+	respBody, statusCode, err := h.geminiBatches.Create(c.Request.Context(), currentClientID(c), modelName, requestBody)
+	if err != nil {
+		logger.Error("Error proxying BatchGenerateContent for model %s: %v", modelName, err)
+		if respondCircuitOpen(c, err, false) {
+			return
+		}
+		var upstreamError map[string]interface{}
+		if json.Unmarshal(respBody, &upstreamError) == nil {
+			c.JSON(statusCode, upstreamError)
+		} else {
+			c.JSON(statusCode, gin.H{"error": "Upstream API error: " + err.Error()})
+		}
+		return
+	}
+	c.Data(statusCode, "application/json; charset=utf-8", respBody)
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"gemini_polling/config"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"gemini_polling/storage"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// newChatStreamRouter 只挂载旧的 ChatStream 接口 (main.go 不再注册它)，上游只有一个指向 upstream 的 Vertex AI 凭据，
+// entries 写入模型目录
+func newChatStreamRouter(t *testing.T, upstream string, entries ...model.ModelEntry) (*gin.Engine, *gorm.DB) {
+	t.Helper()
+	t.Setenv("DB_DRIVER", "sqlite3")
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "data.db"))
+	t.Setenv("POLLING_API_KEY", "")
+	t.Setenv("MAX_RETRIES", "1")
+	t.Setenv("TOKEN_LIMIT_CHECK_ENABLED", "true")
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.InitDB(manager.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	keyPool := service.NewKeyPool(nil, manager)
+	keyPool.SetKeys([]model.APIKey{vertexCredential(t, upstream)})
+	cache, err := service.NewResponseCache(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genai := service.NewGenAIService(manager, nil, keyPool, cache)
+	registryStore := storage.NewRegistryStore(db)
+	for _, entry := range entries {
+		if err := registryStore.SaveModelEntry(&entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := service.NewModelRegistry(manager, registryStore, genai)
+	if err := registry.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	genai.SetTokenLimitSource(registry)
+	chat := NewChatHandler(genai, registry, nil, service.NewPolicyEngine(manager), service.NewPromptTemplates(storage.NewTemplateStore(db)))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/v1/chat/stream", chat.ChatStream)
+	return router, db
+}
+
+func TestChatStreamTemplateErrors(t *testing.T) {
+	upstream, requests := vertexStandIn(t)
+	tests := []struct {
+		name       string
+		body       string
+		closeDB    bool // 模板读取失败
+		wantStatus int
+	}{
+		{name: "unknown template", body: `{"model":"` + routeTestModel + `","stream":true,"template_id":"missing"}`, wantStatus: http.StatusBadRequest},
+		{name: "variables without a template", body: `{"model":"` + routeTestModel + `","stream":true,"variables":{"a":"b"}}`, wantStatus: http.StatusBadRequest},
+		{name: "template store failure", body: `{"model":"` + routeTestModel + `","stream":true,"template_id":"t"}`, closeDB: true, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, db := newChatStreamRouter(t, upstream.URL)
+			if tt.closeDB {
+				sqlDB, _ := db.DB()
+				sqlDB.Close()
+			}
+			before := len(requests())
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/stream", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			// 错误在开始流式输出之前返回，不能带着 SSE 的 Content-Type
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if !strings.Contains(w.Body.String(), `"error"`) {
+				t.Errorf("body = %s, want an OpenAI error", w.Body.String())
+			}
+			if n := len(requests()) - before; n != 0 {
+				t.Errorf("rejected request reached the upstream %d times", n)
+			}
+		})
+	}
+}
+
+func TestChatStreamValidationErrors(t *testing.T) {
+	upstream, requests := vertexStandIn(t)
+	entries := []model.ModelEntry{{Name: "secret-model", Hidden: true}, {Name: "small-model", InputTokenLimit: 10}}
+	chat := func(modelName, extra string) string {
+		return `{"model":"` + modelName + `","stream":true,"messages":[{"role":"user","content":"` + strings.Repeat("x", 200) + `"}]` + extra + `}`
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantError  string // 错误响应中应包含的片段
+	}{
+		{name: "hidden model", body: chat("secret-model", ""), wantStatus: http.StatusNotFound, wantError: `"code":"model_not_found"`},
+		{name: "prompt above the model's input limit", body: chat("small-model", ""), wantStatus: http.StatusBadRequest, wantError: `"code":"context_length_exceeded"`},
+		{name: "unsupported tool type", body: chat(routeTestModel, `,"tools":[{"type":"file_search"}]`), wantStatus: http.StatusBadRequest, wantError: `"param":"tools[0].type"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, _ := newChatStreamRouter(t, upstream.URL, entries...)
+			before := len(requests())
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/stream", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantError) {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantError)
+			}
+			if n := len(requests()) - before; n != 0 {
+				t.Errorf("rejected request reached the upstream %d times", n)
+			}
+		})
+	}
+
+	t.Run("valid request streams", func(t *testing.T) {
+		router, _ := newChatStreamRouter(t, upstream.URL, entries...)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/stream", strings.NewReader(chat(routeTestModel, ""))))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" || !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+			t.Errorf("stream = %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	})
+}
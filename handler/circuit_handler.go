@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"gemini_polling/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CircuitHandler struct {
+	genaiService *service.GenAIService
+}
+
+func NewCircuitHandler(s *service.GenAIService) *CircuitHandler {
+	return &CircuitHandler{genaiService: s}
+}
+
+// ListCircuits 返回所有模型熔断器的状态
+func (h *CircuitHandler) ListCircuits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"circuits": h.genaiService.GetCircuitStatuses(),
+	})
+}
+
+// ResetCircuit 手动关闭指定模型的熔断器
+func (h *CircuitHandler) ResetCircuit(c *gin.Context) {
+	modelName := c.Param("model")
+	if !h.genaiService.ResetCircuit(modelName) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No circuit breaker found for model: " + modelName})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Circuit breaker reset", "model": modelName})
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"gemini_polling/logger"
+	"gemini_polling/middleware"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CompletionHandler 提供 OpenAI 旧版文本补全接口 /v1/completions，供仍在使用 prompt 接口的脚本和评测工具调用
+type CompletionHandler struct {
+	completions *service.CompletionService
+	registry    *service.ModelRegistry
+	policy      *service.PolicyEngine
+}
+
+func NewCompletionHandler(completions *service.CompletionService, registry *service.ModelRegistry, policy *service.PolicyEngine) *CompletionHandler {
+	return &CompletionHandler{completions: completions, registry: registry, policy: policy}
+}
+
+// Complete 处理文本补全请求，stream 为 true 时以 SSE 返回 text_completion chunk
+func (h *CompletionHandler) Complete(c *gin.Context) {
+	var req model.CompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	resolved, ok := resolveRequestModel(c, h.registry, req.Model, true)
+	if !ok {
+		return
+	}
+	req.Model = resolved
+	h.policy.ApplyCompletion(middleware.CurrentClient(c), &req)
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	if !req.Stream {
+		resp, err := h.completions.Complete(ctx, &req)
+		meta.ApplyHeaders(c.Writer.Header())
+		if err != nil {
+			respondCompletionError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	err := h.completions.Stream(ctx, &req, func(chunk *model.TextCompletionResponse) error {
+		if !c.Writer.Written() {
+			meta.ApplyHeaders(c.Writer.Header())
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := c.Writer.Write([]byte("data: " + string(data) + "\n\n")); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		if !c.Writer.Written() {
+			respondCompletionError(c, err)
+			return
+		}
+		// 流已经开始，只能与 /v1/chat/completions 一样发送一个 SSE 错误事件
+		logger.Error("流式补全请求失败: %v", err)
+		errorMsg, _ := json.Marshal(model.OpenAIErrorResponse{
+			Error: model.ErrorDetail{
+				Message: err.Error(),
+				Type:    "api_error",
+			},
+		})
+		c.SSEvent("error", string(errorMsg))
+		return
+	}
+	if !c.Writer.Written() {
+		meta.ApplyHeaders(c.Writer.Header())
+		c.Header("Content-Type", "text/event-stream")
+	}
+	c.Writer.Write([]byte("data: [DONE]\n\n"))
+	c.Writer.Flush()
+}
+
+// respondCompletionError 将补全服务的错误转换为 OpenAI 格式的错误响应
+func respondCompletionError(c *gin.Context, err error) {
+	logger.Error("补全请求失败: %v", err)
+	var reqErr *service.CompletionRequestError
+	if errors.As(err, &reqErr) {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", reqErr.Param, reqErr.Message)
+		return
+	}
+	respondUpstreamFailure(c, err)
+}
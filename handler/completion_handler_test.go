@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"encoding/json"
+	"gemini_polling/model"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompletionsEndpoint(t *testing.T) {
+	upstream, requests := vertexStandIn(t)
+	router := newPolicyRouter(t, upstream.URL)
+
+	t.Run("non-stream", func(t *testing.T) {
+		code, body := doJSON(t, router, http.MethodPost, "/v1/completions", `{"model":"`+routeTestModel+`","prompt":"Say","echo":true}`)
+		if code != http.StatusOK {
+			t.Fatalf("status = %d: %s", code, body)
+		}
+		var resp model.TextCompletionResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Object != "text_completion" || !strings.HasPrefix(resp.ID, "cmpl-") || len(resp.Choices) != 1 || resp.Usage == nil {
+			t.Fatalf("response = %s, want a text_completion with one choice and usage", body)
+		}
+		if choice := resp.Choices[0]; choice.Text != "Sayhi" || choice.FinishReason != "stop" || choice.Logprobs != nil {
+			t.Errorf("choice = %+v, want the echoed prompt followed by the completion", choice)
+		}
+		// logprobs 未请求时仍然以 null 出现在每个 choice 中
+		if !strings.Contains(string(body), `"logprobs":null`) {
+			t.Errorf("body = %s, want logprobs:null", body)
+		}
+	})
+
+	t.Run("suffix", func(t *testing.T) {
+		before := len(requests())
+		if code, body := doJSON(t, router, http.MethodPost, "/v1/completions", `{"model":"`+routeTestModel+`","prompt":"def f():","suffix":"\nf()"}`); code != http.StatusOK {
+			t.Fatalf("status = %d: %s", code, body)
+		}
+		got := requests()[before:]
+		if len(got) != 1 {
+			t.Fatalf("upstream received %d requests, want 1", len(got))
+		}
+		contents, _ := got[0].body["contents"].([]interface{})
+		text, _ := contents[0].(map[string]interface{})["parts"].([]interface{})[0].(map[string]interface{})["text"].(string)
+		if !strings.Contains(text, "<prefix>def f():</prefix>") || !strings.Contains(text, "<suffix>\nf()</suffix>") {
+			t.Errorf("prompt = %q, want a fill-in-the-middle prompt", text)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		code, body := doJSON(t, router, http.MethodPost, "/v1/completions", `{"model":"`+routeTestModel+`","prompt":"Say","stream":true,"stream_options":{"include_usage":true}}`)
+		if code != http.StatusOK {
+			t.Fatalf("status = %d: %s", code, body)
+		}
+		events := strings.Split(strings.TrimSuffix(string(body), "\n\n"), "\n\n")
+		if len(events) != 3 || events[2] != "data: [DONE]" {
+			t.Fatalf("events = %q, want a content chunk, a usage chunk and [DONE]", events)
+		}
+		var chunks [2]model.TextCompletionResponse
+		for i := range chunks {
+			data, ok := strings.CutPrefix(events[i], "data: ")
+			if !ok || json.Unmarshal([]byte(data), &chunks[i]) != nil {
+				t.Fatalf("event %d = %q, want an SSE data line with a JSON chunk", i, events[i])
+			}
+			if chunks[i].Object != "text_completion" || chunks[i].ID != chunks[0].ID {
+				t.Errorf("chunk %d = %+v, want a text_completion chunk sharing the first id", i, chunks[i])
+			}
+		}
+		if len(chunks[0].Choices) != 1 || chunks[0].Choices[0].Text != "hi" || chunks[0].Choices[0].FinishReason != "stop" || chunks[0].Usage != nil {
+			t.Errorf("content chunk = %+v", chunks[0])
+		}
+		if len(chunks[1].Choices) != 0 || chunks[1].Usage == nil {
+			t.Errorf("usage chunk = %+v, want usage without choices", chunks[1])
+		}
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		before := len(requests())
+		for _, body := range []string{
+			`{"model":"` + routeTestModel + `","prompt":[1,2,3]}`,
+			`{"model":"` + routeTestModel + `","prompt":"Say","n":9,"stream":true}`,
+		} {
+			code, resp := doJSON(t, router, http.MethodPost, "/v1/completions", body)
+			if code != http.StatusBadRequest || !strings.Contains(string(resp), `"type":"invalid_request_error"`) || !strings.Contains(string(resp), `"param":`) {
+				t.Errorf("%s: %d %s, want a 400 invalid_request_error naming the parameter", body, code, resp)
+			}
+		}
+		if n := len(requests()) - before; n != 0 {
+			t.Errorf("rejected requests reached the upstream %d times", n)
+		}
+	})
+}
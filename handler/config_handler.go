@@ -42,6 +42,63 @@ func (h *ConfigHandler) GetSettings(c *gin.Context) {
 		"MAX_429_COUNT":      currentConfig.Max429Count,
 		"RECOVERY_BONUS":     currentConfig.RecoveryBonus,
 		"PENALTY_FACTOR":     currentConfig.PenaltyFactor,
+		"MAX_CONCURRENT_PER_KEY": currentConfig.MaxConcurrentPerKey,
+		"CIRCUIT_BREAKER_ENABLED":   currentConfig.CircuitBreakerEnabled,
+		"CIRCUIT_FAILURE_THRESHOLD": currentConfig.CircuitFailureThreshold,
+		"CIRCUIT_MIN_REQUESTS":      currentConfig.CircuitMinRequests,
+		"CIRCUIT_WINDOW_SECONDS":    int(currentConfig.CircuitWindow.Seconds()),
+		"CIRCUIT_OPEN_SECONDS":      int(currentConfig.CircuitOpenDuration.Seconds()),
+		"CIRCUIT_HALF_OPEN_PROBES":  currentConfig.CircuitHalfOpenProbes,
+		"MODEL_FALLBACKS":           currentConfig.ModelFallbacksSpec,
+		"THINKING_BUDGETS":          currentConfig.ThinkingBudgetsSpec,
+		"MODEL_CATALOGUE_TTL_SECONDS": int(currentConfig.ModelCatalogueTTL.Seconds()),
+		"RESPONSE_CACHE_ENABLED":      currentConfig.ResponseCacheEnabled,
+		"RESPONSE_CACHE_BACKEND":      currentConfig.ResponseCacheBackend,
+		"RESPONSE_CACHE_SQLITE_PATH":  currentConfig.ResponseCacheSQLitePath,
+		"RESPONSE_CACHE_TTL_SECONDS":  int(currentConfig.ResponseCacheTTL.Seconds()),
+		"RESPONSE_CACHE_MAX_ENTRIES":  currentConfig.ResponseCacheMaxEntries,
+		"RESPONSE_CACHE_MAX_SIZE_MB":  currentConfig.ResponseCacheMaxBytes / (1024 * 1024),
+		"RESPONSE_CACHE_MAX_ENTRY_KB": currentConfig.ResponseCacheMaxEntryBytes / 1024,
+		"REQUEST_COALESCING_ENABLED":  currentConfig.RequestCoalescingEnabled,
+		"BATCH_FILES_DIR":             currentConfig.BatchFilesDir,
+		"BATCH_POOL_FRACTION":         currentConfig.BatchPoolFraction,
+		"BATCH_MAX_FILE_MB":           currentConfig.BatchMaxFileBytes / (1024 * 1024),
+		"BATCH_MAX_REQUESTS":          currentConfig.BatchMaxRequests,
+		"IMAGE_DEFAULT_MODEL":         currentConfig.ImageDefaultModel,
+		"IMAGE_EDIT_MODEL":            currentConfig.ImageEditModel,
+		"IMAGE_FILES_DIR":             currentConfig.ImageFilesDir,
+		"IMAGE_URL_TTL_MINUTES":       int(currentConfig.ImageURLTTL.Minutes()),
+		"PUBLIC_BASE_URL":             currentConfig.PublicBaseURL,
+		"AUDIO_TTS_MODEL":             currentConfig.AudioTTSModel,
+		"AUDIO_TRANSCRIPTION_MODEL":   currentConfig.AudioTranscriptionModel,
+		"AUDIO_FFMPEG_PATH":           currentConfig.AudioFFmpegPath,
+		"MEDIA_FETCH_ENABLED":         currentConfig.MediaFetchEnabled,
+		"MEDIA_FETCH_MAX_MB":          currentConfig.MediaFetchMaxBytes / (1024 * 1024),
+		"MEDIA_FETCH_MAX_PARTS":       currentConfig.MediaFetchMaxParts,
+		"MEDIA_FETCH_MAX_TOTAL_MB":    currentConfig.MediaFetchMaxTotal / (1024 * 1024),
+		"MEDIA_FETCH_TIMEOUT_SECONDS": int(currentConfig.MediaFetchTimeout.Seconds()),
+		"MEDIA_FETCH_ALLOWED_HOSTS":   currentConfig.MediaFetchAllowedHosts,
+		"LIVE_MAX_SESSION_MINUTES":    int(currentConfig.LiveMaxSession.Minutes()),
+		"LIVE_SETUP_TIMEOUT_SECONDS":  int(currentConfig.LiveSetupTimeout.Seconds()),
+		"CHAT_MAX_N":                  currentConfig.ChatMaxN,
+		"CHAT_CANDIDATES_PER_CALL":    currentConfig.ChatCandidatesPerCall,
+		"POLICY_SAFETY_SETTINGS":      currentConfig.PolicySafetySettingsSpec,
+		"POLICY_SYSTEM_PROMPT":        currentConfig.PolicySystemPrompt,
+		"POLICY_MAX_OUTPUT_TOKENS":    currentConfig.PolicyMaxOutputTokens,
+		"POLICY_MAX_TEMPERATURE":      currentConfig.PolicyMaxTemperature,
+		"POLICY_DISALLOWED_TOOLS":     currentConfig.PolicyDisallowedTools,
+		"POLICY_MAX_BODY_KB":          currentConfig.PolicyMaxBodyBytes / 1024,
+		"REDACTION_MODE":              currentConfig.RedactionMode,
+		"REDACTION_DETECTORS":         currentConfig.RedactionDetectors,
+		"REDACTION_PATTERNS":          currentConfig.RedactionPatterns,
+		"THREAD_CONTEXT_TOKENS":       currentConfig.ThreadContextTokens,
+		"THREAD_OVERFLOW_STRATEGY":    currentConfig.ThreadOverflowStrategy,
+		"THREAD_SUMMARY_MODEL":        currentConfig.ThreadSummaryModel,
+		"CONTEXT_CACHE_ENABLED":       currentConfig.ContextCacheEnabled,
+		"CONTEXT_CACHE_MIN_TOKENS":    currentConfig.ContextCacheMinTokens,
+		"CONTEXT_CACHE_TTL_SECONDS":   int(currentConfig.ContextCacheTTL.Seconds()),
+		"TOKEN_LIMIT_CHECK_ENABLED":   currentConfig.TokenLimitCheckEnabled,
+		"TOKEN_LIMIT_TOLERANCE_PERCENT": currentConfig.TokenLimitTolerance,
 	}
 	c.JSON(http.StatusOK, safeSettings)
 }
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"gemini_polling/logger"
+	"gemini_polling/service"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeminiBatchHandler 提供 Gemini 原生批处理的 /v1beta/batches 接口、结果下载接口和管理接口
+type GeminiBatchHandler struct {
+	proxy *service.GeminiBatchProxy
+}
+
+func NewGeminiBatchHandler(proxy *service.GeminiBatchProxy) *GeminiBatchHandler {
+	return &GeminiBatchHandler{proxy: proxy}
+}
+
+// ListBatches 返回当前客户端通过本服务创建的批处理 (本地记录的最新状态)，支持 pageSize/pageToken 分页
+func (h *GeminiBatchHandler) ListBatches(c *gin.Context) {
+	clientID := currentClientID(c)
+	batches, err := h.proxy.List(&clientID)
+	if err != nil {
+		respondGeminiBatchError(c, err)
+		return
+	}
+
+	// pageToken 是下一页的起始下标
+	start, _ := strconv.Atoi(c.Query("pageToken"))
+	if start < 0 || start > len(batches) {
+		start = len(batches)
+	}
+	end := len(batches)
+	if pageSize, _ := strconv.Atoi(c.Query("pageSize")); pageSize > 0 && start+pageSize < end {
+		end = start + pageSize
+	}
+
+	operations := make([]json.RawMessage, 0, end-start)
+	for _, b := range batches[start:end] {
+		operations = append(operations, json.RawMessage(b.Operation))
+	}
+	resp := gin.H{"operations": operations}
+	if end < len(batches) {
+		resp["nextPageToken"] = strconv.Itoa(end)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// HandleBatchAction 处理 batches/{id} 上的操作: GET 查询、POST :cancel 取消、DELETE 删除
+func (h *GeminiBatchHandler) HandleBatchAction(c *gin.Context) {
+	nameAndAction := strings.TrimPrefix(c.Param("name_and_action"), "/")
+	name, action, _ := strings.Cut(nameAndAction, ":")
+	if name == "" {
+		h.ListBatches(c)
+		return
+	}
+	clientID := currentClientID(c)
+
+	var (
+		body   []byte
+		status int
+		err    error
+	)
+	switch {
+	case c.Request.Method == http.MethodGet && action == "":
+		body, status, err = h.proxy.Get(c.Request.Context(), &clientID, name)
+	case c.Request.Method == http.MethodPost && action == "cancel":
+		body, status, err = h.proxy.Cancel(c.Request.Context(), &clientID, name)
+	case c.Request.Method == http.MethodDelete && action == "":
+		body, status, err = h.proxy.Delete(c.Request.Context(), &clientID, name)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported batch operation: " + c.Request.Method + " " + nameAndAction})
+		return
+	}
+	if err != nil {
+		respondGeminiBatchError(c, err)
+		return
+	}
+	c.Data(status, "application/json; charset=utf-8", body)
+}
+
+// DownloadFile 使用创建批处理的 Key 下载批处理的结果文件 (files/{id}:download)
+func (h *GeminiBatchHandler) DownloadFile(c *gin.Context) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(c.Param("name"), "/"), ":")
+	clientID := currentClientID(c)
+	if err := h.proxy.Download(c.Request.Context(), &clientID, "files/"+name, c.Writer); err != nil {
+		if c.Writer.Written() {
+			logger.Error("下载批处理结果文件 files/%s 中断: %v", name, err)
+			return
+		}
+		respondGeminiBatchError(c, err)
+	}
+}
+
+// AdminListBatches 列出所有客户端、所有 Key 创建的 Gemini 批处理
+func (h *GeminiBatchHandler) AdminListBatches(c *gin.Context) {
+	batches, err := h.proxy.List(nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list Gemini batches: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"batches": batches})
+}
+
+// AdminRefreshBatches 使用各自的 Key 刷新所有未结束的 Gemini 批处理
+func (h *GeminiBatchHandler) AdminRefreshBatches(c *gin.Context) {
+	refreshed, err := h.proxy.RefreshAll(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh Gemini batches: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Gemini batches refreshed", "refreshed": refreshed})
+}
+
+// AdminCancelBatch 取消任意客户端的 Gemini 批处理
+func (h *GeminiBatchHandler) AdminCancelBatch(c *gin.Context) {
+	body, status, err := h.proxy.Cancel(c.Request.Context(), nil, c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if status != http.StatusOK {
+		c.JSON(status, gin.H{"error": "Upstream API error: " + string(body)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Gemini batch cancelled"})
+}
+
+// respondGeminiBatchError 返回 Gemini 格式的错误响应
+func respondGeminiBatchError(c *gin.Context, err error) {
+	status, geminiStatus := http.StatusServiceUnavailable, "UNAVAILABLE"
+	switch {
+	case errors.Is(err, service.ErrGeminiBatchNotFound):
+		status, geminiStatus = http.StatusNotFound, "NOT_FOUND"
+	case errors.Is(err, service.ErrGeminiBatchKeyGone), errors.Is(err, service.ErrGeminiBatchKeyDisabled):
+		status, geminiStatus = http.StatusBadRequest, "FAILED_PRECONDITION"
+	default:
+		logger.Error("Gemini 批处理请求失败: %v", err)
+	}
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"code":    status,
+			"message": err.Error(),
+			"status":  geminiStatus,
+		},
+	})
+}
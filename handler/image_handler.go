@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxEditImageBytes 是 /v1/images/edits 单张上传图片的大小上限，Gemini 内联数据的请求总大小上限为 20MB
+const maxEditImageBytes = 20 * 1024 * 1024
+
+// ImageHandler 提供 OpenAI 兼容的 /v1/images/generations、/v1/images/edits 接口和生成图片的下载接口
+type ImageHandler struct {
+	images   *service.ImageService
+	registry *service.ModelRegistry
+}
+
+func NewImageHandler(images *service.ImageService, registry *service.ModelRegistry) *ImageHandler {
+	return &ImageHandler{images: images, registry: registry}
+}
+
+// Generate 根据提示词生成图片
+func (h *ImageHandler) Generate(c *gin.Context) {
+	var req model.ImageGenerationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	if !h.resolveModel(c, &req, false) {
+		return
+	}
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	resp, err := h.images.Generate(ctx, &req, requestBaseURL(c))
+	meta.ApplyHeaders(c.Writer.Header())
+	if err != nil {
+		respondImageError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Edit 根据提示词编辑上传的图片 (multipart: image 或 image[]、可选的 mask，以及与生成接口相同的其他字段)
+func (h *ImageHandler) Edit(c *gin.Context) {
+	var req model.ImageGenerationRequest
+	if err := c.ShouldBind(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "image", "请求必须是 multipart/form-data: "+err.Error())
+		return
+	}
+
+	var images []service.ImageInput
+	for _, header := range append(form.File["image"], form.File["image[]"]...) {
+		img, err := readImageUpload(header)
+		if err != nil {
+			respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "image", err.Error())
+			return
+		}
+		images = append(images, img)
+	}
+	var mask *service.ImageInput
+	if headers := form.File["mask"]; len(headers) > 0 {
+		img, err := readImageUpload(headers[0])
+		if err != nil {
+			respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "mask", err.Error())
+			return
+		}
+		mask = &img
+	}
+	if !h.resolveModel(c, &req, true) {
+		return
+	}
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	resp, err := h.images.Edit(ctx, &req, images, mask, requestBaseURL(c))
+	meta.ApplyHeaders(c.Writer.Header())
+	if err != nil {
+		respondImageError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ServeImage 下载 response_format=url 生成的图片。文件名是随机生成的，链接过期后返回 404。
+func (h *ImageHandler) ServeImage(c *gin.Context) {
+	path, err := h.images.OpenImage(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.File(path)
+}
+
+// resolveModel 使用默认图片模型补全空的 model，并按模型目录解析别名和检查白名单
+func (h *ImageHandler) resolveModel(c *gin.Context, req *model.ImageGenerationRequest, edit bool) bool {
+	if req.Model == "" {
+		req.Model = h.images.DefaultModel(edit)
+	}
+	resolved, ok := resolveRequestModel(c, h.registry, req.Model, true)
+	req.Model = resolved
+	return ok
+}
+
+// readImageUpload 读取一张上传的图片，Content-Type 缺失时根据内容推断
+func readImageUpload(header *multipart.FileHeader) (service.ImageInput, error) {
+	if header.Size > maxEditImageBytes {
+		return service.ImageInput{}, fmt.Errorf("图片 %s 超过 %dMB 上限", header.Filename, maxEditImageBytes/(1024*1024))
+	}
+	src, err := header.Open()
+	if err != nil {
+		return service.ImageInput{}, fmt.Errorf("读取图片 %s 失败: %w", header.Filename, err)
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return service.ImageInput{}, fmt.Errorf("读取图片 %s 失败: %w", header.Filename, err)
+	}
+
+	mimeType := header.Header.Get("Content-Type")
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return service.ImageInput{}, fmt.Errorf("%s 不是图片文件", header.Filename)
+	}
+	return service.ImageInput{Data: data, MimeType: mimeType}, nil
+}
+
+// requestBaseURL 根据请求 (包括反向代理设置的 X-Forwarded-* 头) 推断客户端访问本服务使用的地址
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := c.Request.Host
+	if forwarded := c.GetHeader("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host
+}
+
+// respondImageError 将图片服务的错误转换为 OpenAI 格式的错误响应
+func respondImageError(c *gin.Context, err error) {
+	logger.Error("图片请求失败: %v", err)
+	var (
+		reqErr     *service.ImageRequestError
+		blockedErr *service.ImageBlockedError
+	)
+	switch {
+	case errors.As(err, &reqErr):
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", reqErr.Param, reqErr.Message)
+	case errors.As(err, &blockedErr):
+		c.JSON(http.StatusBadRequest, model.OpenAIErrorResponse{
+			Error: model.ErrorDetail{
+				Message: blockedErr.Error(),
+				Type:    "invalid_request_error",
+				Code:    "content_policy_violation",
+			},
+		})
+	default:
+		respondUpstreamFailure(c, err)
+	}
+}
+
+// respondUpstreamFailure 将上游调用失败 (熔断、限流、上游错误) 转换为 OpenAI 格式的错误响应
+func respondUpstreamFailure(c *gin.Context, err error) {
+	var upstreamErr *service.UpstreamError
+	switch {
+	case respondCircuitOpen(c, err, true):
+	case respondTokenLimitError(c, err, true):
+	case errors.Is(err, service.ErrAllKeysRateLimited):
+		respondOpenAIError(c, http.StatusTooManyRequests, "rate_limit_error", nil, err.Error())
+	case errors.As(err, &upstreamErr) && upstreamErr.StatusCode < http.StatusInternalServerError:
+		respondOpenAIError(c, upstreamErr.StatusCode, "invalid_request_error", nil, err.Error())
+	default:
+		c.JSON(http.StatusServiceUnavailable, model.OpenAIErrorResponse{
+			Error: model.ErrorDetail{
+				Message: err.Error(),
+				Type:    "api_error",
+				Code:    "service_unavailable",
+			},
+		})
+	}
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"gemini_polling/config"
 	"gemini_polling/logger"
+	"gemini_polling/model"
 	"gemini_polling/service"
 	"gemini_polling/storage"
 	"github.com/gin-gonic/gin"
@@ -10,6 +11,12 @@ import (
 	"strconv"
 )
 
+// keyListItem 是 Key 列表中的一项，附带内存池中的实时负载
+type keyListItem struct {
+	model.APIKey
+	InFlight int `json:"in_flight"`
+}
+
 type KeyHandler struct {
 	store         *storage.KeyStore
 	genaiService  *service.GenAIService
@@ -48,24 +55,42 @@ func (h *KeyHandler) Login(c *gin.Context) {
 }
 
 // AddKey 添加单个 Key
-// AddKey 添加单个 Key, 并立即进行验证
+// AddKey 添加单个 Key 或其他提供方的凭据, 并立即进行验证
 func (h *KeyHandler) AddKey(c *gin.Context) {
 	var json struct {
-		APIKey string `json:"api_key" binding:"required"`
+		APIKey     string `json:"api_key"`
+		Provider   string `json:"provider"`
+		BaseURL    string `json:"base_url"`
+		Project    string `json:"project"`
+		Region     string `json:"region"`
+		Credential string `json:"credential"` // Vertex AI 服务账号 JSON
+		Models     string `json:"models"`
 	}
 	if err := c.ShouldBindJSON(&json); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	key := &model.APIKey{
+		Key:        json.APIKey,
+		Provider:   json.Provider,
+		BaseURL:    json.BaseURL,
+		Project:    json.Project,
+		Region:     json.Region,
+		Credential: json.Credential,
+		Models:     json.Models,
+	}
+	if err := service.NormalizeCredential(key); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	// 1. 先添加到数据库
-	key, err := h.store.Add(json.APIKey)
-	if err != nil {
+	if err := h.store.AddCredential(key); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add key: " + err.Error()})
 		return
 	}
 	// 2. 立即进行验证
-	logger.Info("新 Key (ID: %d) 已添加，正在进行即时验证...", key.ID)
-	isValid, reason := h.genaiService.ValidateAPIKey(key.Key)
+	logger.Info("新 Key (ID: %d, 提供方: %s) 已添加，正在进行即时验证...", key.ID, key.Provider)
+	isValid, reason := h.genaiService.ValidateCredential(key)
 	if !isValid {
 		logger.Warn("新 Key (ID: %d) 未通过验证，已自动禁用。原因: %s", key.ID, reason)
 		h.store.Disable(key.ID, "添加时验证失败: "+reason)
@@ -146,7 +171,7 @@ func (h *KeyHandler) CheckSingleKey(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
 		return
 	}
-	isValid, reason := h.genaiService.ValidateAPIKey(key.Key)
+	isValid, reason := h.genaiService.ValidateCredential(key)
 	// 如果校验结果与当前状态不符，则更新数据库
 	if key.Enabled != isValid {
 		logger.Info("Key ID %d status changed to %v based on validation. Reason: %s", id, isValid, reason)
@@ -158,6 +183,37 @@ func (h *KeyHandler) CheckSingleKey(c *gin.Context) {
 	})
 }
 
+// UpdateKeyModels 修改凭据服务的模型，Key 池在下次刷新时生效
+func (h *KeyHandler) UpdateKeyModels(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+	var json struct {
+		Models string `json:"models"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key, err := h.store.FindByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+	key.Models = json.Models
+	if err := service.NormalizeCredential(key); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.store.UpdateModels(key.ID, key.Models); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update key: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
 // ListKeys 列出所有 Key (支持分页和过滤)
 func (h *KeyHandler) ListKeys(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
@@ -174,8 +230,20 @@ func (h *KeyHandler) ListKeys(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list keys: " + err.Error()})
 		return
 	}
+
+	// 附加每个 Key 当前的 in-flight 请求数
+	ids := make([]uint, len(keys))
+	for i := range keys {
+		ids[i] = keys[i].ID
+	}
+	inFlight := h.keyPool.GetInFlightCounts(ids)
+	items := make([]keyListItem, len(keys))
+	for i := range keys {
+		items[i] = keyListItem{APIKey: keys[i], InFlight: inFlight[keys[i].ID]}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"keys":        keys,
+		"keys":        items,
 		"total_count": total,
 		"page":        page,
 		"page_size":   pageSize,
@@ -311,6 +379,7 @@ func (h *KeyHandler) GetKeyStats(c *gin.Context) {
 	}
 
 	bannedCount := h.keyPool.GetBannedKeyCount()
+	inFlightCount, busiestKeyInFlight := h.keyPool.GetInFlightSummary()
 
 	// The number of truly enabled keys is the total enabled in DB minus those temporarily banned.
 	trulyEnabledCount := enabledCount - int64(bannedCount)
@@ -322,5 +391,8 @@ func (h *KeyHandler) GetKeyStats(c *gin.Context) {
 		"enabled_count":  trulyEnabledCount,
 		"disabled_count": disabledCount,
 		"banned_count":   bannedCount,
+		"in_flight_count":        inFlightCount,
+		"busiest_key_in_flight":  busiestKeyInFlight,
+		"max_concurrent_per_key": h.configManager.Get().MaxConcurrentPerKey,
 	})
 }
\ No newline at end of file
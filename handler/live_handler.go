@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"gemini_polling/logger"
+	"gemini_polling/middleware"
+	"gemini_polling/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// LiveHandler 提供 Gemini Live API 的 WebSocket 代理 (/ws/google.ai.generativelanguage.v1beta.GenerativeService.BidiGenerateContent)
+type LiveHandler struct {
+	live     *service.LiveProxy
+	registry *service.ModelRegistry
+	upgrader websocket.Upgrader
+}
+
+func NewLiveHandler(live *service.LiveProxy, registry *service.ModelRegistry) *LiveHandler {
+	return &LiveHandler{
+		live:     live,
+		registry: registry,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  32 * 1024,
+			WriteBufferSize: 32 * 1024,
+			// 访问控制由 API 密钥完成，允许浏览器从任意来源连接
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// Handle 升级为 WebSocket 连接并转发 BidiGenerateContent 会话
+func (h *LiveHandler) Handle(c *gin.Context) {
+	method := c.Param("method")
+	if !service.LiveMethods[method] {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": gin.H{
+				"code":    http.StatusNotFound,
+				"message": "不支持的 Live API 方法: " + method,
+				"status":  "NOT_FOUND",
+			},
+		})
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"code":    http.StatusBadRequest,
+				"message": "Live API 需要使用 WebSocket 连接",
+				"status":  "INVALID_ARGUMENT",
+			},
+		})
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade 已经向客户端返回了错误响应
+		logger.Warn("Live 会话升级 WebSocket 失败: %v", err)
+		return
+	}
+	client := middleware.CurrentClient(c)
+	h.live.Serve(c.Request.Context(), conn, method, client, func(requested string) (string, error) {
+		return h.registry.Resolve(client, requested)
+	})
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"gemini_polling/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MetricsHandler struct {
+	genaiService *service.GenAIService
+}
+
+func NewMetricsHandler(s *service.GenAIService) *MetricsHandler {
+	return &MetricsHandler{genaiService: s}
+}
+
+// GetMetrics 返回按模型统计的请求数、模型回退情况和响应缓存命中情况
+func (h *MetricsHandler) GetMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, h.genaiService.GetMetrics())
+}
+
+// PurgeCache 清空响应缓存
+func (h *MetricsHandler) PurgeCache(c *gin.Context) {
+	removed := h.genaiService.PurgeResponseCache()
+	c.JSON(http.StatusOK, gin.H{"message": "Response cache purged", "removed": removed})
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"errors"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ModelRegistryHandler 提供模型目录 (别名、隐藏模型、自定义模型) 和客户端凭据的管理接口
+type ModelRegistryHandler struct {
+	registry *service.ModelRegistry
+}
+
+func NewModelRegistryHandler(registry *service.ModelRegistry) *ModelRegistryHandler {
+	return &ModelRegistryHandler{registry: registry}
+}
+
+// ListEntries 返回所有模型目录条目以及上游模型列表缓存的状态
+func (h *ModelRegistryHandler) ListEntries(c *gin.Context) {
+	entries, err := h.registry.ListEntries()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list model entries: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries":   entries,
+		"catalogue": h.registry.Status(),
+	})
+}
+
+// ListCatalogue 返回合并后的完整模型列表 (不按客户端过滤)，便于在后台预览
+func (h *ModelRegistryHandler) ListCatalogue(c *gin.Context) {
+	models, err := h.registry.ListModels(c.Request.Context(), nil)
+	resp := gin.H{"models": models}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SaveEntry 创建或更新模型目录条目 (POST 创建，PUT /:id 更新)
+func (h *ModelRegistryHandler) SaveEntry(c *gin.Context) {
+	var entry model.ModelEntry
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	entry.ID = 0
+	if c.Param("id") != "" {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+			return
+		}
+		entry.ID = uint(id)
+	}
+	if err := h.registry.SaveEntry(&entry); err != nil {
+		respondRegistryError(c, err, "model entry")
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+func (h *ModelRegistryHandler) DeleteEntry(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+	if err := h.registry.DeleteEntry(uint(id)); err != nil {
+		respondRegistryError(c, err, "model entry")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Model entry deleted successfully"})
+}
+
+// RefreshCatalogue 立即从上游重新拉取模型列表
+func (h *ModelRegistryHandler) RefreshCatalogue(c *gin.Context) {
+	count, err := h.registry.RefreshCatalogue(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to refresh model catalogue: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Model catalogue refreshed", "upstream_models": count})
+}
+
+func (h *ModelRegistryHandler) ListClients(c *gin.Context) {
+	clients, err := h.registry.ListClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list clients: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+// clientRequest 是创建/更新客户端的请求体，enabled 省略时默认为启用
+type clientRequest struct {
+	Name          string `json:"name"`
+	Key           string `json:"key"`
+	AllowedModels string `json:"allowed_models"`
+	SystemPrompt  string `json:"system_prompt"`
+	Enabled       *bool  `json:"enabled"`
+}
+
+// SaveClient 创建或更新客户端凭据 (POST 创建，PUT /:id 更新)。key 留空时自动生成。
+func (h *ModelRegistryHandler) SaveClient(c *gin.Context) {
+	var req clientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	client := model.Client{Name: req.Name, Key: req.Key, AllowedModels: req.AllowedModels, SystemPrompt: req.SystemPrompt, Enabled: true}
+	if req.Enabled != nil {
+		client.Enabled = *req.Enabled
+	}
+	if c.Param("id") != "" {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+			return
+		}
+		client.ID = uint(id)
+	}
+	if err := h.registry.SaveClient(&client); err != nil {
+		respondRegistryError(c, err, "client")
+		return
+	}
+	c.JSON(http.StatusOK, client)
+}
+
+func (h *ModelRegistryHandler) DeleteClient(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+	if err := h.registry.DeleteClient(uint(id)); err != nil {
+		respondRegistryError(c, err, "client")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Client deleted successfully"})
+}
+
+// respondRegistryError 将存储层错误转换为合适的 HTTP 状态码
+func respondRegistryError(c *gin.Context, err error, what string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The " + what + " was not found"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to save " + what + ": " + err.Error()})
+}
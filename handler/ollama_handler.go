@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gemini_polling/logger"
+	"gemini_polling/middleware"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ollamaCompatVersion 是 /api/version 返回的版本号，部分客户端据此判断是否支持工具调用等功能
+const ollamaCompatVersion = "0.9.0"
+
+// OllamaHandler 提供 Ollama 兼容的 /api/chat、/api/generate、/api/embed、/api/tags、/api/show 接口，
+// 让 IDE 插件、Open WebUI 等只支持 Ollama 协议的工具可以直接连接本服务。
+type OllamaHandler struct {
+	ollama   *service.OllamaService
+	registry *service.ModelRegistry
+}
+
+func NewOllamaHandler(ollama *service.OllamaService, registry *service.ModelRegistry) *OllamaHandler {
+	return &OllamaHandler{ollama: ollama, registry: registry}
+}
+
+// Chat 处理多轮对话，默认以 NDJSON 流式返回
+func (h *OllamaHandler) Chat(c *gin.Context) {
+	var req model.OllamaChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.resolveModel(c, &req.Model) {
+		return
+	}
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	write := ollamaWriter(c, meta, req.Stream == nil || *req.Stream)
+	err := h.ollama.Chat(ctx, middleware.CurrentClient(c), &req, func(resp *model.OllamaChatResponse) error { return write(resp) })
+	if err != nil {
+		respondOllamaError(c, err)
+	}
+}
+
+// Generate 处理单轮补全 (包括带 suffix 的代码补全)，默认以 NDJSON 流式返回
+func (h *OllamaHandler) Generate(c *gin.Context) {
+	var req model.OllamaGenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.resolveModel(c, &req.Model) {
+		return
+	}
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	write := ollamaWriter(c, meta, req.Stream == nil || *req.Stream)
+	err := h.ollama.Generate(ctx, middleware.CurrentClient(c), &req, func(resp *model.OllamaGenerateResponse) error { return write(resp) })
+	if err != nil {
+		respondOllamaError(c, err)
+	}
+}
+
+// Embed 计算一段或多段文本的向量
+func (h *OllamaHandler) Embed(c *gin.Context) {
+	var req model.OllamaEmbedRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.resolveModel(c, &req.Model) {
+		return
+	}
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	resp, err := h.ollama.Embed(ctx, &req)
+	meta.ApplyHeaders(c.Writer.Header())
+	if err != nil {
+		respondOllamaError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Tags 返回当前客户端可见的模型列表，数据来自模型目录缓存
+func (h *OllamaHandler) Tags(c *gin.Context) {
+	models, err := h.registry.ListModels(c.Request.Context(), middleware.CurrentClient(c))
+	if err != nil && len(models) == 0 {
+		logger.Error("获取模型列表时发生错误: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to fetch models from upstream: " + err.Error()})
+		return
+	}
+
+	modifiedAt := h.registry.Status().FetchedAt
+	list := make([]gin.H, 0, len(models))
+	for _, m := range models {
+		if len(ollamaCapabilities(m.Gemini)) == 0 {
+			continue
+		}
+		digest := sha256.Sum256([]byte(m.ID))
+		list = append(list, gin.H{
+			"name":        m.ID,
+			"model":       m.ID,
+			"modified_at": modifiedAt,
+			"size":        0,
+			"digest":      hex.EncodeToString(digest[:]),
+			"details":     ollamaDetails(m.ID),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": list})
+}
+
+// Show 返回单个模型的详细信息和能力
+func (h *OllamaHandler) Show(c *gin.Context) {
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"` // 旧版本客户端使用 name
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSuffix(req.Model, ":latest")
+	if name == "" {
+		name = strings.TrimSuffix(req.Name, ":latest")
+	}
+
+	models, _ := h.registry.ListModels(c.Request.Context(), middleware.CurrentClient(c))
+	for _, m := range models {
+		if m.ID != name {
+			continue
+		}
+		modelInfo := gin.H{"general.architecture": "gemini"}
+		if limit, ok := m.Gemini["inputTokenLimit"]; ok {
+			modelInfo["gemini.context_length"] = limit
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"modelfile":    "FROM " + m.ID,
+			"parameters":   "",
+			"template":     "{{ .Prompt }}",
+			"details":      ollamaDetails(m.ID),
+			"model_info":   modelInfo,
+			"capabilities": ollamaCapabilities(m.Gemini),
+			"modified_at":  h.registry.Status().FetchedAt,
+		})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "model '" + name + "' not found"})
+}
+
+// Version 返回兼容的 Ollama 版本号
+func (h *OllamaHandler) Version(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": ollamaCompatVersion})
+}
+
+// resolveModel 去掉 Ollama 客户端附加的 ":latest" 标签，按模型目录解析别名并检查客户端的模型白名单
+func (h *OllamaHandler) resolveModel(c *gin.Context, name *string) bool {
+	requested := strings.TrimSuffix(*name, ":latest")
+	if requested == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return false
+	}
+	resolved, err := h.registry.Resolve(middleware.CurrentClient(c), requested)
+	if err != nil {
+		status := http.StatusNotFound
+		var notAllowed *service.ModelNotAllowedError
+		if errors.As(err, &notAllowed) {
+			status = http.StatusForbidden
+		}
+		logger.Warn("拒绝模型 %s 的请求: %v", requested, err)
+		c.JSON(status, gin.H{"error": err.Error()})
+		return false
+	}
+	*name = resolved
+	return true
+}
+
+// ollamaWriter 返回输出单个响应的函数: 流式请求每个响应写成一行 NDJSON 并立即刷新，
+// 非流式请求只会输出一次普通 JSON
+func ollamaWriter(c *gin.Context, meta *service.ResponseMeta, stream bool) func(v interface{}) error {
+	return func(v interface{}) error {
+		if !c.Writer.Written() {
+			meta.ApplyHeaders(c.Writer.Header())
+		}
+		if !stream {
+			c.JSON(http.StatusOK, v)
+			return nil
+		}
+		line, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !c.Writer.Written() {
+			c.Header("Content-Type", "application/x-ndjson")
+		}
+		if _, err := c.Writer.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+}
+
+// ollamaDetails 返回模型的 details 字段，Gemini 模型没有参数量和量化信息
+func ollamaDetails(id string) gin.H {
+	family, _, _ := strings.Cut(id, "-")
+	return gin.H{
+		"parent_model":       "",
+		"format":             "gemini",
+		"family":             family,
+		"families":           []string{family},
+		"parameter_size":     "",
+		"quantization_level": "",
+	}
+}
+
+// ollamaCapabilities 根据 Gemini 模型描述中的 supportedGenerationMethods 推断 Ollama 的能力列表，
+// 不支持对话和向量的模型 (如 Imagen) 返回空列表
+func ollamaCapabilities(desc map[string]interface{}) []string {
+	var methods []string
+	switch v := desc["supportedGenerationMethods"].(type) {
+	case []string:
+		methods = v
+	case []interface{}:
+		for _, m := range v {
+			if s, ok := m.(string); ok {
+				methods = append(methods, s)
+			}
+		}
+	}
+
+	var caps []string
+	for _, m := range methods {
+		switch m {
+		case "generateContent":
+			caps = append(caps, "completion", "tools", "vision")
+		case "embedContent":
+			caps = append(caps, "embedding")
+		}
+	}
+	if thinking, _ := desc["thinking"].(bool); thinking && len(caps) > 0 {
+		caps = append(caps, "thinking")
+	}
+	return caps
+}
+
+// respondOllamaError 返回 Ollama 格式的错误 ({"error": "..."})。
+// 流式响应已经开始时，与 Ollama 一样把错误作为最后一行输出。
+func respondOllamaError(c *gin.Context, err error) {
+	logger.Error("Ollama 请求失败: %v", err)
+	if c.Writer.Written() {
+		line, _ := json.Marshal(gin.H{"error": err.Error()})
+		c.Writer.Write(append(line, '\n'))
+		c.Writer.Flush()
+		return
+	}
+
+	var (
+		reqErr      *service.OllamaRequestError
+		fetchErr    *service.MediaFetchError
+		limitErr    *service.TokenLimitError
+		circuitErr  *service.CircuitOpenError
+		upstreamErr *service.UpstreamError
+	)
+	status := http.StatusServiceUnavailable
+	switch {
+	case errors.As(err, &reqErr), errors.As(err, &fetchErr), errors.As(err, &limitErr):
+		status = http.StatusBadRequest
+	case errors.As(err, &circuitErr):
+		c.Header("Retry-After", strconv.Itoa(circuitErr.RetryAfterSeconds()))
+	case errors.Is(err, service.ErrAllKeysRateLimited):
+		status = http.StatusTooManyRequests
+	case errors.As(err, &upstreamErr) && upstreamErr.StatusCode < http.StatusInternalServerError:
+		status = upstreamErr.StatusCode
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"gemini_polling/config"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"gemini_polling/storage"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newOllamaRouter 挂载所有 Ollama 兼容接口，上游只有一个指向 upstream 的 Vertex AI 凭据，entries 写入模型目录。
+// 没有 AI Studio Key 时无法拉取上游模型列表，/api/tags 只返回模型目录中的模型。
+func newOllamaRouter(t *testing.T, upstream string, entries ...model.ModelEntry) *gin.Engine {
+	t.Helper()
+	t.Setenv("DB_DRIVER", "sqlite3")
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "data.db"))
+	t.Setenv("POLLING_API_KEY", "")
+	t.Setenv("MAX_RETRIES", "1")
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.InitDB(manager.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	keyPool := service.NewKeyPool(nil, manager)
+	keyPool.SetKeys([]model.APIKey{vertexCredential(t, upstream)})
+	cache, err := service.NewResponseCache(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genai := service.NewGenAIService(manager, nil, keyPool, cache)
+	registryStore := storage.NewRegistryStore(db)
+	for _, entry := range entries {
+		if err := registryStore.SaveModelEntry(&entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := service.NewModelRegistry(manager, registryStore, genai)
+	if err := registry.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	ollama := NewOllamaHandler(service.NewOllamaService(genai, service.NewPolicyEngine(manager)), registry)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api")
+	api.POST("/chat", ollama.Chat)
+	api.POST("/generate", ollama.Generate)
+	api.POST("/embed", ollama.Embed)
+	api.GET("/tags", ollama.Tags)
+	api.POST("/show", ollama.Show)
+	api.GET("/version", ollama.Version)
+	return router
+}
+
+func serveOllama(router http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// ndjsonLines 把 NDJSON 响应拆分为每行一个对象，每行必须是完整的 JSON 并以换行结尾
+func ndjsonLines(t *testing.T, body []byte) []map[string]interface{} {
+	t.Helper()
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		t.Fatalf("NDJSON body does not end with a newline: %q", body)
+	}
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestOllamaStreamFraming(t *testing.T) {
+	upstream, requests := vertexStandIn(t)
+	router := newOllamaRouter(t, upstream.URL)
+	tests := []struct {
+		name    string
+		target  string
+		body    string
+		content func(line map[string]interface{}) interface{}
+	}{
+		{
+			name:   "chat",
+			target: "/api/chat",
+			body:   `{"model":"` + routeTestModel + `:latest","messages":[{"role":"user","content":"hello"}]}`,
+			content: func(line map[string]interface{}) interface{} {
+				return line["message"].(map[string]interface{})["content"]
+			},
+		},
+		{
+			name:    "generate",
+			target:  "/api/generate",
+			body:    `{"model":"` + routeTestModel + `","prompt":"hello"}`,
+			content: func(line map[string]interface{}) interface{} { return line["response"] },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(requests())
+			w := serveOllama(router, http.MethodPost, tt.target, tt.body)
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+				t.Fatalf("response = %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+			}
+			// 未指定 stream 时默认流式，":latest" 标签在转发前被去掉
+			got := requests()[before:]
+			if len(got) != 1 || got[0].body["stream"] != true || got[0].body["model"] != "google/"+routeTestModel {
+				t.Fatalf("upstream requests = %+v, want one streaming request for %s", got, routeTestModel)
+			}
+
+			lines := ndjsonLines(t, w.Body.Bytes())
+			if len(lines) != 2 {
+				t.Fatalf("got %d lines, want a content line and a final line: %s", len(lines), w.Body.String())
+			}
+			if lines[0]["done"] != false || tt.content(lines[0]) != "hi" {
+				t.Errorf("content line = %v", lines[0])
+			}
+			final := lines[1]
+			if final["done"] != true || final["done_reason"] != "stop" || tt.content(final) != "" {
+				t.Errorf("final line = %v, want done:true with reason stop and no content", final)
+			}
+			if _, ok := final["total_duration"]; !ok {
+				t.Errorf("final line = %v, want timing metrics", final)
+			}
+			for _, line := range lines {
+				if line["model"] != routeTestModel || line["created_at"] == "" {
+					t.Errorf("line = %v, want model %s and created_at", line, routeTestModel)
+				}
+			}
+		})
+	}
+}
+
+func TestOllamaNonStream(t *testing.T) {
+	upstream, _ := vertexStandIn(t)
+	router := newOllamaRouter(t, upstream.URL)
+
+	w := serveOllama(router, http.MethodPost, "/api/chat", `{"model":"`+routeTestModel+`","messages":[{"role":"user","content":"hello"}],"stream":false}`)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("response = %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	var resp model.OllamaChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("body is not a single JSON object: %s", w.Body.String())
+	}
+	if !resp.Done || resp.Message.Content != "hi" || resp.PromptEvalCount != 1 || resp.EvalCount != 1 {
+		t.Errorf("response = %+v, want the full reply with usage", resp)
+	}
+}
+
+func TestOllamaErrors(t *testing.T) {
+	upstream, requests := vertexStandIn(t)
+	router := newOllamaRouter(t, upstream.URL, model.ModelEntry{Name: "secret-model", Hidden: true})
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+	}{
+		{name: "missing model", target: "/api/chat", body: `{"messages":[{"role":"user","content":"hi"}]}`, wantStatus: http.StatusBadRequest},
+		{name: "hidden model", target: "/api/chat", body: `{"model":"secret-model","messages":[{"role":"user","content":"hi"}]}`, wantStatus: http.StatusNotFound},
+		{name: "invalid format", target: "/api/generate", body: `{"model":"` + routeTestModel + `","prompt":"hi","format":"yaml"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid image", target: "/api/chat", body: `{"model":"` + routeTestModel + `","messages":[{"role":"user","content":"hi","images":["not base64!"]}]}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid embed input", target: "/api/embed", body: `{"model":"gemini-embedding-001","input":42}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(requests())
+			w := serveOllama(router, http.MethodPost, tt.target, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			// 错误在开始流式输出之前返回，是 Ollama 格式的 JSON 而不是 NDJSON
+			var resp struct{ Error string }
+			if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") || json.Unmarshal(w.Body.Bytes(), &resp) != nil || resp.Error == "" {
+				t.Errorf("response = %q %s, want {\"error\": ...}", w.Header().Get("Content-Type"), w.Body.String())
+			}
+			if n := len(requests()) - before; n != 0 {
+				t.Errorf("rejected request reached the upstream %d times", n)
+			}
+		})
+	}
+}
+
+func TestOllamaTagsAndShow(t *testing.T) {
+	upstream, _ := vertexStandIn(t)
+	router := newOllamaRouter(t, upstream.URL,
+		model.ModelEntry{Name: "team-model", InputTokenLimit: 32000},
+		model.ModelEntry{Name: "secret-model", Hidden: true},
+	)
+
+	w := serveOllama(router, http.MethodGet, "/api/tags", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("tags = %d: %s", w.Code, w.Body.String())
+	}
+	var tags struct {
+		Models []struct {
+			Name, Model, Digest string
+			Details             map[string]interface{}
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &tags)
+	if len(tags.Models) != 1 || tags.Models[0].Name != "team-model" || tags.Models[0].Model != "team-model" || len(tags.Models[0].Digest) != 64 {
+		t.Fatalf("tags = %s, want only team-model", w.Body.String())
+	}
+	if tags.Models[0].Details["family"] != "team" || tags.Models[0].Details["format"] != "gemini" {
+		t.Errorf("details = %v", tags.Models[0].Details)
+	}
+
+	w = serveOllama(router, http.MethodPost, "/api/show", `{"model":"team-model:latest"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("show = %d: %s", w.Code, w.Body.String())
+	}
+	var show struct {
+		Modelfile    string
+		ModelInfo    map[string]interface{} `json:"model_info"`
+		Capabilities []string
+	}
+	json.Unmarshal(w.Body.Bytes(), &show)
+	if show.Modelfile != "FROM team-model" || show.ModelInfo["gemini.context_length"] != float64(32000) {
+		t.Errorf("show = %s", w.Body.String())
+	}
+	if want := []string{"completion", "tools", "vision"}; !reflect.DeepEqual(show.Capabilities, want) {
+		t.Errorf("capabilities = %v, want %v", show.Capabilities, want)
+	}
+
+	// 旧版本客户端使用 name 字段；隐藏模型和不存在的模型返回 404
+	if w := serveOllama(router, http.MethodPost, "/api/show", `{"name":"team-model"}`); w.Code != http.StatusOK {
+		t.Errorf("show by name = %d: %s", w.Code, w.Body.String())
+	}
+	for _, name := range []string{"secret-model", "missing-model"} {
+		if w := serveOllama(router, http.MethodPost, "/api/show", `{"model":"`+name+`"}`); w.Code != http.StatusNotFound {
+			t.Errorf("show %s = %d, want 404", name, w.Code)
+		}
+	}
+
+	if w := serveOllama(router, http.MethodGet, "/api/version", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"version":"`+ollamaCompatVersion+`"`) {
+		t.Errorf("version = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOllamaCapabilities(t *testing.T) {
+	tests := []struct {
+		name string
+		desc map[string]interface{}
+		want []string
+	}{
+		{name: "chat model", desc: map[string]interface{}{"supportedGenerationMethods": []interface{}{"generateContent", "countTokens"}}, want: []string{"completion", "tools", "vision"}},
+		{name: "thinking model", desc: map[string]interface{}{"supportedGenerationMethods": []string{"generateContent"}, "thinking": true}, want: []string{"completion", "tools", "vision", "thinking"}},
+		{name: "embedding model", desc: map[string]interface{}{"supportedGenerationMethods": []interface{}{"embedContent"}}, want: []string{"embedding"}},
+		{name: "image model", desc: map[string]interface{}{"supportedGenerationMethods": []interface{}{"predict"}, "thinking": true}},
+	}
+	for _, tt := range tests {
+		if got := ollamaCapabilities(tt.desc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"gemini_polling/config"
+	"gemini_polling/middleware"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"gemini_polling/storage"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	routeTestModel  = "gemini-2.5-flash"
+	routeTestClient = "sk-team"
+	routeTestPrompt = "Team prompt."
+)
+
+// upstreamRequest 是 Vertex AI 替身收到的一次生成请求
+type upstreamRequest struct {
+	path string
+	body map[string]interface{}
+}
+
+// vertexStandIn 是 Vertex AI 的本地替身: /token 签发 access token，
+// OpenAI 兼容的 chat/completions 和原生 generateContent/streamGenerateContent 返回固定回复并记录请求体
+func vertexStandIn(t *testing.T) (*httptest.Server, func() []upstreamRequest) {
+	var mu sync.Mutex
+	var requests []upstreamRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"ya29.test","expires_in":3600,"token_type":"Bearer"}`))
+			return
+		}
+		raw, _ := io.ReadAll(r.Body)
+		req := upstreamRequest{path: r.URL.Path}
+		json.Unmarshal(raw, &req.body)
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/chat/completions") && req.body["stream"] == true:
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"google/` + routeTestModel + `","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}` + "\n\ndata: [DONE]\n\n"))
+		case strings.HasSuffix(r.URL.Path, "/chat/completions"):
+			w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"google/` + routeTestModel + `","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`))
+		case strings.HasSuffix(r.URL.Path, ":streamGenerateContent"):
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(`data: {"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}` + "\n\n"))
+		default:
+			w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":1,"candidatesTokenCount":1,"totalTokenCount":2}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []upstreamRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]upstreamRequest(nil), requests...)
+	}
+}
+
+// vertexCredential 返回一个指向 upstream 替身的 Vertex AI 凭据
+func vertexCredential(t *testing.T, upstream string) model.APIKey {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "demo-project",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email": "proxy@demo-project.iam.gserviceaccount.com",
+		"token_uri":    upstream + "/token",
+	})
+	key := model.APIKey{ID: 1, Provider: model.ProviderVertex, Credential: string(sa), BaseURL: upstream}
+	if err := service.NormalizeCredential(&key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newPolicyRouter 按 main.go 的方式组装所有转发生成请求的路由，上游只有一个指向 upstream 的 Vertex AI 凭据
+func newPolicyRouter(t *testing.T, upstream string) *gin.Engine {
+	t.Helper()
+	dir := t.TempDir()
+	for _, kv := range [][2]string{
+		{"DB_DRIVER", "sqlite3"},
+		{"SQLITE_PATH", filepath.Join(dir, "data.db")},
+		{"BATCH_FILES_DIR", filepath.Join(dir, "batch_files")},
+		{"POLLING_API_KEY", ""},
+		{"MAX_RETRIES", "1"},
+		{"POLICY_SYSTEM_PROMPT", "Global prompt."},
+		{"POLICY_MAX_OUTPUT_TOKENS", "100"},
+		{"POLICY_MAX_TEMPERATURE", "0.5"},
+	} {
+		t.Setenv(kv[0], kv[1])
+	}
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.InitDB(manager.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	keyPool := service.NewKeyPool(nil, manager)
+	keyPool.SetKeys([]model.APIKey{vertexCredential(t, upstream)})
+	cache, err := service.NewResponseCache(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genai := service.NewGenAIService(manager, nil, keyPool, cache)
+
+	registryStore := storage.NewRegistryStore(db)
+	if err := registryStore.SaveClient(&model.Client{Name: "team", Key: routeTestClient, SystemPrompt: routeTestPrompt, Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	registry := service.NewModelRegistry(manager, registryStore, genai)
+	if err := registry.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	templates := service.NewPromptTemplates(storage.NewTemplateStore(db))
+	redactor := service.NewRedactor(manager)
+	policy := service.NewPolicyEngine(manager)
+	batchRunner := service.NewBatchRunner(manager, storage.NewBatchStore(db), genai, registry, templates, keyPool, policy, redactor)
+	if err := batchRunner.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	chatHandler := NewChatHandler(genai, registry, service.NewGeminiBatchProxy(genai, nil, storage.NewBatchStore(db)), policy, templates)
+	completionHandler := NewCompletionHandler(service.NewCompletionService(genai), registry, policy)
+	ollamaHandler := NewOllamaHandler(service.NewOllamaService(genai, policy), registry)
+	threadHandler := NewThreadHandler(service.NewThreadService(manager, storage.NewThreadStore(db), genai, registry, policy), registry)
+	batchHandler := NewBatchHandler(batchRunner)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	auth := []gin.HandlerFunc{middleware.PollingAuthMiddleware(manager, registry), middleware.BodyLimitMiddleware(manager), middleware.RedactionMiddleware(redactor), middleware.CachePolicyMiddleware()}
+	v1 := router.Group("/v1", auth...)
+	v1.POST("/chat/completions", chatHandler.HandleChatCompletions)
+	v1.POST("/completions", completionHandler.Complete)
+	v1.POST("/files", batchHandler.UploadFile)
+	v1.POST("/batches", batchHandler.CreateBatch)
+	v1.GET("/batches/:id", batchHandler.GetBatch)
+	v1.POST("/threads", threadHandler.CreateThread)
+	v1.POST("/threads/:id/messages", threadHandler.AppendMessage)
+	router.Group("/v1beta", auth...).POST("/models/*model_and_action", chatHandler.HandleGeminiAction)
+	ollama := router.Group("/api", auth...)
+	ollama.POST("/chat", ollamaHandler.Chat)
+	ollama.POST("/generate", ollamaHandler.Generate)
+	return router
+}
+
+// do 以客户端 routeTestClient 的身份发送请求，返回状态码和响应体
+func do(t *testing.T, router http.Handler, method, target, contentType string, body io.Reader) (int, []byte) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", "Bearer "+routeTestClient)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+func doJSON(t *testing.T, router http.Handler, method, target, body string) (int, []byte) {
+	t.Helper()
+	return do(t, router, method, target, "application/json", strings.NewReader(body))
+}
+
+// checkChatPolicy 检查 OpenAI 兼容请求体: 客户端的系统提示词在最前面，max_tokens 和 temperature 被限制
+func checkChatPolicy(t *testing.T, body map[string]interface{}) {
+	t.Helper()
+	messages, _ := body["messages"].([]interface{})
+	if len(messages) < 2 {
+		t.Fatalf("messages = %v", body["messages"])
+	}
+	first, _ := messages[0].(map[string]interface{})
+	if first["role"] != "system" || first["content"] != routeTestPrompt {
+		t.Errorf("first message = %v, want the client's system prompt", first)
+	}
+	if body["max_tokens"] != float64(100) || body["temperature"] != 0.5 {
+		t.Errorf("max_tokens = %v, temperature = %v, want 100 and 0.5", body["max_tokens"], body["temperature"])
+	}
+}
+
+// checkNativePolicy 检查 Gemini 原生请求体: 客户端的系统提示词是 systemInstruction 的第一部分，generationConfig 被限制
+func checkNativePolicy(t *testing.T, body map[string]interface{}) {
+	t.Helper()
+	instruction, _ := body["systemInstruction"].(map[string]interface{})
+	parts, _ := instruction["parts"].([]interface{})
+	if len(parts) == 0 || parts[0].(map[string]interface{})["text"] != routeTestPrompt {
+		t.Errorf("systemInstruction = %v, want the client's system prompt first", body["systemInstruction"])
+	}
+	generation, _ := body["generationConfig"].(map[string]interface{})
+	if generation["maxOutputTokens"] != float64(100) || generation["temperature"] != 0.5 {
+		t.Errorf("generationConfig = %v, want maxOutputTokens 100 and temperature 0.5", generation)
+	}
+}
+
+// TestPolicyAppliesToEveryForwardingRoute 依次通过每个转发生成请求的入口发送超出上限的请求，
+// 检查到达上游的请求都带有客户端的系统提示词并且参数被限制。
+// Gemini 原生 batchGenerateContent 和 Live API 只能转发到 AI Studio，分别由 service 包中的 ApplyGeminiBatch 和 LiveProxy 测试覆盖。
+func TestPolicyAppliesToEveryForwardingRoute(t *testing.T) {
+	upstream, requests := vertexStandIn(t)
+	router := newPolicyRouter(t, upstream.URL)
+
+	chatBody := `{"model":"` + routeTestModel + `","messages":[{"role":"user","content":"hello %s"}],"max_tokens":4096,"temperature":1.5%s}`
+	nativeBody := `{"contents":[{"role":"user","parts":[{"text":"hello %s"}]}],"generationConfig":{"maxOutputTokens":4096,"temperature":1.5}}`
+	ollamaOptions := `"options":{"num_predict":4096,"temperature":1.5},"stream":false`
+
+	routes := []struct {
+		name   string
+		target string
+		body   string
+		native bool
+	}{
+		{name: "chat completions", target: "/v1/chat/completions", body: sprintf(chatBody, "chat", "")},
+		{name: "streaming chat completions", target: "/v1/chat/completions", body: sprintf(chatBody, "stream", `,"stream":true`)},
+		{name: "legacy completions", target: "/v1/completions", body: `{"model":"` + routeTestModel + `","prompt":"hello completions","max_tokens":4096,"temperature":1.5}`, native: true},
+		{name: "generateContent", target: "/v1beta/models/" + routeTestModel + ":generateContent", body: sprintf(nativeBody, "native"), native: true},
+		{name: "streamGenerateContent", target: "/v1beta/models/" + routeTestModel + ":streamGenerateContent?alt=sse", body: sprintf(nativeBody, "native stream"), native: true},
+		{name: "ollama chat", target: "/api/chat", body: `{"model":"` + routeTestModel + `","messages":[{"role":"user","content":"hello ollama"}],` + ollamaOptions + `}`},
+		{name: "ollama generate", target: "/api/generate", body: `{"model":"` + routeTestModel + `","prompt":"hello generate",` + ollamaOptions + `}`},
+	}
+	for _, route := range routes {
+		t.Run(route.name, func(t *testing.T) {
+			before := len(requests())
+			if code, resp := doJSON(t, router, http.MethodPost, route.target, route.body); code != http.StatusOK {
+				t.Fatalf("status = %d: %s", code, resp)
+			}
+			got := requests()[before:]
+			if len(got) != 1 {
+				t.Fatalf("upstream received %d requests, want 1", len(got))
+			}
+			if route.native {
+				checkNativePolicy(t, got[0].body)
+			} else {
+				checkChatPolicy(t, got[0].body)
+			}
+		})
+	}
+
+	t.Run("thread messages", func(t *testing.T) {
+		code, resp := doJSON(t, router, http.MethodPost, "/v1/threads", `{"model":"`+routeTestModel+`","instructions":"Thread instructions."}`)
+		if code != http.StatusOK {
+			t.Fatalf("create thread: %d %s", code, resp)
+		}
+		var thread struct{ ID string }
+		json.Unmarshal(resp, &thread)
+
+		before := len(requests())
+		code, resp = doJSON(t, router, http.MethodPost, "/v1/threads/"+thread.ID+"/messages", `{"messages":[{"role":"user","content":"hello thread"}],"max_tokens":4096,"temperature":1.5}`)
+		if code != http.StatusOK {
+			t.Fatalf("append message: %d %s", code, resp)
+		}
+		got := requests()[before:]
+		if len(got) != 1 {
+			t.Fatalf("upstream received %d requests, want 1", len(got))
+		}
+		checkChatPolicy(t, got[0].body)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		writer.WriteField("purpose", "batch")
+		part, _ := writer.CreateFormFile("file", "input.jsonl")
+		line, _ := json.Marshal(map[string]interface{}{
+			"custom_id": "req-1",
+			"method":    "POST",
+			"url":       "/v1/chat/completions",
+			"body":      json.RawMessage(sprintf(chatBody, "batch", "")),
+		})
+		part.Write(append(line, '\n'))
+		writer.Close()
+		code, resp := do(t, router, http.MethodPost, "/v1/files", writer.FormDataContentType(), &form)
+		if code != http.StatusOK {
+			t.Fatalf("upload: %d %s", code, resp)
+		}
+		var file struct{ ID string }
+		json.Unmarshal(resp, &file)
+
+		before := len(requests())
+		code, resp = doJSON(t, router, http.MethodPost, "/v1/batches", `{"input_file_id":"`+file.ID+`","endpoint":"/v1/chat/completions","completion_window":"24h"}`)
+		if code != http.StatusOK {
+			t.Fatalf("create batch: %d %s", code, resp)
+		}
+		var batch struct{ ID, Status string }
+		json.Unmarshal(resp, &batch)
+		for deadline := time.Now().Add(10 * time.Second); batch.Status != string(model.BatchStatusCompleted); time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("batch status = %s, want completed", batch.Status)
+			}
+			_, resp = doJSON(t, router, http.MethodGet, "/v1/batches/"+batch.ID, "")
+			json.Unmarshal(resp, &batch)
+		}
+		got := requests()[before:]
+		if len(got) != 1 {
+			t.Fatalf("upstream received %d requests, want 1", len(got))
+		}
+		checkChatPolicy(t, got[0].body)
+	})
+}
+
+// sprintf 替换模板中的 %s，避免模板中 JSON 的其他字符被当作格式化动词
+func sprintf(format string, args ...string) string {
+	for _, arg := range args {
+		format = strings.Replace(format, "%s", arg, 1)
+	}
+	return format
+}
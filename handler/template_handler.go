@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"errors"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// TemplateHandler 提供提示词模板的管理接口
+type TemplateHandler struct {
+	templates *service.PromptTemplates
+}
+
+func NewTemplateHandler(templates *service.PromptTemplates) *TemplateHandler {
+	return &TemplateHandler{templates: templates}
+}
+
+// ListTemplates 返回每个模板的最新版本
+func (h *TemplateHandler) ListTemplates(c *gin.Context) {
+	templates, err := h.templates.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list prompt templates: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+// ListVersions 返回一个模板的所有版本
+func (h *TemplateHandler) ListVersions(c *gin.Context) {
+	versions, err := h.templates.Versions(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list template versions: " + err.Error()})
+		return
+	}
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The prompt template was not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
+}
+
+// SaveTemplate 把请求中的模板保存为新版本
+func (h *TemplateHandler) SaveTemplate(c *gin.Context) {
+	var template model.PromptTemplate
+	if err := c.ShouldBindJSON(&template); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := h.templates.Save(&template); err != nil {
+		var validationErr *service.TemplateValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save prompt template: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, template)
+}
+
+// DeleteTemplate 删除一个模板的所有版本
+func (h *TemplateHandler) DeleteTemplate(c *gin.Context) {
+	if err := h.templates.Delete(c.Param("name")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "The prompt template was not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete prompt template: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Prompt template deleted successfully"})
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/middleware"
+	"gemini_polling/model"
+	"gemini_polling/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ThreadHandler 处理 /v1/threads 会话线程接口
+type ThreadHandler struct {
+	threads  *service.ThreadService
+	registry *service.ModelRegistry
+}
+
+func NewThreadHandler(threads *service.ThreadService, registry *service.ModelRegistry) *ThreadHandler {
+	return &ThreadHandler{threads: threads, registry: registry}
+}
+
+// CreateThread 创建线程，可以指定默认模型、系统提示词和初始消息
+func (h *ThreadHandler) CreateThread(c *gin.Context) {
+	var req model.CreateThreadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	if req.Model != "" {
+		resolved, ok := resolveRequestModel(c, h.registry, req.Model, true)
+		if !ok {
+			return
+		}
+		req.Model = resolved
+	}
+	thread, err := h.threads.Create(currentClientID(c), &req)
+	if err != nil {
+		respondThreadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, threadObject(thread))
+}
+
+func (h *ThreadHandler) GetThread(c *gin.Context) {
+	thread, err := h.threads.Get(currentClientID(c), c.Param("id"))
+	if err != nil {
+		respondThreadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, threadObject(thread))
+}
+
+func (h *ThreadHandler) DeleteThread(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.threads.Delete(currentClientID(c), id); err != nil {
+		respondThreadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "thread.deleted", "deleted": true})
+}
+
+// ListMessages 按顺序返回线程的完整历史，已归档的消息带有 archived 标记
+func (h *ThreadHandler) ListMessages(c *gin.Context) {
+	messages, err := h.threads.Messages(currentClientID(c), c.Param("id"))
+	if err != nil {
+		respondThreadError(c, err)
+		return
+	}
+	data := make([]gin.H, 0, len(messages))
+	for i := range messages {
+		data = append(data, threadMessageObject(&messages[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
+
+// AppendMessage 追加新消息并返回 chat completion，请求体与 /v1/chat/completions 相同，
+// messages 只包含本轮的新消息，model 为空时使用线程的模型
+func (h *ThreadHandler) AppendMessage(c *gin.Context) {
+	thread, err := h.threads.Get(currentClientID(c), c.Param("id"))
+	if err != nil {
+		respondThreadError(c, err)
+		return
+	}
+	var req model.ChatCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", nil, err.Error())
+		return
+	}
+	if req.TemplateID != "" {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "template_id", "线程中的请求不支持 template_id")
+		return
+	}
+	if req.Model == "" {
+		req.Model = thread.Model
+	}
+	resolved, ok := resolveRequestModel(c, h.registry, req.Model, true)
+	if !ok {
+		return
+	}
+	req.Model = resolved
+	client := middleware.CurrentClient(c)
+
+	if req.Stream {
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+		err := h.threads.Stream(c.Request.Context(), c.Writer, client, thread, &req)
+		if err == nil {
+			return
+		}
+		logger.Error("线程 %s 流式请求失败: %v", thread.ID, err)
+		if !c.Writer.Written() && (respondCircuitOpen(c, err, true) || respondTokenLimitError(c, err, true) || respondMediaFetchError(c, err) || respondChatRequestError(c, err)) {
+			return
+		}
+		errorMsg, _ := json.Marshal(model.OpenAIErrorResponse{Error: model.ErrorDetail{Message: err.Error(), Type: "api_error"}})
+		c.SSEvent("error", string(errorMsg))
+		return
+	}
+
+	ctx, meta := service.WithResponseMeta(c.Request.Context())
+	resp, err := h.threads.Complete(ctx, client, thread, &req)
+	meta.ApplyHeaders(c.Writer.Header())
+	if err != nil {
+		logger.Error("线程 %s 请求失败: %v", thread.ID, err)
+		if respondCircuitOpen(c, err, true) || respondTokenLimitError(c, err, true) || respondMediaFetchError(c, err) || respondChatRequestError(c, err) {
+			return
+		}
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", nil, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// respondThreadError 把线程接口的错误转换为 OpenAI 格式的响应
+func respondThreadError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrThreadNotFound) {
+		respondOpenAIError(c, http.StatusNotFound, "invalid_request_error", nil, err.Error())
+		return
+	}
+	if respondChatRequestError(c, err) {
+		return
+	}
+	logger.Error("线程请求失败: %v", err)
+	respondOpenAIError(c, http.StatusInternalServerError, "api_error", nil, err.Error())
+}
+
+// threadObject 将线程转换为响应对象
+func threadObject(t *model.Thread) gin.H {
+	metadata := map[string]string{}
+	if t.Metadata != "" {
+		json.Unmarshal([]byte(t.Metadata), &metadata)
+	}
+	return gin.H{
+		"id":           t.ID,
+		"object":       "thread",
+		"created_at":   t.CreatedAt.Unix(),
+		"updated_at":   t.UpdatedAt.Unix(),
+		"model":        t.Model,
+		"instructions": t.Instructions,
+		"summary":      t.Summary,
+		"metadata":     metadata,
+	}
+}
+
+// threadMessageObject 将线程消息转换为响应对象，content 和 tool_calls 还原为 JSON
+func threadMessageObject(m *model.ThreadMessage) gin.H {
+	obj := gin.H{
+		"id":         fmt.Sprintf("msg_%d", m.ID),
+		"object":     "thread.message",
+		"thread_id":  m.ThreadID,
+		"created_at": m.CreatedAt.Unix(),
+		"role":       m.Role,
+		"content":    json.RawMessage(m.Content),
+		"archived":   m.Archived,
+	}
+	if m.ToolCalls != "" {
+		obj["tool_calls"] = json.RawMessage(m.ToolCalls)
+	}
+	if m.ToolCallID != "" {
+		obj["tool_call_id"] = m.ToolCallID
+	}
+	return obj
+}
@@ -1,10 +1,12 @@
 package logger
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -30,8 +32,45 @@ type Logger struct {
 
 var (
 	defaultLogger *Logger
+	// scrubber 在日志写出前替换其中的敏感内容，由内容脱敏功能通过 SetScrubber 设置。
+	// 它不能再调用 logger 或获取配置管理器的锁 (配置热重载时会在持有锁的情况下写日志)。
+	scrubber atomic.Pointer[func(string) string]
 )
 
+// SetScrubber 设置日志内容的脱敏函数，传入 nil 表示不处理
+func SetScrubber(fn func(string) string) {
+	if fn == nil {
+		scrubber.Store(nil)
+		return
+	}
+	scrubber.Store(&fn)
+}
+
+// scrub 对一条日志应用脱敏函数
+func scrub(msg string) string {
+	if fn := scrubber.Load(); fn != nil {
+		return (*fn)(msg)
+	}
+	return msg
+}
+
+// scrubWriter 对写入的内容应用脱敏函数，用于 gin 的请求日志等不经过 Logger 的输出
+type scrubWriter struct {
+	w io.Writer
+}
+
+func (s scrubWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, scrub(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewScrubWriter 返回一个在写入 w 之前应用脱敏函数的 io.Writer
+func NewScrubWriter(w io.Writer) io.Writer {
+	return scrubWriter{w: w}
+}
+
 // InitLogger 初始化日志系统
 func InitLogger(level LogLevel, enableFileLogging bool, logFilePath string, maxLogSizeMB int, maxBackups int, maxAgeDays int) {
 	defaultLogger = &Logger{
@@ -80,67 +119,67 @@ func GetLogger() *Logger {
 // Debug 输出调试日志
 func (l *Logger) Debug(format string, v ...interface{}) {
 	if l.level <= DEBUG {
-		l.debugLogger.Printf(format, v...)
+		l.debugLogger.Print(scrub(fmt.Sprintf(format, v...)))
 	}
 }
 
 // Debugln 输出调试日志（换行）
 func (l *Logger) Debugln(v ...interface{}) {
 	if l.level <= DEBUG {
-		l.debugLogger.Println(v...)
+		l.debugLogger.Print(scrub(fmt.Sprintln(v...)))
 	}
 }
 
 // Info 输出信息日志
 func (l *Logger) Info(format string, v ...interface{}) {
 	if l.level <= INFO {
-		l.infoLogger.Printf(format, v...)
+		l.infoLogger.Print(scrub(fmt.Sprintf(format, v...)))
 	}
 }
 
 // Infoln 输出信息日志（换行）
 func (l *Logger) Infoln(v ...interface{}) {
 	if l.level <= INFO {
-		l.infoLogger.Println(v...)
+		l.infoLogger.Print(scrub(fmt.Sprintln(v...)))
 	}
 }
 
 // Warn 输出警告日志
 func (l *Logger) Warn(format string, v ...interface{}) {
 	if l.level <= WARN {
-		l.warnLogger.Printf(format, v...)
+		l.warnLogger.Print(scrub(fmt.Sprintf(format, v...)))
 	}
 }
 
 // Warnln 输出警告日志（换行）
 func (l *Logger) Warnln(v ...interface{}) {
 	if l.level <= WARN {
-		l.warnLogger.Println(v...)
+		l.warnLogger.Print(scrub(fmt.Sprintln(v...)))
 	}
 }
 
 // Error 输出错误日志
 func (l *Logger) Error(format string, v ...interface{}) {
 	if l.level <= ERROR {
-		l.errorLogger.Printf(format, v...)
+		l.errorLogger.Print(scrub(fmt.Sprintf(format, v...)))
 	}
 }
 
 // Errorln 输出错误日志（换行）
 func (l *Logger) Errorln(v ...interface{}) {
 	if l.level <= ERROR {
-		l.errorLogger.Println(v...)
+		l.errorLogger.Print(scrub(fmt.Sprintln(v...)))
 	}
 }
 
 // Fatal 输出致命错误日志并退出程序
 func (l *Logger) Fatal(format string, v ...interface{}) {
-	l.errorLogger.Fatalf(format, v...)
+	l.errorLogger.Fatal(scrub(fmt.Sprintf(format, v...)))
 }
 
 // Fatalln 输出致命错误日志并退出程序
 func (l *Logger) Fatalln(v ...interface{}) {
-	l.errorLogger.Fatalln(v...)
+	l.errorLogger.Fatal(scrub(fmt.Sprintln(v...)))
 }
 
 // SetLevel 动态设置日志级别
@@ -58,7 +58,58 @@ func main() {
 	keyPool.Start(5 * time.Minute) // 每5分钟与数据库同步一次
 
 	// GenAIService 现在也需要接收 ConfigManager 以便动态获取最新配置
-	genaiService := service.NewGenAIService(configManager, keyStore, keyPool)
+	responseCache, err := service.NewResponseCache(configManager)
+	if err != nil {
+		logger.Fatal("无法初始化响应缓存: %v", err)
+	}
+	genaiService := service.NewGenAIService(configManager, keyStore, keyPool, responseCache)
+
+	// 模型目录: 别名、隐藏模型、客户端白名单以及上游模型列表缓存
+	modelRegistry := service.NewModelRegistry(configManager, storage.NewRegistryStore(db), genaiService)
+	if err := modelRegistry.Start(); err != nil {
+		logger.Fatal("无法加载模型目录: %v", err)
+	}
+	// 请求上游之前按模型目录中的 token 上限拒绝明显超出上下文窗口的请求
+	genaiService.SetTokenLimitSource(modelRegistry)
+
+	// 提示词模板: 聊天请求可以通过 template_id 使用管理员保存的带版本的模板
+	promptTemplates := service.NewPromptTemplates(storage.NewTemplateStore(db))
+
+	// 内容脱敏: 检查转发前的消息文本 (包括批处理输入文件和 Live 会话的消息)，日志 (包括 gin 的请求日志) 使用同样的规则替换敏感内容
+	redactor := service.NewRedactor(configManager)
+	logger.SetScrubber(redactor.ScrubLog)
+	gin.DefaultWriter = logger.NewScrubWriter(gin.DefaultWriter)
+
+	// 请求策略: 所有入口 (包括批处理和 Ollama 兼容接口) 在转发前都经过同一个 PolicyEngine
+	policyEngine := service.NewPolicyEngine(configManager)
+
+	// Batch API: 后台执行器会继续执行上次未完成的批处理，每个请求以创建批处理的客户端的身份执行
+	batchRunner := service.NewBatchRunner(configManager, storage.NewBatchStore(db), genaiService, modelRegistry, promptTemplates, keyPool, policyEngine, redactor)
+	if err := batchRunner.Start(); err != nil {
+		logger.Fatal("无法启动批处理执行器: %v", err)
+	}
+
+	// Gemini 原生批处理代理: 记录创建批处理的 Key，之后固定使用该 Key 访问
+	geminiBatchProxy := service.NewGeminiBatchProxy(genaiService, keyStore, storage.NewBatchStore(db))
+
+	// 图片生成: Imagen / Gemini 图片模型，response_format=url 的图片保存在本地并定期清理
+	imageService := service.NewImageService(configManager, genaiService)
+	if err := imageService.Start(); err != nil {
+		logger.Fatal("无法启动图片服务: %v", err)
+	}
+
+	// 语音: Gemini TTS 和多模态模型转写
+	audioService := service.NewAudioService(configManager, genaiService)
+
+	// Ollama 兼容接口: 转换为 OpenAI 兼容的聊天请求和 Gemini 原生的向量请求
+	ollamaService := service.NewOllamaService(genaiService, policyEngine)
+	completionService := service.NewCompletionService(genaiService)
+
+	// 会话线程: 服务端保存对话历史，超过上下文窗口时归档早期消息
+	threadService := service.NewThreadService(configManager, storage.NewThreadStore(db), genaiService, modelRegistry, policyEngine)
+
+	// Live API: 转发 BidiGenerateContent WebSocket 会话，每个会话固定使用一个 Key
+	liveProxy := service.NewLiveProxy(configManager, genaiService, policyEngine, redactor)
 
 	// 设置为每小时扫描一次
 	healthChecker := service.NewKeyHealthChecker(keyStore, genaiService, keyPool, configManager)
@@ -66,8 +117,20 @@ func main() {
 
 	// 各个 Handler 现在接收 ConfigManager
 	keyHandler := handler.NewKeyHandler(keyStore, genaiService, configManager, healthChecker, keyPool)
-	chatHandler := handler.NewChatHandler(genaiService)
+	chatHandler := handler.NewChatHandler(genaiService, modelRegistry, geminiBatchProxy, policyEngine, promptTemplates)
 	configHandler := handler.NewConfigHandler(configManager)
+	circuitHandler := handler.NewCircuitHandler(genaiService)
+	metricsHandler := handler.NewMetricsHandler(genaiService)
+	registryHandler := handler.NewModelRegistryHandler(modelRegistry)
+	templateHandler := handler.NewTemplateHandler(promptTemplates)
+	batchHandler := handler.NewBatchHandler(batchRunner)
+	geminiBatchHandler := handler.NewGeminiBatchHandler(geminiBatchProxy)
+	imageHandler := handler.NewImageHandler(imageService, modelRegistry)
+	audioHandler := handler.NewAudioHandler(audioService, modelRegistry)
+	liveHandler := handler.NewLiveHandler(liveProxy, modelRegistry)
+	ollamaHandler := handler.NewOllamaHandler(ollamaService, modelRegistry)
+	completionHandler := handler.NewCompletionHandler(completionService, modelRegistry, policyEngine)
+	threadHandler := handler.NewThreadHandler(threadService, modelRegistry)
 
 	router := gin.Default()
 
@@ -83,19 +146,80 @@ func main() {
 	// 聊天API
 	v1 := router.Group("/v1")
 	// 中间件现在需要动态获取配置
-	v1.Use(middleware.PollingAuthMiddleware(configManager))
+	v1.Use(middleware.PollingAuthMiddleware(configManager, modelRegistry), middleware.BodyLimitMiddleware(configManager), middleware.RedactionMiddleware(redactor), middleware.CachePolicyMiddleware())
 	{
 		v1.POST("/chat/completions", chatHandler.HandleChatCompletions)
+		v1.POST("/completions", completionHandler.Complete)
 		v1.GET("/models", chatHandler.ListModels)
+
+		// Batch API
+		v1.POST("/files", batchHandler.UploadFile)
+		v1.GET("/files", batchHandler.ListFiles)
+		v1.GET("/files/:id", batchHandler.GetFile)
+		v1.GET("/files/:id/content", batchHandler.GetFileContent)
+		v1.DELETE("/files/:id", batchHandler.DeleteFile)
+		v1.POST("/batches", batchHandler.CreateBatch)
+		v1.GET("/batches", batchHandler.ListBatches)
+		v1.GET("/batches/:id", batchHandler.GetBatch)
+		v1.POST("/batches/:id/cancel", batchHandler.CancelBatch)
+
+		// 图片生成
+		v1.POST("/images/generations", imageHandler.Generate)
+		v1.POST("/images/edits", imageHandler.Edit)
+
+		// 语音
+		v1.POST("/audio/speech", audioHandler.Speech)
+		v1.POST("/audio/transcriptions", audioHandler.Transcribe)
+
+		// 会话线程
+		v1.POST("/threads", threadHandler.CreateThread)
+		v1.GET("/threads/:id", threadHandler.GetThread)
+		v1.DELETE("/threads/:id", threadHandler.DeleteThread)
+		v1.GET("/threads/:id/messages", threadHandler.ListMessages)
+		v1.POST("/threads/:id/messages", threadHandler.AppendMessage)
 	}
 
+	// 生成图片的下载链接不需要认证，文件名随机且会过期
+	router.GET("/images/:name", imageHandler.ServeImage)
+
 	// gemini 格式api
 	v1beta := router.Group("/v1beta")
-	v1beta.Use(middleware.PollingAuthMiddleware(configManager))
+	v1beta.Use(middleware.PollingAuthMiddleware(configManager, modelRegistry), middleware.BodyLimitMiddleware(configManager), middleware.RedactionMiddleware(redactor), middleware.CachePolicyMiddleware())
 	{
 		v1beta.GET("/models", chatHandler.ListModels2)
 		// +++ 新增的 Gemini 原生文本生成路由 +++
 		v1beta.POST("/models/*model_and_action", chatHandler.HandleGeminiAction)
+		// Gemini 原生批处理: 查询/取消/删除固定使用创建批处理的 Key
+		v1beta.GET("/batches", geminiBatchHandler.ListBatches)
+		v1beta.GET("/batches/*name_and_action", geminiBatchHandler.HandleBatchAction)
+		v1beta.POST("/batches/*name_and_action", geminiBatchHandler.HandleBatchAction)
+		v1beta.DELETE("/batches/*name_and_action", geminiBatchHandler.HandleBatchAction)
+	}
+
+	// Gemini Live API (WebSocket)，路径与 Google 一致: /ws/google.ai.generativelanguage.v1beta.GenerativeService.BidiGenerateContent
+	liveGroup := router.Group("/ws")
+	liveGroup.Use(middleware.LiveAuthMiddleware(configManager, modelRegistry))
+	{
+		liveGroup.GET("/:method", liveHandler.Handle)
+	}
+
+	// Ollama 兼容接口，供只支持 Ollama 协议的工具使用
+	ollamaGroup := router.Group("/api")
+	ollamaGroup.Use(middleware.PollingAuthMiddleware(configManager, modelRegistry), middleware.BodyLimitMiddleware(configManager), middleware.RedactionMiddleware(redactor), middleware.CachePolicyMiddleware())
+	{
+		ollamaGroup.POST("/chat", ollamaHandler.Chat)
+		ollamaGroup.POST("/generate", ollamaHandler.Generate)
+		ollamaGroup.POST("/embed", ollamaHandler.Embed)
+		ollamaGroup.GET("/tags", ollamaHandler.Tags)
+		ollamaGroup.POST("/show", ollamaHandler.Show)
+		ollamaGroup.GET("/version", ollamaHandler.Version)
+	}
+
+	// Gemini 批处理结果文件下载
+	downloadGroup := router.Group("/download/v1beta")
+	downloadGroup.Use(middleware.PollingAuthMiddleware(configManager, modelRegistry))
+	{
+		downloadGroup.GET("/files/*name", geminiBatchHandler.DownloadFile)
 	}
 
 	// 管理API
@@ -119,6 +243,7 @@ func main() {
 			keysGroup.POST("/batch-delete", keyHandler.BatchDeleteKeys)
 			keysGroup.DELETE("/disabled", keyHandler.DeleteAllDisabledKeys) // 一键删除所有已禁用的key
 			keysGroup.POST("/:id/check", keyHandler.CheckSingleKey)
+			keysGroup.PUT("/:id/models", keyHandler.UpdateKeyModels)
 			keysGroup.GET("/stats", keyHandler.GetKeyStats)
 		}
 
@@ -128,6 +253,61 @@ func main() {
 			settingsGroup.GET("", configHandler.GetSettings)
 			settingsGroup.POST("", configHandler.UpdateSettings)
 		}
+
+		circuitsGroup := adminApiGroup.Group("/circuits")
+		circuitsGroup.Use(middleware.AdminAuthMiddleware(configManager))
+		{
+			circuitsGroup.GET("", circuitHandler.ListCircuits)
+			circuitsGroup.POST("/:model/reset", circuitHandler.ResetCircuit)
+		}
+
+		adminApiGroup.GET("/metrics", middleware.AdminAuthMiddleware(configManager), metricsHandler.GetMetrics)
+		adminApiGroup.DELETE("/cache", middleware.AdminAuthMiddleware(configManager), metricsHandler.PurgeCache)
+
+		modelsGroup := adminApiGroup.Group("/models")
+		modelsGroup.Use(middleware.AdminAuthMiddleware(configManager))
+		{
+			modelsGroup.GET("", registryHandler.ListEntries)
+			modelsGroup.GET("/catalogue", registryHandler.ListCatalogue)
+			modelsGroup.POST("/refresh", registryHandler.RefreshCatalogue)
+			modelsGroup.POST("", registryHandler.SaveEntry)
+			modelsGroup.PUT("/:id", registryHandler.SaveEntry)
+			modelsGroup.DELETE("/:id", registryHandler.DeleteEntry)
+		}
+
+		clientsGroup := adminApiGroup.Group("/clients")
+		clientsGroup.Use(middleware.AdminAuthMiddleware(configManager))
+		{
+			clientsGroup.GET("", registryHandler.ListClients)
+			clientsGroup.POST("", registryHandler.SaveClient)
+			clientsGroup.PUT("/:id", registryHandler.SaveClient)
+			clientsGroup.DELETE("/:id", registryHandler.DeleteClient)
+		}
+
+		templatesGroup := adminApiGroup.Group("/templates")
+		templatesGroup.Use(middleware.AdminAuthMiddleware(configManager))
+		{
+			templatesGroup.GET("", templateHandler.ListTemplates)
+			templatesGroup.GET("/:name/versions", templateHandler.ListVersions)
+			templatesGroup.POST("", templateHandler.SaveTemplate)
+			templatesGroup.DELETE("/:name", templateHandler.DeleteTemplate)
+		}
+
+		batchesGroup := adminApiGroup.Group("/batches")
+		batchesGroup.Use(middleware.AdminAuthMiddleware(configManager))
+		{
+			batchesGroup.GET("", batchHandler.AdminListBatches)
+			batchesGroup.GET("/progress", batchHandler.GetProgress)
+			batchesGroup.POST("/:id/cancel", batchHandler.AdminCancelBatch)
+		}
+
+		geminiBatchesGroup := adminApiGroup.Group("/gemini-batches")
+		geminiBatchesGroup.Use(middleware.AdminAuthMiddleware(configManager))
+		{
+			geminiBatchesGroup.GET("", geminiBatchHandler.AdminListBatches)
+			geminiBatchesGroup.POST("/refresh", geminiBatchHandler.AdminRefreshBatches)
+			geminiBatchesGroup.POST("/:name/cancel", geminiBatchHandler.AdminCancelBatch)
+		}
 	}
 
 	// ... (服务器启动日志不变)
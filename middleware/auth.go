@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"gemini_polling/config"
+	"gemini_polling/model"
 	"net/http"
 	"strings"
 
@@ -43,14 +44,46 @@ func AdminAuthMiddleware(manager *config.Manager) gin.HandlerFunc {
 	}
 }
 
+// ClientContextKey 是认证通过的客户端 (*model.Client) 在 gin.Context 中的键
+const ClientContextKey = "polling_client"
+
+// ClientLookup 根据密钥查找管理员创建的客户端凭据
+type ClientLookup interface {
+	FindClient(key string) (*model.Client, bool)
+	HasClients() bool
+}
+
+// CurrentClient 返回本次请求认证的客户端。
+// 使用全局 POLLING_API_KEY 或未开启认证时返回 nil，表示不受模型白名单限制。
+func CurrentClient(c *gin.Context) *model.Client {
+	if v, ok := c.Get(ClientContextKey); ok {
+		if client, ok := v.(*model.Client); ok {
+			return client
+		}
+	}
+	return nil
+}
+
 // +++ 修改后的 PollingAuthMiddleware +++
 // PollingAuthMiddleware 验证公共API的密钥
 // 现在它同时支持 "Authorization: Bearer <key>" 和 "x-goog-api-key: <key>"
-func PollingAuthMiddleware(manager *config.Manager) gin.HandlerFunc {
+// 除全局公共密钥外，也接受管理员在模型目录中创建的客户端密钥。
+func PollingAuthMiddleware(manager *config.Manager, clients ClientLookup) gin.HandlerFunc {
+	return pollingAuth(manager, clients, false)
+}
+
+// LiveAuthMiddleware 与 PollingAuthMiddleware 相同，但额外接受查询参数 "?key=<key>"。
+// 浏览器中的 WebSocket 无法设置请求头，因此只用于 Live API 的 /ws 路由；
+// 其他路由不接受查询参数中的密钥，避免密钥出现在访问日志和浏览器历史中。
+func LiveAuthMiddleware(manager *config.Manager, clients ClientLookup) gin.HandlerFunc {
+	return pollingAuth(manager, clients, true)
+}
+
+func pollingAuth(manager *config.Manager, clients ClientLookup, allowQueryKey bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		requiredKey := manager.Get().PollingAPIKey
-		// 如果服务器没有配置公共密钥，则直接放行所有请求
-		if requiredKey == "" {
+		// 如果服务器没有配置公共密钥也没有客户端，则直接放行所有请求
+		if requiredKey == "" && !clients.HasClients() {
 			c.Next()
 			return
 		}
@@ -74,21 +107,34 @@ func PollingAuthMiddleware(manager *config.Manager) gin.HandlerFunc {
 			}
 		}
 
-		// 3. 检查是否获取到了任何密钥
+		// 3. Live API 路由最后尝试查询参数 "key" (Gemini 格式，浏览器中的 WebSocket 无法设置请求头)
+		if providedKey == "" && allowQueryKey {
+			providedKey = c.Query("key")
+		}
+
+		// 4. 检查是否获取到了任何密钥
 		if providedKey == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "API key is required. Provide it in 'Authorization: Bearer <key>' or 'x-goog-api-key: <key>' header."})
+			message := "API key is required. Provide it in 'Authorization: Bearer <key>' or 'x-goog-api-key: <key>' header."
+			if allowQueryKey {
+				message = "API key is required. Provide it in 'Authorization: Bearer <key>' or 'x-goog-api-key: <key>' header, or the 'key' query parameter."
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": message})
 			c.Abort()
 			return
 		}
 
-		// 4. 比较密钥是否正确
-		if providedKey != requiredKey {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API Key"})
-			c.Abort()
-			return
+		// 5. 比较密钥是否正确: 先匹配全局公共密钥，再匹配客户端密钥
+		if requiredKey == "" || providedKey != requiredKey {
+			client, ok := clients.FindClient(providedKey)
+			if !ok {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API Key"})
+				c.Abort()
+				return
+			}
+			c.Set(ClientContextKey, client)
 		}
 
-		// 5. 认证成功
+		// 6. 认证成功
 		c.Next()
 	}
 }
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"gemini_polling/config"
+	"gemini_polling/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fixedClients 是只包含固定客户端的 ClientLookup
+type fixedClients map[string]*model.Client
+
+func (f fixedClients) FindClient(key string) (*model.Client, bool) {
+	client, ok := f[key]
+	return client, ok
+}
+
+func (f fixedClients) HasClients() bool { return len(f) > 0 }
+
+func TestPollingAuthQueryKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("POLLING_API_KEY", "sk-proxy")
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := fixedClients{"sk-team": {Name: "team"}}
+
+	router := gin.New()
+	ok := func(c *gin.Context) {
+		if client := CurrentClient(c); client != nil {
+			c.String(http.StatusOK, client.Name)
+			return
+		}
+		c.String(http.StatusOK, "global")
+	}
+	router.GET("/v1/models", PollingAuthMiddleware(manager, clients), ok)
+	router.GET("/ws/live", LiveAuthMiddleware(manager, clients), ok)
+
+	tests := []struct {
+		name       string
+		path       string
+		header     [2]string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "bearer token", path: "/v1/models", header: [2]string{"Authorization", "Bearer sk-proxy"}, wantStatus: http.StatusOK, wantBody: "global"},
+		{name: "Gemini header with a client key", path: "/v1/models", header: [2]string{"x-goog-api-key", "sk-team"}, wantStatus: http.StatusOK, wantBody: "team"},
+		{name: "query key is ignored outside the Live route", path: "/v1/models?key=sk-proxy", wantStatus: http.StatusUnauthorized},
+		{name: "query key on the Live route", path: "/ws/live?key=sk-proxy", wantStatus: http.StatusOK, wantBody: "global"},
+		{name: "client query key on the Live route", path: "/ws/live?key=sk-team", wantStatus: http.StatusOK, wantBody: "team"},
+		{name: "wrong query key on the Live route", path: "/ws/live?key=sk-wrong", wantStatus: http.StatusUnauthorized},
+		{name: "header wins over the query key", path: "/ws/live?key=sk-team", header: [2]string{"Authorization", "Bearer sk-proxy"}, wantStatus: http.StatusOK, wantBody: "global"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header[0] != "" {
+				req.Header.Set(tt.header[0], tt.header[1])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus || (tt.wantBody != "" && w.Body.String() != tt.wantBody) {
+				t.Errorf("GET %s = %d %s, want %d %s", tt.path, w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
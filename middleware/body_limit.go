@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"gemini_polling/config"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimitMiddleware 拒绝超过 POLICY_MAX_BODY_KB 的请求体 (返回 413)。
+// multipart 上传 (文件、图片编辑、语音转写) 不受此限制，由各接口自己检查文件大小。
+func BodyLimitMiddleware(manager *config.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := manager.Get().PolicyMaxBodyBytes
+		if limit <= 0 || c.Request.Body == nil || strings.HasPrefix(c.ContentType(), "multipart/") {
+			c.Next()
+			return
+		}
+
+		// Content-Length 未知 (分块传输) 时读取到上限为止再判断
+		if c.Request.ContentLength <= limit {
+			body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "Failed to read request body: " + err.Error(), "type": "invalid_request_error"}})
+				return
+			}
+			if int64(len(body)) <= limit {
+				c.Request.Body = io.NopCloser(bytes.NewReader(body))
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": gin.H{
+				"message": fmt.Sprintf("Request body exceeds the limit of %d KB.", limit/1024),
+				"type":    "invalid_request_error",
+				"code":    "request_too_large",
+			},
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"gemini_polling/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CachePolicyMiddleware 读取客户端的 Cache-Control 请求头，
+// 将 no-cache / no-store 转换为响应缓存策略放入请求的 context 中
+func CachePolicyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cacheControl := c.GetHeader("Cache-Control"); cacheControl != "" {
+			ctx := service.WithCachePolicy(c.Request.Context(), service.ParseCachePolicy(cacheControl))
+			c.Request = c.Request.WithContext(ctx)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"bytes"
+	"gemini_polling/logger"
+	"gemini_polling/service"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RedactionMiddleware 在请求转发前按 REDACTION_MODE 检查 JSON 请求体中的消息文本:
+// log_only 只记录检测结果，redact 把敏感内容替换后继续处理，block 直接返回 400。
+// multipart 上传和没有请求体的请求不受影响。应放在 BodyLimitMiddleware 之后，避免读取超限的请求体。
+func RedactionMiddleware(redactor *service.Redactor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Method == http.MethodGet || strings.HasPrefix(c.ContentType(), "multipart/") || redactor.Mode() == service.RedactionOff {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "Failed to read request body: " + err.Error(), "type": "invalid_request_error"}})
+			return
+		}
+		result := redactor.Inspect(body)
+		if result == nil || len(result.Hits) == 0 {
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			c.Next()
+			return
+		}
+
+		switch result.Mode {
+		case service.RedactionBlock:
+			logger.Warn("[内容脱敏] 拒绝请求 %s: 检测到敏感信息 (%s)", c.Request.URL.Path, result.Summary())
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": gin.H{
+					"message": "Request blocked: the prompt contains sensitive information (" + result.Summary() + ").",
+					"type":    "invalid_request_error",
+					"code":    "sensitive_content",
+				},
+			})
+			return
+		case service.RedactionRedact:
+			logger.Info("[内容脱敏] 请求 %s 中的敏感信息已替换 (%s)", c.Request.URL.Path, result.Summary())
+		default:
+			logger.Warn("[内容脱敏] 请求 %s 中检测到敏感信息 (%s)，按原样转发", c.Request.URL.Path, result.Summary())
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(result.Body))
+		c.Request.ContentLength = int64(len(result.Body))
+		c.Next()
+	}
+}
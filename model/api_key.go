@@ -4,8 +4,24 @@ import (
 	"time"
 )
 
+// 上游凭据的提供方
+const (
+	ProviderAIStudio = "aistudio" // Gemini API (AI Studio) 的 API Key
+	ProviderVertex   = "vertex"   // Vertex AI 服务账号，请求时换取 OAuth access token
+	ProviderOpenAI   = "openai"   // 任意 OpenAI 兼容接口的 base URL + API Key
+)
+
 // APIKey 是数据库中 api_keys 表的 GORM 模型
 // model/api_key.go
+//
+// 每一行是一个上游凭据，Provider 决定其余字段的含义:
+//   - aistudio (或空): Key 是 Gemini API Key
+//   - vertex: Credential 是服务账号 JSON，Project/Region 是 Vertex AI 的项目和区域，
+//     Key 是 "vertex:<client_email>/<project>/<region>" 形式的唯一标识，BaseURL 可以覆盖默认的区域地址
+//   - openai: Key 是 API Key，BaseURL 是接口地址 (如 https://api.openai.com/v1)
+//
+// Models 是逗号分隔的模型名 (支持 '*' 通配符)，表示该凭据服务的模型；留空的 AI Studio / Vertex AI 凭据
+// 服务所有没有被其他凭据明确认领的模型。
 type APIKey struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	Key       string    `gorm:"type:varchar(255);uniqueIndex;not null" json:"key"`
@@ -21,4 +37,20 @@ type APIKey struct {
 	RateLimitCount   int       `gorm:"default:0" json:"rate_limit_count"`      // 429次数
 	NextAvailableAt  time.Time `json:"next_available_at"`                     // 下次可用时间
 	IsOnCooldown     bool      `gorm:"default:false" json:"is_on_cooldown"`    // 是否在冷却中
+
+	// 多提供方凭据
+	Provider   string `gorm:"type:varchar(32);not null;default:'aistudio'" json:"provider"`
+	BaseURL    string `gorm:"type:varchar(512)" json:"base_url"`
+	Project    string `gorm:"type:varchar(255)" json:"project"`
+	Region     string `gorm:"type:varchar(64)" json:"region"`
+	Credential string `gorm:"type:text" json:"-"` // Vertex AI 服务账号 JSON，不返回给前端
+	Models     string `gorm:"type:text" json:"models"`
+}
+
+// ProviderName 返回凭据的提供方，旧数据中为空的视为 AI Studio
+func (k *APIKey) ProviderName() string {
+	if k.Provider == "" {
+		return ProviderAIStudio
+	}
+	return k.Provider
 }
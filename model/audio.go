@@ -0,0 +1,37 @@
+package model
+
+// SpeechRequest 是 OpenAI 兼容的 /v1/audio/speech 请求体
+type SpeechRequest struct {
+	Model          string  `json:"model"`
+	Input          string  `json:"input"`
+	Voice          string  `json:"voice"`                     // OpenAI 音色名会映射为 Gemini 预置音色，也可以直接使用 Gemini 音色名
+	Instructions   string  `json:"instructions,omitempty"`    // 语气、风格等朗读要求
+	ResponseFormat string  `json:"response_format,omitempty"` // mp3 (默认)、opus、aac、flac、wav 或 pcm
+	Speed          float64 `json:"speed,omitempty"`           // Gemini 没有语速参数，非 1 时作为朗读要求传给模型
+}
+
+// TranscriptionRequest 是 OpenAI 兼容的 /v1/audio/transcriptions 请求的表单字段 (音频文件为 file 字段)
+type TranscriptionRequest struct {
+	Model          string  `form:"model"`
+	Language       string  `form:"language"`        // ISO-639-1 语言代码，作为提示传给模型
+	Prompt         string  `form:"prompt"`          // 专有名词、拼写等上下文提示
+	ResponseFormat string  `form:"response_format"` // json (默认)、text、srt、vtt 或 verbose_json
+	Temperature    float64 `form:"temperature"`
+}
+
+// TranscriptionSegment 是 verbose_json 响应中的一个分段，时间单位为秒
+type TranscriptionSegment struct {
+	ID    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// TranscriptionResponse 是 verbose_json 格式的转写结果，json 格式只返回 Text
+type TranscriptionResponse struct {
+	Task     string                 `json:"task"`
+	Language string                 `json:"language"`
+	Duration float64                `json:"duration"`
+	Text     string                 `json:"text"`
+	Segments []TranscriptionSegment `json:"segments"`
+}
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"time"
+)
+
+// 批处理状态，与 OpenAI Batch API 保持一致
+const (
+	BatchStatusValidating = "validating"
+	BatchStatusFailed     = "failed"
+	BatchStatusInProgress = "in_progress"
+	BatchStatusFinalizing = "finalizing"
+	BatchStatusCompleted  = "completed"
+	BatchStatusExpired    = "expired"
+	BatchStatusCancelling = "cancelling"
+	BatchStatusCancelled  = "cancelled"
+)
+
+// BatchFile 是通过 /v1/files 上传或由批处理生成的文件 (batch_files 表)。
+// 文件内容保存在本地磁盘的 Path 上，数据库只保存元信息。
+// ClientID 为创建者的客户端 ID，使用全局公共密钥 (或未开启认证) 时为 0。
+type BatchFile struct {
+	ID        string    `gorm:"type:varchar(64);primaryKey" json:"id"`
+	ClientID  uint      `gorm:"index;not null;default:0" json:"client_id"`
+	Filename  string    `gorm:"type:varchar(255)" json:"filename"`
+	Purpose   string    `gorm:"type:varchar(32);index" json:"purpose"`
+	Bytes     int64     `json:"bytes"`
+	Path      string    `gorm:"type:varchar(1024)" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Batch 是一个批处理任务 (batches 表)。
+// 已处理的请求结果逐行追加到本地的输出/错误文件中，服务重启后根据这些文件跳过已完成的请求继续执行。
+type Batch struct {
+	ID               string `gorm:"type:varchar(64);primaryKey" json:"id"`
+	ClientID         uint   `gorm:"index;not null;default:0" json:"client_id"`
+	Endpoint         string `gorm:"type:varchar(255)" json:"endpoint"`
+	InputFileID      string `gorm:"type:varchar(64);index" json:"input_file_id"`
+	CompletionWindow string `gorm:"type:varchar(16)" json:"completion_window"`
+	Status           string `gorm:"type:varchar(32);index" json:"status"`
+	OutputFileID     string `gorm:"type:varchar(64)" json:"output_file_id"`
+	ErrorFileID      string `gorm:"type:varchar(64)" json:"error_file_id"`
+	Errors           string `gorm:"type:text" json:"errors"`   // 校验错误，JSON 数组
+	Metadata         string `gorm:"type:text" json:"metadata"` // 客户端提供的元数据，JSON 对象
+
+	TotalCount     int `json:"total_count"`
+	CompletedCount int `json:"completed_count"`
+	FailedCount    int `json:"failed_count"`
+
+	CreatedAt    time.Time  `gorm:"index" json:"created_at"`
+	InProgressAt *time.Time `json:"in_progress_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	FinalizingAt *time.Time `json:"finalizing_at"`
+	CompletedAt  *time.Time `json:"completed_at"`
+	FailedAt     *time.Time `json:"failed_at"`
+	ExpiredAt    *time.Time `json:"expired_at"`
+	CancellingAt *time.Time `json:"cancelling_at"`
+	CancelledAt  *time.Time `json:"cancelled_at"`
+}
+
+// IsTerminal 判断批处理是否已经结束
+func (b *Batch) IsTerminal() bool {
+	switch b.Status {
+	case BatchStatusFailed, BatchStatusCompleted, BatchStatusExpired, BatchStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// GeminiBatch 记录通过 Gemini 原生 batchGenerateContent 创建的批处理 (gemini_batches 表)。
+// Google 的批处理属于创建它的 Key 所在的项目，之后的查询、取消和结果下载都必须使用同一个 Key。
+type GeminiBatch struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Name          string     `gorm:"type:varchar(255);uniqueIndex;not null" json:"name"` // 上游资源名，如 batches/abc123
+	KeyID         uint       `gorm:"index;not null" json:"key_id"`
+	ClientID      uint       `gorm:"index;not null;default:0" json:"client_id"`
+	Model         string     `gorm:"type:varchar(255)" json:"model"`
+	DisplayName   string     `gorm:"type:varchar(255)" json:"display_name"`
+	State         string     `gorm:"type:varchar(64);index" json:"state"`
+	ResponsesFile string     `gorm:"type:varchar(255);index" json:"responses_file"` // 结果文件名，如 files/xyz
+	Operation     string     `gorm:"type:text" json:"-"`                            // 最近一次从上游获取的 Operation JSON
+	LastPolledAt  *time.Time `json:"last_polled_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// IsTerminal 判断 Gemini 批处理是否已经结束
+func (b *GeminiBatch) IsTerminal() bool {
+	switch b.State {
+	case "BATCH_STATE_SUCCEEDED", "BATCH_STATE_FAILED", "BATCH_STATE_CANCELLED", "BATCH_STATE_EXPIRED":
+		return true
+	}
+	return false
+}
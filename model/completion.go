@@ -0,0 +1,56 @@
+package model
+
+import "encoding/json"
+
+// CompletionRequest 是旧版 OpenAI 文本补全接口 /v1/completions 的请求体
+type CompletionRequest struct {
+	Model            string          `json:"model"`
+	Prompt           json.RawMessage `json:"prompt"`           // 字符串或字符串数组，每个 prompt 是一次独立的单轮请求
+	Suffix           string          `json:"suffix,omitempty"` // 设置后按代码补全 (fill-in-the-middle) 处理
+	MaxTokens        int             `json:"max_tokens,omitempty"`
+	Temperature      *float64        `json:"temperature,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	N                int             `json:"n,omitempty"` // 每个 prompt 生成的候选数
+	Stream           bool            `json:"stream"`
+	StreamOptions    *StreamOptions  `json:"stream_options,omitempty"`
+	Logprobs         *int            `json:"logprobs,omitempty"` // 返回每个位置概率最高的 logprobs 个 token (0-5)
+	Echo             bool            `json:"echo,omitempty"`     // 在补全结果前附上 prompt
+	Stop             interface{}     `json:"stop,omitempty"`     // 字符串或字符串数组
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	Seed             *int            `json:"seed,omitempty"`
+	User             string          `json:"user,omitempty"`
+
+	SystemPrompt string `json:"-"` // 请求策略要求的系统提示词，由 PolicyEngine 设置
+}
+
+// StreamOptions 控制流式响应的附加内容
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // 在 [DONE] 之前额外发送一个只包含 usage 的 chunk
+}
+
+// CompletionLogprobs 是旧版补全接口的 logprobs 格式，各数组按 token 一一对应
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+// TextCompletionChoice 是 text_completion 响应中的一个候选
+type TextCompletionChoice struct {
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs"`
+	FinishReason interface{}         `json:"finish_reason"` // 流式响应未结束的 chunk 中为 null
+}
+
+// TextCompletionResponse 是 /v1/completions 的响应体，流式响应的每个 chunk 也使用这个结构
+type TextCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"` // 总是 "text_completion"
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []TextCompletionChoice `json:"choices"`
+	Usage   *Usage                 `json:"usage,omitempty"`
+}
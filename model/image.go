@@ -0,0 +1,26 @@
+package model
+
+// ImageGenerationRequest 是 OpenAI 兼容的 /v1/images/generations 请求体，
+// /v1/images/edits 的 multipart 表单字段也会被解析为该结构
+type ImageGenerationRequest struct {
+	Model          string `json:"model" form:"model"`
+	Prompt         string `json:"prompt" form:"prompt"`
+	N              int    `json:"n,omitempty" form:"n"`
+	Size           string `json:"size,omitempty" form:"size"`                       // 如 1024x1024，转换为最接近的宽高比
+	ResponseFormat string `json:"response_format,omitempty" form:"response_format"` // url (默认) 或 b64_json
+	Quality        string `json:"quality,omitempty" form:"quality"`                 // 仅为兼容而接收，不影响生成
+	Style          string `json:"style,omitempty" form:"style"`                     // 仅为兼容而接收，不影响生成
+	User           string `json:"user,omitempty" form:"user"`
+}
+
+// ImageData 是响应中的一张图片，URL 和 B64JSON 二选一
+type ImageData struct {
+	URL     string `json:"url,omitempty"`
+	B64JSON string `json:"b64_json,omitempty"`
+}
+
+// ImageResponse 是 OpenAI 兼容的图片生成/编辑响应体
+type ImageResponse struct {
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"time"
+)
+
+// ModelEntry 是管理员维护的模型目录条目 (model_entries 表)。
+// Target 非空时条目是一个别名，请求会被改写为 Target；
+// Hidden 为 true 时该模型不会出现在模型列表中，客户端也不能直接请求它；
+// 其余条目作为自定义模型补充到上游模型列表中。
+// InputTokenLimit/OutputTokenLimit 大于 0 时覆盖上游模型列表和内置表中该模型的 token 上限。
+type ModelEntry struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	Name             string    `gorm:"type:varchar(255);uniqueIndex;not null" json:"name"`
+	Target           string    `gorm:"type:varchar(255)" json:"target"`
+	Hidden           bool      `gorm:"not null;default:false" json:"hidden"`
+	Description      string    `gorm:"type:varchar(1024)" json:"description"`
+	InputTokenLimit  int       `gorm:"not null;default:0" json:"input_token_limit"`
+	OutputTokenLimit int       `gorm:"not null;default:0" json:"output_token_limit"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// IsAlias 判断条目是否为别名
+func (e *ModelEntry) IsAlias() bool {
+	return e.Target != ""
+}
+
+// Client 是可以访问公共 API 的客户端凭据 (clients 表)。
+// AllowedModels 为逗号分隔的模型名，支持 '*' 通配符，留空表示允许所有模型。
+// SystemPrompt 非空时代替全局的 POLICY_SYSTEM_PROMPT 加在该客户端请求的系统提示词前面。
+type Client struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	Name          string    `gorm:"type:varchar(255);not null" json:"name"`
+	Key           string    `gorm:"type:varchar(255);uniqueIndex;not null" json:"key"`
+	AllowedModels string    `gorm:"type:text" json:"allowed_models"`
+	SystemPrompt  string    `gorm:"type:text" json:"system_prompt"`
+	Enabled       bool      `gorm:"not null;default:true" json:"enabled"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
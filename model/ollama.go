@@ -0,0 +1,100 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OllamaOptions 是 Ollama 请求中的 options，只有 Gemini 支持的采样参数会生效
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"` // 最大生成 token 数，-1 表示不限制
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// OllamaFunctionCall 是 Ollama 格式的函数调用，arguments 是 JSON 对象而不是字符串
+type OllamaFunctionCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// OllamaToolCall 是 Ollama 消息中的一个工具调用
+type OllamaToolCall struct {
+	Function OllamaFunctionCall `json:"function"`
+}
+
+// OllamaMessage 是 /api/chat 中的一条消息
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"` // base64 编码的图片
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"` // role 为 tool 时对应的函数名
+}
+
+// OllamaChatRequest 是 /api/chat 的请求体
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []Tool          `json:"tools,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"` // "json" 或 JSON Schema
+	Options  OllamaOptions   `json:"options"`
+	Stream   *bool           `json:"stream,omitempty"` // 未指定时默认为流式
+}
+
+// OllamaGenerateRequest 是 /api/generate 的请求体
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	Suffix  string          `json:"suffix,omitempty"` // 设置后按代码补全 (FIM) 处理
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options OllamaOptions   `json:"options"`
+	Stream  *bool           `json:"stream,omitempty"`
+}
+
+// OllamaMetrics 是 Ollama 在最后一个响应中返回的统计信息，时长单位为纳秒
+type OllamaMetrics struct {
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalCount    int   `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int   `json:"eval_count,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
+}
+
+// OllamaChatResponse 是 /api/chat 的响应，流式时每一行是一个 OllamaChatResponse
+type OllamaChatResponse struct {
+	Model      string        `json:"model"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Message    OllamaMessage `json:"message"`
+	Done       bool          `json:"done"`
+	DoneReason string        `json:"done_reason,omitempty"`
+	OllamaMetrics
+}
+
+// OllamaGenerateResponse 是 /api/generate 的响应，流式时每一行是一个 OllamaGenerateResponse
+type OllamaGenerateResponse struct {
+	Model      string    `json:"model"`
+	CreatedAt  time.Time `json:"created_at"`
+	Response   string    `json:"response"`
+	Done       bool      `json:"done"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	OllamaMetrics
+}
+
+// OllamaEmbedRequest 是 /api/embed 的请求体，input 可以是字符串或字符串数组
+type OllamaEmbedRequest struct {
+	Model      string          `json:"model"`
+	Input      json.RawMessage `json:"input"`
+	Dimensions int             `json:"dimensions,omitempty"`
+}
+
+// OllamaEmbedResponse 是 /api/embed 的响应
+type OllamaEmbedResponse struct {
+	Model         string      `json:"model"`
+	Embeddings    [][]float64 `json:"embeddings"`
+	TotalDuration int64       `json:"total_duration,omitempty"`
+}
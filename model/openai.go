@@ -15,10 +15,12 @@ type FunctionDefinition struct {
 	Parameters json.RawMessage `json:"parameters"`
 }
 
-// Tool 定义了一个工具，目前只支持 "function" 类型。
+// Tool 定义了一个工具。除 "function" 外还接受映射到 Gemini 内置工具的类型:
+// "web_search" / "web_search_preview" / "google_search" (googleSearch)、"url_context" (urlContext)、
+// "code_interpreter" / "code_execution" (codeExecution)，这些类型没有 function 字段。
 type Tool struct {
-	Type     string             `json:"type"` // 必须是 "function"
-	Function FunctionDefinition `json:"function"`
+	Type     string              `json:"type"`
+	Function *FunctionDefinition `json:"function,omitempty"`
 }
 
 // FunctionCall 代表模型希望调用的一个具体函数。
@@ -40,24 +42,84 @@ type ToolCall struct {
 
 // ChatCompletionRequest 更新了对 'tools' 和 'tool_choice' 的支持
 type ChatCompletionRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
-	TopP        float64   `json:"top_p,omitempty"`
+	Model       string      `json:"model"`
+	Messages    []Message   `json:"messages"`
+	Stream      bool        `json:"stream"`
+	N           int         `json:"n,omitempty"` // 选项数量，超过单次调用的候选数上限时由服务拆分为多个上游请求
+	MaxTokens   int         `json:"max_tokens,omitempty"`
+	Temperature float64     `json:"temperature,omitempty"`
+	TopP        float64     `json:"top_p,omitempty"`
+	Stop        interface{} `json:"stop,omitempty"` // 字符串或字符串数组
+	// ResponseFormat 是 {"type": "json_object"} 或 {"type": "json_schema", "json_schema": {...}}
+	ResponseFormat interface{} `json:"response_format,omitempty"`
 	// +++ 新增 +++
 	Tools      []Tool      `json:"tools,omitempty"`
 	ToolChoice interface{} `json:"tool_choice,omitempty"` // 可以是 "none", "auto", 或 {"type": "function", "function": {"name": "my_function"}}
+	// WebSearchOptions 不为空时启用 Gemini 的 Google 搜索 grounding，其中的 search_context_size、user_location 被忽略
+	WebSearchOptions interface{} `json:"web_search_options,omitempty"`
+	// ReasoningEffort 是 OpenAI 的思考强度 ("none"、"minimal"、"low"、"medium"、"high")，由服务转换为思考预算
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	// Thinking 是本服务的扩展，直接指定思考预算和是否返回思考摘要
+	Thinking *ThinkingOptions `json:"thinking,omitempty"`
+	// ExtraBody 是 Gemini OpenAI 兼容接口的扩展参数，发往上游前由服务填充
+	ExtraBody *ExtraBody `json:"extra_body,omitempty"`
+	// TemplateID 是本服务的扩展: 使用管理员保存的提示词模板生成消息，请求中的 messages 追加在模板消息之后。
+	// TemplateVersion 为 0 时使用最新版本。这三个字段在转发前被清空。
+	TemplateID      string                 `json:"template_id,omitempty"`
+	TemplateVersion int                    `json:"template_version,omitempty"`
+	Variables       map[string]interface{} `json:"variables,omitempty"`
+}
+
+// ThinkingOptions 是请求中的 thinking 扩展
+type ThinkingOptions struct {
+	Type            string `json:"type,omitempty"`          // "enabled" 或 "disabled"
+	BudgetTokens    *int   `json:"budget_tokens,omitempty"` // -1 表示动态预算
+	IncludeThoughts *bool  `json:"include_thoughts,omitempty"`
+}
+
+// ExtraBody 对应 Gemini OpenAI 兼容接口的 extra_body
+type ExtraBody struct {
+	Google *GoogleExtraBody `json:"google,omitempty"`
+}
+
+// GoogleExtraBody 是 extra_body.google 中的 Gemini 专有参数
+type GoogleExtraBody struct {
+	ThinkingConfig *GoogleThinkingConfig `json:"thinking_config,omitempty"`
+	// CachedContent 是上游 cachedContents 资源名，由上下文缓存填充，请求中的消息不再包含已缓存的前缀
+	CachedContent string `json:"cached_content,omitempty"`
+}
+
+// GoogleThinkingConfig 对应 Gemini 的 thinkingConfig
+type GoogleThinkingConfig struct {
+	ThinkingBudget  *int `json:"thinking_budget,omitempty"`
+	IncludeThoughts bool `json:"include_thoughts,omitempty"`
 }
 
 // Message 代表对话中的一条消息，增加了对 tool_calls 的支持
 type Message struct {
 	Role    string      `json:"role"`
 	Content interface{} `json:"content"` // 当有 tool_calls 时, content 可以为 null
+	// ReasoningContent 是模型的思考摘要，只在响应中返回
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 	// +++ 新增 +++
 	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // 模型响应中返回
 	ToolCallID string     `json:"tool_call_id,omitempty"` // 在 "tool" role 的消息中，指定这是哪个 tool_call 的结果
+	// Annotations 是 Google 搜索 grounding 返回的引用，只在响应中返回
+	Annotations []Annotation `json:"annotations,omitempty"`
+}
+
+// Annotation 是消息中的一条引用，目前只有 "url_citation" 类型
+type Annotation struct {
+	Type        string       `json:"type"`
+	URLCitation *URLCitation `json:"url_citation,omitempty"`
+}
+
+// URLCitation 指出正文中 [StartIndex, EndIndex) 范围 (按字符计) 的内容引用自哪个网页
+type URLCitation struct {
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
 }
 
 // OpenAICompletionResponse 是非流式调用的标准响应体
@@ -84,6 +146,13 @@ type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"` // 修正
+	// PromptTokensDetails 中的 cached_tokens 是 prompt_tokens 中命中上下文缓存的部分
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// PromptTokensDetails 是输入 token 的明细
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
 }
 
 // ChatCompletionStreamResponse 是流式响应的结构
@@ -105,10 +174,13 @@ type Choice struct {
 
 // Delta 代表流中的增量变化，增加了对 tool_calls 的支持
 type Delta struct {
-	Content string `json:"content,omitempty"`
+	Content          string `json:"content,omitempty"`
+	ReasoningContent string `json:"reasoning_content,omitempty"` // 思考摘要的增量
 	// +++ 新增 +++
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"` // 流式响应中也可能有 tool_calls
 	Role      string     `json:"role,omitempty"`       // role 字段也可能出现在 delta 中
+	// Annotations 是 grounding 引用，在候选结束时随最后一个 chunk 返回
+	Annotations []Annotation `json:"annotations,omitempty"`
 }
 
 // OpenAIErrorResponse 用于向客户端返回符合OpenAI规范的错误信息
@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+)
+
+// PromptTemplate 是提示词模板的一个版本 (prompt_templates 表)。同名模板的每次修改都保存为一个新版本，
+// 旧版本保留以便客户端固定版本和追溯请求使用的提示词。
+// Messages 是 JSON 格式的消息数组 ([{"role": "system", "content": "..."}])，content 中的 {{变量名}} 在请求时替换为
+// variables 中的值；Variables 是 JSON 对象形式的变量默认值，没有默认值的变量必须由请求提供。
+// Model 非空时作为请求没有指定 model 时使用的模型。
+type PromptTemplate struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `gorm:"type:varchar(255);uniqueIndex:idx_prompt_template_version;not null" json:"name"`
+	Version     int       `gorm:"uniqueIndex:idx_prompt_template_version;not null" json:"version"`
+	Model       string    `gorm:"type:varchar(255)" json:"model"`
+	Description string    `gorm:"type:varchar(1024)" json:"description"`
+	Messages    string    `gorm:"type:text;not null" json:"messages"`
+	Variables   string    `gorm:"type:text" json:"variables"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,15 @@
+package model
+
+import (
+	"time"
+)
+
+// ResponseCacheEntry 是 SQLite 响应缓存后端中 response_cache_entries 表的 GORM 模型
+type ResponseCacheEntry struct {
+	Key         string    `gorm:"type:varchar(64);primaryKey" json:"key"`
+	Body        []byte    `json:"-"`
+	ServedModel string    `gorm:"type:varchar(255)" json:"served_model"`
+	Size        int       `json:"size"`
+	ExpiresAt   time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"time"
+)
+
+// Thread 是服务端保存对话历史的会话线程 (threads 表)。
+// ClientID 为创建者的客户端 ID，使用全局公共密钥 (或未开启认证) 时为 0，其他客户端不能访问。
+// Instructions 在每次请求时作为系统提示词放在历史之前；Summary 是已归档的早期消息的摘要。
+type Thread struct {
+	ID           string    `gorm:"type:varchar(64);primaryKey" json:"id"`
+	ClientID     uint      `gorm:"index;not null;default:0" json:"client_id"`
+	Model        string    `gorm:"type:varchar(255)" json:"model"`
+	Instructions string    `gorm:"type:text" json:"instructions"`
+	Summary      string    `gorm:"type:text" json:"summary"`
+	Metadata     string    `gorm:"type:text" json:"metadata"` // 客户端提供的元数据，JSON 对象
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ThreadMessage 是线程中的一条消息 (thread_messages 表)，按 ID 顺序排列。
+// Content 和 ToolCalls 是 JSON 编码的 OpenAI 消息字段。
+// Archived 表示消息已因超出上下文窗口被合并为摘要或丢弃，之后的请求不再发送，但仍保留在历史中。
+type ThreadMessage struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	ThreadID   string    `gorm:"type:varchar(64);index;not null" json:"thread_id"`
+	Role       string    `gorm:"type:varchar(32)" json:"role"`
+	Content    string    `gorm:"type:text" json:"content"`
+	ToolCalls  string    `gorm:"type:text" json:"tool_calls"`
+	ToolCallID string    `gorm:"type:varchar(255)" json:"tool_call_id"`
+	Archived   bool      `gorm:"not null;default:false" json:"archived"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateThreadRequest 是 POST /v1/threads 的请求体，messages 只保存不发送给模型
+type CreateThreadRequest struct {
+	Model        string            `json:"model"`
+	Instructions string            `json:"instructions"`
+	Metadata     map[string]string `json:"metadata"`
+	Messages     []Message         `json:"messages"`
+}
@@ -0,0 +1,495 @@
+// service/audio_service.go
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/model"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxSpeechInputChars 与 OpenAI /v1/audio/speech 的 input 长度上限一致
+	maxSpeechInputChars = 4096
+	// defaultSpeechVoice 是未指定音色时使用的 Gemini 预置音色
+	defaultSpeechVoice = "Kore"
+	// defaultPCMSampleRate 是 Gemini TTS 输出的 PCM 采样率 (16 位单声道)
+	defaultPCMSampleRate = 24000
+)
+
+// openAIVoices 将 OpenAI 的音色名映射为风格相近的 Gemini 预置音色
+var openAIVoices = map[string]string{
+	"alloy":   "Zephyr",
+	"ash":     "Orus",
+	"ballad":  "Sadaltager",
+	"coral":   "Aoede",
+	"echo":    "Puck",
+	"fable":   "Fenrir",
+	"onyx":    "Charon",
+	"nova":    "Kore",
+	"sage":    "Leda",
+	"shimmer": "Callirrhoe",
+	"verse":   "Enceladus",
+}
+
+// geminiVoices 是 Gemini TTS 的预置音色，键为小写名称。上游会拒绝其他音色名，并且这类 400 错误会让 Key 被禁用，
+// 因此未知的音色在本地直接拒绝。
+var geminiVoices = map[string]string{
+	"zephyr":        "Zephyr",
+	"puck":          "Puck",
+	"charon":        "Charon",
+	"kore":          "Kore",
+	"fenrir":        "Fenrir",
+	"leda":          "Leda",
+	"orus":          "Orus",
+	"aoede":         "Aoede",
+	"callirrhoe":    "Callirrhoe",
+	"autonoe":       "Autonoe",
+	"enceladus":     "Enceladus",
+	"iapetus":       "Iapetus",
+	"umbriel":       "Umbriel",
+	"algieba":       "Algieba",
+	"despina":       "Despina",
+	"erinome":       "Erinome",
+	"algenib":       "Algenib",
+	"rasalgethi":    "Rasalgethi",
+	"laomedeia":     "Laomedeia",
+	"achernar":      "Achernar",
+	"alnilam":       "Alnilam",
+	"schedar":       "Schedar",
+	"gacrux":        "Gacrux",
+	"pulcherrima":   "Pulcherrima",
+	"achird":        "Achird",
+	"zubenelgenubi": "Zubenelgenubi",
+	"vindemiatrix":  "Vindemiatrix",
+	"sadachbia":     "Sadachbia",
+	"sadaltager":    "Sadaltager",
+	"sulafat":       "Sulafat",
+}
+
+// transcriptionMimeTypes 是转写接受的音频 MIME 类型及发送给 Gemini 时使用的规范名称，
+// 其他类型会被上游以 400 拒绝，在本地直接返回参数错误
+var transcriptionMimeTypes = map[string]string{
+	"audio/wav":    "audio/wav",
+	"audio/wave":   "audio/wav",
+	"audio/x-wav":  "audio/wav",
+	"audio/mp3":    "audio/mp3",
+	"audio/mpeg":   "audio/mp3",
+	"audio/aiff":   "audio/aiff",
+	"audio/x-aiff": "audio/aiff",
+	"audio/aac":    "audio/aac",
+	"audio/ogg":    "audio/ogg",
+	"audio/flac":   "audio/flac",
+	"audio/x-flac": "audio/flac",
+	"audio/mp4":    "audio/mp4",
+	"audio/m4a":    "audio/mp4",
+	"audio/x-m4a":  "audio/mp4",
+	"audio/webm":   "audio/webm",
+	"video/mp4":    "video/mp4",
+	"video/webm":   "video/webm",
+}
+
+// speechFormats 是 /v1/audio/speech 支持的输出格式及其 Content-Type 和 ffmpeg 编码参数。
+// wav 和 pcm 在 Go 中直接生成，其他格式需要 ffmpeg 转码。
+var speechFormats = map[string]struct {
+	contentType string
+	ffmpegArgs  []string
+}{
+	"mp3":  {"audio/mpeg", []string{"-f", "mp3"}},
+	"opus": {"audio/ogg", []string{"-c:a", "libopus", "-f", "ogg"}},
+	"aac":  {"audio/aac", []string{"-c:a", "aac", "-f", "adts"}},
+	"flac": {"audio/flac", []string{"-f", "flac"}},
+	"wav":  {"audio/wav", nil},
+	"pcm":  {"audio/pcm", nil},
+}
+
+// transcriptionFormats 是 /v1/audio/transcriptions 支持的 response_format
+var transcriptionFormats = map[string]bool{"json": true, "text": true, "srt": true, "vtt": true, "verbose_json": true}
+
+// transcriptionSchema 要求模型以结构化 JSON 返回完整文本和带时间戳的分段
+var transcriptionSchema = map[string]interface{}{
+	"type": "OBJECT",
+	"properties": map[string]interface{}{
+		"language": map[string]string{"type": "STRING"},
+		"text":     map[string]string{"type": "STRING"},
+		"segments": map[string]interface{}{
+			"type": "ARRAY",
+			"items": map[string]interface{}{
+				"type": "OBJECT",
+				"properties": map[string]interface{}{
+					"start": map[string]string{"type": "NUMBER"},
+					"end":   map[string]string{"type": "NUMBER"},
+					"text":  map[string]string{"type": "STRING"},
+				},
+				"required": []string{"start", "end", "text"},
+			},
+		},
+	},
+	"required": []string{"language", "text", "segments"},
+}
+
+// AudioRequestError 表示音频请求的参数不合法
+type AudioRequestError struct {
+	Param   string
+	Message string
+}
+
+func (e *AudioRequestError) Error() string {
+	return e.Message
+}
+
+// ErrNoAudioGenerated 表示 TTS 模型成功响应但没有返回音频
+var ErrNoAudioGenerated = errors.New("上游没有返回音频")
+
+// AudioInput 是 /v1/audio/transcriptions 上传的音频文件
+type AudioInput struct {
+	Data     []byte
+	MimeType string
+}
+
+// AudioService 将 OpenAI 兼容的语音合成和语音转写请求转换为 Gemini TTS 模型和多模态模型的 generateContent 请求，
+// 与文本请求共享 Key 池、重试、熔断和模型回退。
+type AudioService struct {
+	configManager *config.Manager
+	genaiService  *GenAIService
+}
+
+func NewAudioService(manager *config.Manager, genaiService *GenAIService) *AudioService {
+	return &AudioService{configManager: manager, genaiService: genaiService}
+}
+
+// DefaultModel 返回未指定模型时使用的 TTS 或转写模型
+func (s *AudioService) DefaultModel(speech bool) string {
+	cfg := s.configManager.Get()
+	if speech {
+		return cfg.AudioTTSModel
+	}
+	return cfg.AudioTranscriptionModel
+}
+
+// ===================== 语音合成 =====================
+
+// Speech 合成语音，返回音频数据和 Content-Type。req.Model 应已经过模型目录解析。
+func (s *AudioService) Speech(ctx context.Context, req *model.SpeechRequest) ([]byte, string, error) {
+	if strings.TrimSpace(req.Input) == "" {
+		return nil, "", &AudioRequestError{Param: "input", Message: "input 不能为空"}
+	}
+	if utf8.RuneCountInString(req.Input) > maxSpeechInputChars {
+		return nil, "", &AudioRequestError{Param: "input", Message: fmt.Sprintf("input 不能超过 %d 个字符", maxSpeechInputChars)}
+	}
+	format := req.ResponseFormat
+	if format == "" {
+		format = "mp3"
+	}
+	spec, ok := speechFormats[format]
+	if !ok {
+		return nil, "", &AudioRequestError{Param: "response_format", Message: "response_format 必须是 mp3、opus、aac、flac、wav 或 pcm"}
+	}
+	ffmpegPath := ""
+	if spec.ffmpegArgs != nil {
+		path, err := exec.LookPath(s.configManager.Get().AudioFFmpegPath)
+		if err != nil {
+			return nil, "", &AudioRequestError{Param: "response_format", Message: fmt.Sprintf("服务器未安装 ffmpeg，无法输出 %s 格式，请使用 wav 或 pcm", format)}
+		}
+		ffmpegPath = path
+	}
+
+	voice, err := speechVoice(req.Voice)
+	if err != nil {
+		return nil, "", err
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"contents": []map[string]interface{}{{"role": "user", "parts": []map[string]string{{"text": speechPrompt(req)}}}},
+		"generationConfig": map[string]interface{}{
+			"responseModalities": []string{"AUDIO"},
+			"speechConfig": map[string]interface{}{
+				"voiceConfig": map[string]interface{}{"prebuiltVoiceConfig": map[string]string{"voiceName": voice}},
+			},
+		},
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("序列化请求体失败: %w", err)
+	}
+
+	var pcm []byte
+	sampleRate := defaultPCMSampleRate
+	modelName := s.upstreamModel(req.Model, true)
+	err = s.genaiService.withFallback(ctx, modelName, func(ctx context.Context, servedModel string) error {
+		respBody, _, err := s.genaiService.geminiUnary(ctx, "Gemini TTS", servedModel, "generateContent", reqBody)
+		if err != nil {
+			return err
+		}
+		pcm, sampleRate, err = parseGeminiAudio(respBody)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch format {
+	case "pcm":
+		return pcm, spec.contentType, nil
+	case "wav":
+		return wrapPCMAsWAV(pcm, sampleRate), spec.contentType, nil
+	}
+	encoded, err := transcodePCM(ctx, ffmpegPath, pcm, sampleRate, spec.ffmpegArgs)
+	if err != nil {
+		return nil, "", err
+	}
+	return encoded, spec.contentType, nil
+}
+
+// speechVoice 将 OpenAI 音色名或 Gemini 预置音色名 (不区分大小写) 转换为 Gemini 音色名，空值使用默认音色
+func speechVoice(voice string) (string, error) {
+	if voice == "" {
+		return defaultSpeechVoice, nil
+	}
+	name := strings.ToLower(strings.TrimSpace(voice))
+	if mapped, ok := openAIVoices[name]; ok {
+		return mapped, nil
+	}
+	if mapped, ok := geminiVoices[name]; ok {
+		return mapped, nil
+	}
+	return "", &AudioRequestError{Param: "voice", Message: fmt.Sprintf("不支持的音色: %s，请使用 OpenAI 音色名或 Gemini 预置音色名", voice)}
+}
+
+// speechPrompt 将朗读要求和语速合并到待朗读的文本之前
+func speechPrompt(req *model.SpeechRequest) string {
+	var style []string
+	if s := strings.TrimSpace(req.Instructions); s != "" {
+		style = append(style, s)
+	}
+	if req.Speed > 0 && req.Speed != 1 {
+		style = append(style, fmt.Sprintf("Speak at about %.2g times the normal speed.", req.Speed))
+	}
+	if len(style) == 0 {
+		return req.Input
+	}
+	return strings.Join(style, " ") + "\n\nRead the following text aloud:\n" + req.Input
+}
+
+// parseGeminiAudio 取出 TTS 响应中的 PCM 音频及其采样率 (mimeType 形如 audio/L16;codec=pcm;rate=24000)
+func parseGeminiAudio(respBody []byte) ([]byte, int, error) {
+	var resp struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					InlineData *struct {
+						MimeType string `json:"mimeType"`
+						Data     string `json:"data"`
+					} `json:"inlineData"`
+				} `json:"parts"`
+			} `json:"content"`
+			FinishReason string `json:"finishReason"`
+		} `json:"candidates"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, 0, fmt.Errorf("解析 Gemini TTS 响应失败: %w", err)
+	}
+
+	var pcm []byte
+	sampleRate, finishReason := defaultPCMSampleRate, ""
+	for _, candidate := range resp.Candidates {
+		finishReason = candidate.FinishReason
+		for _, part := range candidate.Content.Parts {
+			if part.InlineData == nil || part.InlineData.Data == "" {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+			if err != nil {
+				return nil, 0, fmt.Errorf("解码 Gemini TTS 音频失败: %w", err)
+			}
+			pcm = append(pcm, data...)
+			for _, param := range strings.Split(part.InlineData.MimeType, ";") {
+				if v, ok := strings.CutPrefix(strings.TrimSpace(param), "rate="); ok {
+					if rate, err := strconv.Atoi(v); err == nil && rate > 0 {
+						sampleRate = rate
+					}
+				}
+			}
+		}
+		if len(pcm) > 0 {
+			return pcm, sampleRate, nil
+		}
+	}
+	if finishReason != "" {
+		return nil, 0, fmt.Errorf("%w (finishReason: %s)", ErrNoAudioGenerated, finishReason)
+	}
+	return nil, 0, ErrNoAudioGenerated
+}
+
+// wrapPCMAsWAV 为 16 位单声道小端 PCM 数据加上 44 字节的 WAV 文件头
+func wrapPCMAsWAV(pcm []byte, sampleRate int) []byte {
+	const (
+		channels      = 1
+		bitsPerSample = 16
+	)
+	blockAlign := channels * bitsPerSample / 8
+	var buf bytes.Buffer
+	buf.Grow(44 + len(pcm))
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(pcm)))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16)) // fmt 块大小
+	binary.Write(&buf, binary.LittleEndian, uint16(1))  // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(channels))
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate*blockAlign))
+	binary.Write(&buf, binary.LittleEndian, uint16(blockAlign))
+	binary.Write(&buf, binary.LittleEndian, uint16(bitsPerSample))
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+	return buf.Bytes()
+}
+
+// transcodePCM 使用 ffmpeg 将 PCM 数据转码为其他格式
+func transcodePCM(ctx context.Context, ffmpegPath string, pcm []byte, sampleRate int, formatArgs []string) ([]byte, error) {
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-f", "s16le", "-ar", strconv.Itoa(sampleRate), "-ac", "1", "-i", "pipe:0"}
+	args = append(args, formatArgs...)
+	args = append(args, "pipe:1")
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	cmd.Stdin = bytes.NewReader(pcm)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg 转码失败: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// ===================== 语音转写 =====================
+
+// Transcribe 将音频以内联数据发送给 Gemini 模型进行转写，返回带分段时间戳的结果。
+// req.Model 应已经过模型目录解析。
+func (s *AudioService) Transcribe(ctx context.Context, req *model.TranscriptionRequest, audio AudioInput) (*model.TranscriptionResponse, error) {
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = "json"
+	}
+	if !transcriptionFormats[req.ResponseFormat] {
+		return nil, &AudioRequestError{Param: "response_format", Message: "response_format 必须是 json、text、srt、vtt 或 verbose_json"}
+	}
+	mimeType, ok := transcriptionMimeTypes[strings.ToLower(strings.TrimSpace(strings.Split(audio.MimeType, ";")[0]))]
+	if !ok {
+		return nil, &AudioRequestError{Param: "file", Message: fmt.Sprintf("不支持的音频格式: %s，请上传 wav、mp3、aiff、aac、ogg、flac、m4a 或 webm 文件", audio.MimeType)}
+	}
+
+	instruction := "Generate a verbatim transcript of the speech in this audio. " +
+		"Return the detected language as a lowercase English name (for example \"english\"), the full transcript as text, " +
+		"and the transcript split into sentence-level segments with start and end times in seconds from the beginning of the audio."
+	if req.Language != "" {
+		instruction += fmt.Sprintf(" The audio is in the language with ISO-639-1 code %q.", req.Language)
+	}
+	if req.Prompt != "" {
+		instruction += " Use the following context for names and spelling, but do not transcribe it: " + req.Prompt
+	}
+	generationConfig := map[string]interface{}{
+		"responseMimeType": "application/json",
+		"responseSchema":   transcriptionSchema,
+	}
+	if req.Temperature > 0 {
+		generationConfig["temperature"] = req.Temperature
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"contents": []map[string]interface{}{{
+			"role": "user",
+			"parts": []map[string]interface{}{
+				{"text": instruction},
+				{"inlineData": map[string]string{"mimeType": mimeType, "data": base64.StdEncoding.EncodeToString(audio.Data)}},
+			},
+		}},
+		"generationConfig": generationConfig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("序列化请求体失败: %w", err)
+	}
+
+	var result *model.TranscriptionResponse
+	modelName := s.upstreamModel(req.Model, false)
+	err = s.genaiService.withFallback(ctx, modelName, func(ctx context.Context, servedModel string) error {
+		respBody, _, err := s.genaiService.geminiUnary(ctx, "Gemini Transcription", servedModel, "generateContent", reqBody)
+		if err != nil {
+			return err
+		}
+		result, err = parseTranscription(respBody)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseTranscription 解析模型返回的结构化转写结果
+func parseTranscription(respBody []byte) (*model.TranscriptionResponse, error) {
+	var resp struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+		} `json:"candidates"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("解析 Gemini 转写响应失败: %w", err)
+	}
+	if len(resp.Candidates) == 0 {
+		return nil, errors.New("上游没有返回转写结果")
+	}
+	var text strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		text.WriteString(part.Text)
+	}
+
+	var out struct {
+		Language string                       `json:"language"`
+		Text     string                       `json:"text"`
+		Segments []model.TranscriptionSegment `json:"segments"`
+	}
+	if err := json.Unmarshal([]byte(text.String()), &out); err != nil {
+		return nil, fmt.Errorf("解析转写结果失败: %w", err)
+	}
+	result := &model.TranscriptionResponse{
+		Task:     "transcribe",
+		Language: out.Language,
+		Text:     strings.TrimSpace(out.Text),
+		Segments: out.Segments,
+	}
+	for i := range result.Segments {
+		result.Segments[i].ID = i
+		result.Segments[i].Text = strings.TrimSpace(result.Segments[i].Text)
+		if end := result.Segments[i].End; end > result.Duration {
+			result.Duration = end
+		}
+	}
+	if result.Segments == nil {
+		result.Segments = []model.TranscriptionSegment{}
+	}
+	return result, nil
+}
+
+// upstreamModel 将仍然是 OpenAI 音频模型名 (没有在模型目录中配置别名) 的请求映射到默认模型
+func (s *AudioService) upstreamModel(requested string, speech bool) string {
+	switch {
+	case requested == "",
+		strings.HasPrefix(requested, "tts-"),
+		strings.HasPrefix(requested, "whisper"),
+		strings.HasPrefix(requested, "gpt-4o") && (strings.HasSuffix(requested, "-tts") || strings.HasSuffix(requested, "-transcribe")):
+		return s.DefaultModel(speech)
+	}
+	return requested
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"gemini_polling/model"
+	"net/http"
+	"testing"
+)
+
+func TestSpeechVoice(t *testing.T) {
+	tests := []struct {
+		voice string
+		want  string // "" 表示应返回参数错误
+	}{
+		{voice: "", want: defaultSpeechVoice},
+		{voice: "alloy", want: "Zephyr"},
+		{voice: "Shimmer", want: "Callirrhoe"}, // OpenAI 音色名不区分大小写
+		{voice: "Puck", want: "Puck"},
+		{voice: "zubenelgenubi", want: "Zubenelgenubi"}, // Gemini 音色名转换为规范大小写
+		{voice: " kore ", want: "Kore"},
+		{voice: "marin"},
+		{voice: "Kore2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.voice, func(t *testing.T) {
+			got, err := speechVoice(tt.voice)
+			if tt.want == "" {
+				var reqErr *AudioRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != "voice" {
+					t.Fatalf("speechVoice(%q) = %q, %v, want AudioRequestError on voice", tt.voice, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("speechVoice(%q) = %q, %v, want %q", tt.voice, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpeechValidation(t *testing.T) {
+	pcm := base64.StdEncoding.EncodeToString([]byte{1, 2, 3, 4})
+	tests := []struct {
+		name      string
+		req       model.SpeechRequest
+		wantParam string
+		wantVoice string
+	}{
+		{name: "OpenAI voice is mapped", req: model.SpeechRequest{Input: "hi", Voice: "echo", ResponseFormat: "pcm"}, wantVoice: "Puck"},
+		{name: "Gemini voice is passed through", req: model.SpeechRequest{Input: "hi", Voice: "leda", ResponseFormat: "wav"}, wantVoice: "Leda"},
+		{name: "unknown voice", req: model.SpeechRequest{Input: "hi", Voice: "robot", ResponseFormat: "pcm"}, wantParam: "voice"},
+		{name: "empty input", req: model.SpeechRequest{Input: "  ", ResponseFormat: "pcm"}, wantParam: "input"},
+		{name: "unknown format", req: model.SpeechRequest{Input: "hi", ResponseFormat: "ogg"}, wantParam: "response_format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			genai, requests := newVertexTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"candidates":[{"content":{"parts":[{"inlineData":{"mimeType":"audio/L16;codec=pcm;rate=24000","data":"` + pcm + `"}}]}}]}`))
+			})
+			s := NewAudioService(newTestConfigManager(t), genai)
+			tt.req.Model = "gemini-2.5-flash-preview-tts"
+
+			_, _, err := s.Speech(context.Background(), &tt.req)
+			if tt.wantParam != "" {
+				var reqErr *AudioRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+					t.Fatalf("Speech = %v, want AudioRequestError on %s", err, tt.wantParam)
+				}
+				// 参数错误不能发往上游，否则上游的 400 会让 Key 被禁用
+				if n := len(requests()); n != 0 {
+					t.Errorf("invalid request reached the upstream %d times", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := requests()
+			if len(got) != 1 {
+				t.Fatalf("upstream received %d requests, want 1", len(got))
+			}
+			speechConfig, _ := got[0].body["generationConfig"].(map[string]interface{})["speechConfig"].(map[string]interface{})
+			voiceConfig, _ := speechConfig["voiceConfig"].(map[string]interface{})
+			prebuilt, _ := voiceConfig["prebuiltVoiceConfig"].(map[string]interface{})
+			if prebuilt["voiceName"] != tt.wantVoice {
+				t.Errorf("voiceName = %v, want %s", prebuilt["voiceName"], tt.wantVoice)
+			}
+		})
+	}
+}
+
+func TestTranscribeMimeType(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string // 发往上游的 mimeType，"" 表示应返回参数错误
+	}{
+		{mimeType: "audio/wav", want: "audio/wav"},
+		{mimeType: "audio/x-wav", want: "audio/wav"},
+		{mimeType: "audio/mpeg", want: "audio/mp3"},
+		{mimeType: "audio/MP3", want: "audio/mp3"},
+		{mimeType: "audio/ogg; codecs=opus", want: "audio/ogg"},
+		{mimeType: "audio/mp4", want: "audio/mp4"},
+		{mimeType: "video/webm", want: "video/webm"},
+		{mimeType: "audio/amr"},
+		{mimeType: "video/quicktime"},
+		{mimeType: "application/octet-stream"},
+		{mimeType: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mimeType, func(t *testing.T) {
+			genai, requests := newVertexTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"{\"language\":\"english\",\"text\":\"hi\",\"segments\":[]}"}]}}]}`))
+			})
+			s := NewAudioService(newTestConfigManager(t), genai)
+			req := &model.TranscriptionRequest{Model: "gemini-2.5-flash"}
+
+			_, err := s.Transcribe(context.Background(), req, AudioInput{Data: []byte("audio"), MimeType: tt.mimeType})
+			if tt.want == "" {
+				var reqErr *AudioRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != "file" {
+					t.Fatalf("Transcribe = %v, want AudioRequestError on file", err)
+				}
+				if n := len(requests()); n != 0 {
+					t.Errorf("invalid request reached the upstream %d times", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := requests()
+			if len(got) != 1 {
+				t.Fatalf("upstream received %d requests, want 1", len(got))
+			}
+			contents, _ := got[0].body["contents"].([]interface{})
+			parts, _ := contents[0].(map[string]interface{})["parts"].([]interface{})
+			inline, _ := parts[1].(map[string]interface{})["inlineData"].(map[string]interface{})
+			if inline["mimeType"] != tt.want {
+				t.Errorf("inlineData.mimeType = %v, want %s", inline["mimeType"], tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTranscription(t *testing.T) {
+	body := `{"candidates":[{"content":{"parts":[{"text":"{\"language\":\"english\",\"text\":\" hello world \",` +
+		`\"segments\":[{\"start\":0,\"end\":1.5,\"text\":\" hello \"},{\"start\":1.5,\"end\":2.25,\"text\":\"world\"}]}"}]}}]}`
+	result, err := parseTranscription([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Text != "hello world" || result.Language != "english" || result.Duration != 2.25 || len(result.Segments) != 2 {
+		t.Fatalf("parseTranscription = %+v", result)
+	}
+	if result.Segments[0].Text != "hello" || result.Segments[1].ID != 1 {
+		t.Errorf("segments = %+v", result.Segments)
+	}
+
+	if _, err := parseTranscription([]byte(`{"candidates":[]}`)); err == nil {
+		t.Error("parseTranscription succeeded without candidates")
+	}
+}
+
+func TestParseGeminiAudio(t *testing.T) {
+	pcm := base64.StdEncoding.EncodeToString([]byte{1, 2, 3, 4})
+	tests := []struct {
+		name     string
+		body     string
+		wantLen  int
+		wantRate int
+		wantErr  error
+	}{
+		{name: "rate from the MIME type", body: `{"candidates":[{"content":{"parts":[{"inlineData":{"mimeType":"audio/L16;codec=pcm;rate=16000","data":"` + pcm + `"}}]}}]}`, wantLen: 4, wantRate: 16000},
+		{name: "default rate", body: `{"candidates":[{"content":{"parts":[{"inlineData":{"mimeType":"audio/L16","data":"` + pcm + `"}}]}}]}`, wantLen: 4, wantRate: defaultPCMSampleRate},
+		{name: "no audio", body: `{"candidates":[{"content":{"parts":[{"text":"sorry"}]},"finishReason":"OTHER"}]}`, wantErr: ErrNoAudioGenerated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, rate, err := parseGeminiAudio([]byte(tt.body))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("parseGeminiAudio = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(data) != tt.wantLen || rate != tt.wantRate {
+				t.Errorf("parseGeminiAudio = %d bytes, %d, %v", len(data), rate, err)
+			}
+		})
+	}
+}
+
+func TestWrapPCMAsWAV(t *testing.T) {
+	wav := wrapPCMAsWAV([]byte{1, 2, 3, 4}, 24000)
+	if len(wav) != 48 || string(wav[:4]) != "RIFF" || string(wav[8:12]) != "WAVE" || string(wav[36:40]) != "data" {
+		t.Fatalf("wrapPCMAsWAV header = % x", wav[:44])
+	}
+	if rate := uint32(wav[24]) | uint32(wav[25])<<8 | uint32(wav[26])<<16 | uint32(wav[27])<<24; rate != 24000 {
+		t.Errorf("sample rate = %d", rate)
+	}
+}
@@ -0,0 +1,1080 @@
+// service/batch_runner.go
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// batchCompletionWindow 是目前唯一支持的完成时限
+	batchCompletionWindow = "24h"
+	// batchMaxLineErrors 限制校验失败时记录的错误条数
+	batchMaxLineErrors = 100
+	// batchItemMaxAttempts 是单个请求在模型限流/熔断/503 时的最大尝试次数
+	batchItemMaxAttempts = 3
+	// batchRetryDelay 是单个请求重试前的基础等待时间，按尝试次数线性增加
+	batchRetryDelay = 15 * time.Second
+	// batchCountsFlushInterval 是执行中的请求计数写回数据库的间隔
+	batchCountsFlushInterval = 2 * time.Second
+)
+
+var (
+	// ErrBatchNotFound 表示批处理不存在或不属于当前客户端
+	ErrBatchNotFound = errors.New("批处理不存在")
+	// ErrBatchFileNotFound 表示文件不存在或不属于当前客户端
+	ErrBatchFileNotFound = errors.New("文件不存在")
+
+	errBatchCancelled = errors.New("批处理已取消")
+)
+
+// BatchRequestError 表示客户端的批处理/文件请求参数无效
+type BatchRequestError struct {
+	Param   string
+	Message string
+}
+
+func (e *BatchRequestError) Error() string {
+	return e.Message
+}
+
+// batchEndpoints 是批处理支持的接口
+var batchEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+}
+
+// BatchLineError 是输入文件校验失败时记录的单条错误
+type BatchLineError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// batchRequestLine 是输入 JSONL 文件中的一行
+type batchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResultLine 是输出/错误 JSONL 文件中的一行
+type batchResultLine struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *BatchLineError      `json:"error"`
+}
+
+type batchResultResponse struct {
+	StatusCode int         `json:"status_code"`
+	RequestID  string      `json:"request_id"`
+	Body       interface{} `json:"body"`
+}
+
+// BatchCreateRequest 是创建批处理的请求参数
+type BatchCreateRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// BatchProgressInfo 用于向前端返回批处理执行进度
+type BatchProgressInfo struct {
+	BatchID           string  `json:"batch_id"`
+	Status            string  `json:"status"`
+	TotalRequests     int     `json:"total_requests"`
+	CompletedRequests int     `json:"completed_requests"`
+	FailedRequests    int     `json:"failed_requests"`
+	Progress          float64 `json:"progress"`
+	Concurrency       int     `json:"concurrency"`
+	InFlight          int     `json:"in_flight"`
+	QueuedBatches     int     `json:"queued_batches"`
+	ElapsedTime       string  `json:"elapsed_time"`
+	ETA               string  `json:"eta"`
+	IsActive          bool    `json:"is_active"`
+}
+
+// batchRun 是正在执行的批处理的运行时状态
+type batchRun struct {
+	batch  *model.Batch
+	cancel context.CancelCauseFunc
+
+	startTime time.Time
+	resumed   int32 // 本次启动前已经完成的请求数，不计入 ETA 估算
+	completed atomic.Int32
+	failed    atomic.Int32
+
+	mu          sync.Mutex
+	status      string
+	active      int
+	concurrency int
+	freed       chan struct{}
+}
+
+// BatchRunner 实现 OpenAI 兼容的 Batch API。
+// 上传的 JSONL 文件保存在本地磁盘，批处理按创建顺序逐个在后台执行，
+// 每个请求都通过 GenAIService 发往上游，并发度为 Key 池容量的 BATCH_POOL_FRACTION，
+// 以便为在线请求保留余量。所有状态都保存在数据库和结果文件中，服务重启后会自动继续。
+type BatchRunner struct {
+	configManager *config.Manager
+	store         *storage.BatchStore
+	genaiService  *GenAIService
+	registry      *ModelRegistry
+	templates     *PromptTemplates
+	keyPool       *KeyPool
+	policy        *PolicyEngine
+	redactor      *Redactor
+	dir           string
+
+	mu      sync.Mutex
+	current *batchRun
+	wake    chan struct{}
+}
+
+// NewBatchRunner creates a batch runner storing files under BATCH_FILES_DIR.
+func NewBatchRunner(manager *config.Manager, store *storage.BatchStore, genaiService *GenAIService, registry *ModelRegistry, templates *PromptTemplates, keyPool *KeyPool, policy *PolicyEngine, redactor *Redactor) *BatchRunner {
+	return &BatchRunner{
+		configManager: manager,
+		store:         store,
+		genaiService:  genaiService,
+		registry:      registry,
+		templates:     templates,
+		keyPool:       keyPool,
+		policy:        policy,
+		redactor:      redactor,
+		dir:           manager.Get().BatchFilesDir,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// Start 创建文件目录并启动后台执行器，上次未完成的批处理会被继续执行
+func (r *BatchRunner) Start() error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return fmt.Errorf("创建批处理文件目录 %s 失败: %w", r.dir, err)
+	}
+	if count, err := r.store.CountActiveBatches(); err == nil && count > 0 {
+		logger.Info("[Batch] 发现 %d 个未完成的批处理，将在后台继续执行", count)
+	}
+	go r.loop()
+	logger.Info("批处理执行器已启动，文件目录: %s", r.dir)
+	return nil
+}
+
+func (r *BatchRunner) loop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		r.drain()
+		select {
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain 依次执行所有未结束的批处理
+func (r *BatchRunner) drain() {
+	for {
+		b, err := r.store.NextActiveBatch()
+		if err != nil {
+			logger.Error("[Batch] 查询待执行的批处理失败: %v", err)
+			return
+		}
+		if b == nil {
+			return
+		}
+		r.process(b)
+	}
+}
+
+func (r *BatchRunner) wakeUp() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ===================== 文件 =====================
+
+// SaveFile 将上传的文件保存到本地磁盘。目前只接受 purpose=batch 的 JSONL 文件。
+func (r *BatchRunner) SaveFile(clientID uint, filename, purpose string, src io.Reader) (*model.BatchFile, error) {
+	if purpose != "batch" {
+		return nil, &BatchRequestError{Param: "purpose", Message: fmt.Sprintf("不支持的 purpose '%s'，目前只支持 'batch'", purpose)}
+	}
+
+	id := newObjectID("file-")
+	path := filepath.Join(r.dir, id+".jsonl")
+	dst, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("创建文件失败: %w", err)
+	}
+	maxBytes := r.configManager.Get().BatchMaxFileBytes
+	written, err := io.Copy(dst, io.LimitReader(src, maxBytes+1))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written > maxBytes {
+		err = &BatchRequestError{Param: "file", Message: fmt.Sprintf("文件超过大小上限 %d 字节", maxBytes)}
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	file := &model.BatchFile{
+		ID:       id,
+		ClientID: clientID,
+		Filename: filepath.Base(filename),
+		Purpose:  purpose,
+		Bytes:    written,
+		Path:     path,
+	}
+	if err := r.store.CreateFile(file); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	logger.Info("[Batch] 已保存上传文件 %s (%s, %d 字节)", id, file.Filename, written)
+	return file, nil
+}
+
+// GetFile 返回客户端的文件
+func (r *BatchRunner) GetFile(clientID uint, id string) (*model.BatchFile, error) {
+	file, err := r.store.GetFile(id, &clientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBatchFileNotFound
+	}
+	return file, err
+}
+
+func (r *BatchRunner) ListFiles(clientID uint, purpose string) ([]model.BatchFile, error) {
+	return r.store.ListFiles(clientID, purpose)
+}
+
+// DeleteFile 删除客户端的文件。仍被未结束的批处理使用的输入文件不能删除。
+func (r *BatchRunner) DeleteFile(clientID uint, id string) error {
+	file, err := r.GetFile(clientID, id)
+	if err != nil {
+		return err
+	}
+	inUse, err := r.store.FileInUse(id)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return &BatchRequestError{Param: "file_id", Message: "文件正在被未完成的批处理使用，无法删除"}
+	}
+	if err := r.store.DeleteFile(id); err != nil {
+		return err
+	}
+	if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+		logger.Warn("[Batch] 删除文件 %s 失败: %v", file.Path, err)
+	}
+	return nil
+}
+
+// ===================== 批处理 =====================
+
+// CreateBatch 校验输入文件并创建批处理。输入文件无效时批处理会以 failed 状态创建，
+// 与 OpenAI 的行为一致；请求参数本身无效时返回 BatchRequestError。
+func (r *BatchRunner) CreateBatch(client *model.Client, req *BatchCreateRequest) (*model.Batch, error) {
+	if !batchEndpoints[req.Endpoint] {
+		return nil, &BatchRequestError{Param: "endpoint", Message: fmt.Sprintf("不支持的 endpoint '%s'", req.Endpoint)}
+	}
+	if req.CompletionWindow != batchCompletionWindow {
+		return nil, &BatchRequestError{Param: "completion_window", Message: "completion_window 目前只支持 '24h'"}
+	}
+	clientID := clientIDOf(client)
+	input, err := r.GetFile(clientID, req.InputFileID)
+	if errors.Is(err, ErrBatchFileNotFound) {
+		return nil, &BatchRequestError{Param: "input_file_id", Message: fmt.Sprintf("输入文件 %s 不存在", req.InputFileID)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if input.Purpose != "batch" {
+		return nil, &BatchRequestError{Param: "input_file_id", Message: "输入文件的 purpose 必须是 'batch'"}
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(24 * time.Hour)
+	b := &model.Batch{
+		ID:               newObjectID("batch_"),
+		ClientID:         clientID,
+		Endpoint:         req.Endpoint,
+		InputFileID:      input.ID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           model.BatchStatusValidating,
+		CreatedAt:        now,
+		ExpiresAt:        &expiresAt,
+	}
+	if len(req.Metadata) > 0 {
+		metadata, _ := json.Marshal(req.Metadata)
+		b.Metadata = string(metadata)
+	}
+
+	total, lineErrors, err := r.validateInput(client, input.Path, req.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("读取输入文件失败: %w", err)
+	}
+	b.TotalCount = total
+	if len(lineErrors) > 0 {
+		errorsJSON, _ := json.Marshal(lineErrors)
+		b.Errors = string(errorsJSON)
+		b.Status = model.BatchStatusFailed
+		b.FailedAt = &now
+	}
+
+	if err := r.store.CreateBatch(b); err != nil {
+		return nil, err
+	}
+	if b.Status == model.BatchStatusFailed {
+		logger.Warn("[Batch] 批处理 %s 的输入文件校验失败 (%d 个错误)", b.ID, len(lineErrors))
+	} else {
+		logger.Info("[Batch] 已创建批处理 %s，共 %d 个请求", b.ID, total)
+		r.wakeUp()
+	}
+	return b, nil
+}
+
+// validateInput 校验输入文件的每一行，返回请求总数和错误列表
+func (r *BatchRunner) validateInput(client *model.Client, path, endpoint string) (int, []BatchLineError, error) {
+	var lineErrors []BatchLineError
+	addError := func(e BatchLineError) {
+		if len(lineErrors) < batchMaxLineErrors {
+			lineErrors = append(lineErrors, e)
+		}
+	}
+
+	maxRequests := r.configManager.Get().BatchMaxRequests
+	seen := make(map[string]bool)
+	total := 0
+	err := forEachJSONLine(path, func(lineNo int, raw []byte) error {
+		total++
+		var line batchRequestLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			addError(BatchLineError{Code: "invalid_json_line", Message: "该行不是有效的 JSON: " + err.Error(), Line: lineNo})
+			return nil
+		}
+		switch {
+		case line.CustomID == "":
+			addError(BatchLineError{Code: "missing_required_parameter", Message: "缺少 custom_id", Param: "custom_id", Line: lineNo})
+		case seen[line.CustomID]:
+			addError(BatchLineError{Code: "duplicate_custom_id", Message: fmt.Sprintf("custom_id '%s' 重复", line.CustomID), Param: "custom_id", Line: lineNo})
+		case line.Method != http.MethodPost:
+			addError(BatchLineError{Code: "invalid_method", Message: "method 必须是 POST", Param: "method", Line: lineNo})
+		case line.URL != endpoint:
+			addError(BatchLineError{Code: "invalid_url", Message: fmt.Sprintf("url 必须与批处理的 endpoint '%s' 一致", endpoint), Param: "url", Line: lineNo})
+		default:
+			var body struct {
+				Model  string `json:"model"`
+				Stream bool   `json:"stream"`
+			}
+			if err := json.Unmarshal(line.Body, &body); err != nil || body.Model == "" {
+				addError(BatchLineError{Code: "missing_required_parameter", Message: "body 必须是包含 model 的 JSON 对象", Param: "body.model", Line: lineNo})
+			} else if body.Stream {
+				addError(BatchLineError{Code: "invalid_request", Message: "批处理不支持 stream=true", Param: "body.stream", Line: lineNo})
+			} else if _, err := r.registry.Resolve(client, body.Model); err != nil {
+				addError(BatchLineError{Code: "model_not_found", Message: err.Error(), Param: "body.model", Line: lineNo})
+			} else if r.redactor.Mode() == RedactionBlock {
+				// block 模式在创建时就拒绝包含敏感信息的请求，其他模式在执行时处理
+				if _, err := r.redactor.Filter(line.Body, fmt.Sprintf("批处理输入文件第 %d 行", lineNo)); err != nil {
+					addError(BatchLineError{Code: "sensitive_content", Message: err.Error(), Param: "body", Line: lineNo})
+				}
+			}
+		}
+		seen[line.CustomID] = true
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if total == 0 {
+		addError(BatchLineError{Code: "empty_file", Message: "输入文件没有任何请求"})
+	}
+	if total > maxRequests {
+		addError(BatchLineError{Code: "too_many_requests", Message: fmt.Sprintf("批处理最多包含 %d 个请求，实际为 %d 个", maxRequests, total)})
+	}
+	return total, lineErrors, nil
+}
+
+// GetBatch 返回客户端的批处理，正在执行的批处理会带上实时的请求计数
+func (r *BatchRunner) GetBatch(clientID *uint, id string) (*model.Batch, error) {
+	b, err := r.store.GetBatch(id, clientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.applyLiveCounts(b)
+	return b, nil
+}
+
+// ListBatches 按创建时间倒序分页返回批处理。clientID 为 nil 时返回所有客户端的批处理
+func (r *BatchRunner) ListBatches(clientID *uint, after string, limit int) ([]model.Batch, error) {
+	batches, err := r.store.ListBatches(clientID, after, limit)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, &BatchRequestError{Param: "after", Message: fmt.Sprintf("批处理 %s 不存在", after)}
+	}
+	for i := range batches {
+		r.applyLiveCounts(&batches[i])
+	}
+	return batches, err
+}
+
+func (r *BatchRunner) applyLiveCounts(b *model.Batch) {
+	r.mu.Lock()
+	run := r.current
+	r.mu.Unlock()
+	if run != nil && run.batch.ID == b.ID {
+		b.CompletedCount = int(run.completed.Load())
+		b.FailedCount = int(run.failed.Load())
+	}
+}
+
+// CancelBatch 取消批处理。正在执行的批处理会停止派发新请求并在进行中的请求结束后以 cancelled 结束，
+// 已完成请求的结果仍然可以通过输出文件获取。
+func (r *BatchRunner) CancelBatch(clientID *uint, id string) (*model.Batch, error) {
+	b, err := r.GetBatch(clientID, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status == model.BatchStatusCancelling || b.Status == model.BatchStatusCancelled {
+		return b, nil
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	ok, err := r.store.TransitionBatch(id, []string{model.BatchStatusValidating, model.BatchStatusInProgress}, map[string]interface{}{
+		"status":        model.BatchStatusCancelling,
+		"cancelling_at": now,
+	})
+	if err != nil || !ok {
+		r.mu.Unlock()
+		if err == nil {
+			err = &BatchRequestError{Param: "batch_id", Message: fmt.Sprintf("无法取消状态为 '%s' 的批处理", b.Status)}
+		}
+		return nil, err
+	}
+	if r.current != nil && r.current.batch.ID == id {
+		r.current.setStatus(model.BatchStatusCancelling)
+		r.current.cancel(errBatchCancelled)
+	} else {
+		// 尚未开始执行的批处理直接结束
+		r.finalize(b, model.BatchStatusCancelled, "cancelled_at")
+	}
+	r.mu.Unlock()
+	logger.Info("[Batch] 批处理 %s 已被取消", id)
+
+	return r.GetBatch(clientID, id)
+}
+
+// GetProgress 获取当前批处理的执行进度
+func (r *BatchRunner) GetProgress() BatchProgressInfo {
+	var info BatchProgressInfo
+	if count, err := r.store.CountActiveBatches(); err == nil {
+		info.QueuedBatches = int(count)
+	}
+
+	r.mu.Lock()
+	run := r.current
+	r.mu.Unlock()
+	if run == nil {
+		return info
+	}
+
+	run.mu.Lock()
+	info.Status = run.status
+	info.Concurrency = run.concurrency
+	info.InFlight = run.active
+	run.mu.Unlock()
+
+	info.QueuedBatches--
+	info.BatchID = run.batch.ID
+	info.TotalRequests = run.batch.TotalCount
+	info.CompletedRequests = int(run.completed.Load())
+	info.FailedRequests = int(run.failed.Load())
+	info.IsActive = true
+	info.ElapsedTime = time.Since(run.startTime).Round(time.Second).String()
+
+	processed := info.CompletedRequests + info.FailedRequests
+	// 计算 ETA，只使用本次启动后处理的请求
+	if done := processed - int(run.resumed); done > 0 {
+		avgTimePerRequest := time.Since(run.startTime).Seconds() / float64(done)
+		etaSeconds := avgTimePerRequest * float64(info.TotalRequests-processed)
+		info.ETA = time.Duration(etaSeconds * float64(time.Second)).Round(time.Second).String()
+	}
+	// 计算进度百分比
+	if info.TotalRequests > 0 {
+		info.Progress = float64(processed) / float64(info.TotalRequests) * 100
+	}
+	return info
+}
+
+// ===================== 执行 =====================
+
+// process 执行 (或继续执行) 一个批处理直到它结束
+func (r *BatchRunner) process(b *model.Batch) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	if b.ExpiresAt != nil {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, *b.ExpiresAt)
+		defer cancelDeadline()
+	}
+	run := &batchRun{batch: b, cancel: cancel, startTime: time.Now(), freed: make(chan struct{}, 1)}
+
+	r.mu.Lock()
+	r.current = run
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.current = nil
+		r.mu.Unlock()
+	}()
+
+	// 注册 current 之后重新读取状态，避免与取消请求竞争
+	latest, err := r.store.GetBatch(b.ID, nil)
+	if err != nil {
+		logger.Error("[Batch] 读取批处理 %s 失败: %v", b.ID, err)
+		return
+	}
+	run.setStatus(latest.Status)
+
+	switch latest.Status {
+	case model.BatchStatusCancelling:
+		r.finalize(latest, model.BatchStatusCancelled, "cancelled_at")
+		return
+	case model.BatchStatusFinalizing:
+		r.finalize(latest, model.BatchStatusCompleted, "completed_at")
+		return
+	case model.BatchStatusValidating:
+		ok, err := r.store.TransitionBatch(b.ID, []string{model.BatchStatusValidating}, map[string]interface{}{
+			"status":         model.BatchStatusInProgress,
+			"in_progress_at": time.Now(),
+		})
+		if err != nil {
+			logger.Error("[Batch] 更新批处理 %s 状态失败: %v", b.ID, err)
+			return
+		}
+		if !ok {
+			return // 状态已被取消请求修改，下一轮再处理
+		}
+		run.setStatus(model.BatchStatusInProgress)
+		logger.Info("[Batch] 开始执行批处理 %s (%d 个请求)", b.ID, b.TotalCount)
+	case model.BatchStatusInProgress:
+		logger.Info("[Batch] 继续执行批处理 %s", b.ID)
+	default:
+		return
+	}
+
+	if err := r.runItems(ctx, run); err != nil {
+		logger.Error("[Batch] 批处理 %s 执行失败: %v", b.ID, err)
+		lineErrors, _ := json.Marshal([]BatchLineError{{Code: "internal_error", Message: err.Error()}})
+		r.store.TransitionBatch(b.ID, []string{model.BatchStatusInProgress, model.BatchStatusCancelling}, map[string]interface{}{
+			"status":    model.BatchStatusFailed,
+			"failed_at": time.Now(),
+			"errors":    string(lineErrors),
+		})
+		return
+	}
+
+	switch {
+	case errors.Is(context.Cause(ctx), errBatchCancelled):
+		run.setStatus(model.BatchStatusCancelling)
+		r.finalize(latest, model.BatchStatusCancelled, "cancelled_at")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		if err := r.expireRemaining(run); err != nil {
+			logger.Error("[Batch] 记录批处理 %s 的过期请求失败: %v", b.ID, err)
+		}
+		r.finalize(latest, model.BatchStatusExpired, "expired_at")
+	default:
+		ok, err := r.store.TransitionBatch(b.ID, []string{model.BatchStatusInProgress}, map[string]interface{}{
+			"status":        model.BatchStatusFinalizing,
+			"finalizing_at": time.Now(),
+		})
+		if err != nil {
+			logger.Error("[Batch] 更新批处理 %s 状态失败: %v", b.ID, err)
+			return
+		}
+		if !ok {
+			r.finalize(latest, model.BatchStatusCancelled, "cancelled_at")
+			return
+		}
+		run.setStatus(model.BatchStatusFinalizing)
+		r.finalize(latest, model.BatchStatusCompleted, "completed_at")
+	}
+}
+
+// resultPaths 返回批处理的输出文件和错误文件路径
+func (r *BatchRunner) resultPaths(batchID string) (string, string) {
+	return filepath.Join(r.dir, batchID+"_output.jsonl"), filepath.Join(r.dir, batchID+"_error.jsonl")
+}
+
+// runItems 派发所有尚未完成的请求，直到全部完成或 ctx 被取消
+func (r *BatchRunner) runItems(ctx context.Context, run *batchRun) error {
+	b := run.batch
+	input, err := r.store.GetFile(b.InputFileID, nil)
+	if err != nil {
+		return fmt.Errorf("输入文件 %s 不可用: %w", b.InputFileID, err)
+	}
+
+	outPath, errPath := r.resultPaths(b.ID)
+	done, completed, failed, err := recoverBatchResults(outPath, errPath)
+	if err != nil {
+		return err
+	}
+	run.completed.Store(int32(completed))
+	run.failed.Store(int32(failed))
+	run.resumed = int32(completed + failed)
+
+	outFile, err := newResultWriter(outPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	errFile, err := newResultWriter(errPath)
+	if err != nil {
+		return err
+	}
+	defer errFile.Close()
+
+	stopFlush := make(chan struct{})
+	go r.flushCounts(run, stopFlush)
+	defer func() {
+		close(stopFlush)
+		r.store.UpdateBatchCounts(b.ID, int(run.completed.Load()), int(run.failed.Load()))
+	}()
+
+	var wg sync.WaitGroup
+	err = forEachJSONLine(input.Path, func(_ int, raw []byte) error {
+		var line batchRequestLine
+		if json.Unmarshal(raw, &line) != nil || done[line.CustomID] {
+			return nil
+		}
+		if !run.acquire(ctx, r.concurrencyLimit()) {
+			return errStopIteration
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer run.release()
+			r.execute(ctx, run, &line, outFile, errFile)
+		}()
+		return nil
+	})
+	wg.Wait()
+	if errors.Is(err, errStopIteration) {
+		return nil
+	}
+	return err
+}
+
+// execute 执行单个请求并将结果写入输出或错误文件。
+// 因批处理取消或过期而中断的请求不会被记录，以便之后重新执行或标记为过期。
+func (r *BatchRunner) execute(ctx context.Context, run *batchRun, line *batchRequestLine, outFile, errFile *resultWriter) {
+	result := &batchResultLine{ID: newObjectID("batch_req_"), CustomID: line.CustomID}
+	body, statusCode, err := r.call(ctx, run.batch.ClientID, run.batch.Endpoint, line.Body)
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	result.Response = &batchResultResponse{StatusCode: statusCode, RequestID: result.ID, Body: body}
+
+	target := outFile
+	if statusCode != http.StatusOK {
+		target = errFile
+	}
+	if werr := target.Write(result); werr != nil {
+		logger.Error("[Batch] 写入批处理 %s 的结果失败: %v", run.batch.ID, werr)
+		return
+	}
+	if target == outFile {
+		run.completed.Add(1)
+	} else {
+		run.failed.Add(1)
+		logger.Warn("[Batch] 批处理 %s 的请求 %s 失败: %v", run.batch.ID, line.CustomID, err)
+	}
+}
+
+// call 以创建批处理的客户端的身份将单个请求发往对应的接口，与在线请求一样经过内容脱敏、模型白名单和请求策略，返回响应体和 HTTP 状态码。
+// 模型被限流、熔断或返回 503 时会等待一段时间后重试，尽量不让夜间任务因短暂的容量不足而失败。
+func (r *BatchRunner) call(ctx context.Context, clientID uint, endpoint string, rawBody json.RawMessage) (interface{}, int, error) {
+	var client *model.Client
+	if clientID != 0 {
+		var ok bool
+		if client, ok = r.registry.FindClientByID(clientID); !ok {
+			err := fmt.Errorf("创建批处理的客户端 (ID: %d) 已被禁用或删除", clientID)
+			return batchErrorBody(err.Error(), "permission_error"), http.StatusForbidden, err
+		}
+	}
+	// 输入文件以 multipart 上传，不经过 RedactionMiddleware，在执行时按当前规则检查每个请求
+	rawBody, err := r.redactor.Filter(rawBody, "批处理请求")
+	if err != nil {
+		return model.OpenAIErrorResponse{Error: model.ErrorDetail{Message: err.Error(), Type: "invalid_request_error", Code: "sensitive_content"}}, http.StatusBadRequest, err
+	}
+	var req model.ChatCompletionRequest
+	if err := json.Unmarshal(rawBody, &req); err != nil {
+		return batchErrorBody(err.Error(), "invalid_request_error"), http.StatusBadRequest, err
+	}
+	if _, err := r.templates.Apply(&req); err != nil {
+		var reqErr *ChatRequestError
+		if errors.As(err, &reqErr) {
+			return batchErrorBody(err.Error(), "invalid_request_error"), http.StatusBadRequest, err
+		}
+		return batchErrorBody(err.Error(), "api_error"), http.StatusInternalServerError, err
+	}
+	resolved, err := r.registry.Resolve(client, req.Model)
+	var notAllowed *ModelNotAllowedError
+	if errors.As(err, &notAllowed) {
+		return batchErrorBody(err.Error(), "permission_error"), http.StatusForbidden, err
+	}
+	if err != nil {
+		return batchErrorBody(err.Error(), "invalid_request_error"), http.StatusNotFound, err
+	}
+	req.Model = resolved
+	r.policy.ApplyChat(client, &req)
+
+	for attempt := 1; ; attempt++ {
+		resp, err := r.genaiService.NonStreamChat(ctx, &req)
+		if err == nil {
+			return resp, http.StatusOK, nil
+		}
+		if _, transient := fallbackReason(err); !transient || attempt >= batchItemMaxAttempts || ctx.Err() != nil {
+			return batchFailureBody(err)
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * batchRetryDelay):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+// batchFailureBody 将上游调用错误转换为结果文件中的响应体和状态码
+func batchFailureBody(err error) (interface{}, int, error) {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		var body interface{}
+		if json.Unmarshal(upstreamErr.Body, &body) == nil {
+			return body, upstreamErr.StatusCode, err
+		}
+		return batchErrorBody(string(upstreamErr.Body), "api_error"), upstreamErr.StatusCode, err
+	}
+	var circuitErr *CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		return batchErrorBody(err.Error(), "api_error"), http.StatusServiceUnavailable, err
+	}
+	var (
+		fetchErr *MediaFetchError
+		reqErr   *ChatRequestError
+		limitErr *TokenLimitError
+	)
+	if errors.As(err, &fetchErr) || errors.As(err, &reqErr) || errors.As(err, &limitErr) {
+		return batchErrorBody(err.Error(), "invalid_request_error"), http.StatusBadRequest, err
+	}
+	if errors.Is(err, ErrAllKeysRateLimited) {
+		return batchErrorBody(err.Error(), "rate_limit_error"), http.StatusTooManyRequests, err
+	}
+	return batchErrorBody(err.Error(), "api_error"), http.StatusInternalServerError, err
+}
+
+func batchErrorBody(message, errType string) model.OpenAIErrorResponse {
+	return model.OpenAIErrorResponse{Error: model.ErrorDetail{Message: message, Type: errType}}
+}
+
+// expireRemaining 将过期时仍未完成的请求以 batch_expired 错误写入错误文件
+func (r *BatchRunner) expireRemaining(run *batchRun) error {
+	b := run.batch
+	input, err := r.store.GetFile(b.InputFileID, nil)
+	if err != nil {
+		return err
+	}
+	outPath, errPath := r.resultPaths(b.ID)
+	done, _, _, err := recoverBatchResults(outPath, errPath)
+	if err != nil {
+		return err
+	}
+	errFile, err := newResultWriter(errPath)
+	if err != nil {
+		return err
+	}
+	defer errFile.Close()
+
+	return forEachJSONLine(input.Path, func(_ int, raw []byte) error {
+		var line batchRequestLine
+		if json.Unmarshal(raw, &line) != nil || done[line.CustomID] {
+			return nil
+		}
+		result := &batchResultLine{
+			ID:       newObjectID("batch_req_"),
+			CustomID: line.CustomID,
+			Error:    &BatchLineError{Code: "batch_expired", Message: "该请求在批处理过期前未能执行"},
+		}
+		if err := errFile.Write(result); err != nil {
+			return err
+		}
+		run.failed.Add(1)
+		return nil
+	})
+}
+
+// finalize 登记输出/错误文件并将批处理置为最终状态
+func (r *BatchRunner) finalize(b *model.Batch, status, timestampColumn string) {
+	outPath, errPath := r.resultPaths(b.ID)
+	_, completed, failed, err := recoverBatchResults(outPath, errPath)
+	if err != nil {
+		logger.Error("[Batch] 读取批处理 %s 的结果失败: %v", b.ID, err)
+	}
+
+	updates := map[string]interface{}{
+		"status":          status,
+		timestampColumn:   time.Now(),
+		"completed_count": completed,
+		"failed_count":    failed,
+	}
+	var files []*model.BatchFile
+	register := func(path, suffix, column, existing string) {
+		info, err := os.Stat(path)
+		if existing != "" || err != nil || info.Size() == 0 {
+			return
+		}
+		file := &model.BatchFile{
+			ID:       newObjectID("file-"),
+			ClientID: b.ClientID,
+			Filename: b.ID + suffix,
+			Purpose:  "batch_output",
+			Bytes:    info.Size(),
+			Path:     path,
+		}
+		files = append(files, file)
+		updates[column] = file.ID
+	}
+	register(outPath, "_output.jsonl", "output_file_id", b.OutputFileID)
+	register(errPath, "_error.jsonl", "error_file_id", b.ErrorFileID)
+
+	if err := r.store.FinalizeBatch(b.ID, files, updates); err != nil {
+		logger.Error("[Batch] 更新批处理 %s 的最终状态失败: %v", b.ID, err)
+		return
+	}
+	logger.Info("[Batch] 批处理 %s 已结束: %s (成功 %d, 失败 %d)", b.ID, status, completed, failed)
+}
+
+// flushCounts 定期将请求计数写回数据库，直到 stop 被关闭
+func (r *BatchRunner) flushCounts(run *batchRun, stop <-chan struct{}) {
+	ticker := time.NewTicker(batchCountsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.store.UpdateBatchCounts(run.batch.ID, int(run.completed.Load()), int(run.failed.Load())); err != nil {
+				logger.Warn("[Batch] 更新批处理 %s 的进度失败: %v", run.batch.ID, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// concurrencyLimit 返回批处理允许的最大并发请求数: Key 池容量 × BATCH_POOL_FRACTION，至少为 1。
+// 池容量为 Key 数量乘以单 Key 并发上限；未限制单 Key 并发时按每个 Key 一个请求计算。
+func (r *BatchRunner) concurrencyLimit() int {
+	cfg := r.configManager.Get()
+	capacity := r.keyPool.Size()
+	if cfg.MaxConcurrentPerKey > 0 {
+		capacity *= cfg.MaxConcurrentPerKey
+	}
+	limit := int(float64(capacity) * cfg.BatchPoolFraction)
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// acquire 等待一个并发名额，ctx 被取消时返回 false
+func (run *batchRun) acquire(ctx context.Context, limit int) bool {
+	for {
+		run.mu.Lock()
+		run.concurrency = limit
+		if run.active < limit {
+			run.active++
+			run.mu.Unlock()
+			return true
+		}
+		run.mu.Unlock()
+
+		select {
+		case <-run.freed:
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (run *batchRun) setStatus(status string) {
+	run.mu.Lock()
+	run.status = status
+	run.mu.Unlock()
+}
+
+func (run *batchRun) release() {
+	run.mu.Lock()
+	run.active--
+	run.mu.Unlock()
+	select {
+	case run.freed <- struct{}{}:
+	default:
+	}
+}
+
+// ===================== 文件工具 =====================
+
+// errStopIteration 用于提前结束 forEachJSONLine
+var errStopIteration = errors.New("stop iteration")
+
+// forEachJSONLine 逐行读取 JSONL 文件 (跳过空行)，lineNo 从 1 开始
+func forEachJSONLine(path string, fn func(lineNo int, line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		raw, readErr := reader.ReadBytes('\n')
+		if line := bytes.TrimSpace(raw); len(line) > 0 {
+			if err := fn(lineNo, line); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// recoverBatchResults 读取已写入的输出/错误文件，返回已完成请求的 custom_id 集合以及成功和失败的数量。
+// 服务在写入过程中退出可能留下不完整的最后一行，这里会将其截断。
+func recoverBatchResults(outPath, errPath string) (map[string]bool, int, int, error) {
+	done := make(map[string]bool)
+	completed, err := recoverResultFile(outPath, done)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	failed, err := recoverResultFile(errPath, done)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return done, completed, failed, nil
+}
+
+func recoverResultFile(path string, done map[string]bool) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var validEnd int64
+	count := 0
+	for {
+		raw, readErr := reader.ReadBytes('\n')
+		var line struct {
+			CustomID string `json:"custom_id"`
+		}
+		if readErr == nil && json.Unmarshal(raw, &line) == nil {
+			done[line.CustomID] = true
+			count++
+			validEnd += int64(len(raw))
+			continue
+		}
+		if readErr != nil && readErr != io.EOF {
+			return 0, readErr
+		}
+		break
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > validEnd {
+		logger.Warn("[Batch] 截断结果文件 %s 中不完整的记录", path)
+		if err := f.Truncate(validEnd); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// resultWriter 以追加方式并发安全地写入 JSONL 结果文件
+type resultWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newResultWriter(path string) (*resultWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &resultWriter{f: f}, nil
+}
+
+func (w *resultWriter) Write(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.f.Write(append(line, '\n'))
+	return err
+}
+
+func (w *resultWriter) Close() error {
+	return w.f.Close()
+}
+
+// clientIDOf 返回客户端 ID，全局公共密钥 (client 为 nil) 对应 0
+func clientIDOf(client *model.Client) uint {
+	if client == nil {
+		return 0
+	}
+	return client.ID
+}
+
+// newObjectID 生成带前缀的随机对象 ID，如 file-xxxx、batch_xxxx
+func newObjectID(prefix string) string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%s%d", prefix, time.Now().UnixNano())
+	}
+	return prefix + hex.EncodeToString(buf)
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"fmt"
+	"gemini_polling/model"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestBatchRunner 创建只用于校验输入文件的 BatchRunner
+func newTestBatchRunner(t *testing.T, env ...string) *BatchRunner {
+	t.Helper()
+	manager := newTestConfigManager(t, append([]string{"BATCH_MAX_REQUESTS", "3", "REDACTION_MODE", "off"}, env...)...)
+	registry := newTestModelRegistry(t, []model.ModelEntry{{Name: "gemini-exp", Hidden: true}})
+	return NewBatchRunner(manager, nil, nil, registry, nil, nil, nil, NewRedactor(manager))
+}
+
+// writeJSONL 把 lines 写入临时的 JSONL 文件并返回路径
+func writeJSONL(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// batchLine 生成一行请求，body 为 chat/completions 请求体
+func batchLine(customID, body string) string {
+	return fmt.Sprintf(`{"custom_id":%q,"method":"POST","url":"/v1/chat/completions","body":%s}`, customID, body)
+}
+
+func TestBatchValidateInput(t *testing.T) {
+	const chat = `{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name      string
+		env       []string
+		client    *model.Client
+		lines     []string
+		wantTotal int
+		want      []string // 按顺序排列的 "行号:错误码"
+	}{
+		{
+			name:      "valid file with blank lines",
+			lines:     []string{batchLine("a", chat), "", "   ", batchLine("b", chat)},
+			wantTotal: 2,
+		},
+		{
+			name:      "invalid JSON",
+			lines:     []string{batchLine("a", chat), `{"custom_id":`},
+			wantTotal: 2,
+			want:      []string{"2:invalid_json_line"},
+		},
+		{
+			name:      "missing and duplicate custom_id",
+			lines:     []string{batchLine("", chat), batchLine("a", chat), batchLine("a", chat)},
+			wantTotal: 3,
+			want:      []string{"1:missing_required_parameter", "3:duplicate_custom_id"},
+		},
+		{
+			name: "method and url must match the batch",
+			lines: []string{
+				`{"custom_id":"a","method":"GET","url":"/v1/chat/completions","body":` + chat + `}`,
+				`{"custom_id":"b","method":"POST","url":"/v1/embeddings","body":` + chat + `}`,
+			},
+			wantTotal: 2,
+			want:      []string{"1:invalid_method", "2:invalid_url"},
+		},
+		{
+			name: "body checks",
+			lines: []string{
+				batchLine("a", `{"messages":[]}`),
+				batchLine("b", `"not an object"`),
+				batchLine("c", `{"model":"gemini-2.5-flash","stream":true}`),
+			},
+			wantTotal: 3,
+			want:      []string{"1:missing_required_parameter", "2:missing_required_parameter", "3:invalid_request"},
+		},
+		{
+			name:      "hidden model",
+			lines:     []string{batchLine("a", `{"model":"gemini-exp"}`)},
+			wantTotal: 1,
+			want:      []string{"1:model_not_found"},
+		},
+		{
+			name:      "model outside the client allowlist",
+			client:    &model.Client{Name: "team", AllowedModels: "gemini-2.5-pro"},
+			lines:     []string{batchLine("a", chat)},
+			wantTotal: 1,
+			want:      []string{"1:model_not_found"},
+		},
+		{
+			name:      "sensitive content in block mode",
+			env:       []string{"REDACTION_MODE", "block"},
+			lines:     []string{batchLine("a", chat), batchLine("b", `{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"mail bob@example.com"}]}`)},
+			wantTotal: 2,
+			want:      []string{"2:sensitive_content"},
+		},
+		{
+			name:      "sensitive content is accepted in redact mode",
+			env:       []string{"REDACTION_MODE", "redact"},
+			lines:     []string{batchLine("a", `{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"mail bob@example.com"}]}`)},
+			wantTotal: 1,
+		},
+		{
+			name:      "empty file",
+			lines:     []string{"", ""},
+			wantTotal: 0,
+			want:      []string{"0:empty_file"},
+		},
+		{
+			name:      "too many requests",
+			lines:     []string{batchLine("a", chat), batchLine("b", chat), batchLine("c", chat), batchLine("d", chat)},
+			wantTotal: 4,
+			want:      []string{"0:too_many_requests"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestBatchRunner(t, tt.env...)
+			total, lineErrors, err := r.validateInput(tt.client, writeJSONL(t, tt.lines...), "/v1/chat/completions")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range lineErrors {
+				got = append(got, fmt.Sprintf("%d:%s", e.Line, e.Code))
+			}
+			if total != tt.wantTotal || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateInput = %d, %v, want %d, %v", total, got, tt.wantTotal, tt.want)
+			}
+		})
+	}
+
+	t.Run("error list is capped", func(t *testing.T) {
+		r := newTestBatchRunner(t, "BATCH_MAX_REQUESTS", "1000")
+		lines := make([]string, batchMaxLineErrors+20)
+		for i := range lines {
+			lines[i] = "not json"
+		}
+		total, lineErrors, err := r.validateInput(nil, writeJSONL(t, lines...), "/v1/chat/completions")
+		if err != nil || total != len(lines) || len(lineErrors) != batchMaxLineErrors {
+			t.Errorf("validateInput = %d, %d errors, %v", total, len(lineErrors), err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		r := newTestBatchRunner(t)
+		if _, _, err := r.validateInput(nil, filepath.Join(t.TempDir(), "missing.jsonl"), "/v1/chat/completions"); err == nil {
+			t.Error("validateInput succeeded on a missing file")
+		}
+	})
+}
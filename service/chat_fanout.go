@@ -0,0 +1,234 @@
+// service/chat_fanout.go
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ChatRequestError 表示 chat/completions 的请求参数无效
+type ChatRequestError struct {
+	Param   string
+	Message string
+}
+
+func (e *ChatRequestError) Error() string {
+	return e.Message
+}
+
+// choiceParts 校验 n，并在 n 超过单次调用的候选数上限 (CHAT_CANDIDATES_PER_CALL) 时
+// 返回拆分后每个上游调用的候选数；不需要拆分时返回 nil
+func (s *GenAIService) choiceParts(n int) ([]int, error) {
+	cfg := s.configManager.Get()
+	if n < 0 || n > cfg.ChatMaxN {
+		return nil, &ChatRequestError{Param: "n", Message: fmt.Sprintf("n 必须在 1 到 %d 之间", cfg.ChatMaxN)}
+	}
+	perCall := max(cfg.ChatCandidatesPerCall, 1)
+	if n <= perCall {
+		return nil, nil
+	}
+	var parts []int
+	for ; n > 0; n -= perCall {
+		parts = append(parts, min(n, perCall))
+	}
+	return parts, nil
+}
+
+// partRequest 返回请求 count 个候选的子请求
+func partRequest(req *model.ChatCompletionRequest, count int) *model.ChatCompletionRequest {
+	part := *req
+	part.N = count
+	if count == 1 {
+		part.N = 0
+	}
+	return &part
+}
+
+// fanOut 以最多 limit 的并发执行 count 个上游调用。每个调用使用独立的 ResponseMeta 以免并发写入，
+// 结束后把第一个调用的模型信息合并回 ctx 中的 ResponseMeta。
+// 任一调用失败时取消其余调用，并返回最先失败的调用的错误。
+func fanOut(ctx context.Context, count, limit int, run func(ctx context.Context, i int) error) error {
+	ctx, parent := ensureResponseMeta(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	metas := make([]*ResponseMeta, count)
+	errs := make([]error, count)
+	sem := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		partCtx, meta := WithResponseMeta(ctx)
+		metas[i] = meta
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := run(partCtx, i); err != nil {
+				errs[i] = err
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if metas[0].ServedModel != "" {
+		parent.RequestedModel = metas[0].RequestedModel
+		parent.ServedModel = metas[0].ServedModel
+	}
+	// 被取消的调用返回 context.Canceled，优先返回真正导致失败的错误
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// fanOutChat 把非流式请求拆分为多个并行的上游请求 (GetKey 按最少负载选择，并行请求会落在不同的 Key 上)，
+// 按拆分顺序合并 choices 并重新编号 index，usage 为各请求之和
+func (s *GenAIService) fanOutChat(ctx context.Context, req *model.ChatCompletionRequest, parts []int) (*model.OpenAICompletionResponse, error) {
+	logger.Info("n=%d 超过单次调用的候选数上限，拆分为 %d 个并行请求", req.N, len(parts))
+	results := make([]*model.OpenAICompletionResponse, len(parts))
+	err := fanOut(ctx, len(parts), len(parts), func(ctx context.Context, i int) error {
+		resp, err := s.nonStreamChat(ctx, partRequest(req, parts[i]))
+		results[i] = resp
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	merged := *results[0]
+	merged.Choices = make([]model.CompletionChoice, 0, req.N)
+	merged.Usage = model.Usage{}
+	offset := 0
+	for i, resp := range results {
+		for _, choice := range resp.Choices {
+			choice.Index += offset
+			merged.Choices = append(merged.Choices, choice)
+		}
+		offset += parts[i]
+		merged.Usage.PromptTokens += resp.Usage.PromptTokens
+		merged.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		merged.Usage.TotalTokens += resp.Usage.TotalTokens
+	}
+	return &merged, nil
+}
+
+// fanOutStreamChat 把流式请求拆分为多个并行的上游流，各个流的 chunk 到达后立即交错写给客户端:
+// chunk 使用统一的 id，choice 的 index 按拆分顺序重新编号。
+// 各个流中的 usage 被移除，全部结束后合并为一个只包含 usage 的 chunk 再发送 [DONE]。
+func (s *GenAIService) fanOutStreamChat(ctx context.Context, w, out io.Writer, flusher http.Flusher, req *model.ChatCompletionRequest, parts []int) error {
+	logger.Info("n=%d 超过单次调用的候选数上限，拆分为 %d 个并行流式请求", req.N, len(parts))
+	ctx, parent := ensureResponseMeta(ctx)
+	id, created := newObjectID("chatcmpl-"), time.Now().Unix()
+
+	var (
+		mu       sync.Mutex
+		started  bool
+		usage    *model.Usage
+		lastSeen string // 最后一个 chunk 的模型名，用于 usage chunk
+	)
+	offsets := make([]int, len(parts))
+	for i := 1; i < len(parts); i++ {
+		offsets[i] = offsets[i-1] + parts[i-1]
+	}
+
+	err := fanOut(ctx, len(parts), len(parts), func(partCtx context.Context, i int) error {
+		partOut := &sseDataWriter{onData: func(data []byte) error {
+			var chunk chatStreamChunk
+			if err := json.Unmarshal(data, &chunk); err != nil {
+				logger.Warn("忽略无法解析的流式 chunk: %v", err)
+				return nil
+			}
+			chunk.ID = id
+			chunk.Object = "chat.completion.chunk"
+			chunk.Created = created
+			for j := range chunk.Choices {
+				chunk.Choices[j].Index += offsets[i]
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			lastSeen = chunk.Model
+			if chunk.Usage != nil {
+				if usage == nil {
+					usage = &model.Usage{}
+				}
+				usage.PromptTokens += chunk.Usage.PromptTokens
+				usage.CompletionTokens += chunk.Usage.CompletionTokens
+				usage.TotalTokens += chunk.Usage.TotalTokens
+				chunk.Usage = nil
+				if len(chunk.Choices) == 0 {
+					return nil
+				}
+			}
+			if !started {
+				// 第一个写出的 chunk 决定响应头中的模型信息
+				started = true
+				meta := responseMetaFrom(partCtx)
+				parent.RequestedModel, parent.ServedModel = meta.RequestedModel, meta.ServedModel
+				applyStreamHeaders(ctx, w)
+			}
+			return writeSSEData(out, flusher, chunk)
+		}}
+		return s.streamChat(partCtx, partOut, partOut, partOut, partRequest(req, parts[i]))
+	})
+	if err != nil {
+		return err
+	}
+
+	if !started {
+		applyStreamHeaders(ctx, w)
+	}
+	if usage != nil {
+		final := chatStreamChunk{
+			ChatCompletionStreamResponse: model.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   lastSeen,
+				Choices: []model.Choice{},
+			},
+			Usage: usage,
+		}
+		if err := writeSSEData(out, flusher, final); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(out, "data: [DONE]\n\n"); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// writeSSEData 把 v 序列化为一个 SSE data 事件写出并立即刷新
+func writeSSEData(out io.Writer, flusher http.Flusher, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(out, "data: %s\n\n", data); err != nil {
+		logger.Warn("写入响应流失败: %v (客户端可能已断开连接)", err)
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFanOutTestService 创建每次调用最多返回 2 个候选的 GenAIService，上游是一个 OpenAI 兼容的替身:
+// 按请求中的 n 返回对应数量的 choice，每个 choice 消耗 3 个 completion token；failSingle 时只请求 1 个候选的调用返回 503
+func newFanOutTestService(t *testing.T, failSingle bool) (*GenAIService, func() []recordedRequest) {
+	t.Helper()
+	t.Setenv("CHAT_CANDIDATES_PER_CALL", "2")
+	t.Setenv("MAX_RETRIES", "1")
+	upstream, requests := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req model.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		count := max(req.N, 1)
+		if failSingle && req.N == 0 {
+			http.Error(w, `{"error":{"message":"overloaded"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		usage := model.Usage{PromptTokens: 10, CompletionTokens: 3 * count, TotalTokens: 10 + 3*count}
+		if !req.Stream {
+			resp := model.OpenAICompletionResponse{ID: "chatcmpl-upstream", Object: "chat.completion", Model: req.Model, Usage: usage}
+			for i := 0; i < count; i++ {
+				resp.Choices = append(resp.Choices, model.CompletionChoice{Index: i, Message: model.Message{Role: "assistant", Content: fmt.Sprintf("answer %d of %d", i, count)}, FinishReason: "stop"})
+			}
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < count; i++ {
+			chunk := chatStreamChunk{ChatCompletionStreamResponse: model.ChatCompletionStreamResponse{
+				ID: "chatcmpl-upstream", Object: "chat.completion.chunk", Model: req.Model,
+				Choices: []model.Choice{{Index: i, Delta: model.Delta{Content: fmt.Sprintf("answer %d of %d", i, count)}, FinishReason: "stop"}},
+			}}
+			data, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		data, _ := json.Marshal(chatStreamChunk{ChatCompletionStreamResponse: model.ChatCompletionStreamResponse{ID: "chatcmpl-upstream", Model: req.Model, Choices: []model.Choice{}}, Usage: &usage})
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+	})
+	key := model.APIKey{ID: 1, Provider: model.ProviderOpenAI, Key: "sk-upstream", BaseURL: upstream.URL, Models: "gemini-*"}
+	return newTestGenAIService(t, key), requests
+}
+
+func fanOutTestRequest(n int) *model.ChatCompletionRequest {
+	return &model.ChatCompletionRequest{Model: "gemini-2.5-flash", N: n, Messages: []model.Message{{Role: "user", Content: "hi"}}}
+}
+
+func TestChoiceParts(t *testing.T) {
+	s, _ := newFanOutTestService(t, false)
+	tests := []struct {
+		n       int
+		want    []int
+		wantErr bool
+	}{
+		{n: 0},
+		{n: 2},
+		{n: 3, want: []int{2, 1}},
+		{n: 8, want: []int{2, 2, 2, 2}},
+		{n: 9, wantErr: true},
+		{n: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		parts, err := s.choiceParts(tt.n)
+		if tt.wantErr {
+			var reqErr *ChatRequestError
+			if !errors.As(err, &reqErr) || reqErr.Param != "n" {
+				t.Errorf("choiceParts(%d) error = %v, want a ChatRequestError on n", tt.n, err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(parts) != fmt.Sprint(tt.want) {
+			t.Errorf("choiceParts(%d) = %v, %v; want %v", tt.n, parts, err, tt.want)
+		}
+	}
+}
+
+func TestFanOutChat(t *testing.T) {
+	s, requests := newFanOutTestService(t, false)
+	result, err := s.NonStreamChat(context.Background(), fanOutTestRequest(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := result.(*model.OpenAICompletionResponse)
+
+	if got := len(requests()); got != 3 {
+		t.Fatalf("upstream calls = %d, want 3 (2+2+1)", got)
+	}
+	// choice 按拆分顺序重新编号，各部分内部的顺序保持不变
+	wantContents := []string{"answer 0 of 2", "answer 1 of 2", "answer 0 of 2", "answer 1 of 2", "answer 0 of 1"}
+	if len(resp.Choices) != len(wantContents) {
+		t.Fatalf("got %d choices, want %d", len(resp.Choices), len(wantContents))
+	}
+	for i, choice := range resp.Choices {
+		if choice.Index != i || choice.Message.Content != wantContents[i] {
+			t.Errorf("choice %d = index %d %v, want index %d %q", i, choice.Index, choice.Message.Content, i, wantContents[i])
+		}
+	}
+	// usage 是各部分之和
+	want := model.Usage{PromptTokens: 30, CompletionTokens: 15, TotalTokens: 45}
+	if resp.Usage != want {
+		t.Errorf("usage = %+v, want %+v", resp.Usage, want)
+	}
+}
+
+func TestFanOutStreamChat(t *testing.T) {
+	s, requests := newFanOutTestService(t, false)
+	w := httptest.NewRecorder()
+	if err := s.StreamChat(context.Background(), w, fanOutTestRequest(5)); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(requests()); got != 3 {
+		t.Fatalf("upstream calls = %d, want 3 (2+2+1)", got)
+	}
+
+	body := w.Body.String()
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") || strings.Count(body, "[DONE]") != 1 {
+		t.Fatalf("stream must end with exactly one [DONE]: %s", body)
+	}
+	ids := make(map[string]bool)
+	indexes := make(map[int]int)
+	var usages []model.Usage
+	for _, event := range strings.Split(strings.TrimSuffix(body, "data: [DONE]\n\n"), "\n\n") {
+		data, ok := strings.CutPrefix(event, "data: ")
+		if !ok {
+			continue
+		}
+		var chunk chatStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		ids[chunk.ID] = true
+		for _, choice := range chunk.Choices {
+			indexes[choice.Index]++
+		}
+		if chunk.Usage != nil {
+			if len(chunk.Choices) != 0 {
+				t.Errorf("usage chunk carries choices: %s", data)
+			}
+			usages = append(usages, *chunk.Usage)
+		}
+	}
+
+	// 所有 chunk 使用同一个 id，index 0..4 各出现一次
+	if len(ids) != 1 || ids["chatcmpl-upstream"] {
+		t.Errorf("chunk ids = %v, want one id minted by the proxy", ids)
+	}
+	for i := 0; i < 5; i++ {
+		if indexes[i] != 1 {
+			t.Errorf("choice index %d appeared %d times, want 1 (all: %v)", i, indexes[i], indexes)
+		}
+	}
+	// 各个流的 usage 合并为最后一个 chunk
+	want := model.Usage{PromptTokens: 30, CompletionTokens: 15, TotalTokens: 45}
+	if len(usages) != 1 || usages[0] != want {
+		t.Errorf("usage chunks = %+v, want one %+v", usages, want)
+	}
+}
+
+func TestFanOutPartialFailure(t *testing.T) {
+	t.Run("non-stream", func(t *testing.T) {
+		s, requests := newFanOutTestService(t, true)
+		result, err := s.NonStreamChat(context.Background(), fanOutTestRequest(5))
+		if err == nil {
+			t.Fatalf("got %+v, want the failed part's error instead of a partial response", result)
+		}
+		if !strings.Contains(err.Error(), "503") && !strings.Contains(err.Error(), "overloaded") {
+			t.Errorf("error = %v, want the upstream 503", err)
+		}
+		if len(requests()) == 0 {
+			t.Error("no upstream calls were made")
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		s, _ := newFanOutTestService(t, true)
+		w := httptest.NewRecorder()
+		err := s.StreamChat(context.Background(), w, fanOutTestRequest(5))
+		if err == nil {
+			t.Fatal("StreamChat succeeded with a failed part")
+		}
+		// 失败的流不能以 [DONE] 结束，否则客户端会把缺少 choice 的结果当作完整响应
+		if strings.Contains(w.Body.String(), "[DONE]") {
+			t.Errorf("stream reported [DONE] after a part failed: %s", w.Body.String())
+		}
+	})
+}
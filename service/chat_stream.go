@@ -0,0 +1,68 @@
+// service/chat_stream.go
+package service
+
+import (
+	"bytes"
+	"gemini_polling/model"
+	"strings"
+)
+
+// chatStreamChunk 是 OpenAI 兼容接口 SSE 流中的一个 chunk，最后一个 chunk 可能带有 usage
+type chatStreamChunk struct {
+	model.ChatCompletionStreamResponse
+	Usage *model.Usage `json:"usage,omitempty"`
+}
+
+// sseDataWriter 解析 StreamChat / StreamGenerateContent 写出的 SSE 流，把每个 data 字段交给 onData，
+// 供需要把上游流转换成其他协议的接口使用。onData 返回错误时视为客户端已断开。
+type sseDataWriter struct {
+	buf    []byte
+	onData func(data []byte) error
+}
+
+func (w *sseDataWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := strings.TrimSpace(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+
+		data, ok := strings.CutPrefix(line, "data:")
+		data = strings.TrimSpace(data)
+		if !ok || data == "" || data == "[DONE]" {
+			continue
+		}
+		if err := w.onData([]byte(data)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush 满足 StreamChat 等对 http.Flusher 的要求，转换后的数据由 onData 自行刷新
+func (w *sseDataWriter) Flush() {}
+
+// finishReasonOf 返回 chunk 中的 finish_reason，未结束时为空
+func finishReasonOf(choice model.Choice) string {
+	reason, _ := choice.FinishReason.(string)
+	return reason
+}
+
+// mergeToolCallDeltas 把流式返回的工具调用片段合并到 calls 中:
+// 带 id 的片段开始一个新的调用，不带 id 的片段追加到上一个调用的参数
+func mergeToolCallDeltas(calls []model.ToolCall, deltas []model.ToolCall) []model.ToolCall {
+	for _, delta := range deltas {
+		if delta.ID != "" || len(calls) == 0 {
+			calls = append(calls, delta)
+			continue
+		}
+		last := &calls[len(calls)-1]
+		if delta.Function.Name != "" {
+			last.Function.Name = delta.Function.Name
+		}
+		last.Function.Arguments += delta.Function.Arguments
+	}
+	return calls
+}
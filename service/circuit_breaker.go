@@ -0,0 +1,250 @@
+// service/circuit_breaker.go
+package service
+
+import (
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 熔断器状态
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// circuitBuckets 是统计窗口被划分成的桶数
+const circuitBuckets = 6
+
+// breakerOutcome 是一次上游调用对熔断器的意义
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota // 上游正常响应
+	outcomeFailure                       // 5xx 或超时，计入熔断统计
+	outcomeIgnored                       // 与模型健康无关的结果 (429、Key 无效、客户端取消等)
+)
+
+// CircuitOpenError 在模型的熔断器处于打开状态时返回
+type CircuitOpenError struct {
+	Model      string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("模型 %s 的上游服务暂时不可用 (熔断中)，请在 %d 秒后重试", e.Model, e.RetryAfterSeconds())
+}
+
+// RetryAfterSeconds 返回建议客户端等待的秒数 (至少 1 秒)
+func (e *CircuitOpenError) RetryAfterSeconds() int {
+	secs := int((e.RetryAfter + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// CircuitStatus 用于向管理后台展示单个熔断器的状态
+type CircuitStatus struct {
+	Model       string    `json:"model"`
+	State       string    `json:"state"`
+	Requests    int       `json:"window_requests"`
+	Failures    int       `json:"window_failures"`
+	OpenedAt    time.Time `json:"opened_at,omitempty"`
+	RetryAfter  int       `json:"retry_after_seconds,omitempty"`
+	TotalOpened int       `json:"total_opened"`
+}
+
+type circuitBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+// circuitBreaker 跟踪单个模型的上游失败率
+type circuitBreaker struct {
+	state          string
+	buckets        [circuitBuckets]circuitBucket
+	openedAt       time.Time
+	probesInFlight int
+	totalOpened    int
+}
+
+// CircuitBreakers 为每个模型维护一个独立的熔断器。
+// 当某个模型在统计窗口内的 5xx/超时比例过高时熔断器打开，请求直接失败；
+// 打开一段时间后进入半开状态，只放行少量探测请求，探测成功则恢复。
+type CircuitBreakers struct {
+	configManager *config.Manager
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+// NewCircuitBreakers creates a new per-model circuit breaker registry.
+func NewCircuitBreakers(manager *config.Manager) *CircuitBreakers {
+	return &CircuitBreakers{
+		configManager: manager,
+		breakers:      make(map[string]*circuitBreaker),
+	}
+}
+
+// Allow 判断是否允许向指定模型发送请求。熔断打开时返回 *CircuitOpenError。
+func (cb *CircuitBreakers) Allow(modelName string) error {
+	cfg := cb.configManager.Get()
+	if !cfg.CircuitBreakerEnabled {
+		return nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.breakers[modelName]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	if b.state == CircuitOpen {
+		if elapsed := now.Sub(b.openedAt); elapsed < cfg.CircuitOpenDuration {
+			return &CircuitOpenError{Model: modelName, RetryAfter: cfg.CircuitOpenDuration - elapsed}
+		}
+		b.state = CircuitHalfOpen
+		b.probesInFlight = 0
+		logger.Info("[熔断器] 模型 %s 进入半开状态，开始放行探测请求", modelName)
+	}
+
+	if b.state == CircuitHalfOpen {
+		if b.probesInFlight >= cfg.CircuitHalfOpenProbes {
+			return &CircuitOpenError{Model: modelName, RetryAfter: time.Second}
+		}
+		b.probesInFlight++
+	}
+	return nil
+}
+
+// Record 记录一次已被 Allow 放行的调用结果
+func (cb *CircuitBreakers) Record(modelName string, outcome breakerOutcome) {
+	cfg := cb.configManager.Get()
+	if !cfg.CircuitBreakerEnabled {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.breakers[modelName]
+	if !ok {
+		if outcome != outcomeFailure {
+			return // 只有出现失败时才需要开始跟踪
+		}
+		b = &circuitBreaker{state: CircuitClosed}
+		cb.breakers[modelName] = b
+	}
+
+	now := time.Now()
+	switch b.state {
+	case CircuitHalfOpen:
+		if b.probesInFlight > 0 {
+			b.probesInFlight--
+		}
+		switch outcome {
+		case outcomeSuccess:
+			b.state = CircuitClosed
+			b.buckets = [circuitBuckets]circuitBucket{}
+			logger.Info("[熔断器] 模型 %s 探测请求成功，熔断器已关闭", modelName)
+		case outcomeFailure:
+			cb.open(modelName, b, now)
+		}
+	case CircuitClosed:
+		if outcome == outcomeIgnored {
+			return
+		}
+		bucket := b.bucketFor(now, cfg.CircuitWindow)
+		bucket.total++
+		if outcome == outcomeFailure {
+			bucket.failures++
+			total, failures := b.windowCounts(now, cfg.CircuitWindow)
+			if total >= cfg.CircuitMinRequests && float64(failures)/float64(total) >= cfg.CircuitFailureThreshold {
+				cb.open(modelName, b, now)
+			}
+		}
+	}
+}
+
+// open 将熔断器切换到打开状态
+func (cb *CircuitBreakers) open(modelName string, b *circuitBreaker, now time.Time) {
+	b.state = CircuitOpen
+	b.openedAt = now
+	b.probesInFlight = 0
+	b.totalOpened++
+	logger.Warn("[熔断器] 模型 %s 上游失败率过高，熔断器已打开，将在 %v 后尝试恢复",
+		modelName, cb.configManager.Get().CircuitOpenDuration)
+}
+
+// bucketFor 返回当前时间所在的统计桶，过期的桶会被重置
+func (b *circuitBreaker) bucketFor(now time.Time, window time.Duration) *circuitBucket {
+	width := window / circuitBuckets
+	if width <= 0 {
+		width = time.Second
+	}
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%circuitBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+	return bucket
+}
+
+// windowCounts 汇总统计窗口内的请求数和失败数
+func (b *circuitBreaker) windowCounts(now time.Time, window time.Duration) (total, failures int) {
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < window {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+	return total, failures
+}
+
+// Reset 手动关闭指定模型的熔断器
+func (cb *CircuitBreakers) Reset(modelName string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if _, ok := cb.breakers[modelName]; !ok {
+		return false
+	}
+	delete(cb.breakers, modelName)
+	logger.Info("[熔断器] 模型 %s 的熔断器已被手动重置", modelName)
+	return true
+}
+
+// Statuses 返回所有已跟踪模型的熔断器状态
+func (cb *CircuitBreakers) Statuses() []CircuitStatus {
+	cfg := cb.configManager.Get()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	results := make([]CircuitStatus, 0, len(cb.breakers))
+	for name, b := range cb.breakers {
+		status := CircuitStatus{Model: name, State: b.state, TotalOpened: b.totalOpened}
+		status.Requests, status.Failures = b.windowCounts(now, cfg.CircuitWindow)
+		if b.state != CircuitClosed {
+			status.OpenedAt = b.openedAt
+		}
+		if b.state == CircuitOpen {
+			if remaining := cfg.CircuitOpenDuration - now.Sub(b.openedAt); remaining > 0 {
+				status.RetryAfter = (&CircuitOpenError{RetryAfter: remaining}).RetryAfterSeconds()
+			}
+		}
+		results = append(results, status)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Model < results[j].Model })
+	return results
+}
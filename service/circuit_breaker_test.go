@@ -0,0 +1,189 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const modelName = "gemini-2.5-pro"
+	// 每一步对熔断器执行一个操作，然后检查状态
+	type step struct {
+		allow   bool           // 调用 Allow 并检查是否被拒绝
+		record  breakerOutcome // allow 为 false 时调用 Record
+		elapse  time.Duration  // 不为 0 时把打开时间往前拨，模拟时间流逝
+		reject  bool           // Allow 应当返回 CircuitOpenError
+		state   string         // 操作后的状态，空表示尚未跟踪该模型
+		opened  int            // 操作后累计打开次数
+		records int            // 连续执行 Record 的次数
+	}
+	allow := func(reject bool, state string, opened int) step {
+		return step{allow: true, reject: reject, state: state, opened: opened}
+	}
+	record := func(outcome breakerOutcome, times int, state string, opened int) step {
+		return step{record: outcome, records: times, state: state, opened: opened}
+	}
+	elapse := func(d time.Duration, state string, opened int) step {
+		return step{elapse: d, state: state, opened: opened}
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "successes alone are not tracked",
+			steps: []step{
+				record(outcomeSuccess, 20, "", 0),
+				record(outcomeIgnored, 20, "", 0),
+				allow(false, "", 0),
+			},
+		},
+		{
+			name: "opens once the failure ratio reaches the threshold after the minimum requests",
+			steps: []step{
+				record(outcomeFailure, 3, CircuitClosed, 0), // 少于 CIRCUIT_MIN_REQUESTS
+				record(outcomeSuccess, 3, CircuitClosed, 0),
+				record(outcomeFailure, 1, CircuitOpen, 1), // 4/7 >= 0.5
+				allow(true, CircuitOpen, 1),
+			},
+		},
+		{
+			name: "stays closed below the threshold",
+			steps: []step{
+				record(outcomeFailure, 1, CircuitClosed, 0),
+				record(outcomeSuccess, 9, CircuitClosed, 0),
+				record(outcomeFailure, 3, CircuitClosed, 0), // 4/13 < 0.5
+				allow(false, CircuitClosed, 0),
+			},
+		},
+		{
+			name: "ignored outcomes do not count",
+			steps: []step{
+				record(outcomeFailure, 1, CircuitClosed, 0),
+				record(outcomeIgnored, 50, CircuitClosed, 0),
+				record(outcomeFailure, 3, CircuitOpen, 1), // 4/4
+			},
+		},
+		{
+			name: "half-open probe success closes",
+			steps: []step{
+				record(outcomeFailure, 4, CircuitOpen, 1),
+				elapse(31*time.Second, CircuitOpen, 1),
+				allow(false, CircuitHalfOpen, 1), // 探测请求
+				allow(true, CircuitHalfOpen, 1),  // 超过 CIRCUIT_HALF_OPEN_PROBES
+				record(outcomeSuccess, 1, CircuitClosed, 1),
+				allow(false, CircuitClosed, 1),
+				// 关闭时清空了统计，需要重新积累到最小请求数
+				record(outcomeFailure, 3, CircuitClosed, 1),
+			},
+		},
+		{
+			name: "half-open probe failure reopens",
+			steps: []step{
+				record(outcomeFailure, 4, CircuitOpen, 1),
+				elapse(31*time.Second, CircuitOpen, 1),
+				allow(false, CircuitHalfOpen, 1),
+				record(outcomeFailure, 1, CircuitOpen, 2),
+				allow(true, CircuitOpen, 2),
+			},
+		},
+		{
+			name: "ignored probe result frees the probe slot",
+			steps: []step{
+				record(outcomeFailure, 4, CircuitOpen, 1),
+				elapse(31*time.Second, CircuitOpen, 1),
+				allow(false, CircuitHalfOpen, 1),
+				record(outcomeIgnored, 1, CircuitHalfOpen, 1),
+				allow(false, CircuitHalfOpen, 1),
+			},
+		},
+		{
+			name: "failures outside the window are forgotten",
+			steps: []step{
+				record(outcomeFailure, 3, CircuitClosed, 0),
+				elapse(2*time.Minute, CircuitClosed, 0),
+				record(outcomeFailure, 1, CircuitClosed, 0),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := NewCircuitBreakers(newTestConfigManager(t,
+				"CIRCUIT_MIN_REQUESTS", "4",
+				"CIRCUIT_FAILURE_THRESHOLD", "0.5",
+				"CIRCUIT_WINDOW_SECONDS", "60",
+				"CIRCUIT_OPEN_SECONDS", "30",
+				"CIRCUIT_HALF_OPEN_PROBES", "1",
+			))
+			for i, s := range tt.steps {
+				switch {
+				case s.allow:
+					err := cb.Allow(modelName)
+					var openErr *CircuitOpenError
+					if rejected := errors.As(err, &openErr); rejected != s.reject {
+						t.Fatalf("step %d: Allow = %v, want rejected=%v", i, err, s.reject)
+					}
+				case s.elapse != 0:
+					b := cb.breakers[modelName]
+					b.openedAt = b.openedAt.Add(-s.elapse)
+					for j := range b.buckets {
+						b.buckets[j].start = b.buckets[j].start.Add(-s.elapse)
+					}
+				default:
+					for n := 0; n < s.records; n++ {
+						cb.Record(modelName, s.record)
+					}
+				}
+
+				state, opened := "", 0
+				if b, ok := cb.breakers[modelName]; ok {
+					state, opened = b.state, b.totalOpened
+				}
+				if state != s.state || opened != s.opened {
+					t.Fatalf("step %d: state %q opened %d, want %q %d", i, state, opened, s.state, s.opened)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDisabledAndReset(t *testing.T) {
+	cb := NewCircuitBreakers(newTestConfigManager(t, "CIRCUIT_BREAKER_ENABLED", "false", "CIRCUIT_MIN_REQUESTS", "1"))
+	cb.Record("m", outcomeFailure)
+	if err := cb.Allow("m"); err != nil || len(cb.Statuses()) != 0 {
+		t.Fatalf("disabled breaker tracked the model: %v %v", err, cb.Statuses())
+	}
+
+	cb = NewCircuitBreakers(newTestConfigManager(t, "CIRCUIT_BREAKER_ENABLED", "true", "CIRCUIT_MIN_REQUESTS", "1", "CIRCUIT_OPEN_SECONDS", "30"))
+	cb.Record("m", outcomeFailure)
+	var openErr *CircuitOpenError
+	if err := cb.Allow("m"); !errors.As(err, &openErr) || openErr.RetryAfterSeconds() < 29 || openErr.RetryAfterSeconds() > 30 {
+		t.Fatalf("Allow = %v", err)
+	}
+	statuses := cb.Statuses()
+	if len(statuses) != 1 || statuses[0].State != CircuitOpen || statuses[0].Failures != 1 || statuses[0].RetryAfter == 0 {
+		t.Errorf("Statuses = %+v", statuses)
+	}
+	if !cb.Reset("m") || cb.Reset("m") {
+		t.Error("Reset should succeed once")
+	}
+	if err := cb.Allow("m"); err != nil {
+		t.Errorf("Allow after reset = %v", err)
+	}
+}
+
+func TestCircuitOpenErrorRetryAfter(t *testing.T) {
+	for retryAfter, want := range map[time.Duration]int{
+		0:                       1,
+		200 * time.Millisecond:  1,
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		30 * time.Second:        30,
+	} {
+		if got := (&CircuitOpenError{RetryAfter: retryAfter}).RetryAfterSeconds(); got != want {
+			t.Errorf("RetryAfterSeconds(%v) = %d, want %d", retryAfter, got, want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// service/coalesce.go
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"gemini_polling/logger"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// coalescer 合并并发的相同请求: 同一时刻只有一个请求真正访问上游，
+// 其余请求等待并共享它的结果 (流式请求会收到完整的 SSE 流副本)。
+// 上游调用与发起它的客户端解耦，只有当所有等待者都离开时才会被取消。
+type coalescer struct {
+	mu      sync.Mutex
+	unary   map[string]*unaryFlight
+	streams map[string]*streamFlight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		unary:   make(map[string]*unaryFlight),
+		streams: make(map[string]*streamFlight),
+	}
+}
+
+// unaryFlight 是一次正在进行的非流式上游调用
+type unaryFlight struct {
+	done   chan struct{}
+	body   []byte
+	err    error
+	meta   *ResponseMeta
+	refs   int
+	cancel context.CancelFunc
+}
+
+// streamFlight 是一次正在进行的流式上游调用。已收到的数据全部保留，
+// 中途加入的等待者会从头回放。
+type streamFlight struct {
+	mu     sync.Mutex
+	chunks [][]byte
+	notify chan struct{} // 每次有新数据或流结束时关闭并替换
+	done   bool
+	err    error
+
+	meta   *ResponseMeta
+	refs   int
+	cancel context.CancelFunc
+}
+
+// Write 实现 io.Writer，供 relaySSE 写入上游数据
+func (f *streamFlight) Write(p []byte) (int, error) {
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	f.mu.Lock()
+	f.chunks = append(f.chunks, chunk)
+	close(f.notify)
+	f.notify = make(chan struct{})
+	f.mu.Unlock()
+	return len(p), nil
+}
+
+// Flush 实现 http.Flusher。数据在 Write 时已通知等待者，这里无需处理。
+func (f *streamFlight) Flush() {}
+
+func (f *streamFlight) finish(err error) {
+	f.mu.Lock()
+	f.done = true
+	f.err = err
+	close(f.notify)
+	f.mu.Unlock()
+}
+
+// leaveUnary 在等待者提前离开时调用，最后一个等待者离开时取消上游调用
+func (c *coalescer) leaveUnary(key string, f *unaryFlight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.refs--
+	if f.refs == 0 {
+		if c.unary[key] == f {
+			delete(c.unary, key)
+		}
+		f.cancel()
+	}
+}
+
+// leaveStream 在等待者提前离开时调用，最后一个等待者离开时取消上游调用
+func (c *coalescer) leaveStream(key string, f *streamFlight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.refs--
+	if f.refs == 0 {
+		if c.streams[key] == f {
+			delete(c.streams, key)
+		}
+		f.cancel()
+	}
+}
+
+// flightContext 创建一个不随单个客户端断开而取消、但携带独立 ResponseMeta 的上下文
+func flightContext(ctx context.Context) (context.Context, context.CancelFunc, *ResponseMeta) {
+	flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	flightCtx, meta := WithResponseMeta(flightCtx)
+	return flightCtx, cancel, meta
+}
+
+// copyFlightMeta 将共享调用的模型信息复制到当前请求的 ResponseMeta
+func copyFlightMeta(ctx context.Context, from *ResponseMeta) {
+	meta := responseMetaFrom(ctx)
+	meta.RequestedModel = from.RequestedModel
+	meta.ServedModel = from.ServedModel
+}
+
+// isDeterministicGeminiRequest 判断 Gemini 原生请求是否显式设置了 temperature=0
+func isDeterministicGeminiRequest(reqBody []byte) bool {
+	type generationConfig struct {
+		Temperature *float64 `json:"temperature"`
+	}
+	var req struct {
+		GenerationConfig      *generationConfig `json:"generationConfig"`
+		GenerationConfigSnake *generationConfig `json:"generation_config"`
+	}
+	if err := json.Unmarshal(reqBody, &req); err != nil {
+		return false
+	}
+	cfg := req.GenerationConfig
+	if cfg == nil {
+		cfg = req.GenerationConfigSnake
+	}
+	return cfg != nil && cfg.Temperature != nil && *cfg.Temperature == 0
+}
+
+// coalesceUnary 合并 key 相同的并发非流式调用
+func (s *GenAIService) coalesceUnary(ctx context.Context, key string, run func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if !s.configManager.Get().RequestCoalescingEnabled {
+		return run(ctx)
+	}
+
+	c := s.inflight
+	c.mu.Lock()
+	f, joined := c.unary[key]
+	if joined {
+		f.refs++
+	} else {
+		flightCtx, cancel, meta := flightContext(ctx)
+		f = &unaryFlight{done: make(chan struct{}), meta: meta, refs: 1, cancel: cancel}
+		c.unary[key] = f
+		go func() {
+			f.body, f.err = run(flightCtx)
+			c.mu.Lock()
+			if c.unary[key] == f {
+				delete(c.unary, key)
+			}
+			c.mu.Unlock()
+			cancel()
+			close(f.done)
+		}()
+	}
+	c.mu.Unlock()
+	if joined {
+		s.metrics.RecordCoalesced()
+		logger.Info("[请求合并] 复用进行中的相同请求 (%s)", key[:12])
+	}
+
+	select {
+	case <-f.done:
+		copyFlightMeta(ctx, f.meta)
+		return f.body, f.err
+	case <-ctx.Done():
+		c.leaveUnary(key, f)
+		return nil, ctx.Err()
+	}
+}
+
+// coalesceStream 合并 key 相同的并发流式调用，并将上游 SSE 流分发给所有等待者。
+// 数据写入 out，响应头通过 w 设置。
+func (s *GenAIService) coalesceStream(ctx context.Context, w, out io.Writer, flusher http.Flusher, key string, run func(ctx context.Context, w, out io.Writer, flusher http.Flusher) error) error {
+	if !s.configManager.Get().RequestCoalescingEnabled {
+		return run(ctx, w, out, flusher)
+	}
+
+	c := s.inflight
+	c.mu.Lock()
+	f, joined := c.streams[key]
+	if joined {
+		f.refs++
+	} else {
+		flightCtx, cancel, meta := flightContext(ctx)
+		f = &streamFlight{notify: make(chan struct{}), meta: meta, refs: 1, cancel: cancel}
+		c.streams[key] = f
+		go func() {
+			// 上游数据写入 flight，由各等待者自行转发给自己的客户端
+			err := run(flightCtx, io.Discard, f, f)
+			c.mu.Lock()
+			if c.streams[key] == f {
+				delete(c.streams, key)
+			}
+			c.mu.Unlock()
+			cancel()
+			f.finish(err)
+		}()
+	}
+	c.mu.Unlock()
+	if joined {
+		s.metrics.RecordCoalesced()
+		logger.Info("[请求合并] 加入进行中的相同流式请求 (%s)", key[:12])
+	}
+
+	headersSent := false
+	next := 0
+	for {
+		f.mu.Lock()
+		chunks := f.chunks[next:]
+		done, err, notify := f.done, f.err, f.notify
+		f.mu.Unlock()
+
+		for _, chunk := range chunks {
+			if !headersSent {
+				copyFlightMeta(ctx, f.meta)
+				applyStreamHeaders(ctx, w)
+				headersSent = true
+			}
+			if _, werr := out.Write(chunk); werr != nil {
+				c.leaveStream(key, f)
+				return werr
+			}
+		}
+		if len(chunks) > 0 {
+			flusher.Flush()
+			next += len(chunks)
+		}
+
+		if done {
+			copyFlightMeta(ctx, f.meta)
+			return err
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			c.leaveStream(key, f)
+			return ctx.Err()
+		}
+	}
+}
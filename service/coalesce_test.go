@@ -0,0 +1,324 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newCoalescingService 创建开启请求合并和响应缓存的 GenAIService
+func newCoalescingService(t *testing.T, env ...string) *GenAIService {
+	t.Helper()
+	s := newTestGenAIService(t)
+	s.configManager = newTestConfigManager(t, append([]string{"REQUEST_COALESCING_ENABLED", "true", "RESPONSE_CACHE_ENABLED", "false"}, env...)...)
+	cache, err := NewResponseCache(s.configManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cache = cache
+	return s
+}
+
+func TestIsDeterministicGeminiRequest(t *testing.T) {
+	tests := map[string]bool{
+		`{"generationConfig":{"temperature":0}}`:            true,
+		`{"generation_config":{"temperature":0.0}}`:         true,
+		`{"generationConfig":{"temperature":0.1}}`:          false,
+		`{"generationConfig":{"topK":1}}`:                   false,
+		`{"contents":[{"parts":[{"text":"temperature"}]}]}`: false,
+		`not json`: false,
+	}
+	for body, want := range tests {
+		if got := isDeterministicGeminiRequest([]byte(body)); got != want {
+			t.Errorf("isDeterministicGeminiRequest(%s) = %v, want %v", body, got, want)
+		}
+	}
+}
+
+func TestCoalesceUnary(t *testing.T) {
+	upstreamErr := &UpstreamError{StatusCode: http.StatusServiceUnavailable, Body: []byte("overloaded")}
+	tests := []struct {
+		name      string
+		env       []string
+		waiters   int
+		keys      func(i int) string
+		err       error
+		wantCalls int32
+	}{
+		{name: "identical requests share one call", waiters: 5, keys: func(int) string { return "same" }, wantCalls: 1},
+		{name: "errors are shared too", waiters: 3, keys: func(int) string { return "same" }, err: upstreamErr, wantCalls: 1},
+		{name: "different keys run separately", waiters: 3, keys: func(i int) string { return string(rune('a' + i)) }, wantCalls: 3},
+		{name: "disabled", env: []string{"REQUEST_COALESCING_ENABLED", "false"}, waiters: 3, keys: func(int) string { return "same" }, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newCoalescingService(t, tt.env...)
+			var calls atomic.Int32
+			release := make(chan struct{})
+			run := func(ctx context.Context) ([]byte, error) {
+				calls.Add(1)
+				responseMetaFrom(ctx).ServedModel = "served"
+				<-release
+				return []byte("result"), tt.err
+			}
+
+			var wg sync.WaitGroup
+			results := make([]string, tt.waiters)
+			errs := make([]error, tt.waiters)
+			metas := make([]*ResponseMeta, tt.waiters)
+			for i := 0; i < tt.waiters; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ctx, meta := WithResponseMeta(context.Background())
+					metas[i] = meta
+					key := cacheKey("countTokens", "m", []byte(tt.keys(i)))
+					body, err := s.coalesceUnary(ctx, key, run)
+					results[i], errs[i] = string(body), err
+				}(i)
+			}
+			// 所有等待者都加入 (或开始各自的调用) 后才放行上游调用
+			waitFor(t, "waiters to join", func() bool {
+				if tt.wantCalls > 1 {
+					return calls.Load() == tt.wantCalls
+				}
+				s.inflight.mu.Lock()
+				defer s.inflight.mu.Unlock()
+				for _, f := range s.inflight.unary {
+					return f.refs == tt.waiters
+				}
+				return false
+			})
+			close(release)
+			wg.Wait()
+
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", calls.Load(), tt.wantCalls)
+			}
+			for i := range results {
+				if results[i] != "result" || !errors.Is(errs[i], tt.err) || metas[i].ServedModel != "served" {
+					t.Errorf("waiter %d: %q, %v, served %q", i, results[i], errs[i], metas[i].ServedModel)
+				}
+			}
+			wantCoalesced := int64(0)
+			if tt.wantCalls == 1 {
+				wantCoalesced = int64(tt.waiters - 1)
+			}
+			if got := s.metrics.Snapshot().Coalesced; got != wantCoalesced {
+				t.Errorf("coalesced = %d, want %d", got, wantCoalesced)
+			}
+			if len(s.inflight.unary) != 0 {
+				t.Errorf("flights left behind: %d", len(s.inflight.unary))
+			}
+		})
+	}
+}
+
+func TestCoalesceUnaryCancellation(t *testing.T) {
+	s := newCoalescingService(t)
+	key := cacheKey("countTokens", "m", []byte(`{}`))
+	started := make(chan struct{})
+	upstreamCancelled := make(chan struct{})
+	run := func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		close(upstreamCancelled)
+		return nil, ctx.Err()
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	joinerCtx, cancelJoiner := context.WithCancel(context.Background())
+	leaderDone := make(chan error, 1)
+	go func() {
+		_, err := s.coalesceUnary(leaderCtx, key, run)
+		leaderDone <- err
+	}()
+	<-started
+	joinerDone := make(chan error, 1)
+	go func() {
+		_, err := s.coalesceUnary(joinerCtx, key, run)
+		joinerDone <- err
+	}()
+	waitFor(t, "joiner", func() bool {
+		s.inflight.mu.Lock()
+		defer s.inflight.mu.Unlock()
+		return s.inflight.unary[key] != nil && s.inflight.unary[key].refs == 2
+	})
+
+	// 发起调用的客户端断开后，上游调用继续为剩下的等待者服务
+	cancelLeader()
+	if err := <-leaderDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader err = %v", err)
+	}
+	select {
+	case <-upstreamCancelled:
+		t.Fatal("upstream call cancelled while a waiter remained")
+	default:
+	}
+
+	// 最后一个等待者离开时取消上游调用
+	cancelJoiner()
+	if err := <-joinerDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("joiner err = %v", err)
+	}
+	<-upstreamCancelled
+}
+
+// sseResponse 构造一个响应体为 body 的上游 SSE 响应
+func sseResponse(body string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestCoalesceStreamFanOut(t *testing.T) {
+	s := newCoalescingService(t)
+	key := cacheKey("streamGenerateContent", "m", []byte(`{}`))
+	chunks := []string{"data: {\"n\":1}\n\n", "data: {\"n\":2}\n\n", "data: {\"n\":3}\n\n"}
+	const waiters = 4
+
+	var calls atomic.Int32
+	proceed := make(chan struct{})
+	run := func(ctx context.Context, w, out io.Writer, flusher http.Flusher) error {
+		calls.Add(1)
+		responseMetaFrom(ctx).ServedModel = "served"
+		// 先写出第一段，等所有等待者加入后再写出剩余部分: 中途加入的等待者需要从头回放
+		io.WriteString(out, chunks[0])
+		flusher.Flush()
+		<-proceed
+		for _, chunk := range chunks[1:] {
+			io.WriteString(out, chunk)
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, waiters)
+	errs := make([]error, waiters)
+	for i := 0; i < waiters; i++ {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, _ := WithResponseMeta(context.Background())
+			errs[i] = s.coalesceStream(ctx, recorders[i], recorders[i], recorders[i], key, run)
+		}(i)
+		if i == 0 {
+			waitFor(t, "first chunk", func() bool {
+				s.inflight.mu.Lock()
+				f := s.inflight.streams[key]
+				s.inflight.mu.Unlock()
+				if f == nil {
+					return false
+				}
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				return len(f.chunks) == 1
+			})
+		}
+	}
+	waitFor(t, "waiters to join", func() bool {
+		s.inflight.mu.Lock()
+		defer s.inflight.mu.Unlock()
+		return s.inflight.streams[key] != nil && s.inflight.streams[key].refs == waiters
+	})
+	close(proceed)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("upstream calls = %d, want 1", calls.Load())
+	}
+	want := strings.Join(chunks, "")
+	for i, rec := range recorders {
+		if errs[i] != nil || rec.Body.String() != want || rec.Header().Get(HeaderServedModel) != "served" {
+			t.Errorf("waiter %d: err %v, body %q, headers %v", i, errs[i], rec.Body.String(), rec.Header())
+		}
+	}
+	if got := s.metrics.Snapshot().Coalesced; got != waiters-1 {
+		t.Errorf("coalesced = %d, want %d", got, waiters-1)
+	}
+}
+
+// 合并后的流式响应与 StreamGenerateContent 一样经过 cachedStream，只有完整结束的流才能写入缓存
+func TestCoalescedStreamCaching(t *testing.T) {
+	key := &model.APIKey{ID: 1}
+	tests := []struct {
+		name       string
+		upstream   string
+		stopAtDone bool // OpenAI 兼容流以 [DONE] 结束，Gemini 原生流以带 finishReason 的 chunk 结束
+		wantErr    error
+		wantCached bool
+	}{
+		{
+			name:       "OpenAI stream ending with DONE",
+			upstream:   "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: {\"choices\":[{\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n",
+			stopAtDone: true,
+			wantCached: true,
+		},
+		{
+			name:       "OpenAI stream closed before DONE",
+			upstream:   "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n",
+			stopAtDone: true,
+			wantErr:    ErrStreamTruncated,
+		},
+		{
+			name:       "empty OpenAI stream",
+			upstream:   "",
+			stopAtDone: true,
+			wantErr:    ErrStreamTruncated,
+		},
+		{
+			name:       "Gemini stream with finishReason",
+			upstream:   "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"hi\"}]}}]}\n\ndata: {\"candidates\":[{\"finishReason\":\"STOP\"}]}\n\n",
+			wantCached: true,
+		},
+		{
+			name:     "Gemini stream closed before finishReason",
+			upstream: "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"hi\"}]}}]}\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newCoalescingService(t, "RESPONSE_CACHE_ENABLED", "true")
+			reqBody := []byte(`{"generationConfig":{"temperature":0}}`)
+			stream := func() (*httptest.ResponseRecorder, error) {
+				rec := httptest.NewRecorder()
+				err := s.cachedStream(context.Background(), rec, rec, "streamGenerateContent", "m", reqBody, func(ctx context.Context, out io.Writer) error {
+					flightKey := cacheKey("streamGenerateContent", "m", reqBody)
+					return s.coalesceStream(ctx, rec, out, rec, flightKey, func(ctx context.Context, w, out io.Writer, flusher http.Flusher) error {
+						return relaySSE(out, flusher, sseResponse(tt.upstream), key, tt.stopAtDone)
+					})
+				})
+				return rec, err
+			}
+
+			rec, err := stream()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && rec.Body.String() != tt.upstream {
+				t.Errorf("relayed %q, want %q", rec.Body.String(), tt.upstream)
+			}
+			if cached := s.cache.Stats().Entries == 1; cached != tt.wantCached {
+				t.Fatalf("cached = %v, want %v", cached, tt.wantCached)
+			}
+			if !tt.wantCached {
+				return
+			}
+			ctx, meta := WithResponseMeta(context.Background())
+			replay := httptest.NewRecorder()
+			if err := s.cachedStream(ctx, replay, replay, "streamGenerateContent", "m", reqBody, func(context.Context, io.Writer) error {
+				t.Fatal("cache hit should not reach the upstream")
+				return nil
+			}); err != nil || replay.Body.String() != tt.upstream || meta.CacheStatus != CacheHit {
+				t.Errorf("replay: %v, %q, %s", err, replay.Body.String(), meta.CacheStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+// service/completion_service.go
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxCompletionCandidates 是 Gemini candidateCount 的上限，也是 n 的上限
+	maxCompletionCandidates = 8
+	// maxCompletionLogprobs 是旧版补全接口 logprobs 参数的上限
+	maxCompletionLogprobs = 5
+	// completionConcurrency 是非流式请求中同时发往上游的 prompt 数
+	completionConcurrency = 8
+)
+
+// completionInstruction 让对话模型像旧版补全模型一样直接续写文本
+const completionInstruction = "Continue the text exactly where it ends. Output only the continuation, without repeating the text or adding any commentary."
+
+// CompletionRequestError 表示 /v1/completions 的请求参数无效
+type CompletionRequestError struct {
+	Param   string
+	Message string
+}
+
+func (e *CompletionRequestError) Error() string {
+	return e.Message
+}
+
+// CompletionService 将旧版 OpenAI 文本补全请求转换为 Gemini 原生的单轮 generateContent 请求:
+// 每个 prompt 是一次独立的请求，n 对应 candidateCount，logprobs 对应 responseLogprobs。
+type CompletionService struct {
+	genai *GenAIService
+}
+
+func NewCompletionService(genai *GenAIService) *CompletionService {
+	return &CompletionService{genai: genai}
+}
+
+// geminiCompletionResponse 是 generateContent / streamGenerateContent 响应中补全接口需要的字段
+type geminiCompletionResponse struct {
+	Candidates []struct {
+		Index   int `json:"index"`
+		Content struct {
+			Parts []struct {
+				Text    string `json:"text"`
+				Thought bool   `json:"thought"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason   string                `json:"finishReason"`
+		LogprobsResult *geminiLogprobsResult `json:"logprobsResult"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata *struct {
+		PromptTokenCount int `json:"promptTokenCount"`
+		TotalTokenCount  int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+type geminiLogprob struct {
+	Token          string  `json:"token"`
+	LogProbability float64 `json:"logProbability"`
+}
+
+type geminiLogprobsResult struct {
+	TopCandidates []struct {
+		Candidates []geminiLogprob `json:"candidates"`
+	} `json:"topCandidates"`
+	ChosenCandidates []geminiLogprob `json:"chosenCandidates"`
+}
+
+// usage 将 usageMetadata 转换为 OpenAI 格式，completion_tokens 包含思考消耗的 token
+func (r *geminiCompletionResponse) usage() model.Usage {
+	if r.UsageMetadata == nil {
+		return model.Usage{}
+	}
+	return model.Usage{
+		PromptTokens:     r.UsageMetadata.PromptTokenCount,
+		CompletionTokens: r.UsageMetadata.TotalTokenCount - r.UsageMetadata.PromptTokenCount,
+		TotalTokens:      r.UsageMetadata.TotalTokenCount,
+	}
+}
+
+// completionPlan 是校验后的请求参数
+type completionPlan struct {
+	prompts []string
+	n       int
+	body    func(prompt string) ([]byte, error)
+}
+
+// Complete 处理非流式请求，多个 prompt 并发请求上游，choices 按 prompt 顺序排列 (index = prompt 序号 * n + 候选序号)
+func (s *CompletionService) Complete(ctx context.Context, req *model.CompletionRequest) (*model.TextCompletionResponse, error) {
+	plan, err := planCompletion(req)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*geminiCompletionResponse, len(plan.prompts))
+	err = fanOut(ctx, len(plan.prompts), completionConcurrency, func(ctx context.Context, i int) error {
+		body, err := plan.body(plan.prompts[i])
+		if err != nil {
+			return err
+		}
+		respBody, _, err := s.genai.GenerateContent(ctx, req.Model, body)
+		if err != nil {
+			return err
+		}
+		var parsed geminiCompletionResponse
+		if err := json.Unmarshal(respBody, &parsed); err != nil {
+			return fmt.Errorf("解析 generateContent 响应失败: %w", err)
+		}
+		results[i] = &parsed
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &model.TextCompletionResponse{
+		ID:      newObjectID("cmpl-"),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   servedModel(ctx, req.Model),
+		Choices: make([]model.TextCompletionChoice, 0, len(plan.prompts)*plan.n),
+		Usage:   &model.Usage{},
+	}
+	for i, parsed := range results {
+		if len(parsed.Candidates) == 0 && parsed.PromptFeedback != nil && parsed.PromptFeedback.BlockReason != "" {
+			for j := 0; j < plan.n; j++ {
+				resp.Choices = append(resp.Choices, model.TextCompletionChoice{Index: i*plan.n + j, FinishReason: "content_filter"})
+			}
+		}
+		for _, cand := range parsed.Candidates {
+			text, offset := candidateText(cand.Content.Parts), 0
+			if req.Echo {
+				text, offset = plan.prompts[i]+text, utf8.RuneCountInString(plan.prompts[i])
+			}
+			choice := model.TextCompletionChoice{
+				Text:         text,
+				Index:        i*plan.n + cand.Index,
+				FinishReason: completionFinishReason(cand.FinishReason),
+			}
+			if req.Logprobs != nil {
+				choice.Logprobs, _ = completionLogprobs(cand.LogprobsResult, offset)
+			}
+			resp.Choices = append(resp.Choices, choice)
+		}
+		usage := parsed.usage()
+		resp.Usage.PromptTokens += usage.PromptTokens
+		resp.Usage.CompletionTokens += usage.CompletionTokens
+		resp.Usage.TotalTokens += usage.TotalTokens
+	}
+	return resp, nil
+}
+
+// Stream 处理流式请求，依次流式请求每个 prompt，把每段增量作为一个 text_completion chunk 交给 emit。
+// stream_options.include_usage 为 true 时最后额外发送一个只包含 usage 的 chunk。
+func (s *CompletionService) Stream(ctx context.Context, req *model.CompletionRequest, emit func(*model.TextCompletionResponse) error) error {
+	plan, err := planCompletion(req)
+	if err != nil {
+		return err
+	}
+
+	id, created := newObjectID("cmpl-"), time.Now().Unix()
+	var total model.Usage
+	for i, prompt := range plan.prompts {
+		body, err := plan.body(prompt)
+		if err != nil {
+			return err
+		}
+
+		var usage model.Usage
+		started := make(map[int]bool) // 已经输出过内容的候选，echo 只在第一个 chunk 中附上 prompt
+		offsets := make(map[int]int)  // 每个候选下一个 token 的 text_offset
+		w := &sseDataWriter{onData: func(data []byte) error {
+			var chunk geminiCompletionResponse
+			if err := json.Unmarshal(data, &chunk); err != nil {
+				logger.Warn("忽略无法解析的流式 chunk: %v", err)
+				return nil
+			}
+			if chunk.UsageMetadata != nil {
+				usage = chunk.usage()
+			}
+			for _, cand := range chunk.Candidates {
+				text := candidateText(cand.Content.Parts)
+				if !started[cand.Index] {
+					started[cand.Index] = true
+					if req.Echo {
+						text = prompt + text
+						offsets[cand.Index] = utf8.RuneCountInString(prompt)
+					}
+				}
+				choice := model.TextCompletionChoice{Text: text, Index: i*plan.n + cand.Index}
+				if cand.FinishReason != "" {
+					choice.FinishReason = completionFinishReason(cand.FinishReason)
+				}
+				if req.Logprobs != nil {
+					choice.Logprobs, offsets[cand.Index] = completionLogprobs(cand.LogprobsResult, offsets[cand.Index])
+				}
+				if text == "" && choice.FinishReason == nil {
+					continue
+				}
+				if err := emit(&model.TextCompletionResponse{
+					ID:      id,
+					Object:  "text_completion",
+					Created: created,
+					Model:   servedModel(ctx, req.Model),
+					Choices: []model.TextCompletionChoice{choice},
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}}
+		if err := s.genai.StreamGenerateContent(ctx, w, req.Model, body); err != nil {
+			return err
+		}
+		total.PromptTokens += usage.PromptTokens
+		total.CompletionTokens += usage.CompletionTokens
+		total.TotalTokens += usage.TotalTokens
+	}
+
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		return emit(&model.TextCompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   servedModel(ctx, req.Model),
+			Choices: []model.TextCompletionChoice{},
+			Usage:   &total,
+		})
+	}
+	return nil
+}
+
+// planCompletion 校验请求参数，并返回为单个 prompt 构造 Gemini 请求体的函数
+func planCompletion(req *model.CompletionRequest) (*completionPlan, error) {
+	prompts, err := completionPrompts(req.Prompt)
+	if err != nil {
+		return nil, err
+	}
+	n := req.N
+	if n == 0 {
+		n = 1
+	}
+	if n < 1 || n > maxCompletionCandidates {
+		return nil, &CompletionRequestError{Param: "n", Message: fmt.Sprintf("n 必须在 1 到 %d 之间", maxCompletionCandidates)}
+	}
+	if req.Logprobs != nil && (*req.Logprobs < 0 || *req.Logprobs > maxCompletionLogprobs) {
+		return nil, &CompletionRequestError{Param: "logprobs", Message: fmt.Sprintf("logprobs 必须在 0 到 %d 之间", maxCompletionLogprobs)}
+	}
+	stops, err := stopSequences(req.Stop)
+	if err != nil {
+		return nil, err
+	}
+
+	generationConfig := map[string]interface{}{}
+	if n > 1 {
+		generationConfig["candidateCount"] = n
+	}
+	if req.MaxTokens > 0 {
+		generationConfig["maxOutputTokens"] = req.MaxTokens
+	}
+	if req.Temperature != nil {
+		generationConfig["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		generationConfig["topP"] = *req.TopP
+	}
+	if req.PresencePenalty != nil {
+		generationConfig["presencePenalty"] = *req.PresencePenalty
+	}
+	if req.FrequencyPenalty != nil {
+		generationConfig["frequencyPenalty"] = *req.FrequencyPenalty
+	}
+	if req.Seed != nil {
+		generationConfig["seed"] = *req.Seed
+	}
+	if len(stops) > 0 {
+		generationConfig["stopSequences"] = stops
+	}
+	if req.Logprobs != nil {
+		generationConfig["responseLogprobs"] = true
+		if *req.Logprobs > 0 {
+			generationConfig["logprobs"] = *req.Logprobs
+		}
+	}
+
+	body := func(prompt string) ([]byte, error) {
+		text := prompt
+		payload := map[string]interface{}{}
+		var system []map[string]string
+		if req.SystemPrompt != "" {
+			system = append(system, map[string]string{"text": req.SystemPrompt})
+		}
+		if req.Suffix != "" {
+			text = fillInMiddlePrompt(prompt, req.Suffix)
+		} else {
+			system = append(system, map[string]string{"text": completionInstruction})
+		}
+		if len(system) > 0 {
+			payload["systemInstruction"] = map[string]interface{}{"parts": system}
+		}
+		payload["contents"] = []map[string]interface{}{{"role": "user", "parts": []map[string]string{{"text": text}}}}
+		if len(generationConfig) > 0 {
+			payload["generationConfig"] = generationConfig
+		}
+		return json.Marshal(payload)
+	}
+	return &completionPlan{prompts: prompts, n: n, body: body}, nil
+}
+
+// completionPrompts 解析 prompt (字符串或字符串数组)，不支持 token 数组形式的 prompt
+func completionPrompts(raw json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if single == "" {
+			return nil, &CompletionRequestError{Param: "prompt", Message: "prompt 不能为空"}
+		}
+		return []string{single}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, &CompletionRequestError{Param: "prompt", Message: "prompt 必须是字符串或字符串数组，不支持 token 数组"}
+	}
+	if len(list) == 0 {
+		return nil, &CompletionRequestError{Param: "prompt", Message: "prompt 不能为空"}
+	}
+	return list, nil
+}
+
+// stopSequences 解析 stop (字符串或字符串数组)
+func stopSequences(stop interface{}) ([]string, error) {
+	switch v := stop.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		stops := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, &CompletionRequestError{Param: "stop", Message: "stop 必须是字符串或字符串数组"}
+			}
+			stops = append(stops, s)
+		}
+		return stops, nil
+	}
+	return nil, &CompletionRequestError{Param: "stop", Message: "stop 必须是字符串或字符串数组"}
+}
+
+// candidateText 拼接候选中除思考过程以外的文本
+func candidateText(parts []struct {
+	Text    string `json:"text"`
+	Thought bool   `json:"thought"`
+}) string {
+	var b strings.Builder
+	for _, part := range parts {
+		if !part.Thought {
+			b.WriteString(part.Text)
+		}
+	}
+	return b.String()
+}
+
+// completionFinishReason 将 Gemini 的 finishReason 映射为 OpenAI 的 finish_reason
+func completionFinishReason(reason string) interface{} {
+	switch reason {
+	case "":
+		return nil
+	case "STOP":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	default:
+		// SAFETY、RECITATION、BLOCKLIST、PROHIBITED_CONTENT 等
+		return "content_filter"
+	}
+}
+
+// completionLogprobs 将 Gemini 的 logprobsResult 转换为旧版补全接口的格式。
+// offset 是第一个 token 在 text 中的字符位置，返回值包括下一个 token 的位置。
+func completionLogprobs(result *geminiLogprobsResult, offset int) (*model.CompletionLogprobs, int) {
+	logprobs := &model.CompletionLogprobs{
+		Tokens:        []string{},
+		TokenLogprobs: []float64{},
+		TopLogprobs:   []map[string]float64{},
+		TextOffset:    []int{},
+	}
+	if result == nil {
+		return logprobs, offset
+	}
+	for i, chosen := range result.ChosenCandidates {
+		logprobs.Tokens = append(logprobs.Tokens, chosen.Token)
+		logprobs.TokenLogprobs = append(logprobs.TokenLogprobs, chosen.LogProbability)
+		logprobs.TextOffset = append(logprobs.TextOffset, offset)
+		offset += utf8.RuneCountInString(chosen.Token)
+
+		top := map[string]float64{}
+		if i < len(result.TopCandidates) {
+			for _, candidate := range result.TopCandidates[i].Candidates {
+				top[candidate.Token] = candidate.LogProbability
+			}
+		}
+		logprobs.TopLogprobs = append(logprobs.TopLogprobs, top)
+	}
+	return logprobs, offset
+}
+
+// servedModel 返回实际完成请求的模型 (发生回退时与请求的模型不同)
+func servedModel(ctx context.Context, requested string) string {
+	if served := responseMetaFrom(ctx).ServedModel; served != "" {
+		return served
+	}
+	return requested
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/model"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestCompletionService 创建 CompletionService，上游是 Vertex AI 替身:
+// generateContent 对每个 prompt 返回 candidateCount 个候选 ("<prompt> #<候选序号>")，
+// streamGenerateContent 把每个候选的 " world" 分两个 chunk 返回；prompt 为 "blocked" 时返回 promptFeedback
+func newTestCompletionService(t *testing.T) (*CompletionService, func() []recordedRequest) {
+	t.Helper()
+	genai, requests := newVertexTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Contents []struct {
+				Parts []struct{ Text string } `json:"parts"`
+			} `json:"contents"`
+			GenerationConfig struct {
+				CandidateCount int `json:"candidateCount"`
+			} `json:"generationConfig"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		prompt := req.Contents[0].Parts[0].Text
+		count := max(req.GenerationConfig.CandidateCount, 1)
+		usage := fmt.Sprintf(`"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":%d,"totalTokenCount":%d}`, 2*count, 3+2*count)
+
+		if prompt == "blocked" {
+			w.Write([]byte(`{"promptFeedback":{"blockReason":"SAFETY"},` + usage + `}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ":streamGenerateContent") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < count; i++ {
+				fmt.Fprintf(w, `data: {"candidates":[{"index":%d,"content":{"parts":[{"text":" wor"}]}}]}`+"\n\n", i)
+			}
+			for i := 0; i < count; i++ {
+				fmt.Fprintf(w, `data: {"candidates":[{"index":%d,"content":{"parts":[{"text":"ld"}]},"finishReason":"STOP"}],%s}`+"\n\n", i, usage)
+			}
+			return
+		}
+		var candidates []string
+		for i := 0; i < count; i++ {
+			reason := "STOP"
+			if i == 1 {
+				reason = "MAX_TOKENS"
+			}
+			candidates = append(candidates, fmt.Sprintf(`{"index":%d,"content":{"parts":[{"text":"thinking","thought":true},{"text":" #%d"}]},"finishReason":%q,`+
+				`"logprobsResult":{"chosenCandidates":[{"token":" #","logProbability":-0.5},{"token":"%d","logProbability":-0.1}],"topCandidates":[{"candidates":[{"token":" #","logProbability":-0.5}]}]}}`, i, i, reason, i))
+		}
+		w.Write([]byte(`{"candidates":[` + strings.Join(candidates, ",") + `],` + usage + `}`))
+	})
+	return NewCompletionService(genai), requests
+}
+
+func TestPlanCompletion(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	tests := []struct {
+		name      string
+		req       model.CompletionRequest
+		wantParam string // 非空时期望返回该参数的 CompletionRequestError
+	}{
+		{name: "token array prompt", req: model.CompletionRequest{Prompt: json.RawMessage(`[1, 2, 3]`)}, wantParam: "prompt"},
+		{name: "empty prompt", req: model.CompletionRequest{Prompt: json.RawMessage(`""`)}, wantParam: "prompt"},
+		{name: "empty prompt list", req: model.CompletionRequest{Prompt: json.RawMessage(`[]`)}, wantParam: "prompt"},
+		{name: "n too large", req: model.CompletionRequest{Prompt: json.RawMessage(`"a"`), N: maxCompletionCandidates + 1}, wantParam: "n"},
+		{name: "logprobs too large", req: model.CompletionRequest{Prompt: json.RawMessage(`"a"`), Logprobs: intPtr(maxCompletionLogprobs + 1)}, wantParam: "logprobs"},
+		{name: "stop of the wrong type", req: model.CompletionRequest{Prompt: json.RawMessage(`"a"`), Stop: []interface{}{"x", 1.0}}, wantParam: "stop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := planCompletion(&tt.req)
+			var reqErr *CompletionRequestError
+			if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+				t.Errorf("error = %v, want a CompletionRequestError on %s", err, tt.wantParam)
+			}
+		})
+	}
+
+	t.Run("request body", func(t *testing.T) {
+		temperature := 0.3
+		plan, err := planCompletion(&model.CompletionRequest{
+			Prompt: json.RawMessage(`["a","b"]`), N: 2, MaxTokens: 16, Temperature: &temperature,
+			Stop: []interface{}{"\n"}, Logprobs: intPtr(2), SystemPrompt: "Team prompt.",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(plan.prompts, []string{"a", "b"}) || plan.n != 2 {
+			t.Fatalf("plan = %v x %d", plan.prompts, plan.n)
+		}
+		raw, _ := plan.body("a")
+		assertJSONEqual(t, raw, `{
+			"systemInstruction":{"parts":[{"text":"Team prompt."},{"text":"`+completionInstruction+`"}]},
+			"contents":[{"role":"user","parts":[{"text":"a"}]}],
+			"generationConfig":{"candidateCount":2,"maxOutputTokens":16,"temperature":0.3,"stopSequences":["\n"],"responseLogprobs":true,"logprobs":2}
+		}`)
+	})
+
+	t.Run("suffix", func(t *testing.T) {
+		plan, err := planCompletion(&model.CompletionRequest{Prompt: json.RawMessage(`"def f():"`), Suffix: "\nf()"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := plan.body("def f():")
+		// 代码补全使用 fill-in-the-middle 提示词，不再要求模型续写
+		assertJSONEqual(t, raw, fmt.Sprintf(`{"contents":[{"role":"user","parts":[{"text":%q}]}]}`, fillInMiddlePrompt("def f():", "\nf()")))
+	})
+}
+
+func TestCompleteResponseShape(t *testing.T) {
+	s, requests := newTestCompletionService(t)
+	logprobs := 1
+	resp, err := s.Complete(context.Background(), &model.CompletionRequest{
+		Model:    "gemini-2.5-flash",
+		Prompt:   json.RawMessage(`["Héllo","Bye"]`),
+		N:        2,
+		Echo:     true,
+		Logprobs: &logprobs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(requests()); n != 2 {
+		t.Fatalf("upstream received %d requests, want one per prompt", n)
+	}
+
+	if !strings.HasPrefix(resp.ID, "cmpl-") || resp.Object != "text_completion" || resp.Model != "gemini-2.5-flash" || resp.Created == 0 {
+		t.Errorf("response = %+v, want a text_completion object", resp)
+	}
+	// index = prompt 序号 * n + 候选序号；echo 在补全前附上 prompt，思考过程不计入文本
+	want := []struct {
+		text   string
+		reason string
+	}{{"Héllo #0", "stop"}, {"Héllo #1", "length"}, {"Bye #0", "stop"}, {"Bye #1", "length"}}
+	if len(resp.Choices) != len(want) {
+		t.Fatalf("got %d choices, want %d", len(resp.Choices), len(want))
+	}
+	for i, choice := range resp.Choices {
+		if choice.Index != i || choice.Text != want[i].text || choice.FinishReason != want[i].reason {
+			t.Errorf("choice %d = %+v, want %q finished by %s", i, choice, want[i].text, want[i].reason)
+		}
+	}
+	// echo 时 text_offset 从 prompt 之后开始 (按字符计)
+	if lp := resp.Choices[0].Logprobs; lp == nil || !reflect.DeepEqual(lp.Tokens, []string{" #", "0"}) || !reflect.DeepEqual(lp.TextOffset, []int{5, 7}) {
+		t.Errorf("logprobs = %+v, want tokens [\" #\" \"0\"] at offsets [5 7]", lp)
+	}
+	if want := (model.Usage{PromptTokens: 6, CompletionTokens: 8, TotalTokens: 14}); *resp.Usage != want {
+		t.Errorf("usage = %+v, want %+v", *resp.Usage, want)
+	}
+
+	resp, err = s.Complete(context.Background(), &model.CompletionRequest{Model: "gemini-2.5-flash", Prompt: json.RawMessage(`"blocked"`), N: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Choices) != 2 || resp.Choices[1].Index != 1 || resp.Choices[0].FinishReason != "content_filter" || resp.Choices[0].Text != "" {
+		t.Errorf("blocked prompt choices = %+v, want n empty content_filter choices", resp.Choices)
+	}
+}
+
+func TestCompletionStream(t *testing.T) {
+	s, requests := newTestCompletionService(t)
+	var chunks []*model.TextCompletionResponse
+	err := s.Stream(context.Background(), &model.CompletionRequest{
+		Model:         "gemini-2.5-flash",
+		Prompt:        json.RawMessage(`["Hello","Bye"]`),
+		Echo:          true,
+		Stream:        true,
+		StreamOptions: &model.StreamOptions{IncludeUsage: true},
+	}, func(chunk *model.TextCompletionResponse) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(requests()); n != 2 {
+		t.Fatalf("upstream received %d requests, want one per prompt", n)
+	}
+
+	// 每个 prompt 两个内容 chunk，最后是只包含 usage 的 chunk
+	want := []struct {
+		index  int
+		text   string
+		reason interface{}
+	}{{0, "Hello wor", nil}, {0, "ld", "stop"}, {1, "Bye wor", nil}, {1, "ld", "stop"}}
+	if len(chunks) != len(want)+1 {
+		t.Fatalf("got %d chunks, want %d", len(chunks), len(want)+1)
+	}
+	for i, w := range want {
+		chunk := chunks[i]
+		if chunk.ID != chunks[0].ID || chunk.Object != "text_completion" || chunk.Usage != nil || len(chunk.Choices) != 1 {
+			t.Fatalf("chunk %d = %+v, want one choice in a text_completion chunk sharing the first id", i, chunk)
+		}
+		if choice := chunk.Choices[0]; choice.Index != w.index || choice.Text != w.text || choice.FinishReason != w.reason {
+			t.Errorf("chunk %d choice = %+v, want index %d %q finished by %v", i, choice, w.index, w.text, w.reason)
+		}
+	}
+	last := chunks[len(chunks)-1]
+	if last.ID != chunks[0].ID || len(last.Choices) != 0 || last.Usage == nil || *last.Usage != (model.Usage{PromptTokens: 6, CompletionTokens: 4, TotalTokens: 10}) {
+		t.Errorf("usage chunk = %+v", last)
+	}
+
+	// 没有 include_usage 时不发送 usage chunk
+	chunks = nil
+	if err := s.Stream(context.Background(), &model.CompletionRequest{Model: "gemini-2.5-flash", Prompt: json.RawMessage(`"Hello"`), Stream: true}, func(chunk *model.TextCompletionResponse) error {
+		chunks = append(chunks, chunk)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 || chunks[0].Choices[0].Text != " wor" || chunks[1].Usage != nil {
+		t.Errorf("chunks without echo or usage = %+v", chunks)
+	}
+}
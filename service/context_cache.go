@@ -0,0 +1,323 @@
+// service/context_cache.go
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// contextCacheMargin 是上游缓存到期前停止使用它的余量，避免请求到达上游时缓存刚好过期
+const contextCacheMargin = 30 * time.Second
+
+// contextCacheEntry 是为一个请求前缀创建的上游 cachedContents。
+// 上游缓存属于创建它的 Key 所在的项目，因此使用时固定用这个 Key。
+type contextCacheEntry struct {
+	name      string // cachedContents/xxx，为空表示创建失败，到期前不再尝试
+	keyID     uint
+	tokens    int // 上游统计的缓存 token 数
+	expiresAt time.Time
+}
+
+// contextCaches 按前缀哈希记录前缀的出现时间和对应的上游缓存。
+// 前缀在有效期内第二次出现时才创建缓存，只出现一次的前缀不产生缓存的存储费用。
+type contextCaches struct {
+	mu        sync.Mutex
+	entries   map[string]*contextCacheEntry
+	seen      map[string]time.Time
+	creating  map[string]bool
+	lastPrune time.Time
+}
+
+func newContextCaches() *contextCaches {
+	return &contextCaches{
+		entries:  make(map[string]*contextCacheEntry),
+		seen:     make(map[string]time.Time),
+		creating: make(map[string]bool),
+	}
+}
+
+// lookup 返回前缀可用的缓存。没有可用缓存但前缀已经稳定出现时返回 create = true，
+// 调用方负责创建缓存并通过 store 保存结果；同一前缀同时只有一个请求创建缓存。
+func (c *contextCaches) lookup(hash string, now time.Time, ttl time.Duration) (entry *contextCacheEntry, create bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(now, ttl)
+
+	if e := c.entries[hash]; e != nil && now.Add(contextCacheMargin).Before(e.expiresAt) {
+		return e, false
+	}
+	last, seen := c.seen[hash]
+	c.seen[hash] = now
+	// 缓存过期的前缀已经被证明是稳定的，直接重新创建
+	stable := c.entries[hash] != nil || (seen && now.Sub(last) < ttl)
+	if !stable || c.creating[hash] {
+		return nil, false
+	}
+	c.creating[hash] = true
+	return nil, true
+}
+
+// store 保存创建结果，entry 为 nil 表示没有结果 (如客户端已断开)，之后可以再次尝试
+func (c *contextCaches) store(hash string, entry *contextCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.creating, hash)
+	if entry != nil {
+		c.entries[hash] = entry
+	}
+}
+
+// invalidate 在上游拒绝使用缓存时丢弃它，前缀下次出现时重新创建
+func (c *contextCaches) invalidate(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, hash)
+}
+
+// pruneLocked 每分钟清理一次过期的记录
+func (c *contextCaches) pruneLocked(now time.Time, ttl time.Duration) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+	for hash, e := range c.entries {
+		// 过期的缓存保留一个有效期，用于判断前缀是否稳定
+		if now.After(e.expiresAt.Add(ttl)) {
+			delete(c.entries, hash)
+		}
+	}
+	for hash, t := range c.seen {
+		if now.Sub(t) >= ttl {
+			delete(c.seen, hash)
+		}
+	}
+}
+
+// contextCachedChat 是使用上下文缓存改写后的聊天请求
+type contextCachedChat struct {
+	req   *model.ChatCompletionRequest // 只包含缓存之后的消息，并通过 extra_body 引用缓存
+	entry *contextCacheEntry
+	hash  string
+}
+
+// contextCachedRequest 在请求有可用的上下文缓存时返回改写后的请求，否则返回 nil。
+// 缓存的前缀是最后一条用户消息之前的所有消息；带 tools 的请求和之后还有系统消息的请求不使用缓存，
+// 因为上游要求系统提示词和工具都放在缓存中。
+func (s *GenAIService) contextCachedRequest(ctx context.Context, req *model.ChatCompletionRequest) *contextCachedChat {
+	cfg := s.configManager.Get()
+	if !cfg.ContextCacheEnabled || len(req.Tools) > 0 || req.ToolChoice != nil {
+		return nil
+	}
+	if req.ExtraBody != nil && req.ExtraBody.Google != nil && req.ExtraBody.Google.CachedContent != "" {
+		return nil
+	}
+	split := -1
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == "user" {
+			split = i
+			break
+		}
+	}
+	if split <= 0 {
+		return nil
+	}
+	for _, msg := range req.Messages[split:] {
+		if msg.Role == "system" || msg.Role == "developer" {
+			return nil
+		}
+	}
+	prefix := req.Messages[:split]
+	if estimateMessagesTokens(prefix) < cfg.ContextCacheMinTokens {
+		return nil
+	}
+
+	encoded, err := json.Marshal(prefix)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(append([]byte(req.Model+"\x00"), encoded...))
+	hash := hex.EncodeToString(sum[:])
+
+	entry, create := s.contextCaches.lookup(hash, time.Now(), cfg.ContextCacheTTL)
+	if create {
+		entry = s.createContextCache(ctx, req.Model, prefix, cfg.ContextCacheTTL)
+		s.contextCaches.store(hash, entry)
+	}
+	if entry == nil || entry.name == "" {
+		return nil
+	}
+
+	out := *req
+	out.Messages = req.Messages[split:]
+	var google model.GoogleExtraBody
+	if req.ExtraBody != nil && req.ExtraBody.Google != nil {
+		google = *req.ExtraBody.Google
+	}
+	google.CachedContent = entry.name
+	out.ExtraBody = &model.ExtraBody{Google: &google}
+	return &contextCachedChat{req: &out, entry: entry, hash: hash}
+}
+
+// createContextCache 用 Key 池中的一个 Key 创建上游缓存。创建失败时返回名称为空的记录，有效期内不再尝试；
+// 客户端断开时返回 nil。
+func (s *GenAIService) createContextCache(ctx context.Context, modelName string, prefix []model.Message, ttl time.Duration) *contextCacheEntry {
+	native, err := newNativeChatRequest(&model.ChatCompletionRequest{Messages: prefix})
+	if err != nil {
+		logger.Warn("[上下文缓存] 无法转换请求前缀，不使用缓存: %v", err)
+		return &contextCacheEntry{expiresAt: time.Now().Add(ttl)}
+	}
+	payload := map[string]interface{}{
+		"model": "models/" + modelName,
+		"ttl":   fmt.Sprintf("%ds", int(ttl.Seconds())),
+	}
+	if system, ok := native.payload["systemInstruction"]; ok {
+		payload["systemInstruction"] = system
+	}
+	if contents, _ := native.payload["contents"].([]map[string]interface{}); len(contents) > 0 {
+		payload["contents"] = contents
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return &contextCacheEntry{expiresAt: time.Now().Add(ttl)}
+	}
+
+	var entry *contextCacheEntry
+	err = s.doWithRetry(ctx, upstreamCall{
+		label:        "上下文缓存",
+		model:        modelName,
+		keepKeyOn4xx: true,
+		newRequest: func(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+			httpReq, err := http.NewRequestWithContext(ctx, "POST", geminiAPIBase+"/cachedContents", bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			httpReq.Header.Set("X-Goog-Api-Key", key.Key)
+			httpReq.Header.Set("Content-Type", "application/json")
+			return httpReq, nil
+		},
+		onSuccess: func(resp *http.Response, key *model.APIKey) error {
+			var respBody []byte
+			if err := readBody(resp, &respBody); err != nil {
+				return err
+			}
+			var created struct {
+				Name          string `json:"name"`
+				ExpireTime    string `json:"expireTime"`
+				UsageMetadata struct {
+					TotalTokenCount int `json:"totalTokenCount"`
+				} `json:"usageMetadata"`
+			}
+			if err := json.Unmarshal(respBody, &created); err != nil || created.Name == "" {
+				return fmt.Errorf("解析上游缓存响应失败: %s", string(respBody))
+			}
+			entry = &contextCacheEntry{name: created.Name, keyID: key.ID, tokens: created.UsageMetadata.TotalTokenCount, expiresAt: time.Now().Add(ttl)}
+			if expires, err := time.Parse(time.RFC3339Nano, created.ExpireTime); err == nil {
+				entry.expiresAt = expires
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		logger.Warn("[上下文缓存] 为模型 %s 创建缓存失败，%s 内不再尝试: %v", modelName, ttl, err)
+		return &contextCacheEntry{expiresAt: time.Now().Add(ttl)}
+	}
+	logger.Info("[上下文缓存] 已创建 %s (模型: %s, Key ID: %d, %d tokens, 到期时间 %s)", entry.name, modelName, entry.keyID, entry.tokens, entry.expiresAt.Format(time.RFC3339))
+	return entry
+}
+
+// contextCacheHit 记录一次命中缓存的请求
+func (s *GenAIService) contextCacheHit(cached *contextCachedChat, modelName string) {
+	s.metrics.RecordRequest(modelName)
+	logger.Info("[上下文缓存] 请求命中 %s (Key ID: %d)，%d 个输入 token 来自缓存", cached.entry.name, cached.entry.keyID, cached.entry.tokens)
+}
+
+// contextCacheFailed 记录使用缓存失败的原因。上游的 4xx 错误 (如缓存已被删除) 使缓存失效，
+// 其他错误 (如 Key 冷却中) 只影响本次请求。调用方随后改为发送完整的请求。
+func (s *GenAIService) contextCacheFailed(cached *contextCachedChat, err error) {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.StatusCode >= 400 && upstreamErr.StatusCode < 500 && upstreamErr.StatusCode != http.StatusTooManyRequests {
+		s.contextCaches.invalidate(cached.hash)
+	}
+	logger.Warn("[上下文缓存] 使用 %s (Key ID: %d) 失败，改为普通请求: %v", cached.entry.name, cached.entry.keyID, err)
+}
+
+// applyContextCacheUsage 在 usage 中报告命中缓存的 token 数，上游已经报告时以上游为准
+func applyContextCacheUsage(usage *model.Usage, cachedTokens int) {
+	if usage.PromptTokensDetails == nil {
+		usage.PromptTokensDetails = &model.PromptTokensDetails{}
+	}
+	if usage.PromptTokensDetails.CachedTokens == 0 {
+		usage.PromptTokensDetails.CachedTokens = cachedTokens
+	}
+}
+
+// contextCacheUsageWriter 转发流式响应，并在带 usage 的 chunk 中补充命中缓存的 token 数。
+// written 记录已经写给客户端的字节数，没有写出任何数据时失败的请求可以改为普通请求。
+type contextCacheUsageWriter struct {
+	out     io.Writer
+	tokens  int
+	buf     []byte
+	written int
+}
+
+func (w *contextCacheUsageWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.rewrite(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+		n, err := w.out.Write(line)
+		w.written += n
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// rewrite 处理一行 SSE 数据，只修改包含 usage 对象的 data 行
+func (w *contextCacheUsageWriter) rewrite(line []byte) []byte {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok || !bytes.Contains(data, []byte(`"usage"`)) {
+		return line
+	}
+	var chunk map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&chunk); err != nil {
+		return line
+	}
+	usage, ok := chunk["usage"].(map[string]interface{})
+	if !ok {
+		return line
+	}
+	details, _ := usage["prompt_tokens_details"].(map[string]interface{})
+	if details == nil {
+		details = make(map[string]interface{})
+		usage["prompt_tokens_details"] = details
+	}
+	if cached, _ := jsonNumber(details["cached_tokens"]); cached == 0 {
+		details["cached_tokens"] = w.tokens
+	}
+	rewritten, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return append(append([]byte("data: "), rewritten...), '\n')
+}
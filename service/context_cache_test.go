@@ -0,0 +1,150 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContextCachesLookup(t *testing.T) {
+	const ttl = 10 * time.Minute
+	// 每一步在 at 时刻执行一个操作: 查询 (检查返回的缓存名和 create)、保存创建结果或丢弃缓存
+	type step struct {
+		at         time.Duration
+		store      *contextCacheEntry // 不为 nil 时保存创建结果
+		abandon    bool               // 创建缓存的客户端已断开，调用 store(nil)
+		invalidate bool
+		want       string // 查询返回的缓存名，"" 表示没有缓存，"failed" 表示创建失败的记录
+		create     bool
+	}
+	lookup := func(at time.Duration, want string, create bool) step {
+		return step{at: at, want: want, create: create}
+	}
+	created := func(at time.Duration, name string, expiresIn time.Duration) step {
+		return step{at: at, store: &contextCacheEntry{name: name, expiresAt: time.Time{}.Add(at + expiresIn)}}
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "second sighting within the TTL creates the cache",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(time.Minute, "", true),
+				lookup(time.Minute, "", false), // 已有请求在创建
+				created(time.Minute, "cachedContents/a", ttl),
+				lookup(2*time.Minute, "cachedContents/a", false),
+			},
+		},
+		{
+			name: "sightings further apart than the TTL are not stable",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(ttl, "", false),
+				lookup(ttl+time.Minute, "", true),
+			},
+		},
+		{
+			name: "cache inside the expiry margin is recreated",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(time.Minute, "", true),
+				created(time.Minute, "cachedContents/a", ttl),
+				lookup(time.Minute+ttl-contextCacheMargin-time.Second, "cachedContents/a", false),
+				lookup(time.Minute+ttl-contextCacheMargin, "", true),
+				created(time.Minute+ttl-contextCacheMargin, "cachedContents/b", ttl),
+				lookup(time.Minute+ttl, "cachedContents/b", false),
+			},
+		},
+		{
+			name: "expired cache is recreated on the next sighting",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(time.Minute, "", true),
+				created(time.Minute, "cachedContents/a", ttl),
+				lookup(time.Minute+ttl+5*time.Minute, "", true),
+			},
+		},
+		{
+			name: "failed creation is not retried until it expires",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(time.Minute, "", true),
+				created(time.Minute, "", ttl),
+				lookup(2*time.Minute, "failed", false),
+				lookup(time.Minute+ttl, "", true),
+			},
+		},
+		{
+			name: "abandoned creation can be retried",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(time.Minute, "", true),
+				{at: time.Minute, abandon: true},
+				lookup(2*time.Minute, "", true),
+			},
+		},
+		{
+			name: "invalidated cache is recreated",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(time.Minute, "", true),
+				created(time.Minute, "cachedContents/a", ttl),
+				{at: 2 * time.Minute, invalidate: true},
+				lookup(3*time.Minute, "", true),
+			},
+		},
+		{
+			name: "pruned prefix starts over",
+			steps: []step{
+				lookup(0, "", false),
+				lookup(time.Minute, "", true),
+				created(time.Minute, "cachedContents/a", ttl),
+				// 过期的缓存保留一个有效期，之后和出现记录一起被清理
+				lookup(time.Minute+2*ttl+time.Second, "", false),
+				lookup(time.Minute+2*ttl+2*time.Second, "", true),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newContextCaches()
+			for i, s := range tt.steps {
+				now := time.Time{}.Add(s.at)
+				switch {
+				case s.abandon:
+					c.store("prefix", nil)
+				case s.store != nil:
+					c.store("prefix", s.store)
+				case s.invalidate:
+					c.invalidate("prefix")
+				default:
+					entry, create := c.lookup("prefix", now, ttl)
+					got := ""
+					if entry != nil {
+						got = entry.name
+						if got == "" {
+							got = "failed"
+						}
+					}
+					if got != s.want || create != s.create {
+						t.Fatalf("step %d: lookup = %q, %v, want %q, %v", i, got, create, s.want, s.create)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("prefixes are tracked separately", func(t *testing.T) {
+		c := newContextCaches()
+		now := time.Time{}
+		c.lookup("a", now, ttl)
+		if _, create := c.lookup("b", now.Add(time.Second), ttl); create {
+			t.Error("first sighting of b created a cache")
+		}
+		if _, create := c.lookup("a", now.Add(2*time.Second), ttl); !create {
+			t.Error("second sighting of a did not create a cache")
+		}
+	})
+}
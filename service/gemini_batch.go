@@ -0,0 +1,318 @@
+// service/gemini_batch.go
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// geminiDownloadBase 是 Gemini 文件下载接口的基础地址
+const geminiDownloadBase = "https://generativelanguage.googleapis.com/download/v1beta"
+
+var (
+	// ErrGeminiBatchNotFound 表示批处理不是通过本服务创建的，或不属于当前客户端
+	ErrGeminiBatchNotFound = errors.New("批处理不存在")
+	// ErrGeminiBatchKeyGone 表示创建批处理的 Key 已从数据库中删除，无法再访问该批处理
+	ErrGeminiBatchKeyGone = errors.New("创建该批处理的 API Key 已被删除")
+	// ErrGeminiBatchKeyDisabled 表示创建批处理的 Key 已被禁用，重新启用之前无法访问该批处理
+	ErrGeminiBatchKeyDisabled = errors.New("创建该批处理的 API Key 已被禁用")
+)
+
+// geminiOperation 是上游批处理 Operation 中我们关心的字段
+type geminiOperation struct {
+	Name     string `json:"name"`
+	Done     bool   `json:"done"`
+	Metadata struct {
+		Model       string `json:"model"`
+		DisplayName string `json:"displayName"`
+		State       string `json:"state"`
+		Output      struct {
+			ResponsesFile string `json:"responsesFile"`
+		} `json:"output"`
+	} `json:"metadata"`
+	Response struct {
+		ResponsesFile string `json:"responsesFile"`
+	} `json:"response"`
+}
+
+// GeminiBatchProxy 代理 Gemini 原生批处理 (models/{model}:batchGenerateContent 和 batches/* 操作)。
+// 上游批处理属于创建它的 Key 所在的项目，因此创建时记录所用的 Key，
+// 之后的查询、取消、删除和结果下载都固定使用这个 Key，而不是从 Key 池中轮询。
+type GeminiBatchProxy struct {
+	genaiService *GenAIService
+	keyStore     *storage.KeyStore
+	store        *storage.BatchStore
+}
+
+func NewGeminiBatchProxy(genaiService *GenAIService, keyStore *storage.KeyStore, store *storage.BatchStore) *GeminiBatchProxy {
+	return &GeminiBatchProxy{genaiService: genaiService, keyStore: keyStore, store: store}
+}
+
+// Create 从 Key 池中取 Key 创建批处理，并记录该 Key。返回上游的响应体和状态码。
+func (p *GeminiBatchProxy) Create(ctx context.Context, clientID uint, modelName string, reqBody []byte) ([]byte, int, error) {
+	urlStr := fmt.Sprintf("%s/models/%s:batchGenerateContent", geminiAPIBase, modelName)
+
+	var respBody []byte
+	err := p.genaiService.doWithRetry(ctx, upstreamCall{
+		label: "Gemini BatchGenerateContent",
+		model: modelName,
+		newRequest: func(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+			httpReq, err := http.NewRequestWithContext(ctx, "POST", urlStr, bytes.NewReader(reqBody))
+			if err != nil {
+				return nil, err
+			}
+			httpReq.Header.Set("X-Goog-Api-Key", key.Key)
+			httpReq.Header.Set("Content-Type", "application/json")
+			return httpReq, nil
+		},
+		onSuccess: func(resp *http.Response, key *model.APIKey) error {
+			if err := readBody(resp, &respBody); err != nil {
+				return err
+			}
+			var op geminiOperation
+			if err := json.Unmarshal(respBody, &op); err != nil || op.Name == "" {
+				return fmt.Errorf("无法解析上游返回的批处理: %s", string(respBody))
+			}
+			batch := &model.GeminiBatch{
+				Name:     op.Name,
+				KeyID:    key.ID,
+				ClientID: clientID,
+				Model:    modelName,
+			}
+			applyOperation(batch, &op, respBody)
+			if err := p.store.CreateGeminiBatch(batch); err != nil {
+				// 记录失败意味着之后无法找到对应的 Key，但上游批处理已经创建，只能记录日志
+				logger.Error("[Gemini Batch] 保存批处理 %s (Key ID: %d) 失败: %v", op.Name, key.ID, err)
+				return nil
+			}
+			logger.Info("[Gemini Batch] 已创建批处理 %s (模型: %s, Key ID: %d)", op.Name, modelName, key.ID)
+			return nil
+		},
+	})
+	if err != nil {
+		var upstreamErr *UpstreamError
+		if errors.As(err, &upstreamErr) && upstreamErr.StatusCode < 500 && upstreamErr.StatusCode != http.StatusTooManyRequests {
+			return upstreamErr.Body, upstreamErr.StatusCode, err
+		}
+		return nil, http.StatusServiceUnavailable, err
+	}
+	return respBody, http.StatusOK, nil
+}
+
+// List 返回客户端通过本服务创建的批处理。clientID 为 nil 时返回所有客户端的批处理
+func (p *GeminiBatchProxy) List(clientID *uint) ([]model.GeminiBatch, error) {
+	return p.store.ListGeminiBatches(clientID)
+}
+
+// Get 使用创建批处理的 Key 查询其最新状态，并更新本地记录
+func (p *GeminiBatchProxy) Get(ctx context.Context, clientID *uint, name string) ([]byte, int, error) {
+	batch, err := p.find(clientID, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return p.poll(ctx, batch)
+}
+
+// Cancel 使用创建批处理的 Key 取消批处理
+func (p *GeminiBatchProxy) Cancel(ctx context.Context, clientID *uint, name string) ([]byte, int, error) {
+	batch, err := p.find(clientID, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, status, err := p.pinned(ctx, batch, "POST", fmt.Sprintf("%s/%s:cancel", geminiAPIBase, batch.Name), nil)
+	if err == nil && status == http.StatusOK {
+		logger.Info("[Gemini Batch] 已取消批处理 %s (Key ID: %d)", batch.Name, batch.KeyID)
+	}
+	return body, status, err
+}
+
+// Delete 使用创建批处理的 Key 删除上游批处理，成功后删除本地记录
+func (p *GeminiBatchProxy) Delete(ctx context.Context, clientID *uint, name string) ([]byte, int, error) {
+	batch, err := p.find(clientID, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, status, err := p.pinned(ctx, batch, "DELETE", fmt.Sprintf("%s/%s", geminiAPIBase, batch.Name), nil)
+	if err == nil && (status == http.StatusOK || status == http.StatusNotFound) {
+		if err := p.store.DeleteGeminiBatch(batch.ID); err != nil {
+			logger.Warn("[Gemini Batch] 删除批处理 %s 的本地记录失败: %v", batch.Name, err)
+		}
+	}
+	return body, status, err
+}
+
+// Download 使用创建批处理的 Key 下载其结果文件，响应体原样写入 w
+func (p *GeminiBatchProxy) Download(ctx context.Context, clientID *uint, fileName string, w http.ResponseWriter) error {
+	batch, err := p.store.FindGeminiBatchByResponsesFile(fileName, clientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrGeminiBatchNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	urlStr := fmt.Sprintf("%s/%s:download?alt=media", geminiDownloadBase, fileName)
+	resp, key, err := p.do(ctx, batch, "GET", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	defer p.genaiService.keyPool.ReleaseKey(key)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		p.genaiService.keyPool.MarkRateLimited(key.ID)
+	}
+
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Disposition"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// RefreshAll 使用各自的 Key 查询所有未结束的批处理，返回成功刷新的数量
+func (p *GeminiBatchProxy) RefreshAll(ctx context.Context) (int, error) {
+	batches, err := p.store.ListGeminiBatches(nil)
+	if err != nil {
+		return 0, err
+	}
+	refreshed := 0
+	for i := range batches {
+		if batches[i].IsTerminal() {
+			continue
+		}
+		if _, status, err := p.poll(ctx, &batches[i]); err != nil || status != http.StatusOK {
+			logger.Warn("[Gemini Batch] 刷新批处理 %s 失败 (HTTP %d): %v", batches[i].Name, status, err)
+			continue
+		}
+		refreshed++
+	}
+	return refreshed, nil
+}
+
+func (p *GeminiBatchProxy) find(clientID *uint, name string) (*model.GeminiBatch, error) {
+	if !strings.HasPrefix(name, "batches/") {
+		name = "batches/" + name
+	}
+	batch, err := p.store.GetGeminiBatch(name, clientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrGeminiBatchNotFound
+	}
+	return batch, err
+}
+
+// poll 查询批处理的最新状态并保存到本地记录
+func (p *GeminiBatchProxy) poll(ctx context.Context, batch *model.GeminiBatch) ([]byte, int, error) {
+	body, status, err := p.pinned(ctx, batch, "GET", fmt.Sprintf("%s/%s", geminiAPIBase, batch.Name), nil)
+	if err != nil || status != http.StatusOK {
+		return body, status, err
+	}
+
+	var op geminiOperation
+	if err := json.Unmarshal(body, &op); err == nil {
+		now := time.Now()
+		batch.LastPolledAt = &now
+		applyOperation(batch, &op, body)
+		if err := p.store.UpdateGeminiBatch(batch); err != nil {
+			logger.Warn("[Gemini Batch] 更新批处理 %s 的状态失败: %v", batch.Name, err)
+		}
+	}
+	return body, status, nil
+}
+
+// pinned 使用创建批处理的 Key 发送请求，返回上游的响应体和状态码。
+// 上游的错误响应 (包括 429) 原样返回给客户端，因为无法换用其他 Key 重试。
+func (p *GeminiBatchProxy) pinned(ctx context.Context, batch *model.GeminiBatch, method, urlStr string, body []byte) ([]byte, int, error) {
+	resp, key, err := p.do(ctx, batch, method, urlStr, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer p.genaiService.keyPool.ReleaseKey(key)
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("读取上游响应失败: %w", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		p.genaiService.keyPool.MarkRateLimited(key.ID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Warn("[Gemini Batch] %s %s 失败 (Key ID: %d, HTTP %d)", method, batch.Name, key.ID, resp.StatusCode)
+	}
+	return respBody, resp.StatusCode, nil
+}
+
+// do 从 Key 池中取出创建批处理的 Key 发送请求，调用方在用完响应后需要通过 ReleaseKey 归还该 Key。
+// Key 已被删除或禁用时返回 ErrGeminiBatchKeyGone / ErrGeminiBatchKeyDisabled，冷却中或并发已满时返回 ErrNoAvailableKeys。
+func (p *GeminiBatchProxy) do(ctx context.Context, batch *model.GeminiBatch, method, urlStr string, body []byte) (*http.Response, *model.APIKey, error) {
+	key, err := p.genaiService.keyPool.GetKeyByID(batch.KeyID)
+	if err != nil {
+		return nil, nil, p.pinnedKeyError(batch.KeyID, err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, urlStr, reader)
+	if err != nil {
+		p.genaiService.keyPool.ReleaseKey(key)
+		return nil, nil, err
+	}
+	httpReq.Header.Set("X-Goog-Api-Key", key.Key)
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.genaiService.httpClient.Do(httpReq)
+	if err != nil {
+		p.genaiService.keyPool.ReleaseKey(key)
+		return nil, nil, fmt.Errorf("请求 Google API 失败 (Key ID: %d): %w", key.ID, err)
+	}
+	return resp, key, nil
+}
+
+// pinnedKeyError 区分创建批处理的 Key 不在池中的原因: 已删除、已禁用，或只是暂时不可用
+func (p *GeminiBatchProxy) pinnedKeyError(keyID uint, err error) error {
+	key, findErr := p.keyStore.FindByID(keyID)
+	switch {
+	case errors.Is(findErr, gorm.ErrRecordNotFound):
+		return ErrGeminiBatchKeyGone
+	case findErr != nil:
+		return findErr
+	case !key.Enabled:
+		return ErrGeminiBatchKeyDisabled
+	}
+	return fmt.Errorf("Key ID %d 当前不可用: %w", keyID, err)
+}
+
+// applyOperation 将上游 Operation 中的状态写入本地记录
+func applyOperation(batch *model.GeminiBatch, op *geminiOperation, raw []byte) {
+	batch.Operation = string(raw)
+	if op.Metadata.DisplayName != "" {
+		batch.DisplayName = op.Metadata.DisplayName
+	}
+	if op.Metadata.State != "" {
+		batch.State = op.Metadata.State
+	}
+	if file := op.Metadata.Output.ResponsesFile; file != "" {
+		batch.ResponsesFile = file
+	} else if file := op.Response.ResponsesFile; file != "" {
+		batch.ResponsesFile = file
+	}
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestGeminiBatchProxy 创建使用临时 SQLite 数据库的 GeminiBatchProxy，数据库和 Key 池中有两个 AI Studio Key，
+// 发往 Gemini API 的请求由一个替身应答: 创建和查询返回 batches/b1，取消返回空对象
+func newTestGeminiBatchProxy(t *testing.T) (*GeminiBatchProxy, func() []recordedRequest) {
+	t.Helper()
+	manager := newTestConfigManager(t, "DB_DRIVER", "sqlite3", "SQLITE_PATH", filepath.Join(t.TempDir(), "data.db"), "MAX_RETRIES", "1")
+	db, err := storage.InitDB(manager.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	keyStore := storage.NewKeyStore(db)
+	var keys []model.APIKey
+	for _, value := range []string{"AIza-first", "AIza-second"} {
+		key := model.APIKey{Key: value, Provider: model.ProviderAIStudio}
+		if err := keyStore.AddCredential(&key); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	genai, requests := newAIStudioTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ":cancel") {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"name":"batches/b1","metadata":{"model":"models/gemini-2.5-flash","state":"BATCH_STATE_PENDING"}}`))
+	}, keys...)
+	genai.keyStore = keyStore
+	return NewGeminiBatchProxy(genai, keyStore, storage.NewBatchStore(db)), requests
+}
+
+func TestGeminiBatchKeyPinning(t *testing.T) {
+	proxy, requests := newTestGeminiBatchProxy(t)
+	ctx := context.Background()
+	clientID := uint(7)
+
+	if _, status, err := proxy.Create(ctx, clientID, "gemini-2.5-flash", []byte(`{"batch":{}}`)); err != nil || status != http.StatusOK {
+		t.Fatalf("Create = %d, %v", status, err)
+	}
+	batches, err := proxy.List(&clientID)
+	if err != nil || len(batches) != 1 {
+		t.Fatalf("List = %v, %v; want the created batch", batches, err)
+	}
+	creator := batches[0].KeyID
+	creatorKey := requests()[0].header.Get("X-Goog-Api-Key")
+
+	// 查询和取消总是使用创建批处理的 Key，用完后归还
+	for i := 0; i < 5; i++ {
+		if _, status, err := proxy.Get(ctx, &clientID, "b1"); err != nil || status != http.StatusOK {
+			t.Fatalf("Get = %d, %v", status, err)
+		}
+	}
+	if _, status, err := proxy.Cancel(ctx, &clientID, "batches/b1"); err != nil || status != http.StatusOK {
+		t.Fatalf("Cancel = %d, %v", status, err)
+	}
+	for _, req := range requests()[1:] {
+		if got := req.header.Get("X-Goog-Api-Key"); got != creatorKey {
+			t.Errorf("%s %s used key %q, want the creating key %q", req.method, req.path, got, creatorKey)
+		}
+	}
+	if last := requests()[len(requests())-1]; last.method != http.MethodPost || last.path != "/v1beta/batches/b1:cancel" {
+		t.Errorf("cancel request = %s %s", last.method, last.path)
+	}
+	if got := proxy.genaiService.keyPool.GetInFlightCounts([]uint{creator}); got[creator] != 0 {
+		t.Errorf("creating key still has %d requests in flight", got[creator])
+	}
+
+	// 其他客户端看不到该批处理
+	other := uint(8)
+	if _, _, err := proxy.Get(ctx, &other, "b1"); !errors.Is(err, ErrGeminiBatchNotFound) {
+		t.Errorf("Get from another client: got %v, want ErrGeminiBatchNotFound", err)
+	}
+}
+
+func TestGeminiBatchPinnedKeyUnavailable(t *testing.T) {
+	tests := []struct {
+		name    string
+		disable func(p *GeminiBatchProxy, keyID uint)
+		wantErr error
+	}{
+		{
+			name:    "cooling down",
+			disable: func(p *GeminiBatchProxy, keyID uint) { p.genaiService.keyPool.MarkRateLimited(keyID) },
+			wantErr: ErrNoAvailableKeys,
+		},
+		{
+			name: "disabled",
+			disable: func(p *GeminiBatchProxy, keyID uint) {
+				p.genaiService.disableKey(&model.APIKey{ID: keyID}, "test")
+			},
+			wantErr: ErrGeminiBatchKeyDisabled,
+		},
+		{
+			name: "deleted",
+			disable: func(p *GeminiBatchProxy, keyID uint) {
+				p.keyStore.Delete(keyID)
+				p.genaiService.keyPool.Remove(keyID)
+			},
+			wantErr: ErrGeminiBatchKeyGone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, requests := newTestGeminiBatchProxy(t)
+			ctx := context.Background()
+			if _, _, err := proxy.Create(ctx, 1, "gemini-2.5-flash", []byte(`{"batch":{}}`)); err != nil {
+				t.Fatal(err)
+			}
+			batches, _ := proxy.List(nil)
+			creator := batches[0].KeyID
+			tt.disable(proxy, creator)
+			before := len(requests())
+
+			// 不会换用池中的其他 Key，也不会发出请求
+			if _, _, err := proxy.Get(ctx, nil, "b1"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Get: got %v, want %v", err, tt.wantErr)
+			}
+			if _, _, err := proxy.Cancel(ctx, nil, "b1"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Cancel: got %v, want %v", err, tt.wantErr)
+			}
+			if n := len(requests()) - before; n != 0 {
+				t.Errorf("%d requests reached the upstream with the creating key unavailable", n)
+			}
+		})
+	}
+}
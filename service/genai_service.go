@@ -1,11 +1,8 @@
 package service
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"gemini_polling/config" // 引入 config 包
 	"gemini_polling/logger"
@@ -15,7 +12,6 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
@@ -26,6 +22,14 @@ type GenAIService struct {
 	httpClient    *http.Client
 	configManager *config.Manager // 持有 Manager 而不是静态配置
 	keyPool       *KeyPool
+	breakers      *CircuitBreakers
+	metrics       *Metrics
+	cache         *ResponseCache
+	inflight      *coalescer
+	media         *mediaFetcher
+	contextCaches *contextCaches
+	tokenLimits   TokenLimitSource
+	vertexTokens  *vertexTokens
 }
 
 // BannedKeyInfo 用于向前端展示被临时禁用的Key信息
@@ -35,7 +39,7 @@ type BannedKeyInfo struct {
 }
 
 // NewGenAIService 构造函数现在接收完整的配置
-func NewGenAIService(manager *config.Manager, keyStore *storage.KeyStore, keyPool *KeyPool) *GenAIService {
+func NewGenAIService(manager *config.Manager, keyStore *storage.KeyStore, keyPool *KeyPool, cache *ResponseCache) *GenAIService {
 	// 优化后的 HTTP 连接池配置
 	transport := &http.Transport{
 		// 连接池大小优化 - 支持更高的并发
@@ -66,10 +70,21 @@ func NewGenAIService(manager *config.Manager, keyStore *storage.KeyStore, keyPoo
 		httpClient:    &http.Client{Timeout: 5 * time.Minute, Transport: transport},
 		configManager: manager,
 		keyPool:       keyPool,
+		breakers:      NewCircuitBreakers(manager),
+		metrics:       NewMetrics(),
+		cache:         cache,
+		inflight:      newCoalescer(),
+		media:         newMediaFetcher(manager),
+		contextCaches: newContextCaches(),
+		vertexTokens:  newVertexTokens(),
 	}
 }
 
-// StreamChat 现在使用配置的最大重试次数
+// SetTokenLimitSource 设置请求上游之前检查 token 上限使用的模型上限来源
+func (s *GenAIService) SetTokenLimitSource(source TokenLimitSource) {
+	s.tokenLimits = source
+}
+
 // StreamChat 现在使用配置的最大重试次数
 func (s *GenAIService) StreamChat(ctx context.Context, w io.Writer, req *model.ChatCompletionRequest) error {
 	flusher, ok := w.(http.Flusher)
@@ -77,106 +92,96 @@ func (s *GenAIService) StreamChat(ctx context.Context, w io.Writer, req *model.C
 		return fmt.Errorf("streaming unsupported")
 	}
 
+	parts, err := s.choiceParts(req.N)
+	if err != nil {
+		return err
+	}
+	if _, _, err := requestedThinking(req); err != nil {
+		return err
+	}
+	if err := checkTools(req); err != nil {
+		return err
+	}
+	promptTokens := estimateChatRequestTokens(req)
+	if err := s.checkTokenLimits(req.Model, promptTokens, "messages", req.MaxTokens, "max_tokens"); err != nil {
+		return err
+	}
+	if err := s.media.inlineMessages(ctx, req.Messages); err != nil {
+		return err
+	}
 	req.Stream = true
-
-	reqBodyBytes, err := json.Marshal(req)
+	cacheBody, err := json.Marshal(req)
 	if err != nil {
 		return fmt.Errorf("序列化请求体失败: %w", err)
 	}
 
-	maxRetries := s.configManager.Get().MaxRetries
-	var lastErr error
-
-	for i := 0; i < maxRetries; i++ {
-		activeKey, err := s.keyPool.GetKey()
-		if err != nil {
-			lastErr = err
-			if errors.Is(err, ErrNoAvailableKeys) {
-				logger.Infoln("无可用 Key，等待 Key 池释放...")
-				time.Sleep(2 * time.Second) // Wait a bit before retrying
-			}
-			continue
-		}
-
-		logger.Info("第 %d 次尝试, 使用 Key ID: %d, 模型: %s", i+1, activeKey.ID, req.Model)
-
-		const url = "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBodyBytes))
-		if err != nil {
-			lastErr = fmt.Errorf("创建 HTTP 请求失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false) // Return key on failure
-			logger.Errorln(lastErr)
-			continue
+	return s.cachedStream(ctx, w, flusher, "chat_stream", req.Model, cacheBody, func(ctx context.Context, out io.Writer) error {
+		out = &streamUsageWriter{out: out, promptTokens: promptTokens}
+		if parts != nil {
+			return s.fanOutStreamChat(ctx, w, out, flusher, req, parts)
 		}
+		return s.streamChat(ctx, w, out, flusher, req)
+	})
+}
 
-		httpReq.Header.Set("Authorization", "Bearer "+activeKey.Key)
-		httpReq.Header.Set("Content-Type", "application/json")
-		httpReq.Header.Set("Accept", "text/event-stream")
-		httpReq.Header.Set("Cache-Control", "no-cache")
-		httpReq.Header.Set("Connection", "keep-alive")
-
-		resp, err := s.httpClient.Do(httpReq)
-		if err != nil {
-			lastErr = fmt.Errorf("请求 Google API 失败 (Key ID: %d): %w", activeKey.ID, err)
-			s.keyPool.ReturnKey(activeKey, false) // Return key on network failure
-			logger.Errorln(lastErr)
-			continue
-		}
-		defer resp.Body.Close()
+// streamChat 按回退链依次尝试模型，将上游 SSE 流转发到 out。
+// 请求有可用的上下文缓存时先使用缓存，在向客户端写出数据之前失败则改为普通请求。
+func (s *GenAIService) streamChat(ctx context.Context, w, out io.Writer, flusher http.Flusher, req *model.ChatCompletionRequest) error {
+	if usesBuiltinTools(req) {
+		return s.streamNativeChat(ctx, w, out, flusher, req)
+	}
+	if cached := s.contextCachedRequest(ctx, req); cached != nil {
+		ctx, meta := ensureResponseMeta(ctx)
+		meta.RequestedModel, meta.ServedModel = req.Model, req.Model
+		cachedOut := &contextCacheUsageWriter{out: out, tokens: cached.entry.tokens}
+		err := s.streamChatAttempt(ctx, w, cachedOut, flusher, cached.req, req.Model, cached.entry.keyID)
+		if err == nil {
+			s.contextCacheHit(cached, req.Model)
+			return nil
+		}
+		if cachedOut.written > 0 || ctx.Err() != nil {
+			return err
+		}
+		s.contextCacheFailed(cached, err)
+	}
+	return s.withFallback(ctx, req.Model, func(ctx context.Context, modelName string) error {
+		return s.streamChatAttempt(ctx, w, out, flusher, req, modelName, 0)
+	})
+}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			errorMsg := fmt.Sprintf("上游API错误 (HTTP %d): %s", resp.StatusCode, string(body))
-			lastErr = errors.New(errorMsg)
-			logger.Error("Key ID %d 请求失败: %s", activeKey.ID, errorMsg)
-
-			if resp.StatusCode == http.StatusTooManyRequests {
-				s.keyPool.ReturnKey(activeKey, true) // Cooldown
-			} else {
-				if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-					s.keyStore.Disable(activeKey.ID, errorMsg)
-				}
-				s.keyPool.ReturnKey(activeKey, false) // Return without cooldown
-			}
-			continue
-		}
+// streamChatAttempt 使用指定模型发送一次流式请求，keyID 不为 0 时固定使用该 Key
+func (s *GenAIService) streamChatAttempt(ctx context.Context, w, out io.Writer, flusher http.Flusher, req *model.ChatCompletionRequest, modelName string, keyID uint) error {
+	attemptReq, splitThinking := thinkingRequest(req, modelName, s.configManager.Get().ThinkingBudgets)
+	attemptReq.Model = modelName
+	reqBodyBytes, err := json.Marshal(attemptReq)
+	if err != nil {
+		return fmt.Errorf("序列化请求体失败: %w", err)
+	}
 
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.TrimSpace(line) == "" {
-				continue
-			}
-			if _, err := fmt.Fprintf(w, "%s\n\n", line); err != nil {
-				logger.Warn("写入响应流失败: %v (客户端可能已断开连接)", err)
-				s.keyPool.ReturnKey(activeKey, false)
-				return err
+	return s.doWithRetry(ctx, upstreamCall{
+		label:        "流式",
+		model:        modelName,
+		api:          apiOpenAIChat,
+		keyID:        keyID,
+		keepKeyOn4xx: keyID != 0,
+		newRequest: func(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+			httpReq, err := s.newOpenAIChatRequest(ctx, key, reqBodyBytes)
+			if err != nil {
+				return nil, err
 			}
-			flusher.Flush()
-			if strings.HasSuffix(line, "[DONE]") {
-				logger.Info("请求处理成功 (Key ID: %d), 流已结束。", activeKey.ID)
-				s.keyPool.ReturnKey(activeKey, false)
-				return nil
+			httpReq.Header.Set("Accept", "text/event-stream")
+			httpReq.Header.Set("Cache-Control", "no-cache")
+			httpReq.Header.Set("Connection", "keep-alive")
+			return httpReq, nil
+		},
+		onSuccess: func(resp *http.Response, key *model.APIKey) error {
+			applyStreamHeaders(ctx, w)
+			if splitThinking {
+				return relayThoughtSSE(out, flusher, resp, key)
 			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			logger.Error("读取上游流时发生错误 (Key ID: %d): %v", activeKey.ID, err)
-			lastErr = err
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
-		}
-
-		logger.Info("请求处理成功 (Key ID: %d), 上游流正常关闭。", activeKey.ID)
-		s.keyPool.ReturnKey(activeKey, false)
-		return nil
-	}
-
-	logger.Error("所有 %d 次重试均失败。", maxRetries)
-	if lastErr != nil {
-		return fmt.Errorf("所有 API Key 均尝试失败，最后一次错误: %w", lastErr)
-	}
-	return errors.New("所有 API Key 均尝试失败，但未捕获到具体错误")
+			return relaySSE(out, flusher, resp, key, true)
+		},
+	})
 }
 
 // =================================================================
@@ -184,232 +189,210 @@ func (s *GenAIService) StreamChat(ctx context.Context, w io.Writer, req *model.C
 // =================================================================
 // NonStreamChat 处理非流式请求，并返回一个完整的响应体或错误
 func (s *GenAIService) NonStreamChat(ctx context.Context, req *model.ChatCompletionRequest) (interface{}, error) {
+	parts, err := s.choiceParts(req.N)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := requestedThinking(req); err != nil {
+		return nil, err
+	}
+	if err := checkTools(req); err != nil {
+		return nil, err
+	}
+	if err := s.checkTokenLimits(req.Model, estimateChatRequestTokens(req), "messages", req.MaxTokens, "max_tokens"); err != nil {
+		return nil, err
+	}
+	if err := s.media.inlineMessages(ctx, req.Messages); err != nil {
+		return nil, err
+	}
 	req.Stream = false // 确保 stream 标志位为 false
-	reqBodyBytes, err := json.Marshal(req)
+	cacheBody, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("序列化请求体失败: %w", err)
 	}
-	maxRetries := s.configManager.Get().MaxRetries
-	var lastErr error
-	for i := 0; i < maxRetries; i++ {
-		activeKey, err := s.keyPool.GetKey()
-		if err != nil {
-			lastErr = err
-			if errors.Is(err, ErrNoAvailableKeys) {
-				logger.Infoln("无可用 Key，等待 Key 池释放...")
-				time.Sleep(2 * time.Second)
-			}
-			continue
-		}
 
-		logger.Info("第 %d 次尝试 (非流式), 使用 Key ID: %d, 模型: %s", i+1, activeKey.ID, req.Model)
-		const url = "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBodyBytes))
-		if err != nil {
-			lastErr = fmt.Errorf("创建 HTTP 请求失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
-		}
-		httpReq.Header.Set("Authorization", "Bearer "+activeKey.Key)
-		httpReq.Header.Set("Content-Type", "application/json")
-		resp, err := s.httpClient.Do(httpReq)
-		if err != nil {
-			lastErr = fmt.Errorf("请求 Google API 失败 (Key ID: %d): %w", activeKey.ID, err)
-			s.keyPool.ReturnKey(activeKey, false)
-			logger.Errorln(lastErr)
-			continue
+	body, err := s.cachedUnary(ctx, "chat", req.Model, cacheBody, func(ctx context.Context) ([]byte, error) {
+		var successResp *model.OpenAICompletionResponse
+		if parts != nil {
+			successResp, err = s.fanOutChat(ctx, req, parts)
+		} else {
+			successResp, err = s.nonStreamChat(ctx, req)
 		}
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			lastErr = fmt.Errorf("读取响应体失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false)
-			logger.Errorln(lastErr)
-			continue
-		}
-
-		if resp.StatusCode == http.StatusOK {
-			logger.Info("非流式请求成功 (Key ID: %d)", activeKey.ID)
-			var successResp model.OpenAICompletionResponse
-			if err := json.Unmarshal(body, &successResp); err != nil {
-				s.keyPool.ReturnKey(activeKey, false)
-				return nil, fmt.Errorf("解析上游成功响应失败: %w", err)
-			}
-			s.keyPool.ReturnKey(activeKey, false)
-			return &successResp, nil
+			return nil, err
 		}
-
-		errorMsg := fmt.Sprintf("上游API错误 (HTTP %d): %s", resp.StatusCode, string(body))
-		lastErr = errors.New(errorMsg)
-		logger.Error("Key ID %d 请求失败: %s", activeKey.ID, errorMsg)
-
-		isRateLimited := resp.StatusCode == http.StatusTooManyRequests
-		if !isRateLimited && resp.StatusCode >= 400 && resp.StatusCode < 500 {
-			s.keyStore.Disable(activeKey.ID, errorMsg)
-		}
-		s.keyPool.ReturnKey(activeKey, isRateLimited)
+		return json.Marshal(successResp)
+	})
+	if err != nil {
+		return nil, err
 	}
-	logger.Error("所有 %d 次重试均失败。", maxRetries)
-	if lastErr != nil {
-		return nil, fmt.Errorf("所有 API Key 均尝试失败，最后一次错误: %w", lastErr)
+
+	var resp model.OpenAICompletionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("解析缓存响应失败: %w", err)
 	}
-	return nil, errors.New("所有 API Key 均尝试失败，但未捕获到具体错误")
+	return &resp, nil
 }
 
-// ListOpenAICompatibleModels 和 ValidateAPIKey 保持不变...
-func (s *GenAIService) ListOpenAICompatibleModels(ctx context.Context) ([]byte, int, error) {
-	activeKey, err := s.keyPool.GetKey()
-	if err != nil {
-		logger.Errorln("获取模型列表失败: 没有可用的API Key")
-		return nil, http.StatusInternalServerError, fmt.Errorf("没有可用的 API Key: %w", err)
+// nonStreamChat 按回退链依次尝试模型，返回解析后的上游响应。
+// 请求有可用的上下文缓存时先使用缓存，失败则改为普通请求。
+func (s *GenAIService) nonStreamChat(ctx context.Context, req *model.ChatCompletionRequest) (*model.OpenAICompletionResponse, error) {
+	if usesBuiltinTools(req) {
+		return s.nonStreamNativeChat(ctx, req)
 	}
-	defer s.keyPool.ReturnKey(activeKey, false) // Always return the key
-
-	logger.Info("正在使用 Key ID: %d 获取 OpenAI 模型列表", activeKey.ID)
-	const url = "https://generativelanguage.googleapis.com/v1beta/openai/models"
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("创建请求失败: %w", err)
+	if cached := s.contextCachedRequest(ctx, req); cached != nil {
+		ctx, meta := ensureResponseMeta(ctx)
+		meta.RequestedModel, meta.ServedModel = req.Model, req.Model
+		resp, err := s.nonStreamChatAttempt(ctx, cached.req, req.Model, cached.entry.keyID)
+		if err == nil {
+			applyContextCacheUsage(&resp.Usage, cached.entry.tokens)
+			s.contextCacheHit(cached, req.Model)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		s.contextCacheFailed(cached, err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+activeKey.Key)
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	var successResp *model.OpenAICompletionResponse
+	err := s.withFallback(ctx, req.Model, func(ctx context.Context, modelName string) error {
+		resp, err := s.nonStreamChatAttempt(ctx, req, modelName, 0)
+		successResp = resp
+		return err
+	})
 	if err != nil {
-		return nil, http.StatusBadGateway, fmt.Errorf("请求 Google API 失败: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return successResp, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// nonStreamChatAttempt 使用指定模型发送一次非流式请求，keyID 不为 0 时固定使用该 Key
+func (s *GenAIService) nonStreamChatAttempt(ctx context.Context, req *model.ChatCompletionRequest, modelName string, keyID uint) (*model.OpenAICompletionResponse, error) {
+	attemptReq, splitThinking := thinkingRequest(req, modelName, s.configManager.Get().ThinkingBudgets)
+	attemptReq.Model = modelName
+	reqBodyBytes, err := json.Marshal(attemptReq)
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("读取响应体失败: %w", err)
+		return nil, fmt.Errorf("序列化请求体失败: %w", err)
 	}
 
-	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-		errorReason := fmt.Sprintf("获取模型列表失败, 状态码: %d", resp.StatusCode)
-		if resp.StatusCode == http.StatusTooManyRequests {
-			// This key is already on cooldown via the main request logic,
-			// but we can re-affirm it here if needed.
-			s.keyPool.ReturnKey(activeKey, true)
-		} else {
-			s.keyStore.Disable(activeKey.ID, errorReason)
-		}
-		logger.Warn("因获取模型列表失败而处理 Key ID %d", activeKey.ID)
+	var successResp model.OpenAICompletionResponse
+	err = s.doWithRetry(ctx, upstreamCall{
+		label:        "非流式",
+		model:        modelName,
+		api:          apiOpenAIChat,
+		keyID:        keyID,
+		keepKeyOn4xx: keyID != 0,
+		newRequest: func(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+			return s.newOpenAIChatRequest(ctx, key, reqBodyBytes)
+		},
+		onSuccess: func(resp *http.Response, key *model.APIKey) error {
+			var body []byte
+			if err := readBody(resp, &body); err != nil {
+				return err
+			}
+			logger.Info("非流式请求成功 (Key ID: %d)", key.ID)
+			if err := json.Unmarshal(body, &successResp); err != nil {
+				return fmt.Errorf("解析上游成功响应失败: %w", err)
+			}
+			// 告知客户端实际完成请求的模型 (发生回退时与请求的模型不同)
+			successResp.Model = modelName
+			if splitThinking {
+				splitThoughts(&successResp)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return body, resp.StatusCode, nil
+	return &successResp, nil
 }
 
-func (s *GenAIService) ListGeminiCompatibleModels(ctx context.Context, queryParams url.Values) ([]byte, int, error) {
+// FetchUpstreamModels 使用一个 Key 分页拉取上游完整的 Gemini 模型列表，供模型目录缓存使用
+func (s *GenAIService) FetchUpstreamModels(ctx context.Context) ([]map[string]interface{}, error) {
 	activeKey, err := s.keyPool.GetKey()
 	if err != nil {
 		logger.Errorln("获取模型列表失败: 没有可用的API Key")
-		return nil, http.StatusInternalServerError, fmt.Errorf("没有可用的 API Key: %w", err)
-	}
-	// Defer returning the key right away. It will be returned without cooldown.
-	// If a 429 happens, a separate ReturnKey(key, true) call can be made,
-	// but the deferred one will just be a no-op on an empty channel.
-	defer s.keyPool.ReturnKey(activeKey, false)
-
-	logger.Info("正在使用 Key ID: %d 获取 Gemini 模型列表", activeKey.ID)
-	baseURL := "https://generativelanguage.googleapis.com/v1beta/models"
-	apiURL, _ := url.Parse(baseURL)
-	apiURL.RawQuery = queryParams.Encode()
-	req, err := http.NewRequestWithContext(ctx, "GET", apiURL.String(), nil)
-	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("创建请求失败: %w", err)
-	}
-
-	req.Header.Set("X-Goog-Api-Key", activeKey.Key)
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, http.StatusBadGateway, fmt.Errorf("请求 Google API 失败: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("读取响应体失败: %w", err)
+		return nil, fmt.Errorf("没有可用的 API Key: %w", err)
 	}
+	logger.Info("正在使用 Key ID: %d 获取上游模型列表", activeKey.ID)
 
-	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-		errorReason := fmt.Sprintf("获取模型列表失败, 状态码: %d", resp.StatusCode)
-		if resp.StatusCode == http.StatusTooManyRequests {
-			s.keyPool.ReturnKey(activeKey, true) // Explicitly start cooldown
-		} else {
-			s.keyStore.Disable(activeKey.ID, errorReason)
+	models := make([]map[string]interface{}, 0)
+	pageToken := ""
+	for {
+		query := url.Values{"pageSize": {"1000"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
 		}
-		logger.Warn("因获取模型列表失败而处理 Key ID %d", activeKey.ID)
-	}
-
-	return body, resp.StatusCode, nil
-}
-
-// +++ 新增: 处理 Gemini 原生 generateContent API +++
-func (s *GenAIService) GenerateContent(ctx context.Context, modelName string, reqBody []byte) ([]byte, int, error) {
-	maxRetries := s.configManager.Get().MaxRetries
-	var lastErr error
-
-	for i := 0; i < maxRetries; i++ {
-		activeKey, err := s.keyPool.GetKey()
+		req, err := http.NewRequestWithContext(ctx, "GET", geminiAPIBase+"/models?"+query.Encode(), nil)
 		if err != nil {
-			lastErr = err
-			if errors.Is(err, ErrNoAvailableKeys) {
-				time.Sleep(2 * time.Second)
-			}
-			continue
+			s.keyPool.ReleaseKey(activeKey)
+			return nil, fmt.Errorf("创建请求失败: %w", err)
 		}
+		req.Header.Set("X-Goog-Api-Key", activeKey.Key)
+		req.Header.Set("Accept", "application/json")
 
-		logger.Info("第 %d 次尝试 (Gemini GenerateContent), 使用 Key ID: %d, 模型: %s", i+1, activeKey.ID, modelName)
-		url_str := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent", modelName)
-
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", url_str, bytes.NewReader(reqBody))
+		resp, err := s.httpClient.Do(req)
 		if err != nil {
-			lastErr = fmt.Errorf("创建 HTTP 请求失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
+			s.keyPool.ReleaseKey(activeKey)
+			return nil, fmt.Errorf("请求 Google API 失败: %w", err)
 		}
-
-		httpReq.Header.Set("X-Goog-Api-Key", activeKey.Key)
-		httpReq.Header.Set("Content-Type", "application/json")
-
-		resp, err := s.httpClient.Do(httpReq)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
-			lastErr = fmt.Errorf("请求 Google API 失败 (Key ID: %d): %w", activeKey.ID, err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
+			s.keyPool.ReleaseKey(activeKey)
+			return nil, fmt.Errorf("读取响应体失败: %w", err)
 		}
-		defer resp.Body.Close()
-
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			lastErr = fmt.Errorf("读取上游响应体失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
+		if resp.StatusCode != http.StatusOK {
+			s.releaseListingKey(activeKey, resp.StatusCode)
+			return nil, &UpstreamError{StatusCode: resp.StatusCode, Body: body}
 		}
 
-		if resp.StatusCode == http.StatusOK {
-			logger.Info("Gemini GenerateContent 请求成功 (Key ID: %d)", activeKey.ID)
-			s.keyPool.ReturnKey(activeKey, false)
-			return respBody, resp.StatusCode, nil
+		var page struct {
+			Models        []map[string]interface{} `json:"models"`
+			NextPageToken string                   `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			s.keyPool.ReleaseKey(activeKey)
+			return nil, fmt.Errorf("解析模型列表失败: %w", err)
 		}
+		models = append(models, page.Models...)
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
 
-		errorMsg := fmt.Sprintf("上游API错误 (HTTP %d): %s", resp.StatusCode, string(respBody))
-		lastErr = errors.New(errorMsg)
-		logger.Error("Key ID %d 请求失败: %s", activeKey.ID, errorMsg)
+	s.releaseListingKey(activeKey, http.StatusOK)
+	return models, nil
+}
 
-		isRateLimited := resp.StatusCode == http.StatusTooManyRequests
-		if !isRateLimited && resp.StatusCode >= 400 && resp.StatusCode < 500 {
-			s.keyStore.Disable(activeKey.ID, errorMsg)
+// +++ 新增: 处理 Gemini 原生 generateContent API +++
+func (s *GenAIService) GenerateContent(ctx context.Context, modelName string, reqBody []byte) ([]byte, int, error) {
+	if err := s.checkGeminiTokenLimits(modelName, reqBody); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	body, err := s.cachedUnary(ctx, "generateContent", modelName, reqBody, func(ctx context.Context) ([]byte, error) {
+		generate := func(ctx context.Context) ([]byte, error) {
+			var body []byte
+			err := s.withFallback(ctx, modelName, func(ctx context.Context, servedModel string) error {
+				var err error
+				body, _, err = s.geminiUnary(ctx, "Gemini GenerateContent", servedModel, "generateContent", reqBody)
+				return err
+			})
+			return body, err
+		}
+		// 只有确定性的请求 (temperature=0) 才能安全地共享同一个响应
+		if !isDeterministicGeminiRequest(reqBody) {
+			return generate(ctx)
 		}
-		s.keyPool.ReturnKey(activeKey, isRateLimited)
+		return s.coalesceUnary(ctx, cacheKey("generateContent", modelName, reqBody), generate)
+	})
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
 	}
-	return nil, http.StatusServiceUnavailable, fmt.Errorf("所有 API Key 均尝试失败，最后一次错误: %w", lastErr)
+	return body, http.StatusOK, nil
 }
 
 func (s *GenAIService) StreamGenerateContent(ctx context.Context, w io.Writer, modelName string, reqBody []byte) error {
@@ -417,148 +400,81 @@ func (s *GenAIService) StreamGenerateContent(ctx context.Context, w io.Writer, m
 	if !ok {
 		return fmt.Errorf("streaming unsupported")
 	}
+	if err := s.checkGeminiTokenLimits(modelName, reqBody); err != nil {
+		return err
+	}
 
-	maxRetries := s.configManager.Get().MaxRetries
-	var lastErr error
-
-	for i := 0; i < maxRetries; i++ {
-		activeKey, err := s.keyPool.GetKey()
-		if err != nil {
-			lastErr = err
-			if errors.Is(err, ErrNoAvailableKeys) {
-				time.Sleep(2 * time.Second)
-			}
-			continue
-		}
-
-		logger.Info("第 %d 次尝试 (Gemini Stream), 使用 Key ID: %d, 模型: %s", i+1, activeKey.ID, modelName)
-		url_str := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:streamGenerateContent?alt=sse", modelName)
-
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", url_str, bytes.NewReader(reqBody))
-		if err != nil {
-			lastErr = fmt.Errorf("创建 HTTP 请求失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
-		}
-
-		httpReq.Header.Set("X-Goog-Api-Key", activeKey.Key)
-		httpReq.Header.Set("Content-Type", "application/json")
-		httpReq.Header.Set("Accept", "text/event-stream")
-
-		resp, err := s.httpClient.Do(httpReq)
-		if err != nil {
-			lastErr = fmt.Errorf("请求 Google API 失败 (Key ID: %d): %w", activeKey.ID, err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			errorMsg := fmt.Sprintf("上游API错误 (HTTP %d): %s", resp.StatusCode, string(body))
-			lastErr = errors.New(errorMsg)
-			logger.Error("Key ID %d 请求失败: %s", activeKey.ID, errorMsg)
-
-			isRateLimited := resp.StatusCode == http.StatusTooManyRequests
-			if !isRateLimited && resp.StatusCode >= 400 && resp.StatusCode < 500 {
-				s.keyStore.Disable(activeKey.ID, errorMsg)
-			}
-			s.keyPool.ReturnKey(activeKey, isRateLimited)
-			continue
-		}
-
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.TrimSpace(line) == "" {
-				continue
-			}
-			_, err := fmt.Fprintf(w, "%s\n\n", line)
-			if err != nil {
-				s.keyPool.ReturnKey(activeKey, false)
-				return err
-			}
-			flusher.Flush()
-		}
-
-		if err := scanner.Err(); err != nil {
-			lastErr = err
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
+	return s.cachedStream(ctx, w, flusher, "streamGenerateContent", modelName, reqBody, func(ctx context.Context, out io.Writer) error {
+		if !isDeterministicGeminiRequest(reqBody) {
+			return s.streamGenerateContent(ctx, w, out, flusher, modelName, reqBody)
 		}
+		key := cacheKey("streamGenerateContent", modelName, reqBody)
+		return s.coalesceStream(ctx, w, out, flusher, key, func(ctx context.Context, w, out io.Writer, flusher http.Flusher) error {
+			return s.streamGenerateContent(ctx, w, out, flusher, modelName, reqBody)
+		})
+	})
+}
 
-		logger.Info("Gemini Stream 请求成功 (Key ID: %d), 流已结束。", activeKey.ID)
-		s.keyPool.ReturnKey(activeKey, false)
-		return nil
-	}
-
-	return fmt.Errorf("所有 API Key 均尝试失败，最后一次错误: %w", lastErr)
+// streamGenerateContent 按回退链依次尝试模型，将上游 SSE 流转发到 out
+func (s *GenAIService) streamGenerateContent(ctx context.Context, w, out io.Writer, flusher http.Flusher, modelName string, reqBody []byte) error {
+	return s.withFallback(ctx, modelName, func(ctx context.Context, servedModel string) error {
+		return s.doWithRetry(ctx, upstreamCall{
+			label: "Gemini Stream",
+			model: servedModel,
+			api:   apiGeminiNative,
+			newRequest: func(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+				httpReq, err := s.newGeminiRequest(ctx, key, servedModel, "streamGenerateContent", "?alt=sse", reqBody)
+				if err != nil {
+					return nil, err
+				}
+				httpReq.Header.Set("Accept", "text/event-stream")
+				return httpReq, nil
+			},
+			onSuccess: func(resp *http.Response, key *model.APIKey) error {
+				applyStreamHeaders(ctx, w)
+				return relaySSE(out, flusher, resp, key, false)
+			},
+		})
+	})
 }
 
 // +++ 新增: 处理 Gemini 原生 countTokens API +++
 func (s *GenAIService) CountTokens(ctx context.Context, modelName string, reqBody []byte) ([]byte, int, error) {
-	maxRetries := s.configManager.Get().MaxRetries
-	var lastErr error
+	body, err := s.cachedUnary(ctx, "countTokens", modelName, reqBody, func(ctx context.Context) ([]byte, error) {
+		return s.coalesceUnary(ctx, cacheKey("countTokens", modelName, reqBody), func(ctx context.Context) ([]byte, error) {
+			responseMetaFrom(ctx).ServedModel = modelName
+			body, _, err := s.geminiUnary(ctx, "Gemini CountTokens", modelName, "countTokens", reqBody)
+			return body, err
+		})
+	})
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	return body, http.StatusOK, nil
+}
 
-	for i := 0; i < maxRetries; i++ {
-		activeKey, err := s.keyPool.GetKey()
-		if err != nil {
-			lastErr = err
-			if errors.Is(err, ErrNoAvailableKeys) {
-				time.Sleep(2 * time.Second)
+// geminiUnary 代理一个非流式的 Gemini 原生 models/{model}:{action} 请求
+func (s *GenAIService) geminiUnary(ctx context.Context, label, modelName, action string, reqBody []byte) ([]byte, int, error) {
+	var respBody []byte
+	err := s.doWithRetry(ctx, upstreamCall{
+		label: label,
+		model: modelName,
+		api:   geminiNativeAPI(action),
+		newRequest: func(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+			return s.newGeminiRequest(ctx, key, modelName, action, "", reqBody)
+		},
+		onSuccess: func(resp *http.Response, key *model.APIKey) error {
+			if err := readBody(resp, &respBody); err != nil {
+				return err
 			}
-			continue
-		}
-
-		logger.Info("第 %d 次尝试 (Gemini CountTokens), 使用 Key ID: %d, 模型: %s", i+1, activeKey.ID, modelName)
-		url_str := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:countTokens", modelName)
-
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", url_str, bytes.NewReader(reqBody))
-		if err != nil {
-			lastErr = fmt.Errorf("创建 HTTP 请求失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
-		}
-
-		httpReq.Header.Set("X-Goog-Api-Key", activeKey.Key)
-		httpReq.Header.Set("Content-Type", "application/json")
-
-		resp, err := s.httpClient.Do(httpReq)
-		if err != nil {
-			lastErr = fmt.Errorf("请求 Google API 失败 (Key ID: %d): %w", activeKey.ID, err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
-		}
-		defer resp.Body.Close()
-
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			lastErr = fmt.Errorf("读取上游响应体失败: %w", err)
-			s.keyPool.ReturnKey(activeKey, false)
-			continue
-		}
-
-		if resp.StatusCode == http.StatusOK {
-			logger.Info("Gemini CountTokens 请求成功 (Key ID: %d)", activeKey.ID)
-			s.keyPool.ReturnKey(activeKey, false)
-			return respBody, resp.StatusCode, nil
-		}
-
-		errorMsg := fmt.Sprintf("上游API错误 (HTTP %d): %s", resp.StatusCode, string(respBody))
-		lastErr = errors.New(errorMsg)
-		logger.Error("Key ID %d 请求失败: %s", activeKey.ID, errorMsg)
-
-		isRateLimited := resp.StatusCode == http.StatusTooManyRequests
-		if !isRateLimited && resp.StatusCode >= 400 && resp.StatusCode < 500 {
-			s.keyStore.Disable(activeKey.ID, errorMsg)
-		}
-		s.keyPool.ReturnKey(activeKey, isRateLimited)
-	}
-	logger.Error("所有 %d 次重试均失败。", maxRetries)
-	if lastErr != nil {
-		return nil, http.StatusServiceUnavailable, fmt.Errorf("所有 API Key 均尝试失败，最后一次错误: %w", lastErr)
+			logger.Info("%s 请求成功 (Key ID: %d)", label, key.ID)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
 	}
-	return nil, http.StatusServiceUnavailable, errors.New("所有 API Key 均尝试失败，但未捕获到具体错误")
+	return respBody, http.StatusOK, nil
 }
 
 func (s *GenAIService) ValidateAPIKey(apiKey string) (bool, string) {
@@ -583,7 +499,48 @@ func (s *GenAIService) ValidateAPIKey(apiKey string) (bool, string) {
 	return false, fmt.Sprintf("Invalid (HTTP %d): %s", resp.StatusCode, string(body))
 }
 
+// disableKey 在数据库中永久禁用 Key，并立即将其移出内存池
+func (s *GenAIService) disableKey(key *model.APIKey, reason string) {
+	s.keyStore.Disable(key.ID, reason)
+	s.keyPool.Remove(key.ID)
+}
+
+// releaseListingKey 根据模型列表请求的状态码归还 Key
+func (s *GenAIService) releaseListingKey(key *model.APIKey, statusCode int) {
+	isRateLimited := statusCode == http.StatusTooManyRequests
+	if statusCode >= 400 && statusCode < 500 {
+		logger.Warn("因获取模型列表失败而处理 Key ID %d", key.ID)
+		if !isRateLimited {
+			s.disableKey(key, fmt.Sprintf("获取模型列表失败, 状态码: %d", statusCode))
+		}
+	}
+	s.keyPool.ReturnKey(key, isRateLimited)
+}
+
 // GetBannedKeysInfo 获取所有当前在内存中被临时禁用的Key的详细信息
 func (s *GenAIService) GetBannedKeysInfo() ([]BannedKeyInfo, error) {
 	return s.keyPool.GetBannedKeysInfo()
 }
+
+// GetCircuitStatuses 返回所有模型熔断器的当前状态
+func (s *GenAIService) GetCircuitStatuses() []CircuitStatus {
+	return s.breakers.Statuses()
+}
+
+// ResetCircuit 手动关闭指定模型的熔断器
+func (s *GenAIService) ResetCircuit(modelName string) bool {
+	return s.breakers.Reset(modelName)
+}
+
+// GetMetrics 返回请求与模型回退指标的快照
+func (s *GenAIService) GetMetrics() MetricsSnapshot {
+	snapshot := s.metrics.Snapshot()
+	cacheStats := s.cache.Stats()
+	snapshot.Cache = &cacheStats
+	return snapshot
+}
+
+// PurgeResponseCache 清空响应缓存，返回删除的条目数
+func (s *GenAIService) PurgeResponseCache() int {
+	return s.cache.Purge()
+}
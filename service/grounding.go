@@ -0,0 +1,720 @@
+// service/grounding.go
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Gemini 的 OpenAI 兼容接口既不接受 googleSearch 等内置工具，也不返回 groundingMetadata。
+// 请求中带有 web_search_options 或非 function 类型的工具时，聊天请求被转换为 Gemini 原生 generateContent 请求，
+// 响应再转换回 chat.completion 格式，搜索引用放在 message.annotations 中。
+
+// builtinTools 把 OpenAI 请求中的工具类型映射为 Gemini 内置工具
+var builtinTools = map[string]string{
+	"web_search":         "googleSearch",
+	"web_search_preview": "googleSearch",
+	"google_search":      "googleSearch",
+	"url_context":        "urlContext",
+	"code_interpreter":   "codeExecution",
+	"code_execution":     "codeExecution",
+}
+
+// inputAudioMimeTypes 是 input_audio.format 允许的取值 (与 OpenAI 一致) 及对应的 MIME 类型
+var inputAudioMimeTypes = map[string]string{"wav": "audio/wav", "mp3": "audio/mp3"}
+
+// inlineDataMimeTypes 是 data URL 中允许的 MIME 类型 (音频另见 transcriptionMimeTypes)。
+// 其他类型会被上游以 400 拒绝，而这类错误会让 Key 被禁用，因此在转换时直接拒绝。
+var inlineDataMimeTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/webp": true, "image/heic": true, "image/heif": true,
+	"video/mp4": true, "video/mpeg": true, "video/mov": true, "video/quicktime": true, "video/avi": true,
+	"video/x-flv": true, "video/mpg": true, "video/webm": true, "video/wmv": true, "video/3gpp": true,
+	"application/pdf": true, "text/plain": true,
+}
+
+// skipThoughtSignature 是 Gemini 文档给出的占位思考签名。历史消息中的函数调用来自 OpenAI 格式，没有原始签名，
+// 较新的模型在缺少签名时会以 400 拒绝请求 (并导致 Key 被禁用)
+const skipThoughtSignature = "skip_thought_signature_validator"
+
+// checkTools 校验请求中的工具类型，避免把上游会拒绝的工具定义转发出去
+func checkTools(req *model.ChatCompletionRequest) error {
+	for i, tool := range req.Tools {
+		if tool.Type == "function" {
+			if tool.Function == nil || tool.Function.Name == "" {
+				return &ChatRequestError{Param: fmt.Sprintf("tools[%d].function", i), Message: "function 类型的工具必须提供 function.name"}
+			}
+			continue
+		}
+		if _, ok := builtinTools[tool.Type]; !ok {
+			return &ChatRequestError{Param: fmt.Sprintf("tools[%d].type", i), Message: fmt.Sprintf("不支持的工具类型: %s", tool.Type)}
+		}
+	}
+	return nil
+}
+
+// usesBuiltinTools 判断请求是否需要 Gemini 内置工具，需要时只能通过原生接口处理
+func usesBuiltinTools(req *model.ChatCompletionRequest) bool {
+	if req.WebSearchOptions != nil {
+		return true
+	}
+	for _, tool := range req.Tools {
+		if _, ok := builtinTools[tool.Type]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nativeChatRequest 是转换后的原生请求，generationConfig 单独保存，以便按模型填入思考配置
+type nativeChatRequest struct {
+	payload    map[string]interface{}
+	generation map[string]interface{}
+}
+
+// newNativeChatRequest 把 OpenAI 聊天请求转换为 Gemini 原生 generateContent 请求
+func newNativeChatRequest(req *model.ChatCompletionRequest) (*nativeChatRequest, error) {
+	payload := make(map[string]interface{})
+	var system []interface{}
+	var contents []map[string]interface{}
+	toolNames := make(map[string]string) // tool_call_id -> 函数名，tool 消息的 functionResponse 需要函数名
+
+	appendContent := func(role string, parts []interface{}) {
+		if len(parts) == 0 {
+			return
+		}
+		// 连续的同角色消息合并为一个 content，多个工具结果必须放在同一轮中
+		if n := len(contents); n > 0 && contents[n-1]["role"] == role {
+			contents[n-1]["parts"] = append(contents[n-1]["parts"].([]interface{}), parts...)
+			return
+		}
+		contents = append(contents, map[string]interface{}{"role": role, "parts": parts})
+	}
+
+	for i, msg := range req.Messages {
+		param := fmt.Sprintf("messages[%d]", i)
+		switch msg.Role {
+		case "system", "developer":
+			parts, err := nativeContentParts(msg.Content, param)
+			if err != nil {
+				return nil, err
+			}
+			system = append(system, parts...)
+		case "user":
+			parts, err := nativeContentParts(msg.Content, param)
+			if err != nil {
+				return nil, err
+			}
+			appendContent("user", parts)
+		case "assistant":
+			parts, err := nativeContentParts(msg.Content, param)
+			if err != nil {
+				return nil, err
+			}
+			for j, call := range msg.ToolCalls {
+				args := map[string]interface{}{}
+				if strings.TrimSpace(call.Function.Arguments) != "" {
+					if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+						return nil, &ChatRequestError{Param: fmt.Sprintf("%s.tool_calls[%d].function.arguments", param, j), Message: "工具调用的参数必须是 JSON 对象"}
+					}
+				}
+				toolNames[call.ID] = call.Function.Name
+				parts = append(parts, map[string]interface{}{
+					"functionCall":     map[string]interface{}{"name": call.Function.Name, "args": args},
+					"thoughtSignature": skipThoughtSignature,
+				})
+			}
+			appendContent("model", parts)
+		case "tool":
+			name, ok := toolNames[msg.ToolCallID]
+			if !ok {
+				return nil, &ChatRequestError{Param: param + ".tool_call_id", Message: "tool 消息的 tool_call_id 没有对应的工具调用"}
+			}
+			appendContent("user", []interface{}{map[string]interface{}{
+				"functionResponse": map[string]interface{}{"name": name, "response": toolResponse(msg.Content)},
+			}})
+		default:
+			return nil, &ChatRequestError{Param: param + ".role", Message: fmt.Sprintf("不支持的消息角色: %s", msg.Role)}
+		}
+	}
+	if len(system) > 0 {
+		payload["systemInstruction"] = map[string]interface{}{"parts": system}
+	}
+	payload["contents"] = contents
+
+	var declarations []interface{}
+	var tools []interface{}
+	added := make(map[string]bool)
+	addBuiltin := func(name string) {
+		if !added[name] {
+			added[name] = true
+			tools = append(tools, map[string]interface{}{name: map[string]interface{}{}})
+		}
+	}
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			addBuiltin(builtinTools[tool.Type])
+			continue
+		}
+		decl := map[string]interface{}{"name": tool.Function.Name}
+		if tool.Function.Description != "" {
+			decl["description"] = tool.Function.Description
+		}
+		// parametersJsonSchema 接受完整的 JSON Schema，parameters 只接受 OpenAPI 子集，会拒绝 additionalProperties 等字段
+		if params := bytes.TrimSpace(tool.Function.Parameters); len(params) > 0 && !bytes.Equal(params, []byte("null")) {
+			decl["parametersJsonSchema"] = json.RawMessage(params)
+		}
+		declarations = append(declarations, decl)
+	}
+	if req.WebSearchOptions != nil {
+		addBuiltin("googleSearch")
+	}
+	if len(declarations) > 0 {
+		tools = append([]interface{}{map[string]interface{}{"functionDeclarations": declarations}}, tools...)
+		if config, err := nativeToolConfig(req.ToolChoice); err != nil {
+			return nil, err
+		} else if config != nil {
+			payload["toolConfig"] = config
+		}
+	}
+	if len(tools) > 0 {
+		payload["tools"] = tools
+	}
+
+	generation := make(map[string]interface{})
+	if req.MaxTokens > 0 {
+		generation["maxOutputTokens"] = req.MaxTokens
+	}
+	if req.Temperature != 0 {
+		generation["temperature"] = req.Temperature
+	}
+	if req.TopP != 0 {
+		generation["topP"] = req.TopP
+	}
+	if req.N > 1 {
+		generation["candidateCount"] = req.N
+	}
+	stops, err := stopSequences(req.Stop)
+	if err != nil {
+		return nil, &ChatRequestError{Param: "stop", Message: err.Error()}
+	}
+	if len(stops) > 0 {
+		generation["stopSequences"] = stops
+	}
+	if format, ok := req.ResponseFormat.(map[string]interface{}); ok {
+		switch format["type"] {
+		case "json_object":
+			generation["responseMimeType"] = "application/json"
+		case "json_schema":
+			generation["responseMimeType"] = "application/json"
+			if spec, ok := format["json_schema"].(map[string]interface{}); ok && spec["schema"] != nil {
+				generation["responseJsonSchema"] = spec["schema"]
+			}
+		}
+	}
+	return &nativeChatRequest{payload: payload, generation: generation}, nil
+}
+
+// body 返回发往 modelName 的请求体，思考预算按 thinkingRequest 的规则与该模型的默认预算合并
+func (r *nativeChatRequest) body(req *model.ChatCompletionRequest, modelName string, budgets map[string]int) ([]byte, error) {
+	generation := maps.Clone(r.generation)
+	attemptReq, include := thinkingRequest(req, modelName, budgets)
+	if attemptReq.ExtraBody != nil && attemptReq.ExtraBody.Google != nil && attemptReq.ExtraBody.Google.ThinkingConfig != nil {
+		thinking := map[string]interface{}{"includeThoughts": include}
+		if budget := attemptReq.ExtraBody.Google.ThinkingConfig.ThinkingBudget; budget != nil {
+			thinking["thinkingBudget"] = *budget
+		}
+		generation["thinkingConfig"] = thinking
+	}
+	payload := maps.Clone(r.payload)
+	if len(generation) > 0 {
+		payload["generationConfig"] = generation
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("序列化请求体失败: %w", err)
+	}
+	return body, nil
+}
+
+// nativeContentParts 把 OpenAI 消息的 content 转换为 Gemini parts。远程地址在此之前已由 mediaFetcher 替换为内联数据。
+func nativeContentParts(content interface{}, param string) ([]interface{}, error) {
+	switch v := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		return []interface{}{map[string]interface{}{"text": v}}, nil
+	case []interface{}:
+		parts := make([]interface{}, 0, len(v))
+		for j, item := range v {
+			part, _ := item.(map[string]interface{})
+			partParam := fmt.Sprintf("%s.content[%d]", param, j)
+			switch part["type"] {
+			case "text":
+				text, _ := part["text"].(string)
+				parts = append(parts, map[string]interface{}{"text": text})
+			case "image_url":
+				imageURL, _ := part["image_url"].(map[string]interface{})
+				rawURL, _ := imageURL["url"].(string)
+				if s, ok := part["image_url"].(string); ok {
+					rawURL = s
+				}
+				inline, err := inlineDataPart(rawURL, partParam, "image_url 必须是 http(s) 地址或 data URL")
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, inline)
+			case "input_audio":
+				audio, _ := part["input_audio"].(map[string]interface{})
+				data, _ := audio["data"].(string)
+				format, _ := audio["format"].(string)
+				if data == "" || format == "" {
+					return nil, &ChatRequestError{Param: partParam, Message: "input_audio 必须包含 data 和 format"}
+				}
+				mimeType, ok := inputAudioMimeTypes[format]
+				if !ok {
+					return nil, &ChatRequestError{Param: partParam + ".input_audio.format", Message: "input_audio.format 必须是 wav 或 mp3"}
+				}
+				if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+					return nil, &ChatRequestError{Param: partParam + ".input_audio.data", Message: "input_audio.data 必须是 base64 编码的音频"}
+				}
+				parts = append(parts, map[string]interface{}{"inlineData": map[string]interface{}{"mimeType": mimeType, "data": data}})
+			case "file":
+				file, _ := part["file"].(map[string]interface{})
+				data, _ := file["file_data"].(string)
+				inline, err := inlineDataPart(data, partParam, "file 必须通过 file_data 提供 data URL 或 http(s) 地址")
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, inline)
+			default:
+				return nil, &ChatRequestError{Param: partParam, Message: fmt.Sprintf("不支持的内容类型: %v", part["type"])}
+			}
+		}
+		return parts, nil
+	}
+	return nil, &ChatRequestError{Param: param + ".content", Message: "content 必须是字符串或内容数组"}
+}
+
+// inlineDataPart 把 data URL 转换为 inlineData part，格式不正确时返回带 invalid 说明的 ChatRequestError，
+// 不支持的 MIME 类型和无法解码的数据同样在本地拒绝
+func inlineDataPart(dataURL, param, invalid string) (map[string]interface{}, error) {
+	rest, ok := strings.CutPrefix(dataURL, "data:")
+	if !ok {
+		return nil, &ChatRequestError{Param: param, Message: invalid}
+	}
+	header, data, ok := strings.Cut(rest, ",")
+	mimeType, isBase64 := strings.CutSuffix(header, ";base64")
+	if !ok || !isBase64 || mimeType == "" {
+		return nil, &ChatRequestError{Param: param, Message: invalid}
+	}
+	mimeType = strings.ToLower(mimeType)
+	if audio, ok := transcriptionMimeTypes[mimeType]; ok {
+		mimeType = audio
+	} else if !inlineDataMimeTypes[mimeType] {
+		return nil, &ChatRequestError{Param: param, Message: fmt.Sprintf("不支持的内联数据类型: %s", mimeType)}
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		return nil, &ChatRequestError{Param: param, Message: "data URL 中的数据不是有效的 base64 编码"}
+	}
+	return map[string]interface{}{"inlineData": map[string]interface{}{"mimeType": mimeType, "data": data}}, nil
+}
+
+// toolResponse 把 tool 消息的内容转换为 functionResponse.response: Gemini 要求它是 JSON 对象，
+// 内容本身是 JSON 对象时直接使用，否则放在 content 字段中
+func toolResponse(content interface{}) map[string]interface{} {
+	text, ok := content.(string)
+	if !ok {
+		// 内容数组只取其中的文本
+		if items, isArray := content.([]interface{}); isArray {
+			var b strings.Builder
+			for _, item := range items {
+				if part, _ := item.(map[string]interface{}); part["type"] == "text" {
+					s, _ := part["text"].(string)
+					b.WriteString(s)
+				}
+			}
+			text = b.String()
+		}
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &object); err == nil && object != nil {
+		return object
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err == nil {
+		return map[string]interface{}{"content": value}
+	}
+	return map[string]interface{}{"content": text}
+}
+
+// nativeToolConfig 把 tool_choice 转换为 toolConfig.functionCallingConfig
+func nativeToolConfig(choice interface{}) (map[string]interface{}, error) {
+	calling := make(map[string]interface{})
+	switch v := choice.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		switch v {
+		case "auto":
+			calling["mode"] = "AUTO"
+		case "none":
+			calling["mode"] = "NONE"
+		case "required":
+			calling["mode"] = "ANY"
+		default:
+			return nil, &ChatRequestError{Param: "tool_choice", Message: "tool_choice 必须是 none、auto、required 或指定的函数"}
+		}
+	case map[string]interface{}:
+		function, _ := v["function"].(map[string]interface{})
+		name, _ := function["name"].(string)
+		if name == "" {
+			return nil, &ChatRequestError{Param: "tool_choice", Message: "tool_choice 必须是 none、auto、required 或指定的函数"}
+		}
+		calling["mode"] = "ANY"
+		calling["allowedFunctionNames"] = []string{name}
+	default:
+		return nil, &ChatRequestError{Param: "tool_choice", Message: "tool_choice 必须是 none、auto、required 或指定的函数"}
+	}
+	return map[string]interface{}{"functionCallingConfig": calling}, nil
+}
+
+// nativeChatResponse 是 generateContent / streamGenerateContent 响应中聊天接口需要的字段
+type nativeChatResponse struct {
+	Candidates []struct {
+		Index   int `json:"index"`
+		Content struct {
+			Parts []nativePart `json:"parts"`
+		} `json:"content"`
+		FinishReason      string             `json:"finishReason"`
+		GroundingMetadata *groundingMetadata `json:"groundingMetadata"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata *struct {
+		PromptTokenCount int `json:"promptTokenCount"`
+		TotalTokenCount  int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+type nativePart struct {
+	Text         string `json:"text"`
+	Thought      bool   `json:"thought"`
+	FunctionCall *struct {
+		Name string          `json:"name"`
+		Args json.RawMessage `json:"args"`
+	} `json:"functionCall"`
+	ExecutableCode *struct {
+		Language string `json:"language"`
+		Code     string `json:"code"`
+	} `json:"executableCode"`
+	CodeExecutionResult *struct {
+		Outcome string `json:"outcome"`
+		Output  string `json:"output"`
+	} `json:"codeExecutionResult"`
+}
+
+// groundingMetadata 是 Google 搜索 grounding 的来源和正文中被引用的片段，片段位置是正文的 UTF-8 字节偏移
+type groundingMetadata struct {
+	GroundingChunks []struct {
+		Web *struct {
+			URI   string `json:"uri"`
+			Title string `json:"title"`
+		} `json:"web"`
+	} `json:"groundingChunks"`
+	GroundingSupports []struct {
+		Segment struct {
+			StartIndex int `json:"startIndex"`
+			EndIndex   int `json:"endIndex"`
+		} `json:"segment"`
+		GroundingChunkIndices []int `json:"groundingChunkIndices"`
+	} `json:"groundingSupports"`
+}
+
+func (r *nativeChatResponse) usage() model.Usage {
+	if r.UsageMetadata == nil {
+		return model.Usage{}
+	}
+	return model.Usage{
+		PromptTokens:     r.UsageMetadata.PromptTokenCount,
+		CompletionTokens: r.UsageMetadata.TotalTokenCount - r.UsageMetadata.PromptTokenCount,
+		TotalTokens:      r.UsageMetadata.TotalTokenCount,
+	}
+}
+
+// convertParts 把候选的 parts 转换为正文、思考摘要和工具调用。
+// 代码执行的代码和结果没有对应的 OpenAI 字段，以 Markdown 代码块的形式放在正文中。
+func convertParts(parts []nativePart) (content, reasoning string, calls []model.ToolCall) {
+	var c, r strings.Builder
+	for _, part := range parts {
+		switch {
+		case part.FunctionCall != nil:
+			args := string(part.FunctionCall.Args)
+			if args == "" || args == "null" {
+				args = "{}"
+			}
+			calls = append(calls, model.ToolCall{
+				ID:       newObjectID("call_"),
+				Type:     "function",
+				Function: model.FunctionCall{Name: part.FunctionCall.Name, Arguments: args},
+			})
+		case part.ExecutableCode != nil:
+			fmt.Fprintf(&c, "\n```%s\n%s\n```\n", strings.ToLower(part.ExecutableCode.Language), strings.TrimRight(part.ExecutableCode.Code, "\n"))
+		case part.CodeExecutionResult != nil:
+			fmt.Fprintf(&c, "\n```\n%s\n```\n", strings.TrimRight(part.CodeExecutionResult.Output, "\n"))
+		case part.Thought:
+			r.WriteString(part.Text)
+		default:
+			c.WriteString(part.Text)
+		}
+	}
+	return c.String(), r.String(), calls
+}
+
+// groundingAnnotations 把 grounding 引用转换为 url_citation。没有 groundingSupports 时每个来源引用整段正文。
+func groundingAnnotations(meta *groundingMetadata, content string) []model.Annotation {
+	if meta == nil {
+		return nil
+	}
+	citation := func(chunk int, start, end int) (model.Annotation, bool) {
+		if chunk < 0 || chunk >= len(meta.GroundingChunks) || meta.GroundingChunks[chunk].Web == nil {
+			return model.Annotation{}, false
+		}
+		web := meta.GroundingChunks[chunk].Web
+		return model.Annotation{
+			Type:        "url_citation",
+			URLCitation: &model.URLCitation{StartIndex: start, EndIndex: end, URL: web.URI, Title: web.Title},
+		}, true
+	}
+
+	var annotations []model.Annotation
+	if len(meta.GroundingSupports) == 0 {
+		end := utf8.RuneCountInString(content)
+		for i := range meta.GroundingChunks {
+			if a, ok := citation(i, 0, end); ok {
+				annotations = append(annotations, a)
+			}
+		}
+		return annotations
+	}
+	for _, support := range meta.GroundingSupports {
+		start, end := runeOffset(content, support.Segment.StartIndex), runeOffset(content, support.Segment.EndIndex)
+		for _, i := range support.GroundingChunkIndices {
+			if a, ok := citation(i, start, end); ok {
+				annotations = append(annotations, a)
+			}
+		}
+	}
+	return annotations
+}
+
+// runeOffset 把 UTF-8 字节偏移转换为字符偏移
+func runeOffset(s string, byteOffset int) int {
+	return utf8.RuneCountInString(s[:max(0, min(byteOffset, len(s)))])
+}
+
+// chatFinishReason 把 Gemini 的结束原因转换为 chat.completion 的 finish_reason
+func chatFinishReason(reason string, toolCalls bool) interface{} {
+	if reason == "STOP" && toolCalls {
+		return "tool_calls"
+	}
+	return completionFinishReason(reason)
+}
+
+// nonStreamNativeChat 通过 Gemini 原生接口处理需要内置工具的非流式请求
+func (s *GenAIService) nonStreamNativeChat(ctx context.Context, req *model.ChatCompletionRequest) (*model.OpenAICompletionResponse, error) {
+	native, err := newNativeChatRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp *model.OpenAICompletionResponse
+	err = s.withFallback(ctx, req.Model, func(ctx context.Context, modelName string) error {
+		reqBody, err := native.body(req, modelName, s.configManager.Get().ThinkingBudgets)
+		if err != nil {
+			return err
+		}
+		respBody, _, err := s.geminiUnary(ctx, "Gemini Grounding", modelName, "generateContent", reqBody)
+		if err != nil {
+			return err
+		}
+		var parsed nativeChatResponse
+		if err := json.Unmarshal(respBody, &parsed); err != nil {
+			return fmt.Errorf("解析 generateContent 响应失败: %w", err)
+		}
+		resp = nativeToChatResponse(&parsed, modelName, max(req.N, 1))
+		return nil
+	})
+	return resp, err
+}
+
+// nativeToChatResponse 把 generateContent 响应转换为 chat.completion 响应
+func nativeToChatResponse(parsed *nativeChatResponse, modelName string, n int) *model.OpenAICompletionResponse {
+	resp := &model.OpenAICompletionResponse{
+		ID:      newObjectID("chatcmpl-"),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   modelName,
+		Choices: []model.CompletionChoice{},
+		Usage:   parsed.usage(),
+	}
+	if len(parsed.Candidates) == 0 && parsed.PromptFeedback != nil && parsed.PromptFeedback.BlockReason != "" {
+		for i := 0; i < n; i++ {
+			resp.Choices = append(resp.Choices, model.CompletionChoice{
+				Index:        i,
+				Message:      model.Message{Role: "assistant", Content: ""},
+				FinishReason: "content_filter",
+			})
+		}
+		return resp
+	}
+	for _, cand := range parsed.Candidates {
+		content, reasoning, calls := convertParts(cand.Content.Parts)
+		msg := model.Message{
+			Role:             "assistant",
+			Content:          content,
+			ReasoningContent: reasoning,
+			ToolCalls:        calls,
+			Annotations:      groundingAnnotations(cand.GroundingMetadata, content),
+		}
+		if content == "" && len(calls) > 0 {
+			msg.Content = nil
+		}
+		finish, _ := chatFinishReason(cand.FinishReason, len(calls) > 0).(string)
+		resp.Choices = append(resp.Choices, model.CompletionChoice{Index: cand.Index, Message: msg, FinishReason: finish})
+	}
+	return resp
+}
+
+// streamNativeChat 通过 Gemini 原生流式接口处理需要内置工具的流式请求，把每个原生 chunk 转换为 chat.completion.chunk 写到 out
+func (s *GenAIService) streamNativeChat(ctx context.Context, w, out io.Writer, flusher http.Flusher, req *model.ChatCompletionRequest) error {
+	native, err := newNativeChatRequest(req)
+	if err != nil {
+		return err
+	}
+	return s.withFallback(ctx, req.Model, func(ctx context.Context, modelName string) error {
+		reqBody, err := native.body(req, modelName, s.configManager.Get().ThinkingBudgets)
+		if err != nil {
+			return err
+		}
+		return s.doWithRetry(ctx, upstreamCall{
+			label: "Gemini Grounding Stream",
+			model: modelName,
+			api:   apiGeminiNative,
+			newRequest: func(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+				httpReq, err := s.newGeminiRequest(ctx, key, modelName, "streamGenerateContent", "?alt=sse", reqBody)
+				if err != nil {
+					return nil, err
+				}
+				httpReq.Header.Set("Accept", "text/event-stream")
+				return httpReq, nil
+			},
+			onSuccess: func(resp *http.Response, key *model.APIKey) error {
+				applyStreamHeaders(ctx, w)
+				return relayNativeChatSSE(out, flusher, resp, key, modelName)
+			},
+		})
+	})
+}
+
+// nativeStreamState 是流式转换中每个候选的状态
+type nativeStreamState struct {
+	started   bool
+	toolCalls bool
+	content   strings.Builder // 已输出的正文，用于把引用的字节偏移转换为字符偏移
+	grounding *groundingMetadata
+}
+
+// relayNativeChatSSE 把上游的原生 SSE 流转换为 chat.completion.chunk 流。
+// grounding 引用在候选结束的 chunk 中随 delta.annotations 返回，usage 在最后以单独的 chunk 发送，随后发送 [DONE]。
+func relayNativeChatSSE(out io.Writer, flusher http.Flusher, resp *http.Response, key *model.APIKey, modelName string) error {
+	id, created := newObjectID("chatcmpl-"), time.Now().Unix()
+	states := make(map[int]*nativeStreamState)
+	var usage *model.Usage
+	newChunk := func(choices []model.Choice) chatStreamChunk {
+		return chatStreamChunk{ChatCompletionStreamResponse: model.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   modelName,
+			Choices: choices,
+		}}
+	}
+
+	converter := &sseDataWriter{onData: func(data []byte) error {
+		var chunk nativeChatResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			logger.Warn("忽略无法解析的流式 chunk: %v", err)
+			return nil
+		}
+		if chunk.UsageMetadata != nil {
+			u := chunk.usage()
+			usage = &u
+		}
+		if len(chunk.Candidates) == 0 && chunk.PromptFeedback != nil && chunk.PromptFeedback.BlockReason != "" {
+			return writeSSEData(out, flusher, newChunk([]model.Choice{{Delta: model.Delta{Role: "assistant"}, FinishReason: "content_filter"}}))
+		}
+		for _, cand := range chunk.Candidates {
+			state, ok := states[cand.Index]
+			if !ok {
+				state = &nativeStreamState{}
+				states[cand.Index] = state
+			}
+			content, reasoning, calls := convertParts(cand.Content.Parts)
+			state.content.WriteString(content)
+			state.toolCalls = state.toolCalls || len(calls) > 0
+			if cand.GroundingMetadata != nil {
+				state.grounding = cand.GroundingMetadata
+			}
+
+			choice := model.Choice{
+				Index: cand.Index,
+				Delta: model.Delta{Content: content, ReasoningContent: reasoning, ToolCalls: calls},
+			}
+			if cand.FinishReason != "" {
+				choice.FinishReason = chatFinishReason(cand.FinishReason, state.toolCalls)
+				choice.Delta.Annotations = groundingAnnotations(state.grounding, state.content.String())
+			}
+			if content == "" && reasoning == "" && len(calls) == 0 && choice.FinishReason == nil {
+				continue
+			}
+			if !state.started {
+				state.started = true
+				choice.Delta.Role = "assistant"
+			}
+			if err := writeSSEData(out, flusher, newChunk([]model.Choice{choice})); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	if err := relaySSE(converter, converter, resp, key, false); err != nil {
+		return err
+	}
+
+	if usage != nil {
+		final := newChunk([]model.Choice{})
+		final.Usage = usage
+		if err := writeSSEData(out, flusher, final); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(out, "data: [DONE]\n\n"); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gemini_polling/model"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNativeContentParts(t *testing.T) {
+	part := func(typ string, fields map[string]interface{}) []interface{} {
+		item := map[string]interface{}{"type": typ}
+		for k, v := range fields {
+			item[k] = v
+		}
+		return []interface{}{item}
+	}
+	audio := func(format, data string) []interface{} {
+		return part("input_audio", map[string]interface{}{"input_audio": map[string]interface{}{"format": format, "data": data}})
+	}
+	imageURL := func(url string) []interface{} {
+		return part("image_url", map[string]interface{}{"image_url": map[string]interface{}{"url": url}})
+	}
+	file := func(data string) []interface{} {
+		return part("file", map[string]interface{}{"file": map[string]interface{}{"file_data": data}})
+	}
+
+	tests := []struct {
+		name      string
+		content   interface{}
+		wantMime  string // 第一个 part 的 inlineData.mimeType
+		wantParam string
+	}{
+		{name: "wav audio", content: audio("wav", "UklGRg=="), wantMime: "audio/wav"},
+		{name: "mp3 audio", content: audio("mp3", "SUQz"), wantMime: "audio/mp3"},
+		{name: "audio format outside OpenAI's list", content: audio("ogg", "T2dnUw=="), wantParam: "messages[0].content[0].input_audio.format"},
+		{name: "audio format is case sensitive", content: audio("WAV", "UklGRg=="), wantParam: "messages[0].content[0].input_audio.format"},
+		{name: "audio data is not base64", content: audio("wav", "not base64!"), wantParam: "messages[0].content[0].input_audio.data"},
+		{name: "audio without data", content: audio("wav", ""), wantParam: "messages[0].content[0]"},
+		{name: "png data URL", content: imageURL("data:image/png;base64,iVBORw0KGgo="), wantMime: "image/png"},
+		{name: "audio data URL is normalized", content: file("data:audio/mpeg;base64,SUQz"), wantMime: "audio/mp3"},
+		{name: "pdf data URL", content: file("data:application/pdf;base64,JVBERi0="), wantMime: "application/pdf"},
+		{name: "unsupported data URL type", content: imageURL("data:image/svg+xml;base64,PHN2Zz4="), wantParam: "messages[0].content[0]"},
+		{name: "data URL without base64", content: imageURL("data:image/png,raw"), wantParam: "messages[0].content[0]"},
+		{name: "data URL with invalid base64", content: imageURL("data:image/png;base64,%%%"), wantParam: "messages[0].content[0]"},
+		{name: "remote URL left unresolved", content: file("https://example.com/a.pdf"), wantParam: "messages[0].content[0]"},
+		{name: "unknown part type", content: part("video_url", nil), wantParam: "messages[0].content[0]"},
+		{name: "content of the wrong type", content: 42, wantParam: "messages[0].content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := nativeContentParts(tt.content, "messages[0]")
+			if tt.wantParam != "" {
+				var reqErr *ChatRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+					t.Fatalf("nativeContentParts = %v, want ChatRequestError on %s", err, tt.wantParam)
+				}
+				return
+			}
+			if err != nil || len(parts) != 1 {
+				t.Fatalf("nativeContentParts = %v, %v", parts, err)
+			}
+			inline, _ := parts[0].(map[string]interface{})["inlineData"].(map[string]interface{})
+			if inline["mimeType"] != tt.wantMime {
+				t.Errorf("mimeType = %v, want %s", inline["mimeType"], tt.wantMime)
+			}
+		})
+	}
+}
+
+func TestNativeChatRequestTools(t *testing.T) {
+	function := func(name, params string) model.Tool {
+		return model.Tool{Type: "function", Function: &model.FunctionDefinition{Name: name, Parameters: json.RawMessage(params)}}
+	}
+	messages := []model.Message{{Role: "user", Content: "hi"}}
+	tests := []struct {
+		name      string
+		req       model.ChatCompletionRequest
+		want      string // payload 中的 tools 和 toolConfig
+		wantParam string
+	}{
+		{
+			name: "builtin tools are mapped and deduplicated",
+			req: model.ChatCompletionRequest{Tools: []model.Tool{
+				{Type: "web_search"}, {Type: "url_context"}, {Type: "code_execution"}, {Type: "google_search"}, {Type: "code_interpreter"},
+			}},
+			want: `{"tools":[{"googleSearch":{}},{"urlContext":{}},{"codeExecution":{}}]}`,
+		},
+		{
+			name: "web_search_options enables Google search",
+			req:  model.ChatCompletionRequest{WebSearchOptions: map[string]interface{}{"search_context_size": "low"}},
+			want: `{"tools":[{"googleSearch":{}}]}`,
+		},
+		{
+			name: "function declarations come first and keep the full JSON schema",
+			req: model.ChatCompletionRequest{
+				Tools:      []model.Tool{{Type: "url_context"}, function("lookup", `{"type":"object","additionalProperties":false}`), function("now", "null")},
+				ToolChoice: "required",
+			},
+			want: `{"tools":[{"functionDeclarations":[{"name":"lookup","parametersJsonSchema":{"type":"object","additionalProperties":false}},{"name":"now"}]},{"urlContext":{}}],` +
+				`"toolConfig":{"functionCallingConfig":{"mode":"ANY"}}}`,
+		},
+		{
+			name: "tool_choice naming a function",
+			req: model.ChatCompletionRequest{
+				Tools:      []model.Tool{{Type: "web_search"}, function("lookup", "")},
+				ToolChoice: map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "lookup"}},
+			},
+			want: `{"tools":[{"functionDeclarations":[{"name":"lookup"}]},{"googleSearch":{}}],"toolConfig":{"functionCallingConfig":{"mode":"ANY","allowedFunctionNames":["lookup"]}}}`,
+		},
+		{
+			name:      "invalid tool_choice",
+			req:       model.ChatCompletionRequest{Tools: []model.Tool{{Type: "web_search"}, function("lookup", "")}, ToolChoice: "sometimes"},
+			wantParam: "tool_choice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Messages = messages
+			native, err := newNativeChatRequest(&tt.req)
+			if tt.wantParam != "" {
+				var reqErr *ChatRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+					t.Fatalf("newNativeChatRequest = %v, want ChatRequestError on %s", err, tt.wantParam)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]interface{}{"tools": native.payload["tools"]}
+			if config, ok := native.payload["toolConfig"]; ok {
+				got["toolConfig"] = config
+			}
+			gotJSON, _ := json.Marshal(got)
+			assertJSONEqual(t, gotJSON, tt.want)
+		})
+	}
+}
+
+func TestCheckTools(t *testing.T) {
+	tests := []struct {
+		name      string
+		tools     []model.Tool
+		wantParam string
+	}{
+		{name: "function and builtin tools", tools: []model.Tool{{Type: "function", Function: &model.FunctionDefinition{Name: "f"}}, {Type: "url_context"}}},
+		{name: "function without a name", tools: []model.Tool{{Type: "function", Function: &model.FunctionDefinition{}}}, wantParam: "tools[0].function"},
+		{name: "unknown tool type", tools: []model.Tool{{Type: "web_search"}, {Type: "file_search"}}, wantParam: "tools[1].type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTools(&model.ChatCompletionRequest{Tools: tt.tools})
+			var reqErr *ChatRequestError
+			if tt.wantParam == "" {
+				if err != nil {
+					t.Errorf("checkTools = %v", err)
+				}
+			} else if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+				t.Errorf("checkTools = %v, want ChatRequestError on %s", err, tt.wantParam)
+			}
+		})
+	}
+}
+
+func TestNativeResponseFormat(t *testing.T) {
+	schema := map[string]interface{}{"type": "object", "properties": map[string]interface{}{"a": map[string]interface{}{"type": "string"}}}
+	tests := []struct {
+		name   string
+		format interface{}
+		want   string // generationConfig 中与格式有关的字段
+	}{
+		{name: "json_object", format: map[string]interface{}{"type": "json_object"}, want: `{"responseMimeType":"application/json"}`},
+		{
+			name:   "json_schema",
+			format: map[string]interface{}{"type": "json_schema", "json_schema": map[string]interface{}{"name": "out", "schema": schema}},
+			want:   `{"responseMimeType":"application/json","responseJsonSchema":{"type":"object","properties":{"a":{"type":"string"}}}}`,
+		},
+		{name: "json_schema without a schema", format: map[string]interface{}{"type": "json_schema", "json_schema": map[string]interface{}{"name": "out"}}, want: `{"responseMimeType":"application/json"}`},
+		{name: "text", format: map[string]interface{}{"type": "text"}, want: `{}`},
+		{name: "none", want: `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			native, err := newNativeChatRequest(&model.ChatCompletionRequest{
+				Messages:       []model.Message{{Role: "user", Content: "hi"}},
+				ResponseFormat: tt.format,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(native.generation)
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestGroundingAnnotations(t *testing.T) {
+	// "北京天气晴。" 每个汉字 3 个字节，"It is sunny." 从第 19 个字节 (第 7 个字符) 开始；第二个来源不是网页
+	content := "北京天气晴。 It is sunny."
+	chunks := `"groundingChunks":[{"web":{"uri":"https://a.example","title":"a"}},{"retrievedContext":{}},{"web":{"uri":"https://b.example","title":"b"}}]`
+	tests := []struct {
+		name string
+		meta string
+		want []model.URLCitation
+	}{
+		{
+			name: "without supports every source cites the whole content",
+			meta: `{` + chunks + `}`,
+			want: []model.URLCitation{
+				{StartIndex: 0, EndIndex: 19, URL: "https://a.example", Title: "a"},
+				{StartIndex: 0, EndIndex: 19, URL: "https://b.example", Title: "b"},
+			},
+		},
+		{
+			name: "byte offsets become character offsets and invalid chunks are skipped",
+			meta: `{` + chunks + `,"groundingSupports":[` +
+				`{"segment":{"startIndex":0,"endIndex":18},"groundingChunkIndices":[0,1,2]},` +
+				`{"segment":{"startIndex":19,"endIndex":31},"groundingChunkIndices":[2,7]},` +
+				`{"segment":{"startIndex":40,"endIndex":50},"groundingChunkIndices":[-1]}]}`,
+			want: []model.URLCitation{
+				{StartIndex: 0, EndIndex: 6, URL: "https://a.example", Title: "a"},
+				{StartIndex: 0, EndIndex: 6, URL: "https://b.example", Title: "b"},
+				{StartIndex: 7, EndIndex: 19, URL: "https://b.example", Title: "b"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var meta groundingMetadata
+			if err := json.Unmarshal([]byte(tt.meta), &meta); err != nil {
+				t.Fatal(err)
+			}
+			var got []model.URLCitation
+			for _, a := range groundingAnnotations(&meta, content) {
+				if a.Type != "url_citation" || a.URLCitation == nil {
+					t.Fatalf("annotation = %+v", a)
+				}
+				got = append(got, *a.URLCitation)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("annotations = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if got := groundingAnnotations(nil, content); got != nil {
+		t.Errorf("annotations without grounding metadata = %+v", got)
+	}
+}
+
+func TestNativeChatRejectsInvalidMediaLocally(t *testing.T) {
+	s, requests := newAIStudioTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`))
+	})
+	req := &model.ChatCompletionRequest{
+		Model: "gemini-2.5-flash",
+		Tools: []model.Tool{{Type: "web_search"}},
+		Messages: []model.Message{{Role: "user", Content: []interface{}{
+			map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"format": "flac", "data": "ZkxhQw=="}},
+		}}},
+	}
+	_, err := s.nonStreamNativeChat(context.Background(), req)
+	var reqErr *ChatRequestError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("nonStreamNativeChat = %v, want ChatRequestError", err)
+	}
+	// 上游会以 400 拒绝这类请求并导致 Key 被禁用，因此请求不能发出
+	if n := len(requests()); n != 0 {
+		t.Errorf("invalid request reached the upstream %d times", n)
+	}
+}
@@ -0,0 +1,524 @@
+// service/image_service.go
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	imageFormatURL = "url"
+	imageFormatB64 = "b64_json"
+
+	// maxImagesPerRequest 与 OpenAI 的 n 参数上限一致
+	maxImagesPerRequest = 10
+	// imagenMaxSampleCount 是 Imagen 单次 predict 最多生成的图片数，超过时分多次请求
+	imagenMaxSampleCount = 4
+	// imageFilePrefix 是本地保存的图片文件名前缀，用于区分目录中的其他文件
+	imageFilePrefix = "img_"
+)
+
+// Imagen 和 Gemini 图片模型各自支持的宽高比，OpenAI 的 size 会被转换为其中最接近的一个
+var (
+	imagenAspectRatios = []string{"1:1", "3:4", "4:3", "9:16", "16:9"}
+	geminiAspectRatios = []string{"1:1", "2:3", "3:2", "3:4", "4:3", "4:5", "5:4", "9:16", "16:9", "21:9"}
+)
+
+// editImageMimeTypes 是 Gemini 图片模型接受的输入图片格式。其他格式或无法解析的图片会被上游以 400 拒绝，
+// 而这类错误会让 Key 被禁用，因此在本地直接拒绝。
+var editImageMimeTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/webp": true}
+
+// ErrImageNotFound 表示请求的本地图片不存在或已过期
+var ErrImageNotFound = errors.New("图片不存在或已过期")
+
+// ImageRequestError 表示图片请求的参数不合法
+type ImageRequestError struct {
+	Param   string
+	Message string
+}
+
+func (e *ImageRequestError) Error() string {
+	return e.Message
+}
+
+// ImageBlockedError 表示上游成功响应但没有返回任何图片，通常是提示词或图片被安全策略拦截
+type ImageBlockedError struct {
+	Reason string
+}
+
+func (e *ImageBlockedError) Error() string {
+	return "上游没有返回图片: " + e.Reason
+}
+
+// ImageInput 是 /v1/images/edits 上传的一张图片
+type ImageInput struct {
+	Data     []byte
+	MimeType string
+}
+
+// generatedImage 是上游返回的一张图片，Data 为 base64 编码
+type generatedImage struct {
+	MimeType string
+	Data     string
+}
+
+// ImageService 将 OpenAI 兼容的图片生成/编辑请求转换为 Imagen 的 :predict 或
+// Gemini 图片模型的 :generateContent 请求，与文本请求共享 Key 池、重试、熔断和模型回退。
+// response_format=url 时图片保存在 IMAGE_FILES_DIR 中，通过 /images/{name} 提供下载，过期后自动删除。
+type ImageService struct {
+	configManager *config.Manager
+	genaiService  *GenAIService
+	dir           string
+}
+
+func NewImageService(manager *config.Manager, genaiService *GenAIService) *ImageService {
+	return &ImageService{
+		configManager: manager,
+		genaiService:  genaiService,
+		dir:           manager.Get().ImageFilesDir,
+	}
+}
+
+// Start 创建图片目录并启动过期图片的清理任务
+func (s *ImageService) Start() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("创建图片目录 %s 失败: %w", s.dir, err)
+	}
+	go s.janitor()
+	logger.Info("图片服务已启动，图片目录: %s", s.dir)
+	return nil
+}
+
+// DefaultModel 返回未指定模型时使用的图片模型
+func (s *ImageService) DefaultModel(edit bool) string {
+	cfg := s.configManager.Get()
+	if edit {
+		return cfg.ImageEditModel
+	}
+	return cfg.ImageDefaultModel
+}
+
+// Generate 根据提示词生成图片。req.Model 应已经过模型目录解析；
+// baseURL 是本次请求的服务地址，未配置 PUBLIC_BASE_URL 时用于拼接图片链接。
+func (s *ImageService) Generate(ctx context.Context, req *model.ImageGenerationRequest, baseURL string) (*model.ImageResponse, error) {
+	return s.run(ctx, req, nil, nil, baseURL)
+}
+
+// Edit 根据提示词编辑上传的图片。只有 Gemini 图片模型支持编辑，mask 作为附加图片传给模型。
+func (s *ImageService) Edit(ctx context.Context, req *model.ImageGenerationRequest, images []ImageInput, mask *ImageInput, baseURL string) (*model.ImageResponse, error) {
+	if len(images) == 0 {
+		return nil, &ImageRequestError{Param: "image", Message: "缺少要编辑的图片"}
+	}
+	checked := make([]ImageInput, len(images))
+	for i, img := range images {
+		var err error
+		if checked[i], err = checkEditImage(img, "image"); err != nil {
+			return nil, err
+		}
+	}
+	if mask != nil {
+		checkedMask, err := checkEditImage(*mask, "mask")
+		if err != nil {
+			return nil, err
+		}
+		if checkedMask.MimeType != "image/png" {
+			return nil, &ImageRequestError{Param: "mask", Message: "mask 必须是带透明通道的 PNG 图片"}
+		}
+		mask = &checkedMask
+	}
+	return s.run(ctx, req, checked, mask, baseURL)
+}
+
+// checkEditImage 按文件内容识别上传图片的格式 (不信任客户端声明的 Content-Type)，
+// 只接受可以解析出尺寸的 PNG、JPEG 和 WebP 图片，返回使用识别出的 MIME 类型的图片
+func checkEditImage(img ImageInput, param string) (ImageInput, error) {
+	mimeType := http.DetectContentType(img.Data)
+	if !editImageMimeTypes[mimeType] {
+		return ImageInput{}, &ImageRequestError{Param: param, Message: fmt.Sprintf("%s 必须是 PNG、JPEG 或 WebP 图片", param)}
+	}
+	var width, height int
+	if mimeType == "image/webp" {
+		width, height = webpSize(img.Data)
+	} else if cfg, _, err := image.DecodeConfig(bytes.NewReader(img.Data)); err == nil {
+		width, height = cfg.Width, cfg.Height
+	}
+	if width <= 0 || height <= 0 {
+		return ImageInput{}, &ImageRequestError{Param: param, Message: fmt.Sprintf("%s 无法解析，图片文件可能已损坏", param)}
+	}
+	return ImageInput{Data: img.Data, MimeType: mimeType}, nil
+}
+
+// webpSize 从 WebP 文件的第一个数据块 (VP8、VP8L 或 VP8X) 中读取图片尺寸，无法解析时返回 0
+func webpSize(data []byte) (int, int) {
+	if len(data) < 30 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0
+	}
+	chunk := data[20:]
+	switch string(data[12:16]) {
+	case "VP8 ": // 有损: 3 字节帧标记、3 字节起始码，之后是 14 位的宽和高
+		if !bytes.Equal(chunk[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0
+		}
+		return int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff), int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff)
+	case "VP8L": // 无损: 1 字节签名，之后是各 14 位的宽减一和高减一
+		if chunk[0] != 0x2f {
+			return 0, 0
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1
+	case "VP8X": // 扩展格式: 4 字节标志，之后是各 24 位的宽减一和高减一
+		width := int(chunk[4]) | int(chunk[5])<<8 | int(chunk[6])<<16
+		height := int(chunk[7]) | int(chunk[8])<<8 | int(chunk[9])<<16
+		return width + 1, height + 1
+	}
+	return 0, 0
+}
+
+func (s *ImageService) run(ctx context.Context, req *model.ImageGenerationRequest, inputs []ImageInput, mask *ImageInput, baseURL string) (*model.ImageResponse, error) {
+	if strings.TrimSpace(req.Prompt) == "" {
+		return nil, &ImageRequestError{Param: "prompt", Message: "prompt 不能为空"}
+	}
+	n := req.N
+	if n == 0 {
+		n = 1
+	}
+	if n < 1 || n > maxImagesPerRequest {
+		return nil, &ImageRequestError{Param: "n", Message: fmt.Sprintf("n 必须是 1 到 %d 之间的整数", maxImagesPerRequest)}
+	}
+	format := req.ResponseFormat
+	if format == "" {
+		format = imageFormatURL
+	}
+	if format != imageFormatURL && format != imageFormatB64 {
+		return nil, &ImageRequestError{Param: "response_format", Message: "response_format 必须是 url 或 b64_json"}
+	}
+	ratio, err := parseImageSize(req.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	edit := inputs != nil
+	modelName := s.upstreamModel(req.Model, edit)
+	var images []generatedImage
+	err = s.genaiService.withFallback(ctx, modelName, func(ctx context.Context, servedModel string) error {
+		var err error
+		if isImagenModel(servedModel) {
+			if edit {
+				return &ImageRequestError{Param: "model", Message: fmt.Sprintf("Imagen 模型 %s 不支持图片编辑，请使用 Gemini 图片模型", servedModel)}
+			}
+			images, err = s.predictImagen(ctx, servedModel, req.Prompt, n, nearestAspectRatio(ratio, imagenAspectRatios))
+		} else {
+			images, err = s.generateGemini(ctx, servedModel, req.Prompt, inputs, mask, n, nearestAspectRatio(ratio, geminiAspectRatios))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &model.ImageResponse{Created: time.Now().Unix(), Data: make([]model.ImageData, 0, len(images))}
+	for _, img := range images {
+		if format == imageFormatB64 {
+			resp.Data = append(resp.Data, model.ImageData{B64JSON: img.Data})
+			continue
+		}
+		name, err := s.saveImage(img)
+		if err != nil {
+			return nil, err
+		}
+		resp.Data = append(resp.Data, model.ImageData{URL: s.imageURL(baseURL, name)})
+	}
+	return resp, nil
+}
+
+// upstreamModel 将仍然是 OpenAI 图片模型名 (没有在模型目录中配置别名) 的请求映射到默认图片模型
+func (s *ImageService) upstreamModel(requested string, edit bool) string {
+	if requested == "" || strings.HasPrefix(requested, "dall-e") || strings.HasPrefix(requested, "gpt-image") {
+		return s.DefaultModel(edit)
+	}
+	return requested
+}
+
+// predictImagen 调用 Imagen 的 :predict 接口，n 超过单次上限时分多次请求
+func (s *ImageService) predictImagen(ctx context.Context, modelName, prompt string, n int, aspectRatio string) ([]generatedImage, error) {
+	var images []generatedImage
+	for remaining := n; remaining > 0; {
+		count := min(remaining, imagenMaxSampleCount)
+		params := map[string]interface{}{"sampleCount": count}
+		if aspectRatio != "" {
+			params["aspectRatio"] = aspectRatio
+		}
+		reqBody, err := json.Marshal(map[string]interface{}{
+			"instances":  []map[string]string{{"prompt": prompt}},
+			"parameters": params,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("序列化请求体失败: %w", err)
+		}
+
+		respBody, _, err := s.genaiService.geminiUnary(ctx, "Imagen Predict", modelName, "predict", reqBody)
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Predictions []struct {
+				BytesBase64Encoded string `json:"bytesBase64Encoded"`
+				MimeType           string `json:"mimeType"`
+				RaiFilteredReason  string `json:"raiFilteredReason"`
+			} `json:"predictions"`
+		}
+		if err := json.Unmarshal(respBody, &resp); err != nil {
+			return nil, fmt.Errorf("解析 Imagen 响应失败: %w", err)
+		}
+
+		got, reason := 0, ""
+		for _, p := range resp.Predictions {
+			if p.BytesBase64Encoded == "" {
+				reason = p.RaiFilteredReason
+				continue
+			}
+			images = append(images, generatedImage{MimeType: p.MimeType, Data: p.BytesBase64Encoded})
+			got++
+		}
+		if got == 0 {
+			if reason == "" {
+				reason = "Imagen 没有返回图片，提示词可能被安全策略过滤"
+			}
+			return nil, &ImageBlockedError{Reason: reason}
+		}
+		remaining -= count
+	}
+	return images, nil
+}
+
+// generateGemini 调用 Gemini 图片模型的 :generateContent 接口。
+// 每次调用只生成一张图片，n 张图片并发请求，各自从 Key 池中取 Key。
+func (s *ImageService) generateGemini(ctx context.Context, modelName, prompt string, inputs []ImageInput, mask *ImageInput, n int, aspectRatio string) ([]generatedImage, error) {
+	parts := []map[string]interface{}{{"text": prompt}}
+	for _, img := range inputs {
+		parts = append(parts, inlineImagePart(img))
+	}
+	if mask != nil {
+		parts = append(parts,
+			map[string]interface{}{"text": "The next image is a mask. Only edit the areas of the first image where the mask is fully transparent, and keep everything else unchanged."},
+			inlineImagePart(*mask),
+		)
+	}
+	generationConfig := map[string]interface{}{"responseModalities": []string{"TEXT", "IMAGE"}}
+	if aspectRatio != "" {
+		generationConfig["imageConfig"] = map[string]string{"aspectRatio": aspectRatio}
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"contents":         []map[string]interface{}{{"role": "user", "parts": parts}},
+		"generationConfig": generationConfig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("序列化请求体失败: %w", err)
+	}
+
+	images := make([]generatedImage, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			respBody, _, err := s.genaiService.geminiUnary(ctx, "Gemini Image", modelName, "generateContent", reqBody)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			images[i], errs[i] = parseGeminiImage(respBody)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// parseGeminiImage 取出 generateContent 响应中的第一张图片
+func parseGeminiImage(respBody []byte) (generatedImage, error) {
+	var resp struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text       string `json:"text"`
+					InlineData *struct {
+						MimeType string `json:"mimeType"`
+						Data     string `json:"data"`
+					} `json:"inlineData"`
+				} `json:"parts"`
+			} `json:"content"`
+			FinishReason string `json:"finishReason"`
+		} `json:"candidates"`
+		PromptFeedback struct {
+			BlockReason string `json:"blockReason"`
+		} `json:"promptFeedback"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return generatedImage{}, fmt.Errorf("解析 Gemini 响应失败: %w", err)
+	}
+
+	reason := resp.PromptFeedback.BlockReason
+	for _, candidate := range resp.Candidates {
+		var text strings.Builder
+		for _, part := range candidate.Content.Parts {
+			if part.InlineData != nil && part.InlineData.Data != "" {
+				return generatedImage{MimeType: part.InlineData.MimeType, Data: part.InlineData.Data}, nil
+			}
+			text.WriteString(part.Text)
+		}
+		if reason == "" {
+			reason = strings.TrimSpace(candidate.FinishReason + " " + text.String())
+		}
+	}
+	if reason == "" {
+		reason = "模型没有返回图片"
+	}
+	return generatedImage{}, &ImageBlockedError{Reason: reason}
+}
+
+func inlineImagePart(img ImageInput) map[string]interface{} {
+	return map[string]interface{}{
+		"inlineData": map[string]string{
+			"mimeType": img.MimeType,
+			"data":     base64.StdEncoding.EncodeToString(img.Data),
+		},
+	}
+}
+
+func isImagenModel(modelName string) bool {
+	return strings.HasPrefix(modelName, "imagen")
+}
+
+// parseImageSize 解析 OpenAI 的 size 参数 (如 1024x1792)，返回宽高比；为空或 auto 时返回 0，表示使用模型默认值
+func parseImageSize(size string) (float64, error) {
+	if size == "" || size == "auto" {
+		return 0, nil
+	}
+	w, h, ok := strings.Cut(size, "x")
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	if !ok || err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+		return 0, &ImageRequestError{Param: "size", Message: "size 必须是 auto 或 宽x高 的格式，如 1024x1024"}
+	}
+	return float64(width) / float64(height), nil
+}
+
+// nearestAspectRatio 从 supported 中选出与 ratio 最接近的宽高比，ratio 为 0 时返回空字符串
+func nearestAspectRatio(ratio float64, supported []string) string {
+	if ratio <= 0 {
+		return ""
+	}
+	best, bestDiff := "", math.Inf(1)
+	for _, candidate := range supported {
+		w, h, _ := strings.Cut(candidate, ":")
+		width, _ := strconv.ParseFloat(w, 64)
+		height, _ := strconv.ParseFloat(h, 64)
+		if diff := math.Abs(math.Log(ratio / (width / height))); diff < bestDiff {
+			best, bestDiff = candidate, diff
+		}
+	}
+	return best
+}
+
+// ===================== 本地图片 =====================
+
+// saveImage 将图片保存到本地目录，返回文件名
+func (s *ImageService) saveImage(img generatedImage) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(img.Data)
+	if err != nil {
+		return "", fmt.Errorf("解码上游图片失败: %w", err)
+	}
+	ext := ".png"
+	switch img.MimeType {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/webp":
+		ext = ".webp"
+	}
+	name := newObjectID(imageFilePrefix) + ext
+	if err := os.WriteFile(filepath.Join(s.dir, name), data, 0644); err != nil {
+		return "", fmt.Errorf("保存图片失败: %w", err)
+	}
+	return name, nil
+}
+
+// imageURL 拼接图片的下载地址，优先使用 PUBLIC_BASE_URL
+func (s *ImageService) imageURL(baseURL, name string) string {
+	if public := s.configManager.Get().PublicBaseURL; public != "" {
+		baseURL = public
+	}
+	return strings.TrimRight(baseURL, "/") + "/images/" + name
+}
+
+// OpenImage 返回未过期图片的本地路径
+func (s *ImageService) OpenImage(name string) (string, error) {
+	if filepath.Base(name) != name || !strings.HasPrefix(name, imageFilePrefix) {
+		return "", ErrImageNotFound
+	}
+	path := filepath.Join(s.dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", ErrImageNotFound
+	}
+	if time.Since(info.ModTime()) > s.configManager.Get().ImageURLTTL {
+		os.Remove(path)
+		return "", ErrImageNotFound
+	}
+	return path, nil
+}
+
+// janitor 定期删除过期的图片
+func (s *ImageService) janitor() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			logger.Warn("[Images] 读取图片目录失败: %v", err)
+			continue
+		}
+		ttl := s.configManager.Get().ImageURLTTL
+		removed := 0
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasPrefix(entry.Name(), imageFilePrefix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) <= ttl {
+				continue
+			}
+			if os.Remove(filepath.Join(s.dir, entry.Name())) == nil {
+				removed++
+			}
+		}
+		if removed > 0 {
+			logger.Info("[Images] 已删除 %d 张过期图片", removed)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"gemini_polling/model"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encodeTestImage 生成一张 4x2 的 PNG 或 JPEG 图片
+func encodeTestImage(t *testing.T, format string) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// webpHeader 生成只包含文件头和第一个数据块开头的 WebP 数据，足够识别格式和读取尺寸
+func webpHeader(chunk string, payload ...byte) []byte {
+	data := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), payload...)
+	return append(data, make([]byte, 16)...)
+}
+
+func TestCheckEditImage(t *testing.T) {
+	pngData := encodeTestImage(t, "png")
+	tests := []struct {
+		name     string
+		input    ImageInput
+		wantMime string // "" 表示应返回参数错误
+	}{
+		{name: "png", input: ImageInput{Data: pngData, MimeType: "image/png"}, wantMime: "image/png"},
+		{name: "jpeg", input: ImageInput{Data: encodeTestImage(t, "jpeg"), MimeType: "image/jpeg"}, wantMime: "image/jpeg"},
+		{name: "declared type is ignored", input: ImageInput{Data: pngData, MimeType: "image/gif"}, wantMime: "image/png"},
+		{name: "lossy webp", input: ImageInput{Data: webpHeader("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 4, 0, 2, 0)}, wantMime: "image/webp"},
+		{name: "lossless webp", input: ImageInput{Data: webpHeader("VP8L", 0x2f, 3, 0x40, 0, 0)}, wantMime: "image/webp"},
+		{name: "extended webp", input: ImageInput{Data: webpHeader("VP8X", 0, 0, 0, 0, 3, 0, 0, 1, 0, 0)}, wantMime: "image/webp"},
+		{name: "gif", input: ImageInput{Data: []byte("GIF89a\x04\x00\x02\x00\x00\x00\x00"), MimeType: "image/gif"}},
+		{name: "truncated png", input: ImageInput{Data: pngData[:12], MimeType: "image/png"}},
+		{name: "webp with a broken frame", input: ImageInput{Data: webpHeader("VP8 ", 0, 0, 0, 1, 2, 3, 4, 0, 2, 0)}},
+		{name: "text labelled as png", input: ImageInput{Data: []byte("not an image"), MimeType: "image/png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkEditImage(tt.input, "image")
+			if tt.wantMime == "" {
+				var reqErr *ImageRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != "image" {
+					t.Fatalf("checkEditImage = %v, want ImageRequestError on image", err)
+				}
+				return
+			}
+			if err != nil || got.MimeType != tt.wantMime {
+				t.Errorf("checkEditImage = %q, %v, want %s", got.MimeType, err, tt.wantMime)
+			}
+		})
+	}
+}
+
+func TestImageSizeMapping(t *testing.T) {
+	tests := []struct {
+		size       string
+		wantImagen string
+		wantGemini string
+		wantErr    bool
+	}{
+		{size: ""},
+		{size: "auto"},
+		{size: "1024x1024", wantImagen: "1:1", wantGemini: "1:1"},
+		{size: "1792x1024", wantImagen: "16:9", wantGemini: "16:9"},
+		{size: "1024x1792", wantImagen: "9:16", wantGemini: "9:16"},
+		{size: "1536x1024", wantImagen: "4:3", wantGemini: "3:2"}, // Imagen 没有 3:2
+		{size: "1024x1536", wantImagen: "3:4", wantGemini: "2:3"},
+		{size: "2560x1080", wantImagen: "16:9", wantGemini: "21:9"},
+		{size: "1024", wantErr: true},
+		{size: "0x1024", wantErr: true},
+		{size: "axb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			ratio, err := parseImageSize(tt.size)
+			if tt.wantErr {
+				var reqErr *ImageRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != "size" {
+					t.Fatalf("parseImageSize = %v, want ImageRequestError on size", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := nearestAspectRatio(ratio, imagenAspectRatios); got != tt.wantImagen {
+				t.Errorf("Imagen aspect ratio = %q, want %q", got, tt.wantImagen)
+			}
+			if got := nearestAspectRatio(ratio, geminiAspectRatios); got != tt.wantGemini {
+				t.Errorf("Gemini aspect ratio = %q, want %q", got, tt.wantGemini)
+			}
+		})
+	}
+}
+
+// newTestImageService 创建使用 AI Studio 替身的 ImageService，Imagen 按 sampleCount 返回图片，Gemini 每次返回一张
+func newTestImageService(t *testing.T) (*ImageService, func() []recordedRequest) {
+	t.Helper()
+	pngData := base64.StdEncoding.EncodeToString(encodeTestImage(t, "png"))
+	genai, requests := newAIStudioTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ":predict") {
+			var body struct {
+				Parameters struct {
+					SampleCount int `json:"sampleCount"`
+				} `json:"parameters"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			var predictions []string
+			for i := 0; i < body.Parameters.SampleCount; i++ {
+				predictions = append(predictions, `{"mimeType":"image/png","bytesBase64Encoded":"`+pngData+`"}`)
+			}
+			w.Write([]byte(`{"predictions":[` + strings.Join(predictions, ",") + `]}`))
+			return
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"inlineData":{"mimeType":"image/png","data":"` + pngData + `"}}]}}]}`))
+	})
+	manager := newTestConfigManager(t, "IMAGE_FILES_DIR", t.TempDir(), "PUBLIC_BASE_URL", "", "MODEL_FALLBACKS", "")
+	return NewImageService(manager, genai), requests
+}
+
+func TestImageRequestValidation(t *testing.T) {
+	pngImage := ImageInput{Data: encodeTestImage(t, "png"), MimeType: "image/png"}
+	jpegImage := ImageInput{Data: encodeTestImage(t, "jpeg"), MimeType: "image/jpeg"}
+	tests := []struct {
+		name      string
+		req       model.ImageGenerationRequest
+		edit      []ImageInput
+		mask      *ImageInput
+		wantParam string
+	}{
+		{name: "empty prompt", req: model.ImageGenerationRequest{Prompt: " "}, wantParam: "prompt"},
+		{name: "n above the limit", req: model.ImageGenerationRequest{Prompt: "cat", N: maxImagesPerRequest + 1}, wantParam: "n"},
+		{name: "negative n", req: model.ImageGenerationRequest{Prompt: "cat", N: -1}, wantParam: "n"},
+		{name: "unknown response_format", req: model.ImageGenerationRequest{Prompt: "cat", ResponseFormat: "png"}, wantParam: "response_format"},
+		{name: "invalid size", req: model.ImageGenerationRequest{Prompt: "cat", Size: "large"}, wantParam: "size"},
+		{name: "edit without images", req: model.ImageGenerationRequest{Prompt: "cat"}, edit: []ImageInput{}, wantParam: "image"},
+		{name: "edit with a corrupt image", req: model.ImageGenerationRequest{Prompt: "cat"}, edit: []ImageInput{pngImage, {Data: []byte("junk"), MimeType: "image/png"}}, wantParam: "image"},
+		{name: "mask must be png", req: model.ImageGenerationRequest{Prompt: "cat"}, edit: []ImageInput{pngImage}, mask: &jpegImage, wantParam: "mask"},
+		{name: "Imagen cannot edit", req: model.ImageGenerationRequest{Model: "imagen-4.0-generate-001", Prompt: "cat"}, edit: []ImageInput{pngImage}, wantParam: "model"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, requests := newTestImageService(t)
+			var err error
+			if tt.edit != nil {
+				_, err = s.Edit(context.Background(), &tt.req, tt.edit, tt.mask, "http://proxy")
+			} else {
+				_, err = s.Generate(context.Background(), &tt.req, "http://proxy")
+			}
+			var reqErr *ImageRequestError
+			if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+				t.Fatalf("err = %v, want ImageRequestError on %s", err, tt.wantParam)
+			}
+			if n := len(requests()); n != 0 {
+				t.Errorf("invalid request reached the upstream %d times", n)
+			}
+		})
+	}
+}
+
+func TestImageRouting(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        model.ImageGenerationRequest
+		edit       bool
+		wantPaths  []string // 每个上游请求路径的后缀
+		wantCounts []float64
+		wantRatio  string
+	}{
+		{
+			name:       "Imagen splits n into batches of four",
+			req:        model.ImageGenerationRequest{Model: "imagen-4.0-generate-001", Prompt: "cat", N: 6, Size: "1792x1024", ResponseFormat: imageFormatB64},
+			wantPaths:  []string{"imagen-4.0-generate-001:predict", "imagen-4.0-generate-001:predict"},
+			wantCounts: []float64{4, 2},
+			wantRatio:  "16:9",
+		},
+		{
+			name:      "OpenAI model names use the default Imagen model",
+			req:       model.ImageGenerationRequest{Model: "dall-e-3", Prompt: "cat"},
+			wantPaths: []string{"imagen-4.0-generate-001:predict"},
+		},
+		{
+			name:      "Gemini sends one request per image",
+			req:       model.ImageGenerationRequest{Model: "gemini-2.5-flash-image", Prompt: "cat", N: 2, Size: "1536x1024"},
+			wantPaths: []string{"gemini-2.5-flash-image:generateContent", "gemini-2.5-flash-image:generateContent"},
+			wantRatio: "3:2",
+		},
+		{
+			name:      "edits use the default Gemini edit model",
+			req:       model.ImageGenerationRequest{Model: "gpt-image-1", Prompt: "cat"},
+			edit:      true,
+			wantPaths: []string{"gemini-2.5-flash-image:generateContent"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, requests := newTestImageService(t)
+			var resp *model.ImageResponse
+			var err error
+			if tt.edit {
+				resp, err = s.Edit(context.Background(), &tt.req, []ImageInput{{Data: encodeTestImage(t, "jpeg")}}, nil, "http://proxy")
+			} else {
+				resp, err = s.Generate(context.Background(), &tt.req, "http://proxy")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := requests()
+			if len(got) != len(tt.wantPaths) {
+				t.Fatalf("upstream received %d requests, want %d", len(got), len(tt.wantPaths))
+			}
+			for i, req := range got {
+				if !strings.HasSuffix(req.path, "/"+tt.wantPaths[i]) {
+					t.Errorf("request %d path = %s, want suffix %s", i, req.path, tt.wantPaths[i])
+				}
+				var params map[string]interface{}
+				if strings.HasSuffix(req.path, ":predict") {
+					params, _ = req.body["parameters"].(map[string]interface{})
+					if tt.wantCounts != nil && params["sampleCount"] != tt.wantCounts[i] {
+						t.Errorf("request %d sampleCount = %v, want %v", i, params["sampleCount"], tt.wantCounts[i])
+					}
+				} else {
+					generationConfig, _ := req.body["generationConfig"].(map[string]interface{})
+					params, _ = generationConfig["imageConfig"].(map[string]interface{})
+					if tt.edit {
+						contents, _ := req.body["contents"].([]interface{})
+						parts, _ := contents[0].(map[string]interface{})["parts"].([]interface{})
+						inline, _ := parts[1].(map[string]interface{})["inlineData"].(map[string]interface{})
+						if inline["mimeType"] != "image/jpeg" {
+							t.Errorf("edit image mimeType = %v, want image/jpeg", inline["mimeType"])
+						}
+					}
+				}
+				if ratio, _ := params["aspectRatio"].(string); ratio != tt.wantRatio {
+					t.Errorf("request %d aspectRatio = %q, want %q", i, ratio, tt.wantRatio)
+				}
+			}
+
+			n := max(tt.req.N, 1)
+			if len(resp.Data) != n {
+				t.Fatalf("got %d images, want %d", len(resp.Data), n)
+			}
+			for _, img := range resp.Data {
+				if tt.req.ResponseFormat == imageFormatB64 {
+					if img.B64JSON == "" || img.URL != "" {
+						t.Errorf("b64_json image = %+v", img)
+					}
+					continue
+				}
+				name, ok := strings.CutPrefix(img.URL, "http://proxy/images/")
+				if !ok {
+					t.Fatalf("image URL = %s", img.URL)
+				}
+				if _, err := os.Stat(filepath.Join(s.dir, name)); err != nil {
+					t.Errorf("saved image: %v", err)
+				}
+			}
+		})
+	}
+}
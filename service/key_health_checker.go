@@ -3,6 +3,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gemini_polling/config"
 	"gemini_polling/logger"
@@ -10,7 +11,6 @@ import (
 	"gemini_polling/storage"
 	"io"
 	"net/http"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -232,11 +232,11 @@ func (c *KeyHealthChecker) runChecksConcurrently(keys []model.APIKey, checkType
 			for key := range jobs {
 				// For enabled keys, don't re-check if they are already in the cooldown map.
 				if checkType == "enabled" {
-					if _, onCooldown := c.keyPool.cooldownKeys.Load(key.ID); onCooldown {
+					if c.keyPool.IsOnCooldown(key.ID) {
 						continue
 					}
 				}
-				status, reason := c.checkKeyStatus(key.Key)
+				status, reason := c.checkKeyStatus(&key)
 				results <- checkResult{Key: key, Status: status, Reason: reason}
 			}
 		}(i)
@@ -268,11 +268,12 @@ func (c *KeyHealthChecker) processResults(results chan checkResult, checkType st
 				rateLimitedCount++
 				logger.Debug("  -> [启用Key检查] Key ID %d 检测到速率限制(429)，将进入冷却。原因: %s", result.Key.ID, result.Reason)
 				// Use the keypool's method to handle cooldown
-				c.keyPool.ReturnKey(&result.Key, true)
+				c.keyPool.MarkRateLimited(result.Key.ID)
 			case KeyStatusInvalid:
 				invalidCount++
 				logger.Debug("  -> [启用Key检查] Key ID %d 检测为无效(4xx)，将【永久禁用】。原因: %s", result.Key.ID, result.Reason)
 				c.keyStore.Disable(result.Key.ID, "例行检查发现Key无效: "+result.Reason)
+				c.keyPool.Remove(result.Key.ID)
 			}
 		case "disabled":
 			if result.Status == KeyStatusOK {
@@ -410,12 +411,12 @@ func (c *KeyHealthChecker) runChecksConcurrentlyWithProgress(keys []model.APIKey
 			for key := range jobs {
 				// For enabled keys, don't re-check if they are already in the cooldown map.
 				if checkType == "enabled" {
-					if _, onCooldown := c.keyPool.cooldownKeys.Load(key.ID); onCooldown {
+					if c.keyPool.IsOnCooldown(key.ID) {
 						c.updateProgress()
 						continue
 					}
 				}
-				status, reason := c.checkKeyStatus(key.Key)
+				status, reason := c.checkKeyStatus(&key)
 				results <- checkResult{Key: key, Status: status, Reason: reason}
 				c.updateProgress()
 
@@ -466,24 +467,21 @@ func (c *KeyHealthChecker) runChecksConcurrentlyWithProgress(keys []model.APIKey
 }
 
 // checkKeyStatus uses a lightweight API call to check the status of a key.
-func (c *KeyHealthChecker) checkKeyStatus(apiKey string) (int, string) {
-	// 使用 'POST models:countTokens' 请求作为健康检查，因为它能更准确地反映生成类API的速率限制状态。
-	// 我们使用 gemini-2.5-pro，因为它是一个常用模型。
-	const url = "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-pro:generateContent"
-	const requestBody = `{"contents":[{"parts":[{"text":"Explain how AI works in a few words"}]}]}`
-
+func (c *KeyHealthChecker) checkKeyStatus(key *model.APIKey) (int, string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(requestBody))
+	req, err := c.newHealthCheckRequest(ctx, key)
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		// Vertex AI 服务账号换取 access token 失败
+		return c.statusFromResponse(upstreamErr.StatusCode, upstreamErr.Body)
+	}
 	if err != nil {
 		// 这是一个本地错误，不是密钥状态问题。
 		return KeyStatusOK, "Failed to create request: " + err.Error()
 	}
 
-	req.Header.Set("x-goog-api-key", apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
 	resp, err := c.genaiService.httpClient.Do(req)
 	if err != nil {
 		// 网络错误，暂时假定密钥正常，可能只是临时的网络问题。
@@ -491,16 +489,39 @@ func (c *KeyHealthChecker) checkKeyStatus(apiKey string) (int, string) {
 	}
 	defer resp.Body.Close()
 
-	switch resp.StatusCode {
+	var body []byte
+	if resp.StatusCode != http.StatusOK {
+		body, _ = io.ReadAll(resp.Body)
+	}
+	return c.statusFromResponse(resp.StatusCode, body)
+}
+
+// newHealthCheckRequest 按凭据的提供方构造健康检查请求。
+// AI Studio 和 Vertex AI 使用 'POST models:generateContent' 请求作为健康检查，因为它能更准确地反映生成类API的速率限制状态。
+// 我们使用 gemini-2.5-pro，因为它是一个常用模型。OpenAI 兼容接口没有统一的模型，使用 GET {base}/models。
+func (c *KeyHealthChecker) newHealthCheckRequest(ctx context.Context, key *model.APIKey) (*http.Request, error) {
+	if key.ProviderName() == model.ProviderOpenAI {
+		req, err := http.NewRequestWithContext(ctx, "GET", key.BaseURL+"/models", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+		return req, nil
+	}
+	const requestBody = `{"contents":[{"parts":[{"text":"Explain how AI works in a few words"}]}]}`
+	return c.genaiService.newGeminiRequest(ctx, key, "gemini-2.5-pro", "generateContent", "", []byte(requestBody))
+}
+
+// statusFromResponse 把健康检查的响应状态码转换为 Key 状态
+func (c *KeyHealthChecker) statusFromResponse(statusCode int, body []byte) (int, string) {
+	switch statusCode {
 	case http.StatusOK:
 		return KeyStatusOK, ""
 	case http.StatusTooManyRequests:
-		body, _ := io.ReadAll(resp.Body)
 		return KeyStatusRateLimited, fmt.Sprintf("API返回429: %s", string(body))
 	default:
-		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-			body, _ := io.ReadAll(resp.Body)
-			return KeyStatusInvalid, fmt.Sprintf("API返回%d: %s", resp.StatusCode, string(body))
+		if statusCode >= 400 && statusCode < 500 {
+			return KeyStatusInvalid, fmt.Sprintf("API返回%d: %s", statusCode, string(body))
 		}
 		// 对于 5xx 或其他错误，我们假定是临时的服务器端问题，不惩罚密钥。
 		return KeyStatusOK, ""
@@ -2,12 +2,14 @@
 package service
 
 import (
+	"container/heap"
 	"errors"
 	"gemini_polling/config"
 	"gemini_polling/logger"
 	"gemini_polling/model"
 	"gemini_polling/storage"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,21 +17,44 @@ import (
 // ErrNoAvailableKeys is returned when no keys are available in the pool.
 var ErrNoAvailableKeys = errors.New("key pool: no available keys")
 
+// ErrNoMatchingKeys 表示池中没有任何可以服务该请求的凭据 (例如模型被路由到了没有配置凭据的提供方)，
+// 与 ErrNoAvailableKeys 不同，等待也不会有结果
+var ErrNoMatchingKeys = errors.New("key pool: no credentials serve this request")
+
+const (
+	// keyWaitTimeout 是 GetKey 在没有可用 Key 时的最长等待时间
+	keyWaitTimeout = 30 * time.Second
+	// keySampleSize 是每次选择 Key 时随机抽样的候选数量，避免在大池子中全量扫描
+	keySampleSize = 8
+	// claimedCacheSize 是缓存的模型 → 认领凭据列表的最大数量，超过后清空重建
+	claimedCacheSize = 1024
+)
+
 // KeyPool manages a pool of API keys in memory for high-performance access.
+//
+// 所有状态都由 mu 保护：entries 保存全部已知的启用 Key，ready 是当前不在冷却中的 Key
+// (支持 O(1) 随机抽样和删除)，cooldown 是按 NextAvailableAt 排序的最小堆。
+// Key 在被 GetKey 取出时不会从 ready 中移除，而是通过 inFlight 计数跟踪占用情况，
+// 并据此执行单 Key 并发上限 (MaxConcurrentPerKey) 和最少负载优先的选择策略。
 type KeyPool struct {
 	keyStore      *storage.KeyStore
 	configManager *config.Manager
 
-	mu            sync.RWMutex
-	availableKeys chan *model.APIKey // Channel of available keys, acts as the pool
-	allKeys       map[uint]*model.APIKey // Holds all known enabled keys for quick lookup
-
-	// A separate map to track keys that are temporarily on cooldown (e.g., due to 429).
-	// This prevents them from being added back to the available pool immediately.
-	cooldownKeys sync.Map // map[uint]time.Time
-	
-	// 新增：智能key管理
-	keyStats      map[uint]*KeyStats
+	mu       sync.Mutex
+	entries  map[uint]*keyEntry
+	ready    []*keyEntry
+	cooldown cooldownHeap
+	routed   []*keyEntry    // 通过 Models 指定了服务模型的凭据，通常只有少数几个
+	unrouted map[string]int // 没有指定 Models、可以服务任意模型的凭据按提供方计数 (包括冷却中的)
+	// unroutedReady 按提供方保存 ready 中没有指定 Models 的 AI Studio / Vertex AI 凭据，
+	// 选择时只在被接受的提供方中抽样，不会抽到认领了其他模型的凭据或 OpenAI 兼容凭据
+	unroutedReady map[string][]*keyEntry
+	// claimed 缓存每个模型名被哪些 routed 凭据认领 (包括冷却中的)，在 SetKeys/Remove 时清空
+	claimed map[string][]*keyEntry
+
+	// waiters 记录当前阻塞在 GetKey 中的调用者数量，只有存在等待者时才广播
+	waiters int
+	notify  chan struct{}
 }
 
 // KeyStats 用于跟踪key的统计信息
@@ -44,13 +69,51 @@ type KeyStats struct {
 	IsOnCooldown    bool
 }
 
+// keyEntry 是池中单个 Key 的内部状态
+type keyEntry struct {
+	key      *model.APIKey
+	stats    KeyStats
+	inFlight int
+	readyIdx int    // 在 ready 中的下标，不在其中时为 -1
+	heapIdx  int    // 在 cooldown 堆中的下标，不在其中时为 -1
+	group    string // 所属的 unroutedReady 提供方，routed 和 OpenAI 兼容凭据为空
+	groupIdx int    // 在 unroutedReady[group] 中的下标，不在其中时为 -1
+}
+
+// cooldownHeap 是按 NextAvailableAt 排序的最小堆，实现 heap.Interface
+type cooldownHeap []*keyEntry
+
+func (h cooldownHeap) Len() int { return len(h) }
+func (h cooldownHeap) Less(i, j int) bool {
+	return h[i].stats.NextAvailableAt.Before(h[j].stats.NextAvailableAt)
+}
+func (h cooldownHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
+}
+func (h *cooldownHeap) Push(x interface{}) {
+	e := x.(*keyEntry)
+	e.heapIdx = len(*h)
+	*h = append(*h, e)
+}
+func (h *cooldownHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.heapIdx = -1
+	*h = old[:n-1]
+	return e
+}
+
 // NewKeyPool creates a new KeyPool service.
 func NewKeyPool(keyStore *storage.KeyStore, configManager *config.Manager) *KeyPool {
 	return &KeyPool{
 		keyStore:      keyStore,
 		configManager: configManager,
-		allKeys:       make(map[uint]*model.APIKey),
-		keyStats:      make(map[uint]*KeyStats),
+		entries:       make(map[uint]*keyEntry),
+		notify:        make(chan struct{}),
 	}
 }
 
@@ -74,24 +137,10 @@ func (p *KeyPool) initialLoad() {
 	keys, err := p.keyStore.GetAllEnabledKeys()
 	if err != nil {
 		logger.Error("[错误] Key 池初始化加载失败: %v", err)
-		// Even if it fails, we create the channel to avoid nil panics.
-		p.availableKeys = make(chan *model.APIKey, 1) // Default size
 		return
 	}
 
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	// Create a channel with enough capacity for all keys.
-	p.availableKeys = make(chan *model.APIKey, len(keys))
-	p.allKeys = make(map[uint]*model.APIKey, len(keys))
-
-	for i := range keys {
-		key := keys[i] // Create a new variable for the pointer
-		p.allKeys[key.ID] = &key
-		p.availableKeys <- &key
-	}
-
+	p.SetKeys(keys)
 	logger.Info("Key 池初始化成功，加载了 %d 个可用的 Key。", len(keys))
 }
 
@@ -103,157 +152,373 @@ func (p *KeyPool) refresh() {
 		return
 	}
 
+	p.SetKeys(dbKeys)
+
+	p.mu.Lock()
+	total, available := len(p.entries), len(p.ready)
+	p.mu.Unlock()
+	logger.Info("[Key Pool] 刷新完成。数据库中共有 %d 个启用 Key，当前可用 %d 个。", total, available)
+}
+
+// SetKeys 用给定的 Key 列表替换池中的 Key 集合。
+// 仍然存在的 Key 会保留其统计、冷却和 in-flight 状态；不再存在的 Key 会被移出池。
+func (p *KeyPool) SetKeys(keys []model.APIKey) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	newKeysMap := make(map[uint]*model.APIKey, len(dbKeys))
-	for i := range dbKeys {
-		key := dbKeys[i]
-		newKeysMap[key.ID] = &key
-	}
-
-	// Update allKeys map
-	p.allKeys = newKeysMap
-
-	// Rebuild the availableKeys channel
-	// 1. Drain the current channel of any remaining keys
-	close(p.availableKeys)
-	// 2. Create a new channel
-	p.availableKeys = make(chan *model.APIKey, len(p.allKeys))
-	// 3. Fill it with the new set of keys, respecting cooldowns
-	refreshedCount := 0
-	for _, key := range p.allKeys {
-		if _, onCooldown := p.cooldownKeys.Load(key.ID); !onCooldown {
-			p.availableKeys <- key
-			refreshedCount++
+	seen := make(map[uint]struct{}, len(keys))
+	for i := range keys {
+		key := keys[i] // Create a new variable for the pointer
+		seen[key.ID] = struct{}{}
+		if e, ok := p.entries[key.ID]; ok {
+			e.key = &key
+			continue
+		}
+		e := &keyEntry{
+			key:      &key,
+			stats:    KeyStats{HealthScore: 100},
+			readyIdx: -1,
+			heapIdx:  -1,
+			groupIdx: -1,
+		}
+		p.entries[key.ID] = e
+		p.addReadyLocked(e)
+	}
+
+	for id, e := range p.entries {
+		if _, ok := seen[id]; !ok {
+			p.removeLocked(e)
+		}
+	}
+
+	p.rebuildRoutingLocked()
+	p.broadcastLocked()
+}
+
+// rebuildRoutingLocked 重新收集通过 Models 指定了服务模型的凭据，并按提供方分组其余的凭据，
+// 使 routeLocked 和 pickLocked 不需要遍历整个池。SetKeys 可能改变已有凭据的 Models 或提供方，因此每次都完整重建。
+func (p *KeyPool) rebuildRoutingLocked() {
+	p.routed = p.routed[:0]
+	p.unrouted = make(map[string]int)
+	p.unroutedReady = make(map[string][]*keyEntry)
+	p.claimed = make(map[string][]*keyEntry)
+	for _, e := range p.entries {
+		e.group, e.groupIdx = "", -1
+		if e.key.Models != "" {
+			p.routed = append(p.routed, e)
+			continue
+		}
+		provider := e.key.ProviderName()
+		if provider == model.ProviderOpenAI {
+			continue
+		}
+		p.unrouted[provider]++
+		e.group = provider
+		if e.readyIdx >= 0 {
+			p.addGroupLocked(e)
 		}
 	}
+}
 
-	logger.Info("[Key Pool] 刷新完成。数据库中共有 %d 个启用 Key，当前可用 %d 个。", len(p.allKeys), refreshedCount)
+// Remove 立即将指定 Key 移出池，例如在 Key 被永久禁用时调用
+func (p *KeyPool) Remove(keyID uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[keyID]; ok {
+		p.removeLocked(e)
+		p.rebuildRoutingLocked()
+	}
 }
 
-// GetKey retrieves an available key from the pool using intelligent selection.
+// GetKey 取出一个没有指定服务模型的 AI Studio Key，用于模型列表、Live API 等只有 AI Studio 支持的接口
 func (p *KeyPool) GetKey() (*model.APIKey, error) {
-	// 首先尝试获取智能选择的key
-	if key := p.getBestAvailableKey(); key != nil {
-		return key, nil
-	}
-	
-	// 如果没有可用key，等待并重试
-	select {
-	case key, ok := <-p.availableKeys:
+	return p.GetKeyFor("", func(provider string) bool {
+		return provider == model.ProviderAIStudio
+	})
+}
+
+// GetKeyFor retrieves an available key from the pool using intelligent selection.
+// 只选择可以服务 modelName 且提供方被 accept 接受的凭据 (accept 为 nil 时不限制)；
+// 池中没有这样的凭据时立即返回 ErrNoMatchingKeys。
+// 如果当前没有可用 Key (全部冷却中或并发已满)，会一直等待到有 Key 被释放、冷却结束或超时。
+func (p *KeyPool) GetKeyFor(modelName string, accept func(provider string) bool) (*model.APIKey, error) {
+	deadline := time.Now().Add(keyWaitTimeout)
+	for {
+		p.mu.Lock()
+		now := time.Now()
+		p.promoteExpiredLocked(now)
+		from, match, ok := p.routeLocked(modelName, accept)
 		if !ok {
-			return nil, errors.New("key channel is closed")
+			p.mu.Unlock()
+			return nil, ErrNoMatchingKeys
 		}
-		return key, nil
-	case <-time.After(30 * time.Second):
-		return nil, ErrNoAvailableKeys
+		if e := p.pickLocked(now, from, match); e != nil {
+			e.inFlight++
+			key := e.key
+			p.mu.Unlock()
+			return key, nil
+		}
+
+		wait := deadline.Sub(now)
+		if wait <= 0 {
+			p.mu.Unlock()
+			return nil, ErrNoAvailableKeys
+		}
+		// 最早冷却结束的 Key 到期时主动唤醒
+		if len(p.cooldown) > 0 {
+			if untilNext := p.cooldown[0].stats.NextAvailableAt.Sub(now); untilNext < wait {
+				wait = untilNext
+			}
+		}
+		notify := p.notify
+		p.waiters++
+		p.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		p.mu.Lock()
+		p.waiters--
+		p.mu.Unlock()
 	}
 }
 
-// getBestAvailableKey 使用智能算法选择最佳可用key
-func (p *KeyPool) getBestAvailableKey() *model.APIKey {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	
-	var availableKeys []*model.APIKey
+// GetKeyByID 取出指定的 Key，用于访问该 Key 创建的上游资源 (如上下文缓存)。
+// Key 不在池中、冷却中或不满足选择条件时立即返回 ErrNoAvailableKeys，不等待。
+func (p *KeyPool) GetKeyByID(keyID uint) (*model.APIKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	now := time.Now()
-	cfg := p.configManager.Get()
-	
-	// 收集所有可用的key
-	for _, key := range p.allKeys {
-		stats := p.keyStats[key.ID]
-		
-		// 检查key是否可用
-		if stats != nil {
-			// 如果key在冷却中且未到时间，跳过
-			if stats.IsOnCooldown && now.Before(stats.NextAvailableAt) {
-				continue
+	p.promoteExpiredLocked(now)
+	e, ok := p.entries[keyID]
+	if !ok || e.readyIdx < 0 || !p.isEligible(e, p.configManager.Get(), now, false) {
+		return nil, ErrNoAvailableKeys
+	}
+	e.inFlight++
+	return e.key, nil
+}
+
+// routeLocked 决定本次选择的候选范围和过滤条件: 有凭据通过 Models 明确认领 modelName 时只使用这些凭据，
+// 否则使用没有指定 Models 的 AI Studio / Vertex AI 凭据。池中没有任何满足条件的凭据 (包括冷却中的) 时 ok 为 false。
+// match 为 nil 表示 from 中的凭据都满足条件。
+func (p *KeyPool) routeLocked(modelName string, accept func(provider string) bool) (from [][]*keyEntry, match func(*keyEntry) bool, ok bool) {
+	if claimed := p.claimedLocked(modelName); len(claimed) > 0 {
+		for _, e := range claimed {
+			if accept == nil || accept(e.key.ProviderName()) {
+				match = func(e *keyEntry) bool {
+					return e.readyIdx >= 0 && (accept == nil || accept(e.key.ProviderName()))
+				}
+				return [][]*keyEntry{claimed}, match, true
 			}
-			
-			// 如果key健康分数太低，跳过
-			if stats.HealthScore < cfg.MinHealthScore {
-				continue
+		}
+		return nil, nil, false
+	}
+
+	for provider, n := range p.unrouted {
+		if n > 0 && (accept == nil || accept(provider)) {
+			ok = true
+			if group := p.unroutedReady[provider]; len(group) > 0 {
+				from = append(from, group)
 			}
-			
-			// 如果429次数过多，跳过
-			if stats.RateLimitCount > cfg.Max429Count {
-				continue
+		}
+	}
+	return from, nil, ok
+}
+
+// claimedLocked 返回通过 Models 认领了 modelName 的凭据 (包括冷却中的)，结果按模型名缓存到下次 SetKeys/Remove
+func (p *KeyPool) claimedLocked(modelName string) []*keyEntry {
+	if modelName == "" || len(p.routed) == 0 {
+		return nil
+	}
+	modelName = strings.TrimPrefix(modelName, "models/")
+	if claimed, ok := p.claimed[modelName]; ok {
+		return claimed
+	}
+	var claimed []*keyEntry
+	for _, e := range p.routed {
+		if servesModel(e.key, modelName) {
+			claimed = append(claimed, e)
+		}
+	}
+	if len(p.claimed) >= claimedCacheSize {
+		p.claimed = make(map[string][]*keyEntry)
+	}
+	p.claimed[modelName] = claimed
+	return claimed
+}
+
+// pickLocked 从 from (若干组候选 Key，视为一个连续的列表) 里选择一个满足 match 的 Key。
+// 优先不放回地随机抽样 keySampleSize 个，抽样失败时回退到全量扫描。
+func (p *KeyPool) pickLocked(now time.Time, from [][]*keyEntry, match func(*keyEntry) bool) *keyEntry {
+	total := 0
+	for _, group := range from {
+		total += len(group)
+	}
+	if total == 0 {
+		return nil
+	}
+	cfg := p.configManager.Get()
+	accept := func(e *keyEntry, skipRecent429 bool) bool {
+		return (match == nil || match(e)) && p.isEligible(e, cfg, now, skipRecent429)
+	}
+
+	var candidates []*keyEntry
+	if total <= keySampleSize {
+		candidates = make([]*keyEntry, 0, total)
+		for _, group := range from {
+			for _, e := range group {
+				if accept(e, true) {
+					candidates = append(candidates, e)
+				}
 			}
-			
-			// 如果最近有429记录，根据时间判断是否跳过
-			if !stats.Last429At.IsZero() {
-				timeSince429 := now.Sub(stats.Last429At)
-				// 如果429发生在最近1小时内，降低选择概率
-				if timeSince429 < time.Hour {
-					if rand.Float32() > 0.1 { // 90%概率跳过
-						continue
+		}
+	} else {
+		candidates = make([]*keyEntry, 0, keySampleSize)
+		var sample [keySampleSize]int
+		for _, i := range sampleIndices(sample[:], total) {
+			for _, group := range from {
+				if i < len(group) {
+					if e := group[i]; accept(e, true) {
+						candidates = append(candidates, e)
 					}
+					break
 				}
+				i -= len(group)
 			}
 		}
-		
-		availableKeys = append(availableKeys, key)
 	}
-	
-	if len(availableKeys) == 0 {
-		return nil
+
+	// 抽样没有命中时全量扫描一次，此时不再按最近 429 做概率跳过，避免无谓等待
+	if len(candidates) == 0 {
+		for _, group := range from {
+			for _, e := range group {
+				if accept(e, false) {
+					candidates = append(candidates, e)
+				}
+			}
+		}
 	}
-	
-	// 根据健康分数加权随机选择
-	return p.selectKeyByWeight(availableKeys)
+
+	return p.selectKeyByWeight(leastLoaded(candidates))
+}
+
+// sampleIndices 用 Floyd 算法从 [0, n) 中不放回地随机选出 len(dst) 个不同的下标写入 dst，要求 len(dst) <= n。
+// 同一个 Key 不会在候选中出现多次，避免放大其在加权选择中的权重。
+func sampleIndices(dst []int, n int) []int {
+	k := len(dst)
+	for j, filled := n-k, 0; j < n; j, filled = j+1, filled+1 {
+		t := rand.Intn(j + 1)
+		for _, picked := range dst[:filled] {
+			if picked == t {
+				t = j
+				break
+			}
+		}
+		dst[filled] = t
+	}
+	return dst
+}
+
+// leastLoaded 只保留 in-flight 请求数最少的候选 Key
+func leastLoaded(entries []*keyEntry) []*keyEntry {
+	if len(entries) < 2 {
+		return entries
+	}
+	minInFlight := entries[0].inFlight
+	for _, e := range entries[1:] {
+		if e.inFlight < minInFlight {
+			minInFlight = e.inFlight
+		}
+	}
+	result := entries[:0]
+	for _, e := range entries {
+		if e.inFlight == minInFlight {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// isEligible 判断 Key 当前是否可以被选中
+func (p *KeyPool) isEligible(e *keyEntry, cfg *config.Config, now time.Time, skipRecent429 bool) bool {
+	stats := &e.stats
+
+	// 如果key并发已达上限，跳过
+	if cfg.MaxConcurrentPerKey > 0 && e.inFlight >= cfg.MaxConcurrentPerKey {
+		return false
+	}
+
+	// 如果key健康分数太低，跳过
+	if stats.HealthScore < cfg.MinHealthScore {
+		return false
+	}
+
+	// 如果429次数过多，跳过
+	if stats.RateLimitCount > cfg.Max429Count {
+		return false
+	}
+
+	// 如果429发生在最近1小时内，降低选择概率
+	if skipRecent429 && !stats.Last429At.IsZero() && now.Sub(stats.Last429At) < time.Hour {
+		if rand.Float32() > 0.1 { // 90%概率跳过
+			return false
+		}
+	}
+
+	return true
 }
 
 // selectKeyByWeight 根据健康分数加权随机选择key
-func (p *KeyPool) selectKeyByWeight(keys []*model.APIKey) *model.APIKey {
-	if len(keys) == 0 {
+func (p *KeyPool) selectKeyByWeight(entries []*keyEntry) *keyEntry {
+	if len(entries) == 0 {
 		return nil
 	}
-	
-	if len(keys) == 1 {
-		return keys[0]
+
+	if len(entries) == 1 {
+		return entries[0]
 	}
-	
+
 	// 计算总权重
 	totalWeight := 0
-	weights := make([]int, len(keys))
-	for i, key := range keys {
-		stats := p.keyStats[key.ID]
-		weight := 50 // 基础权重
-		
-		if stats != nil {
-			weight = stats.HealthScore
-			// 根据最近的成功率调整权重
-			if stats.SuccessCount+stats.FailureCount > 0 {
-				successRate := float64(stats.SuccessCount) / float64(stats.SuccessCount+stats.FailureCount)
-				weight = int(float64(weight) * successRate)
-			}
+	weights := make([]int, len(entries))
+	for i, e := range entries {
+		stats := &e.stats
+		weight := stats.HealthScore
+		// 根据最近的成功率调整权重
+		if stats.SuccessCount+stats.FailureCount > 0 {
+			successRate := float64(stats.SuccessCount) / float64(stats.SuccessCount+stats.FailureCount)
+			weight = int(float64(weight) * successRate)
 		}
-		
+
 		// 确保权重不为0
 		if weight < 1 {
 			weight = 1
 		}
-		
+
 		weights[i] = weight
 		totalWeight += weight
 	}
-	
+
 	// 加权随机选择
 	randomWeight := rand.Intn(totalWeight)
 	currentWeight := 0
-	
+
 	for i, weight := range weights {
 		currentWeight += weight
 		if randomWeight < currentWeight {
-			return keys[i]
+			return entries[i]
 		}
 	}
-	
-	return keys[len(keys)-1]
+
+	return entries[len(entries)-1]
 }
 
-// ReturnKey returns a key to the pool, optionally putting it on cooldown with intelligent strategy.
+// ReturnKey releases a key previously obtained from GetKey, optionally putting it on cooldown.
 func (p *KeyPool) ReturnKey(key *model.APIKey, isRateLimited bool) {
 	if key == nil {
 		return
@@ -261,78 +526,194 @@ func (p *KeyPool) ReturnKey(key *model.APIKey, isRateLimited bool) {
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	
-	// 确保stats存在
-	if _, exists := p.keyStats[key.ID]; !exists {
-		p.keyStats[key.ID] = &KeyStats{
-			HealthScore: 100,
-		}
+
+	e, ok := p.entries[key.ID]
+	if !ok {
+		// Key 在使用期间已被移出池 (禁用或删除)
+		return
 	}
-	
-	stats := p.keyStats[key.ID]
-	stats.LastUsedAt = time.Now()
+	if e.inFlight > 0 {
+		e.inFlight--
+	}
+	e.stats.LastUsedAt = time.Now()
 
 	if isRateLimited {
 		// 智能冷却策略
-		p.handleRateLimit(key, stats)
+		p.handleRateLimit(e)
 	} else {
 		// 成功使用，增加健康分数
-		p.handleSuccess(key, stats)
+		p.handleSuccess(e)
 	}
+	p.broadcastLocked()
+}
 
-	// 如果key可用，返回到池中
-	if !stats.IsOnCooldown && stats.HealthScore >= 30 {
-		select {
-		case p.availableKeys <- key:
-		default:
-			logger.Warn("[Key Pool] Key ID %d 返回失败，通道已满。", key.ID)
-		}
+// ReleaseKey 释放 Key 的占用但不影响其健康统计，
+// 用于上游 5xx、超时或客户端取消等与 Key 本身无关的失败
+func (p *KeyPool) ReleaseKey(key *model.APIKey) {
+	if key == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[key.ID]; ok && e.inFlight > 0 {
+		e.inFlight--
+		p.broadcastLocked()
+	}
+}
+
+// MarkRateLimited 在不占用 Key 的情况下让其进入冷却，供健康检查等旁路使用
+func (p *KeyPool) MarkRateLimited(keyID uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[keyID]; ok {
+		p.handleRateLimit(e)
 	}
 }
 
+// IsOnCooldown 返回 Key 当前是否处于冷却中
+func (p *KeyPool) IsOnCooldown(keyID uint) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[keyID]
+	return ok && e.heapIdx >= 0 && time.Now().Before(e.stats.NextAvailableAt)
+}
+
 // handleRateLimit 处理429限流
-func (p *KeyPool) handleRateLimit(key *model.APIKey, stats *KeyStats) {
+func (p *KeyPool) handleRateLimit(e *keyEntry) {
+	stats := &e.stats
 	stats.Last429At = time.Now()
 	stats.RateLimitCount++
 	stats.FailureCount++
-	
+
 	// 计算智能冷却时间
 	cooldownDuration := p.calculateSmartCooldown(stats)
 	stats.NextAvailableAt = time.Now().Add(cooldownDuration)
 	stats.IsOnCooldown = true
-	
+
 	// 降低健康分数
 	p.decreaseHealthScore(stats, 20)
-	
-	logger.Info("[Key Pool] Key ID %d 遭遇429，智能冷却 %v (健康分数: %d, 429次数: %d)", 
-		key.ID, cooldownDuration, stats.HealthScore, stats.RateLimitCount)
-	
-	// 异步恢复key
-	go p.scheduleKeyRecovery(key.ID, cooldownDuration)
+
+	p.removeReadyLocked(e)
+	if e.heapIdx >= 0 {
+		heap.Fix(&p.cooldown, e.heapIdx)
+	} else {
+		heap.Push(&p.cooldown, e)
+	}
+
+	logger.Info("[Key Pool] Key ID %d 遭遇429，智能冷却 %v (健康分数: %d, 429次数: %d)",
+		e.key.ID, cooldownDuration, stats.HealthScore, stats.RateLimitCount)
 }
 
 // handleSuccess 处理成功使用
-func (p *KeyPool) handleSuccess(key *model.APIKey, stats *KeyStats) {
+func (p *KeyPool) handleSuccess(e *keyEntry) {
+	stats := &e.stats
 	stats.SuccessCount++
-	
+
 	// 增加健康分数，但不超过100
 	cfg := p.configManager.Get()
 	if stats.HealthScore < 100 {
 		p.increaseHealthScore(stats, cfg.RecoveryBonus)
 	}
-	
+
 	// 如果之前在冷却中，重置状态
 	if stats.IsOnCooldown {
 		stats.IsOnCooldown = false
-		logger.Info("[Key Pool] Key ID %d 冷却结束，已恢复可用 (健康分数: %d)", key.ID, stats.HealthScore)
+		if e.heapIdx >= 0 {
+			heap.Remove(&p.cooldown, e.heapIdx)
+		}
+		p.addReadyLocked(e)
+		logger.Info("[Key Pool] Key ID %d 冷却结束，已恢复可用 (健康分数: %d)", e.key.ID, stats.HealthScore)
+	}
+}
+
+// promoteExpiredLocked 将冷却到期的 Key 从堆中移回 ready
+func (p *KeyPool) promoteExpiredLocked(now time.Time) {
+	for len(p.cooldown) > 0 && !now.Before(p.cooldown[0].stats.NextAvailableAt) {
+		e := heap.Pop(&p.cooldown).(*keyEntry)
+		e.stats.IsOnCooldown = false
+		p.addReadyLocked(e)
+		logger.Info("[Key Pool] Key ID %d 冷却结束，已返回可用池 (健康分数: %d)", e.key.ID, e.stats.HealthScore)
+	}
+}
+
+// addReadyLocked 将 Key 加入 ready 集合
+func (p *KeyPool) addReadyLocked(e *keyEntry) {
+	if e.readyIdx >= 0 {
+		return
+	}
+	e.readyIdx = len(p.ready)
+	p.ready = append(p.ready, e)
+	if e.group != "" {
+		p.addGroupLocked(e)
+	}
+}
+
+// removeReadyLocked 以交换删除的方式将 Key 移出 ready 集合
+func (p *KeyPool) removeReadyLocked(e *keyEntry) {
+	idx := e.readyIdx
+	if idx < 0 {
+		return
+	}
+	last := len(p.ready) - 1
+	p.ready[idx] = p.ready[last]
+	p.ready[idx].readyIdx = idx
+	p.ready[last] = nil
+	p.ready = p.ready[:last]
+	e.readyIdx = -1
+	p.removeGroupLocked(e)
+}
+
+// addGroupLocked 将 ready 中没有指定 Models 的凭据加入其提供方的 unroutedReady 分组
+func (p *KeyPool) addGroupLocked(e *keyEntry) {
+	if e.groupIdx >= 0 {
+		return
+	}
+	e.groupIdx = len(p.unroutedReady[e.group])
+	p.unroutedReady[e.group] = append(p.unroutedReady[e.group], e)
+}
+
+// removeGroupLocked 以交换删除的方式将凭据移出其 unroutedReady 分组
+func (p *KeyPool) removeGroupLocked(e *keyEntry) {
+	idx := e.groupIdx
+	if idx < 0 {
+		return
 	}
+	group := p.unroutedReady[e.group]
+	last := len(group) - 1
+	group[idx] = group[last]
+	group[idx].groupIdx = idx
+	group[last] = nil
+	p.unroutedReady[e.group] = group[:last]
+	e.groupIdx = -1
+}
+
+// removeLocked 将 Key 从池的所有结构中移除
+func (p *KeyPool) removeLocked(e *keyEntry) {
+	p.removeReadyLocked(e)
+	if e.heapIdx >= 0 {
+		heap.Remove(&p.cooldown, e.heapIdx)
+	}
+	delete(p.entries, e.key.ID)
+}
+
+// broadcastLocked 唤醒所有等待 Key 的调用者
+func (p *KeyPool) broadcastLocked() {
+	if p.waiters == 0 {
+		return
+	}
+	close(p.notify)
+	p.notify = make(chan struct{})
 }
 
 // calculateSmartCooldown 计算智能冷却时间
 func (p *KeyPool) calculateSmartCooldown(stats *KeyStats) time.Duration {
-	baseCooldown := p.configManager.Get().RateLimitCooldown
 	cfg := p.configManager.Get()
-	
+	baseCooldown := cfg.RateLimitCooldown
+
 	// 根据429频率动态调整冷却时间
 	if stats.RateLimitCount > 10 {
 		// 频繁429，使用更长的冷却时间
@@ -344,8 +725,8 @@ func (p *KeyPool) calculateSmartCooldown(stats *KeyStats) time.Duration {
 		// 偶尔429
 		return time.Duration(float64(baseCooldown) * cfg.PenaltyFactor)
 	}
-	
-	return time.Duration(baseCooldown)
+
+	return baseCooldown
 }
 
 // decreaseHealthScore 降低健康分数
@@ -364,46 +745,21 @@ func (p *KeyPool) increaseHealthScore(stats *KeyStats, amount int) {
 	}
 }
 
-// scheduleKeyRecovery 安排key恢复
-func (p *KeyPool) scheduleKeyRecovery(keyID uint, cooldownDuration time.Duration) {
-	time.AfterFunc(cooldownDuration, func() {
-		p.mu.Lock()
-		defer p.mu.Unlock()
-		
-		if stats, exists := p.keyStats[keyID]; exists {
-			stats.IsOnCooldown = false
-			
-			// 检查key是否仍在allKeys中
-			if key, keyExists := p.allKeys[keyID]; keyExists {
-				select {
-				case p.availableKeys <- key:
-					logger.Info("[Key Pool] Key ID %d 冷却结束，已返回可用池 (健康分数: %d)", keyID, stats.HealthScore)
-				default:
-					logger.Warn("[Key Pool] Key ID %d 冷却结束，但通道已满。", keyID)
-				}
-			}
-		}
-	})
-}
-
 // GetBannedKeysInfo returns information about keys currently on cooldown.
 func (p *KeyPool) GetBannedKeysInfo() ([]BannedKeyInfo, error) {
 	var results []BannedKeyInfo
 
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	now := time.Now()
-	// Iterate over all known keys and check their stats
-	for keyID, key := range p.allKeys {
-		if stats, ok := p.keyStats[keyID]; ok {
-			// Check if the key is on cooldown and the cooldown period has not expired
-			if stats.IsOnCooldown && now.Before(stats.NextAvailableAt) {
-				results = append(results, BannedKeyInfo{
-					APIKey:      *key,
-					BannedUntil: stats.NextAvailableAt,
-				})
-			}
+	// 冷却堆中恰好是所有处于冷却状态的 Key
+	for _, e := range p.cooldown {
+		if now.Before(e.stats.NextAvailableAt) {
+			results = append(results, BannedKeyInfo{
+				APIKey:      *e.key,
+				BannedUntil: e.stats.NextAvailableAt,
+			})
 		}
 	}
 
@@ -413,16 +769,49 @@ func (p *KeyPool) GetBannedKeysInfo() ([]BannedKeyInfo, error) {
 // GetBannedKeyCount returns the number of keys currently on cooldown.
 func (p *KeyPool) GetBannedKeyCount() int {
 	count := 0
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	now := time.Now()
-	for keyID := range p.allKeys {
-		if stats, ok := p.keyStats[keyID]; ok {
-			if stats.IsOnCooldown && now.Before(stats.NextAvailableAt) {
-				count++
-			}
+	for _, e := range p.cooldown {
+		if now.Before(e.stats.NextAvailableAt) {
+			count++
 		}
 	}
 	return count
-}
\ No newline at end of file
+}
+
+// GetInFlightCounts 返回指定 Key 当前正在处理的请求数，不在池中的 Key 计为 0
+func (p *KeyPool) GetInFlightCounts(keyIDs []uint) map[uint]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make(map[uint]int, len(keyIDs))
+	for _, id := range keyIDs {
+		if e, ok := p.entries[id]; ok {
+			counts[id] = e.inFlight
+		}
+	}
+	return counts
+}
+
+// GetInFlightSummary 返回池中所有 Key 的 in-flight 请求总数，以及负载最高的单个 Key 的请求数
+func (p *KeyPool) GetInFlightSummary() (total int, busiest int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, e := range p.entries {
+		total += e.inFlight
+		if e.inFlight > busiest {
+			busiest = e.inFlight
+		}
+	}
+	return total, busiest
+}
+
+// Size 返回池中已启用 Key 的数量 (包括冷却中的 Key)
+func (p *KeyPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
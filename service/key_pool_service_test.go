@@ -0,0 +1,328 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/model"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// newBenchmarkPool 创建一个只在内存中保存 n 个 AI Studio Key 的池
+func newBenchmarkPool(b *testing.B, n int) (*KeyPool, []model.APIKey) {
+	b.Helper()
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := make([]model.APIKey, n)
+	for i := range keys {
+		keys[i] = model.APIKey{ID: uint(i + 1), Key: fmt.Sprintf("AIza-benchmark-%05d", i), Provider: model.ProviderAIStudio}
+	}
+	pool := NewKeyPool(nil, manager)
+	pool.SetKeys(keys)
+	return pool, keys
+}
+
+// BenchmarkGetReturnKey 在 10k 个 Key 的池上并发执行 GetKey/ReturnKey，衡量锁竞争下的选择开销
+func BenchmarkGetReturnKey(b *testing.B) {
+	pool, _ := newBenchmarkPool(b, 10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key, err := pool.GetKey()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			pool.ReturnKey(key, false)
+		}
+	})
+}
+
+func BenchmarkGetKey(b *testing.B) {
+	pool, _ := newBenchmarkPool(b, 10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key, err := pool.GetKey()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			pool.ReleaseKey(key)
+		}
+	})
+}
+
+func BenchmarkReturnKey(b *testing.B) {
+	pool, keys := newBenchmarkPool(b, 10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			pool.ReturnKey(&keys[r.Intn(len(keys))], false)
+		}
+	})
+}
+
+func TestKeyPoolRouting(t *testing.T) {
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewKeyPool(nil, manager)
+	pool.SetKeys([]model.APIKey{
+		{ID: 1, Key: "vertex:sa@example.iam.gserviceaccount.com/project/us-central1", Provider: model.ProviderVertex},
+		{ID: 2, Key: "sk-openai", Provider: model.ProviderOpenAI, BaseURL: "https://api.example.com/v1", Models: "gpt-*"},
+	})
+
+	if _, err := pool.GetKey(); !errors.Is(err, ErrNoMatchingKeys) {
+		t.Fatalf("GetKey without AI Studio keys: got %v, want ErrNoMatchingKeys", err)
+	}
+	key, err := pool.GetKeyFor("gemini-2.5-flash", func(provider string) bool { return supportsAPI(provider, apiGeminiNative) })
+	if err != nil || key.ID != 1 {
+		t.Fatalf("unrouted model: got %v, %v; want key 1", key, err)
+	}
+	pool.ReleaseKey(key)
+	key, err = pool.GetKeyFor("models/gpt-4o", func(provider string) bool { return supportsAPI(provider, apiOpenAIChat) })
+	if err != nil || key.ID != 2 {
+		t.Fatalf("claimed model: got %v, %v; want key 2", key, err)
+	}
+	pool.ReleaseKey(key)
+	if _, err := pool.GetKeyFor("gpt-4o", func(provider string) bool { return supportsAPI(provider, apiGeminiNative) }); !errors.Is(err, ErrNoMatchingKeys) {
+		t.Fatalf("claimed model on unsupported API: got %v, want ErrNoMatchingKeys", err)
+	}
+
+	pool.Remove(1)
+	if _, err := pool.GetKeyFor("gemini-2.5-flash", nil); !errors.Is(err, ErrNoMatchingKeys) {
+		t.Fatalf("after removing the only unrouted key: got %v, want ErrNoMatchingKeys", err)
+	}
+}
+
+func TestSampleIndicesDistinct(t *testing.T) {
+	for _, n := range []int{keySampleSize, keySampleSize + 1, 20, 10000} {
+		seen := make(map[int]bool)
+		for round := 0; round < 2000; round++ {
+			var sample [keySampleSize]int
+			picked := make(map[int]bool, keySampleSize)
+			for _, i := range sampleIndices(sample[:], n) {
+				if i < 0 || i >= n {
+					t.Fatalf("n=%d: index %d out of range", n, i)
+				}
+				if picked[i] {
+					t.Fatalf("n=%d: index %d sampled twice in %v", n, i, sample)
+				}
+				picked[i] = true
+				seen[i] = true
+			}
+		}
+		if n <= 20 && len(seen) != n {
+			t.Errorf("n=%d: only %d distinct indices reached after 2000 rounds", n, len(seen))
+		}
+	}
+}
+
+func TestKeyPoolRoutingIndex(t *testing.T) {
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 池中绝大多数是认领了其他模型的凭据和 OpenAI 兼容凭据，只有一个可以服务任意 Gemini 模型的 Vertex AI 凭据
+	keys := []model.APIKey{{ID: 1, Key: "vertex:sa@example.iam.gserviceaccount.com/project/us-central1", Provider: model.ProviderVertex}}
+	for i := 2; i <= 2000; i++ {
+		key := model.APIKey{ID: uint(i), Key: fmt.Sprintf("sk-%d", i), Provider: model.ProviderOpenAI, BaseURL: "https://api.example.com/v1"}
+		if i%2 == 0 {
+			key.Models = "gpt-*"
+		}
+		keys = append(keys, key)
+	}
+	pool := NewKeyPool(nil, manager)
+	pool.SetKeys(keys)
+
+	gemini := func(provider string) bool { return supportsAPI(provider, apiGeminiNative) }
+	for i := 0; i < 50; i++ {
+		key, err := pool.GetKeyFor("gemini-2.5-flash", gemini)
+		if err != nil || key.ID != 1 {
+			t.Fatalf("unrouted model: got %v, %v; want key 1", key, err)
+		}
+		pool.ReleaseKey(key)
+	}
+	if got := len(pool.unroutedReady[model.ProviderVertex]); got != 1 {
+		t.Fatalf("vertex ready group has %d entries, want 1", got)
+	}
+
+	key, err := pool.GetKeyFor("gpt-4o", nil)
+	if err != nil || key.Models != "gpt-*" {
+		t.Fatalf("claimed model: got %v, %v; want a gpt-* key", key, err)
+	}
+	pool.ReleaseKey(key)
+	if got := len(pool.claimed["gpt-4o"]); got != 1000 {
+		t.Fatalf("claimed index for gpt-4o has %d entries, want 1000", got)
+	}
+
+	// 凭据进入冷却后离开分组，冷却结束前没有可用凭据
+	pool.MarkRateLimited(1)
+	if got := len(pool.unroutedReady[model.ProviderVertex]); got != 0 {
+		t.Fatalf("vertex ready group has %d entries after cooldown, want 0", got)
+	}
+
+	// SetKeys 修改 Models 后认领索引会重建
+	keys[0].Models = "gpt-4o"
+	pool.SetKeys(keys)
+	if got := len(pool.claimed); got != 0 {
+		t.Fatalf("claimed cache kept %d entries after SetKeys", got)
+	}
+	if _, err := pool.GetKeyFor("gemini-2.5-flash", gemini); !errors.Is(err, ErrNoMatchingKeys) {
+		t.Fatalf("after routing the only Vertex key: got %v, want ErrNoMatchingKeys", err)
+	}
+	if got := len(pool.claimedLocked("gpt-4o")); got != 1001 {
+		t.Fatalf("claimed index for gpt-4o has %d entries, want 1001", got)
+	}
+}
+
+// newTestConfigManager 用 env 中成对给出的环境变量 (名称, 值) 创建配置管理器
+func newTestConfigManager(t testing.TB, env ...string) *config.Manager {
+	t.Helper()
+	for i := 0; i+1 < len(env); i += 2 {
+		t.Setenv(env[i], env[i+1])
+	}
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// newConcurrencyTestPool 创建单 Key 并发上限为 limit 的池，包含 n 个未指定 Models 的 AI Studio Key
+func newConcurrencyTestPool(t *testing.T, limit, n int) (*KeyPool, []model.APIKey) {
+	t.Helper()
+	manager := newTestConfigManager(t, "MAX_CONCURRENT_PER_KEY", fmt.Sprint(limit))
+	keys := make([]model.APIKey, n)
+	for i := range keys {
+		keys[i] = model.APIKey{ID: uint(i + 1), Key: fmt.Sprintf("AIza-concurrency-%d", i), Provider: model.ProviderAIStudio}
+	}
+	pool := NewKeyPool(nil, manager)
+	pool.SetKeys(keys)
+	return pool, keys
+}
+
+func TestKeyPoolConcurrencyCap(t *testing.T) {
+	pool, _ := newConcurrencyTestPool(t, 2, 2)
+
+	// 两个 Key 各占满 2 个并发后，再取 Key 不会超过上限
+	held := make(map[uint]int)
+	var keys []*model.APIKey
+	for i := 0; i < 4; i++ {
+		key, err := pool.GetKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		held[key.ID]++
+		keys = append(keys, key)
+	}
+	if held[1] != 2 || held[2] != 2 {
+		t.Fatalf("in-flight per key = %v, want 2 each", held)
+	}
+
+	// 释放 Key 1 的一个占用后只有它可以被选中
+	pool.ReleaseKey(keys[0])
+	released := keys[0].ID
+	for i := 0; i < 20; i++ {
+		pool.mu.Lock()
+		e := pool.pickLocked(time.Now(), [][]*keyEntry{pool.unroutedReady[model.ProviderAIStudio]}, nil)
+		pool.mu.Unlock()
+		if e == nil || e.key.ID != released {
+			t.Fatalf("picked %v with key %d below its cap, want key %d", e, released, released)
+		}
+	}
+	if got := pool.GetInFlightCounts([]uint{1, 2}); got[released] != 1 {
+		t.Fatalf("in-flight counts = %v, want %d for key %d", got, 1, released)
+	}
+}
+
+func TestKeyPoolWaitsForRelease(t *testing.T) {
+	pool, _ := newConcurrencyTestPool(t, 1, 1)
+	first, err := pool.GetKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		key *model.APIKey
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		key, err := pool.GetKeyFor("gemini-2.5-flash", nil)
+		done <- result{key, err}
+	}()
+
+	waitFor(t, "GetKeyFor to wait", func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.waiters == 1
+	})
+	select {
+	case r := <-done:
+		t.Fatalf("GetKeyFor returned %v, %v while the only key was at its cap", r.key, r.err)
+	default:
+	}
+
+	pool.ReleaseKey(first)
+	select {
+	case r := <-done:
+		if r.err != nil || r.key.ID != first.ID {
+			t.Fatalf("after ReleaseKey: got %v, %v; want key %d", r.key, r.err, first.ID)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("GetKeyFor still waiting after ReleaseKey freed a slot")
+	}
+	if got := pool.GetInFlightCounts([]uint{first.ID}); got[first.ID] != 1 {
+		t.Errorf("in-flight = %v, want 1", got)
+	}
+}
+
+func TestKeyPoolLeastLoaded(t *testing.T) {
+	pool, _ := newConcurrencyTestPool(t, 0, 3)
+
+	// Key 1 和 Key 2 各有进行中的请求，Key 3 空闲时总是选中 Key 3
+	pool.mu.Lock()
+	pool.entries[1].inFlight = 3
+	pool.entries[2].inFlight = 1
+	pool.mu.Unlock()
+	for i := 0; i < 20; i++ {
+		key, err := pool.GetKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.ID != 3 {
+			t.Fatalf("round %d: picked key %d, want the idle key 3", i, key.ID)
+		}
+		pool.ReleaseKey(key)
+	}
+
+	// 负载相同时才按健康分数加权，负载更低的 Key 即使分数较低也优先
+	pool.mu.Lock()
+	pool.entries[3].inFlight = 1
+	pool.entries[2].stats.HealthScore = pool.configManager.Get().MinHealthScore
+	pool.mu.Unlock()
+	for i := 0; i < 20; i++ {
+		key, err := pool.GetKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.ID == 1 {
+			t.Fatalf("round %d: picked the busiest key 1", i)
+		}
+		pool.ReleaseKey(key)
+	}
+
+	entries := []*keyEntry{{inFlight: 2}, {inFlight: 0}, {inFlight: 1}, {inFlight: 0}}
+	got := leastLoaded(entries)
+	if len(got) != 2 || got[0].inFlight != 0 || got[1].inFlight != 0 {
+		t.Errorf("leastLoaded kept %d entries, want the 2 idle ones", len(got))
+	}
+}
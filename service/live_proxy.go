@@ -0,0 +1,423 @@
+// service/live_proxy.go
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// geminiLiveBase 是 Gemini Live API 的 WebSocket 地址前缀，后接 RPC 方法名
+const geminiLiveBase = "wss://generativelanguage.googleapis.com/ws/"
+
+// liveMaxMessageBytes 是单条 WebSocket 消息的大小上限
+const liveMaxMessageBytes = 16 * 1024 * 1024
+
+// LiveMethods 是允许代理的 Live API 方法 (/ws/{method})
+var LiveMethods = map[string]bool{
+	"google.ai.generativelanguage.v1beta.GenerativeService.BidiGenerateContent":  true,
+	"google.ai.generativelanguage.v1alpha.GenerativeService.BidiGenerateContent": true,
+}
+
+// LiveSetupError 表示客户端的首条消息不是合法的 setup 消息，或请求的模型不可用
+type LiveSetupError struct {
+	Message string
+}
+
+func (e *LiveSetupError) Error() string {
+	return "无效的 setup 消息: " + e.Message
+}
+
+// LiveProxy 将客户端的 Live API (BidiGenerateContent) WebSocket 会话转发到 Gemini。
+// 每个会话从 Key 池取一个 Key 并在整个会话期间占用，会话结束时按上游的关闭原因归还。
+type LiveProxy struct {
+	configManager *config.Manager
+	genai         *GenAIService
+	policy        *PolicyEngine
+	redactor      *Redactor
+	dialer        *websocket.Dialer
+	upstreamBase  string
+}
+
+func NewLiveProxy(manager *config.Manager, genai *GenAIService, policy *PolicyEngine, redactor *Redactor) *LiveProxy {
+	return &LiveProxy{
+		configManager: manager,
+		genai:         genai,
+		policy:        policy,
+		redactor:      redactor,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 15 * time.Second,
+		},
+		upstreamBase: geminiLiveBase,
+	}
+}
+
+// liveSession 是一个已经收到 setupComplete 的上游会话
+type liveSession struct {
+	model     string
+	key       *model.APIKey
+	upstream  *websocket.Conn
+	firstType int
+	first     []byte // 上游对 setup 的响应，建立会话后首先转发给客户端
+}
+
+// Serve 处理一个已升级的客户端连接，直到任意一端关闭或会话超过最大时长。
+// owner 是发起会话的客户端 (全局公共密钥为 nil)，setup 消息按其请求策略改写；客户端发送的 setup 和文本消息经过内容脱敏；
+// resolve 按模型目录解析 setup 消息中的模型名，并检查客户端的模型白名单。
+func (p *LiveProxy) Serve(ctx context.Context, client *websocket.Conn, method string, owner *model.Client, resolve func(string) (string, error)) {
+	defer client.Close()
+	cfg := p.configManager.Get()
+	client.SetReadLimit(liveMaxMessageBytes)
+
+	// 必须先收到 setup 消息才能知道模型，进而选择 Key 和检查熔断
+	client.SetReadDeadline(time.Now().Add(cfg.LiveSetupTimeout))
+	msgType, setup, err := client.ReadMessage()
+	if err != nil {
+		logger.Warn("Live 会话未收到 setup 消息: %v", err)
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+
+	setup, err = p.redactor.Filter(setup, "Live 会话的 setup 消息")
+	if err != nil {
+		code, reason := liveCloseFrame(err)
+		closeLive(client, code, reason)
+		return
+	}
+	setup, modelName, err := rewriteLiveSetup(setup, resolve)
+	if err != nil {
+		logger.Warn("拒绝 Live 会话: %v", err)
+		code, reason := liveCloseFrame(err)
+		closeLive(client, code, reason)
+		return
+	}
+	setup = p.policy.ApplyLiveSetup(owner, modelName, setup)
+
+	p.genai.metrics.RecordRequest(modelName)
+	session, err := p.connect(ctx, method, modelName, msgType, setup)
+	if err != nil {
+		logger.Error("Live 会话建立失败 (模型: %s): %v", modelName, err)
+		code, reason := liveCloseFrame(err)
+		closeLive(client, code, reason)
+		return
+	}
+	p.relay(ctx, client, session, cfg.LiveMaxSession)
+}
+
+// filterClientMessage 对客户端发往上游的文本消息应用内容脱敏规则
+func (p *LiveProxy) filterClientMessage(msgType int, data []byte) ([]byte, error) {
+	if msgType != websocket.TextMessage {
+		return data, nil
+	}
+	return p.redactor.Filter(data, "Live 会话的消息")
+}
+
+// rewriteLiveSetup 解析 setup 消息中的模型名，并替换为模型目录解析后的实际模型
+func rewriteLiveSetup(data []byte, resolve func(string) (string, error)) ([]byte, string, error) {
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, "", &LiveSetupError{Message: "首条消息必须是 JSON 格式的 setup 消息"}
+	}
+	var setup map[string]json.RawMessage
+	if raw, ok := msg["setup"]; !ok || json.Unmarshal(raw, &setup) != nil {
+		return nil, "", &LiveSetupError{Message: "首条消息必须是 setup 消息"}
+	}
+	var requested string
+	if err := json.Unmarshal(setup["model"], &requested); err != nil || requested == "" {
+		return nil, "", &LiveSetupError{Message: "setup.model 不能为空"}
+	}
+
+	resolved, err := resolve(strings.TrimPrefix(requested, "models/"))
+	if err != nil {
+		return nil, "", &LiveSetupError{Message: err.Error()}
+	}
+	setup["model"], _ = json.Marshal("models/" + resolved)
+	msg["setup"], _ = json.Marshal(setup)
+	out, err := json.Marshal(msg)
+	return out, resolved, err
+}
+
+// connect 依次使用 Key 池中的 Key 建立上游会话，直到收到 setupComplete、
+// 遇到不可重试的错误、模型熔断或用尽 MaxRetries 次尝试。
+func (p *LiveProxy) connect(ctx context.Context, method, modelName string, msgType int, setup []byte) (*liveSession, error) {
+	s := p.genai
+	maxRetries := p.configManager.Get().MaxRetries
+	var lastErr error
+	allRateLimited := true
+
+	for i := 0; i < maxRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := s.breakers.Allow(modelName); err != nil {
+			return nil, err
+		}
+
+		key, err := s.keyPool.GetKey()
+		if err != nil {
+			s.breakers.Record(modelName, outcomeIgnored)
+			lastErr = err
+			if errors.Is(err, ErrNoAvailableKeys) {
+				time.Sleep(2 * time.Second)
+			}
+			continue
+		}
+
+		logger.Info("第 %d 次尝试 (Live), 使用 Key ID: %d, 模型: %s", i+1, key.ID, modelName)
+		session, err := p.open(ctx, method, modelName, key, msgType, setup)
+		if err == nil {
+			return session, nil
+		}
+		if !isRetryable(err) {
+			return nil, err
+		}
+		lastErr = err
+		var upstreamErr *UpstreamError
+		if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusTooManyRequests {
+			allRateLimited = false
+		}
+	}
+
+	if lastErr != nil && allRateLimited {
+		return nil, fmt.Errorf("%w，最后一次错误: %w", ErrAllKeysRateLimited, lastErr)
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("所有 API Key 均尝试失败，最后一次错误: %w", lastErr)
+	}
+	return nil, errors.New("所有 API Key 均尝试失败，但未捕获到具体错误")
+}
+
+// open 使用单个 Key 连接上游、发送 setup 并等待上游的第一条响应。
+// 失败时负责归还 Key 和记录熔断结果，可以换 Key 重试的错误用 retryable 包装。
+func (p *LiveProxy) open(ctx context.Context, method, modelName string, key *model.APIKey, msgType int, setup []byte) (*liveSession, error) {
+	s := p.genai
+	timeout := p.configManager.Get().LiveSetupTimeout
+
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, resp, err := p.dialer.DialContext(dialCtx, p.upstreamBase+method+"?key="+url.QueryEscape(key.Key), nil)
+	if err != nil {
+		if resp != nil {
+			// 握手被拒绝，按 HTTP 状态码处理 Key
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			upstreamErr := &UpstreamError{StatusCode: resp.StatusCode, Body: body}
+			logger.Error("Key ID %d 建立 Live 会话失败: %s", key.ID, upstreamErr.Error())
+			s.handleUpstreamError(modelName, key, upstreamErr)
+			return nil, retryable(upstreamErr)
+		}
+		s.keyPool.ReleaseKey(key)
+		if ctx.Err() != nil {
+			s.breakers.Record(modelName, outcomeIgnored)
+			return nil, ctx.Err()
+		}
+		s.breakers.Record(modelName, outcomeFailure)
+		err = fmt.Errorf("连接 Gemini Live API 失败 (Key ID: %d): %w", key.ID, err)
+		logger.Errorln(err)
+		return nil, retryable(err)
+	}
+
+	conn.SetReadLimit(liveMaxMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var (
+		firstType int
+		first     []byte
+	)
+	err = conn.WriteMessage(msgType, setup)
+	if err == nil {
+		firstType, first, err = conn.ReadMessage()
+	}
+	if err != nil {
+		conn.Close()
+		var closeErr *websocket.CloseError
+		isClose := errors.As(err, &closeErr)
+		if status := liveCloseStatus(err); status != 0 {
+			// Key 限流或失效时上游会在握手成功后立即关闭会话
+			upstreamErr := &UpstreamError{StatusCode: status, Body: []byte(closeErr.Text)}
+			logger.Error("Key ID %d 建立 Live 会话失败: %s", key.ID, upstreamErr.Error())
+			s.handleUpstreamError(modelName, key, upstreamErr)
+			return nil, retryable(upstreamErr)
+		}
+		if isClose {
+			// 上游拒绝了 setup (如模型不支持 Live API)，是请求本身的问题，直接转告客户端
+			s.keyPool.ReleaseKey(key)
+			s.breakers.Record(modelName, outcomeIgnored)
+			return nil, err
+		}
+		s.keyPool.ReleaseKey(key)
+		s.breakers.Record(modelName, outcomeFailure)
+		err = fmt.Errorf("等待 Gemini Live setupComplete 失败 (Key ID: %d): %w", key.ID, err)
+		logger.Errorln(err)
+		return nil, retryable(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	return &liveSession{model: modelName, key: key, upstream: conn, firstType: firstType, first: first}, nil
+}
+
+// liveRelayResult 是一个转发方向结束的原因，upstreamEnded 表示结束的一方是上游
+type liveRelayResult struct {
+	upstreamEnded bool
+	err           error
+}
+
+// relay 在客户端和上游之间双向转发消息，任意一端关闭或会话超时后关闭另一端，并归还 Key
+func (p *LiveProxy) relay(ctx context.Context, client *websocket.Conn, session *liveSession, maxSession time.Duration) {
+	s := p.genai
+	upstream := session.upstream
+	defer upstream.Close()
+
+	s.metrics.RecordLiveSession(1)
+	defer s.metrics.RecordLiveSession(-1)
+	start := time.Now()
+	logger.Info("Live 会话已建立, Key ID: %d, 模型: %s", session.key.ID, session.model)
+
+	results := make(chan liveRelayResult, 2)
+	pending := 0
+	var upstreamErr error
+	if err := client.WriteMessage(session.firstType, session.first); err != nil {
+		closeLive(upstream, websocket.CloseNormalClosure, "")
+	} else {
+		pending = 2
+		go func() { results <- pipeLive(client, upstream, true, nil) }()
+		go func() { results <- pipeLive(upstream, client, false, p.filterClientMessage) }()
+
+		timer := time.NewTimer(maxSession)
+		select {
+		case res := <-results:
+			pending--
+			if res.upstreamEnded {
+				upstreamErr = res.err
+				code, reason := liveCloseFrame(res.err)
+				closeLive(client, code, reason)
+			} else {
+				var blocked *SensitiveContentError
+				if errors.As(res.err, &blocked) {
+					code, reason := liveCloseFrame(res.err)
+					closeLive(client, code, reason)
+				}
+				closeLive(upstream, websocket.CloseNormalClosure, "")
+			}
+		case <-timer.C:
+			logger.Warn("Live 会话超过最大时长 %v, Key ID: %d", maxSession, session.key.ID)
+			closeLive(client, websocket.CloseGoingAway, fmt.Sprintf("会话超过最大时长 %v", maxSession))
+			closeLive(upstream, websocket.CloseNormalClosure, "")
+		case <-ctx.Done():
+			closeLive(client, websocket.CloseGoingAway, "")
+			closeLive(upstream, websocket.CloseNormalClosure, "")
+		}
+		timer.Stop()
+	}
+
+	// 关闭底层连接，让另一个方向的转发退出
+	client.Close()
+	upstream.Close()
+	for ; pending > 0; pending-- {
+		<-results
+	}
+
+	if status := liveCloseStatus(upstreamErr); status != 0 {
+		var closeErr *websocket.CloseError
+		errors.As(upstreamErr, &closeErr)
+		s.handleUpstreamError(session.model, session.key, &UpstreamError{StatusCode: status, Body: []byte(closeErr.Text)})
+	} else if upstreamErr != nil && !isCleanClose(upstreamErr) {
+		// 上游异常断开 (网络错误或内部错误)，计入熔断统计但不惩罚 Key
+		s.keyPool.ReleaseKey(session.key)
+		s.breakers.Record(session.model, outcomeFailure)
+	} else {
+		s.keyPool.ReturnKey(session.key, false)
+		s.breakers.Record(session.model, outcomeSuccess)
+	}
+	logger.Info("Live 会话结束, Key ID: %d, 模型: %s, 时长: %v", session.key.ID, session.model, time.Since(start).Round(time.Second))
+}
+
+// pipeLive 将 src 的消息写入 dst，直到任意一端出错。filter 不为空时消息先经过 filter，filter 返回错误时结束转发
+func pipeLive(dst, src *websocket.Conn, srcIsUpstream bool, filter func(int, []byte) ([]byte, error)) liveRelayResult {
+	for {
+		msgType, data, err := src.ReadMessage()
+		if err != nil {
+			return liveRelayResult{upstreamEnded: srcIsUpstream, err: err}
+		}
+		if filter != nil {
+			if data, err = filter(msgType, data); err != nil {
+				return liveRelayResult{upstreamEnded: srcIsUpstream, err: err}
+			}
+		}
+		if err := dst.WriteMessage(msgType, data); err != nil {
+			return liveRelayResult{upstreamEnded: !srcIsUpstream, err: err}
+		}
+	}
+}
+
+// liveCloseStatus 将上游关闭会话的原因映射为等价的 HTTP 状态码 (限流 429，Key 无效 403)，无法识别时返回 0
+func liveCloseStatus(err error) int {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return 0
+	}
+	reason := strings.ToLower(closeErr.Text)
+	switch {
+	case strings.Contains(reason, "quota"), strings.Contains(reason, "resource_exhausted"), strings.Contains(reason, "rate limit"):
+		return http.StatusTooManyRequests
+	case strings.Contains(reason, "api key not valid"), strings.Contains(reason, "api_key_invalid"):
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+// isCleanClose 判断上游是否以正常的关闭帧结束会话
+func isCleanClose(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure && closeErr.Code != websocket.CloseInternalServerErr
+}
+
+// liveCloseFrame 根据会话结束的原因选择发给客户端的关闭状态码和原因
+func liveCloseFrame(err error) (int, string) {
+	var (
+		closeErr   *websocket.CloseError
+		setupErr   *LiveSetupError
+		blocked    *SensitiveContentError
+		circuitErr *CircuitOpenError
+	)
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseNoStatusReceived:
+			return websocket.CloseNormalClosure, ""
+		case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+			// 这两个状态码只表示连接异常，不能出现在关闭帧中
+		default:
+			return closeErr.Code, closeErr.Text
+		}
+	}
+	switch {
+	case errors.As(err, &setupErr):
+		return websocket.ClosePolicyViolation, setupErr.Error()
+	case errors.As(err, &blocked):
+		return websocket.ClosePolicyViolation, blocked.Error()
+	case errors.As(err, &circuitErr), errors.Is(err, ErrAllKeysRateLimited):
+		return websocket.CloseTryAgainLater, err.Error()
+	}
+	return websocket.CloseInternalServerErr, err.Error()
+}
+
+// closeLive 发送关闭帧，原因超过控制帧上限 (123 字节) 时按 UTF-8 字符截断
+func closeLive(conn *websocket.Conn, code int, reason string) {
+	for len(reason) > 123 {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gemini_polling/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testLiveMethod = "google.ai.generativelanguage.v1beta.GenerativeService.BidiGenerateContent"
+
+// liveStandIn 是 Gemini Live API 的本地替身: 记录每次连接使用的 ?key= 和收到的 setup 消息，
+// 按 Key 模拟握手被限流 (AIza-429)、setup 后因配额关闭 (AIza-quota)，其余 Key 回复 setupComplete 后原样回显消息
+type liveStandIn struct {
+	*httptest.Server
+	mu     sync.Mutex
+	keys   []string
+	paths  []string
+	setups []map[string]interface{}
+}
+
+func newLiveStandIn(t *testing.T) *liveStandIn {
+	s := &liveStandIn{}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		s.mu.Lock()
+		s.keys = append(s.keys, key)
+		s.paths = append(s.paths, r.URL.Path)
+		s.mu.Unlock()
+		if key == "AIza-429" {
+			http.Error(w, `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED"}}`, http.StatusTooManyRequests)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var setup map[string]interface{}
+		json.Unmarshal(raw, &setup)
+		s.mu.Lock()
+		s.setups = append(s.setups, setup)
+		s.mu.Unlock()
+		if key == "AIza-quota" {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "You exceeded your current quota"), time.Now().Add(time.Second))
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"setupComplete":{}}`)); err != nil {
+			return
+		}
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *liveStandIn) recorded() (keys, paths []string, setups []map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...), append([]string(nil), s.paths...), append([]map[string]interface{}(nil), s.setups...)
+}
+
+// newTestLiveProxy 创建连接 upstream 的 LiveProxy，以及一个把每个 WebSocket 连接交给 serve 的代理入口
+func newTestLiveProxy(t *testing.T, upstream *liveStandIn, keys []model.APIKey, env ...string) (*LiveProxy, *KeyPool, func(serve func(ctx context.Context, conn *websocket.Conn)) string) {
+	t.Helper()
+	manager := newTestConfigManager(t, env...)
+	s := newTestGenAIService(t, keys...)
+	s.configManager = manager
+	proxy := NewLiveProxy(manager, s, NewPolicyEngine(manager), NewRedactor(manager))
+	proxy.upstreamBase = "ws" + strings.TrimPrefix(upstream.URL, "http") + "/ws/"
+
+	listen := func(serve func(ctx context.Context, conn *websocket.Conn)) string {
+		upgrader := websocket.Upgrader{}
+		entry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			serve(r.Context(), conn)
+		}))
+		t.Cleanup(entry.Close)
+		return "ws" + strings.TrimPrefix(entry.URL, "http")
+	}
+	return proxy, s.keyPool, listen
+}
+
+// resolveLiveModel 模拟模型目录: gemini-live 是 gemini-2.0-flash-live-001 的别名
+func resolveLiveModel(requested string) (string, error) {
+	if requested == "gemini-live" {
+		return "gemini-2.0-flash-live-001", nil
+	}
+	return requested, nil
+}
+
+// dialLive 连接代理入口并发送 setup 消息
+func dialLive(t *testing.T, url, setup string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(setup)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// waitFor 轮询 cond 直到其为 true 或超时，用于等待会话结束后的 Key 归还
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLiveProxyRelay(t *testing.T) {
+	upstream := newLiveStandIn(t)
+	keys := []model.APIKey{{ID: 1, Key: "AIza-good"}}
+	proxy, pool, listen := newTestLiveProxy(t, upstream, keys,
+		"POLICY_SYSTEM_PROMPT", "Answer in English.",
+		"POLICY_MAX_OUTPUT_TOKENS", "256",
+		"POLICY_MAX_TEMPERATURE", "0.5",
+	)
+	url := listen(func(ctx context.Context, conn *websocket.Conn) {
+		proxy.Serve(ctx, conn, testLiveMethod, nil, resolveLiveModel)
+	})
+
+	client := dialLive(t, url, `{"setup":{"model":"models/gemini-live","generationConfig":{"maxOutputTokens":4096,"temperature":1.2},"systemInstruction":{"parts":[{"text":"Be terse."}]}}}`)
+	_, first, err := client.ReadMessage()
+	if err != nil || string(first) != `{"setupComplete":{}}` {
+		t.Fatalf("first message = %s, %v", first, err)
+	}
+
+	// 文本和二进制消息双向转发
+	for _, msg := range []struct {
+		typ  int
+		data string
+	}{
+		{websocket.TextMessage, `{"realtimeInput":{"text":"hello"}}`},
+		{websocket.BinaryMessage, "\x00\x01audio"},
+	} {
+		if err := client.WriteMessage(msg.typ, []byte(msg.data)); err != nil {
+			t.Fatal(err)
+		}
+		typ, data, err := client.ReadMessage()
+		if err != nil || typ != msg.typ || string(data) != msg.data {
+			t.Fatalf("echo = %d %q %v, want %d %q", typ, data, err, msg.typ, msg.data)
+		}
+	}
+
+	keysUsed, paths, setups := upstream.recorded()
+	if len(keysUsed) != 1 || keysUsed[0] != "AIza-good" || paths[0] != "/ws/"+testLiveMethod {
+		t.Fatalf("upstream connections = %v %v", keysUsed, paths)
+	}
+	if counts := pool.GetInFlightCounts([]uint{1}); counts[1] != 1 {
+		t.Errorf("key in-flight during session = %d, want 1", counts[1])
+	}
+
+	// setup 中的模型按目录解析，系统提示词和参数上限由请求策略改写
+	setup := setups[0]["setup"].(map[string]interface{})
+	if setup["model"] != "models/gemini-2.0-flash-live-001" {
+		t.Errorf("setup.model = %v", setup["model"])
+	}
+	parts := setup["systemInstruction"].(map[string]interface{})["parts"].([]interface{})
+	if len(parts) != 2 || parts[0].(map[string]interface{})["text"] != "Answer in English." || parts[1].(map[string]interface{})["text"] != "Be terse." {
+		t.Errorf("systemInstruction.parts = %v", parts)
+	}
+	generation := setup["generationConfig"].(map[string]interface{})
+	if generation["maxOutputTokens"] != float64(256) || generation["temperature"] != 0.5 {
+		t.Errorf("generationConfig = %v", generation)
+	}
+	if _, ok := setup["safetySettings"]; ok {
+		t.Errorf("setup gained safetySettings: %v", setup)
+	}
+
+	client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	waitFor(t, "key release", func() bool { return pool.GetInFlightCounts([]uint{1})[1] == 0 })
+	if pool.IsOnCooldown(1) {
+		t.Error("key put on cooldown after a clean session")
+	}
+}
+
+func TestLiveProxyMaxSession(t *testing.T) {
+	upstream := newLiveStandIn(t)
+	proxy, pool, listen := newTestLiveProxy(t, upstream, []model.APIKey{{ID: 1, Key: "AIza-good"}})
+	const maxSession = 200 * time.Millisecond
+	url := listen(func(ctx context.Context, conn *websocket.Conn) {
+		defer conn.Close()
+		msgType, setup, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		setup, modelName, err := rewriteLiveSetup(setup, resolveLiveModel)
+		if err != nil {
+			return
+		}
+		session, err := proxy.connect(ctx, testLiveMethod, modelName, msgType, setup)
+		if err != nil {
+			return
+		}
+		proxy.relay(ctx, conn, session, maxSession)
+	})
+
+	start := time.Now()
+	client := dialLive(t, url, `{"setup":{"model":"gemini-live"}}`)
+	if _, _, err := client.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	// 会话期间正常转发，到达最大时长后代理以 1001 关闭连接
+	for {
+		if err := client.WriteMessage(websocket.TextMessage, []byte(`{"realtimeInput":{"text":"ping"}}`)); err != nil {
+			break
+		}
+		if _, _, err := client.ReadMessage(); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || !strings.Contains(closeErr.Text, "最大时长") {
+				t.Fatalf("session ended with %v, want a 1001 max-session close", err)
+			}
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < maxSession || elapsed > maxSession+2*time.Second {
+		t.Errorf("session lasted %v, want about %v", elapsed, maxSession)
+	}
+	waitFor(t, "key release", func() bool { return pool.GetInFlightCounts([]uint{1})[1] == 0 })
+	if pool.IsOnCooldown(1) {
+		t.Error("key put on cooldown after the session reached its maximum length")
+	}
+}
+
+func TestLiveProxyRateLimitedKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "handshake 429", key: "AIza-429"},
+		{name: "quota close after setup", key: "AIza-quota"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newLiveStandIn(t)
+			proxy, pool, listen := newTestLiveProxy(t, upstream, []model.APIKey{{ID: 1, Key: tt.key}}, "MAX_RETRIES", "1")
+			url := listen(func(ctx context.Context, conn *websocket.Conn) {
+				proxy.Serve(ctx, conn, testLiveMethod, nil, resolveLiveModel)
+			})
+
+			client := dialLive(t, url, `{"setup":{"model":"gemini-live"}}`)
+			_, _, err := client.ReadMessage()
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater {
+				t.Fatalf("client got %v, want a 1013 close", err)
+			}
+			if keysUsed, _, _ := upstream.recorded(); len(keysUsed) != 1 || keysUsed[0] != tt.key {
+				t.Fatalf("upstream saw keys %v", keysUsed)
+			}
+			if !pool.IsOnCooldown(1) {
+				t.Error("rate-limited key was not put on cooldown")
+			}
+			if counts := pool.GetInFlightCounts([]uint{1}); counts[1] != 0 {
+				t.Errorf("rate-limited key still has %d in-flight sessions", counts[1])
+			}
+		})
+	}
+}
+
+func TestLiveProxyRejectsInvalidSetup(t *testing.T) {
+	upstream := newLiveStandIn(t)
+	proxy, _, listen := newTestLiveProxy(t, upstream, []model.APIKey{{ID: 1, Key: "AIza-good"}})
+	url := listen(func(ctx context.Context, conn *websocket.Conn) {
+		proxy.Serve(ctx, conn, testLiveMethod, nil, resolveLiveModel)
+	})
+
+	for _, setup := range []string{`not json`, `{"clientContent":{}}`, `{"setup":{}}`} {
+		client := dialLive(t, url, setup)
+		_, _, err := client.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+			t.Errorf("setup %s: got %v, want a 1008 close", setup, err)
+		}
+	}
+	if keysUsed, _, _ := upstream.recorded(); len(keysUsed) != 0 {
+		t.Errorf("invalid setups reached the upstream with keys %v", keysUsed)
+	}
+}
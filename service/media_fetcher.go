@@ -0,0 +1,392 @@
+// service/media_fetcher.go
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// mediaFetchMaxRedirects 是下载远程媒体时最多跟随的重定向次数
+	mediaFetchMaxRedirects = 3
+	// mediaFetchConcurrency 是单个请求同时下载的远程媒体数量
+	mediaFetchConcurrency = 4
+)
+
+// cgnatNet 是运营商级 NAT 地址段 (100.64.0.0/10)，net.IP.IsPrivate 不包含它
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// MediaFetchError 表示消息中的远程媒体无法下载或不符合要求，属于客户端请求错误
+type MediaFetchError struct {
+	URL    string
+	Reason string
+}
+
+func (e *MediaFetchError) Error() string {
+	return fmt.Sprintf("无法获取远程媒体 %s: %s", e.URL, e.Reason)
+}
+
+// mediaFetcher 下载 OpenAI 格式消息中以 http(s) 地址给出的图片、音频和文件，并转换为内联 base64 数据，
+// 因为 Gemini 无法访问任意的远程地址。
+// 为防止 SSRF，只允许 http/https，拨号时拒绝内网、回环、链路本地等地址 (在 MEDIA_FETCH_ALLOWED_HOSTS 中
+// 显式列出的主机除外)，重定向的目标同样需要通过检查，并且不使用环境变量中的代理。
+type mediaFetcher struct {
+	configManager *config.Manager
+	client        *http.Client
+}
+
+func newMediaFetcher(manager *config.Manager) *mediaFetcher {
+	f := &mediaFetcher{configManager: manager}
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           f.dialContext,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       60 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	f.client = &http.Client{Transport: transport, CheckRedirect: f.checkRedirect}
+	return f
+}
+
+// mediaBudget 是单个请求中所有下载共享的剩余字节数
+type mediaBudget struct {
+	remaining atomic.Int64
+}
+
+// budgetReader 在读取时扣减 budget，总量超出上限后返回 errMediaBudgetExceeded，
+// 使并发下载占用的内存不会超过单个请求的总量上限
+type budgetReader struct {
+	r      io.Reader
+	budget *mediaBudget
+}
+
+var errMediaBudgetExceeded = errors.New("media budget exceeded")
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if b.budget.remaining.Add(-int64(n)) < 0 {
+		return n, errMediaBudgetExceeded
+	}
+	return n, err
+}
+
+// inlineMessages 将消息中的远程 image_url、input_audio 和 file 内容替换为内联数据。
+// 每个请求最多下载 MEDIA_FETCH_MAX_PARTS 个地址，最多 mediaFetchConcurrency 个同时下载，
+// 下载总量不超过 MEDIA_FETCH_MAX_TOTAL_MB，防止单个请求放大为大量的出站请求和内存占用。
+func (f *mediaFetcher) inlineMessages(ctx context.Context, messages []model.Message) error {
+	cfg := f.configManager.Get()
+	if !cfg.MediaFetchEnabled {
+		return nil
+	}
+
+	var jobs []func(ctx context.Context, budget *mediaBudget) error
+	for i := range messages {
+		parts, ok := messages[i].Content.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, p := range parts {
+			part, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if job := f.partJob(part); job != nil {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+	if cfg.MediaFetchMaxParts > 0 && len(jobs) > cfg.MediaFetchMaxParts {
+		return &MediaFetchError{URL: fmt.Sprintf("(共 %d 个)", len(jobs)), Reason: fmt.Sprintf("单个请求最多下载 %d 个远程媒体", cfg.MediaFetchMaxParts)}
+	}
+
+	budget := &mediaBudget{}
+	budget.remaining.Store(cfg.MediaFetchMaxTotal)
+	errs := make([]error, len(jobs))
+	sem := make(chan struct{}, mediaFetchConcurrency)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job func(ctx context.Context, budget *mediaBudget) error) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = job(ctx, budget)
+		}(i, job)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// partJob 返回下载并替换单个内容部分的任务，不需要下载时返回 nil
+func (f *mediaFetcher) partJob(part map[string]interface{}) func(ctx context.Context, budget *mediaBudget) error {
+	switch part["type"] {
+	case "image_url":
+		// image_url 可以是 {"url": "..."} 或直接是地址字符串
+		imageURL, _ := part["image_url"].(map[string]interface{})
+		if s, ok := part["image_url"].(string); ok {
+			imageURL = map[string]interface{}{"url": s}
+		}
+		rawURL, _ := imageURL["url"].(string)
+		if !isRemoteURL(rawURL) {
+			return nil
+		}
+		return func(ctx context.Context, budget *mediaBudget) error {
+			data, mimeType, err := f.fetch(ctx, budget, rawURL)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(mimeType, "image/") {
+				return &MediaFetchError{URL: rawURL, Reason: "内容不是图片 (" + mimeType + ")"}
+			}
+			imageURL["url"] = dataURL(mimeType, data)
+			part["image_url"] = imageURL
+			return nil
+		}
+
+	case "input_audio":
+		audio, _ := part["input_audio"].(map[string]interface{})
+		rawURL, _ := audio["data"].(string)
+		if !isRemoteURL(rawURL) {
+			return nil
+		}
+		return func(ctx context.Context, budget *mediaBudget) error {
+			data, mimeType, err := f.fetch(ctx, budget, rawURL)
+			if err != nil {
+				return err
+			}
+			format, ok := audioFormat(mimeType)
+			if !ok {
+				return &MediaFetchError{URL: rawURL, Reason: "内容不是音频 (" + mimeType + ")"}
+			}
+			audio["data"] = base64.StdEncoding.EncodeToString(data)
+			audio["format"] = format
+			return nil
+		}
+
+	case "file":
+		// 远程文件可以放在 file_data 中，也可以使用 file_url 字段
+		file, _ := part["file"].(map[string]interface{})
+		rawURL, _ := file["file_url"].(string)
+		if data, ok := file["file_data"].(string); ok && isRemoteURL(data) {
+			rawURL = data
+		}
+		if !isRemoteURL(rawURL) {
+			return nil
+		}
+		return func(ctx context.Context, budget *mediaBudget) error {
+			data, mimeType, err := f.fetch(ctx, budget, rawURL)
+			if err != nil {
+				return err
+			}
+			delete(file, "file_url")
+			file["file_data"] = dataURL(mimeType, data)
+			if _, ok := file["filename"]; !ok {
+				if u, err := url.Parse(rawURL); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+					file["filename"] = path.Base(u.Path)
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// fetch 下载远程媒体并从 budget 中扣除其大小，返回内容和根据内容推断的 MIME 类型
+func (f *mediaFetcher) fetch(ctx context.Context, budget *mediaBudget, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", &MediaFetchError{URL: rawURL, Reason: "地址格式不正确"}
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, "", err
+	}
+
+	cfg := f.configManager.Get()
+	ctx, cancel := context.WithTimeout(ctx, cfg.MediaFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, "", &MediaFetchError{URL: rawURL, Reason: err.Error()}
+	}
+	req.Header.Set("User-Agent", "gemini-polling-media-fetcher")
+
+	start := time.Now()
+	resp, err := f.client.Do(req)
+	if err != nil {
+		var fetchErr *MediaFetchError
+		if errors.As(err, &fetchErr) {
+			return nil, "", &MediaFetchError{URL: rawURL, Reason: fetchErr.Reason}
+		}
+		return nil, "", &MediaFetchError{URL: rawURL, Reason: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &MediaFetchError{URL: rawURL, Reason: fmt.Sprintf("HTTP %d", resp.StatusCode)}
+	}
+	if resp.ContentLength > cfg.MediaFetchMaxBytes {
+		return nil, "", &MediaFetchError{URL: rawURL, Reason: fmt.Sprintf("文件大小超过 %dMB 上限", cfg.MediaFetchMaxBytes/(1024*1024))}
+	}
+	totalExceeded := &MediaFetchError{URL: rawURL, Reason: fmt.Sprintf("单个请求的远程媒体总大小超过 %dMB 上限", cfg.MediaFetchMaxTotal/(1024*1024))}
+	if resp.ContentLength > budget.remaining.Load() {
+		return nil, "", totalExceeded
+	}
+	data, err := io.ReadAll(&budgetReader{r: io.LimitReader(resp.Body, cfg.MediaFetchMaxBytes+1), budget: budget})
+	if errors.Is(err, errMediaBudgetExceeded) {
+		return nil, "", totalExceeded
+	}
+	if err != nil {
+		return nil, "", &MediaFetchError{URL: rawURL, Reason: "读取内容失败: " + err.Error()}
+	}
+	if int64(len(data)) > cfg.MediaFetchMaxBytes {
+		return nil, "", &MediaFetchError{URL: rawURL, Reason: fmt.Sprintf("文件大小超过 %dMB 上限", cfg.MediaFetchMaxBytes/(1024*1024))}
+	}
+
+	mimeType := sniffMediaType(data, resp.Header.Get("Content-Type"))
+	logger.Debug("[Media] 已下载 %s (%s, %d 字节, 耗时 %v)", u.Redacted(), mimeType, len(data), time.Since(start))
+	return data, mimeType, nil
+}
+
+// checkURL 检查地址的协议和主机是否允许访问
+func (f *mediaFetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &MediaFetchError{URL: u.Redacted(), Reason: "只允许 http 或 https 地址"}
+	}
+	host := u.Hostname()
+	if host == "" {
+		return &MediaFetchError{URL: u.Redacted(), Reason: "地址缺少主机名"}
+	}
+	allowed := f.allowedHosts()
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range allowed {
+		if hostMatches(pattern, host) {
+			return nil
+		}
+	}
+	return &MediaFetchError{URL: u.Redacted(), Reason: "主机 " + host + " 不在 MEDIA_FETCH_ALLOWED_HOSTS 白名单中"}
+}
+
+func (f *mediaFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > mediaFetchMaxRedirects {
+		return &MediaFetchError{URL: via[0].URL.Redacted(), Reason: "重定向次数过多"}
+	}
+	return f.checkURL(req.URL)
+}
+
+// dialContext 在建立连接时检查解析后的 IP，防止通过 DNS 解析到内网地址绕过检查。
+// 在白名单中显式列出 (非通配符) 的主机允许解析到内网地址。
+func (f *mediaFetcher) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !f.explicitlyAllowed(host) {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			ipStr, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(ipStr); ip == nil || isInternalIP(ip) {
+				return &MediaFetchError{URL: host, Reason: "拒绝访问内网地址 " + ipStr}
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (f *mediaFetcher) allowedHosts() []string {
+	var hosts []string
+	for _, h := range strings.Split(f.configManager.Get().MediaFetchAllowedHosts, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func (f *mediaFetcher) explicitlyAllowed(host string) bool {
+	for _, pattern := range f.allowedHosts() {
+		if !strings.Contains(pattern, "*") && strings.EqualFold(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches 判断主机是否匹配白名单条目，*.example.com 匹配 example.com 的所有子域名
+func hostMatches(pattern, host string) bool {
+	host = strings.ToLower(host)
+	if pattern == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return pattern == host
+}
+
+// isInternalIP 判断 IP 是否属于不应从公网请求中访问的地址
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		cgnatNet.Contains(ip) || (ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+func isRemoteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// sniffMediaType 根据内容推断 MIME 类型，无法识别时使用响应头中的 Content-Type
+func sniffMediaType(data []byte, header string) string {
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if detected != "application/octet-stream" && !strings.HasPrefix(detected, "text/plain") {
+		return detected
+	}
+	if declared, _, err := mime.ParseMediaType(header); err == nil && declared != "" {
+		return declared
+	}
+	return detected
+}
+
+// audioFormat 将音频 MIME 类型转换为 input_audio 的 format 字段
+func audioFormat(mimeType string) (string, bool) {
+	switch mimeType {
+	case "audio/wav", "audio/wave", "audio/x-wav", "audio/vnd.wave":
+		return "wav", true
+	case "audio/mpeg", "audio/mp3":
+		return "mp3", true
+	case "application/ogg":
+		return "ogg", true
+	}
+	if format, ok := strings.CutPrefix(mimeType, "audio/"); ok {
+		return strings.TrimPrefix(format, "x-"), true
+	}
+	return "", false
+}
+
+func dataURL(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
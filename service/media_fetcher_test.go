@@ -0,0 +1,197 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gemini_polling/model"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pngOf 返回 size 字节、可以被识别为 PNG 的内容
+func pngOf(size int) []byte {
+	return append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, size-8)...)
+}
+
+// imageMessages 返回一条包含 n 个远程 image_url 的用户消息
+func imageMessages(urls ...string) []model.Message {
+	parts := []interface{}{map[string]interface{}{"type": "text", "text": "describe"}}
+	for _, u := range urls {
+		parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": u}})
+	}
+	return []model.Message{{Role: "user", Content: parts}}
+}
+
+func TestIsInternalIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true}, // 云厂商元数据地址
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"8.8.8.8", false},
+		{"100.128.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if got := isInternalIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isInternalIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"cdn.example.com", "cdn.example.com", true},
+		{"cdn.example.com", "CDN.Example.com", true},
+		{"cdn.example.com", "evil.com", false},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "evilexample.com", false},
+		{"*", "anything", true},
+	}
+	for _, tt := range tests {
+		if got := hostMatches(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMediaFetcherSSRF(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pngOf(64))
+	}))
+	defer internal.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://metadata.google.internal/computeMetadata/v1/", http.StatusFound)
+	}))
+	defer redirect.Close()
+	host := strings.TrimPrefix(internal.URL, "http://")
+	hostname, _, _ := net.SplitHostPort(host)
+
+	tests := []struct {
+		name       string
+		allowed    string
+		url        string
+		wantReason string
+	}{
+		{name: "loopback rejected at dial time", url: internal.URL + "/a.png", wantReason: "拒绝访问内网地址"},
+		{name: "not in allowlist", allowed: "*.example.com", url: internal.URL + "/a.png", wantReason: "不在 MEDIA_FETCH_ALLOWED_HOSTS 白名单中"},
+		// 通配符条目不允许访问内网地址，只有显式列出的主机可以
+		{name: "wildcard does not unlock internal", allowed: "*", url: internal.URL + "/a.png", wantReason: "拒绝访问内网地址"},
+		{name: "redirect target checked", allowed: hostname, url: redirect.URL, wantReason: "不在 MEDIA_FETCH_ALLOWED_HOSTS 白名单中"},
+		{name: "explicitly allowed internal host", allowed: hostname, url: internal.URL + "/a.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newMediaFetcher(newTestConfigManager(t, "MEDIA_FETCH_ALLOWED_HOSTS", tt.allowed))
+			msgs := imageMessages(tt.url)
+			err := f.inlineMessages(context.Background(), msgs)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				part := msgs[0].Content.([]interface{})[1].(map[string]interface{})
+				if u := part["image_url"].(map[string]interface{})["url"].(string); !strings.HasPrefix(u, "data:image/png;base64,") {
+					t.Fatalf("image_url not inlined: %.40s", u)
+				}
+				return
+			}
+			var fetchErr *MediaFetchError
+			if !errors.As(err, &fetchErr) || !strings.Contains(fetchErr.Reason, tt.wantReason) {
+				t.Fatalf("err = %v, want reason containing %q", err, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestMediaFetcherRequestLimits(t *testing.T) {
+	var requests, active, maxActive atomic.Int32
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		n := active.Add(1)
+		defer active.Add(-1)
+		mu.Lock()
+		if n > maxActive.Load() {
+			maxActive.Store(n)
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		size := 400 * 1024
+		if r.URL.Path == "/small.png" {
+			size = 1024
+		}
+		w.Write(pngOf(size))
+	}))
+	defer server.Close()
+	hostname, _, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	repeat := func(path string, n int) []string {
+		urls := make([]string, n)
+		for i := range urls {
+			urls[i] = server.URL + path
+		}
+		return urls
+	}
+	tests := []struct {
+		name         string
+		urls         []string
+		wantReason   string
+		wantRequests int32
+	}{
+		{name: "too many parts", urls: repeat("/small.png", 5), wantReason: "最多下载 4 个", wantRequests: 0},
+		{name: "total budget", urls: repeat("/large.png", 3), wantReason: "总大小超过 1MB", wantRequests: 3},
+		{name: "within limits", urls: repeat("/small.png", 4), wantRequests: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			f := newMediaFetcher(newTestConfigManager(t,
+				"MEDIA_FETCH_ALLOWED_HOSTS", hostname,
+				"MEDIA_FETCH_MAX_PARTS", "4",
+				"MEDIA_FETCH_MAX_TOTAL_MB", "1",
+			))
+			err := f.inlineMessages(context.Background(), imageMessages(tt.urls...))
+			if tt.wantReason == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantReason != "" && (err == nil || !strings.Contains(err.Error(), tt.wantReason)) {
+				t.Fatalf("err = %v, want it to mention %q", err, tt.wantReason)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("made %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+
+	maxActive.Store(0)
+	f := newMediaFetcher(newTestConfigManager(t, "MEDIA_FETCH_ALLOWED_HOSTS", hostname, "MEDIA_FETCH_MAX_PARTS", "12"))
+	if err := f.inlineMessages(context.Background(), imageMessages(repeat("/small.png", 12)...)); err != nil {
+		t.Fatal(err)
+	}
+	if got := maxActive.Load(); got > mediaFetchConcurrency {
+		t.Errorf("%d downloads ran at once, want at most %d", got, mediaFetchConcurrency)
+	}
+}
@@ -0,0 +1,137 @@
+// service/metrics.go
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics 在内存中汇总请求级别的运行指标，供管理后台查看。
+// 进程重启后指标会清零。
+type Metrics struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	models    map[string]*ModelMetrics
+	fallbacks map[string]*FallbackMetrics
+	coalesced int64
+	live      int64 // 进行中的 Live 会话数
+}
+
+// ModelMetrics 是按客户端请求的模型统计的计数
+type ModelMetrics struct {
+	Model      string `json:"model"`
+	Requests   int64  `json:"requests"`
+	Downgraded int64  `json:"downgraded"` // 由回退模型完成的请求数
+}
+
+// FallbackMetrics 统计一条 "原模型 -> 回退模型" 边被使用的情况
+type FallbackMetrics struct {
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	Count    int64            `json:"count"`
+	Reasons  map[string]int64 `json:"reasons"`
+	LastUsed time.Time        `json:"last_used"`
+}
+
+// MetricsSnapshot 是 Metrics 在某一时刻的只读副本
+type MetricsSnapshot struct {
+	StartedAt    time.Time         `json:"started_at"`
+	Models       []ModelMetrics    `json:"models"`
+	Fallbacks    []FallbackMetrics `json:"fallbacks"`
+	Cache        *CacheStats       `json:"cache,omitempty"`
+	Coalesced    int64             `json:"coalesced_requests"` // 复用了进行中相同请求的次数
+	LiveSessions int64             `json:"live_sessions"`      // 进行中的 Live API 会话数
+}
+
+// NewMetrics creates an empty metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		startedAt: time.Now(),
+		models:    make(map[string]*ModelMetrics),
+		fallbacks: make(map[string]*FallbackMetrics),
+	}
+}
+
+func (m *Metrics) modelLocked(name string) *ModelMetrics {
+	mm, ok := m.models[name]
+	if !ok {
+		mm = &ModelMetrics{Model: name}
+		m.models[name] = mm
+	}
+	return mm
+}
+
+// RecordRequest 记录一次针对 requestedModel 的请求
+func (m *Metrics) RecordRequest(requestedModel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.modelLocked(requestedModel).Requests++
+}
+
+// RecordFallback 记录一次从 from 回退到 to 的切换
+func (m *Metrics) RecordFallback(from, to, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := from + "->" + to
+	fm, ok := m.fallbacks[key]
+	if !ok {
+		fm = &FallbackMetrics{From: from, To: to, Reasons: make(map[string]int64)}
+		m.fallbacks[key] = fm
+	}
+	fm.Count++
+	fm.Reasons[reason]++
+	fm.LastUsed = time.Now()
+}
+
+// RecordDowngrade 记录一次最终由回退模型完成的请求
+func (m *Metrics) RecordDowngrade(requestedModel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.modelLocked(requestedModel).Downgraded++
+}
+
+// RecordCoalesced 记录一次被合并到进行中相同请求的调用
+func (m *Metrics) RecordCoalesced() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.coalesced++
+}
+
+// RecordLiveSession 在 Live 会话开始 (delta=1) 和结束 (delta=-1) 时更新进行中的会话数
+func (m *Metrics) RecordLiveSession(delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.live += delta
+}
+
+// Snapshot 返回当前指标的副本
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := MetricsSnapshot{
+		StartedAt:    m.startedAt,
+		Coalesced:    m.coalesced,
+		LiveSessions: m.live,
+		Models:       make([]ModelMetrics, 0, len(m.models)),
+		Fallbacks:    make([]FallbackMetrics, 0, len(m.fallbacks)),
+	}
+	for _, mm := range m.models {
+		snapshot.Models = append(snapshot.Models, *mm)
+	}
+	for _, fm := range m.fallbacks {
+		copied := *fm
+		copied.Reasons = make(map[string]int64, len(fm.Reasons))
+		for reason, count := range fm.Reasons {
+			copied.Reasons[reason] = count
+		}
+		snapshot.Fallbacks = append(snapshot.Fallbacks, copied)
+	}
+	sort.Slice(snapshot.Models, func(i, j int) bool { return snapshot.Models[i].Model < snapshot.Models[j].Model })
+	sort.Slice(snapshot.Fallbacks, func(i, j int) bool {
+		return snapshot.Fallbacks[i].Count > snapshot.Fallbacks[j].Count
+	})
+	return snapshot
+}
@@ -0,0 +1,128 @@
+// service/model_fallback.go
+package service
+
+import (
+	"context"
+	"errors"
+	"gemini_polling/logger"
+	"io"
+	"net/http"
+)
+
+const (
+	// HeaderServedModel 告知客户端实际完成请求的模型
+	HeaderServedModel = "X-Served-Model"
+	// HeaderFallbackFrom 在发生模型回退时告知客户端原始请求的模型
+	HeaderFallbackFrom = "X-Fallback-From"
+)
+
+// ResponseMeta 收集服务层在处理一次请求时产生的、需要通过响应头告知客户端的信息
+type ResponseMeta struct {
+	RequestedModel string
+	ServedModel    string
+	CacheStatus    string // 响应缓存状态 (HIT/MISS/BYPASS)，未启用缓存时为空
+}
+
+type responseMetaKey struct{}
+
+// WithResponseMeta 返回一个携带 ResponseMeta 的 context，服务层会在处理请求时填充它
+func WithResponseMeta(ctx context.Context) (context.Context, *ResponseMeta) {
+	meta := &ResponseMeta{}
+	return context.WithValue(ctx, responseMetaKey{}, meta), meta
+}
+
+// responseMetaFrom 取出 context 中的 ResponseMeta，不存在时返回一个不会被读取的临时对象
+func responseMetaFrom(ctx context.Context) *ResponseMeta {
+	if meta, ok := ctx.Value(responseMetaKey{}).(*ResponseMeta); ok {
+		return meta
+	}
+	return &ResponseMeta{}
+}
+
+// ensureResponseMeta 保证 context 中携带 ResponseMeta，以便调用链下游共享同一份元信息
+func ensureResponseMeta(ctx context.Context) (context.Context, *ResponseMeta) {
+	if meta, ok := ctx.Value(responseMetaKey{}).(*ResponseMeta); ok {
+		return ctx, meta
+	}
+	return WithResponseMeta(ctx)
+}
+
+// ApplyHeaders 将元信息写入响应头
+func (m *ResponseMeta) ApplyHeaders(h http.Header) {
+	if m.CacheStatus != "" {
+		h.Set(HeaderCacheStatus, m.CacheStatus)
+	}
+	if m.ServedModel == "" {
+		return
+	}
+	h.Set(HeaderServedModel, m.ServedModel)
+	if m.RequestedModel != "" && m.RequestedModel != m.ServedModel {
+		h.Set(HeaderFallbackFrom, m.RequestedModel)
+	}
+}
+
+// applyStreamHeaders 在开始向客户端写流之前设置元信息响应头
+func applyStreamHeaders(ctx context.Context, w io.Writer) {
+	if rw, ok := w.(http.ResponseWriter); ok {
+		responseMetaFrom(ctx).ApplyHeaders(rw.Header())
+	}
+}
+
+// fallbackReason 判断错误是否应该触发模型回退，并返回用于指标统计的原因
+func fallbackReason(err error) (string, bool) {
+	var circuitErr *CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		return "circuit_open", true
+	}
+	if errors.Is(err, ErrAllKeysRateLimited) {
+		return "rate_limited", true
+	}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusServiceUnavailable {
+		return "unavailable", true
+	}
+	return "", false
+}
+
+// fallbackChain 返回请求模型及其配置的回退模型，按尝试顺序排列且不重复
+func (s *GenAIService) fallbackChain(requestedModel string) []string {
+	chain := []string{requestedModel}
+	seen := map[string]bool{requestedModel: true}
+	for _, name := range s.configManager.Get().ModelFallbacks[requestedModel] {
+		if !seen[name] {
+			seen[name] = true
+			chain = append(chain, name)
+		}
+	}
+	return chain
+}
+
+// withFallback 依次使用请求模型和回退模型执行 run。
+// 只有当前模型被限流 (所有 Key 429)、返回 503 或处于熔断状态时才会尝试下一个模型。
+func (s *GenAIService) withFallback(ctx context.Context, requestedModel string, run func(ctx context.Context, modelName string) error) error {
+	ctx, meta := ensureResponseMeta(ctx)
+	meta.RequestedModel = requestedModel
+	s.metrics.RecordRequest(requestedModel)
+
+	chain := s.fallbackChain(requestedModel)
+	var err error
+	for i, modelName := range chain {
+		meta.ServedModel = modelName
+		if err = run(ctx, modelName); err == nil {
+			if i > 0 {
+				s.metrics.RecordDowngrade(requestedModel)
+				logger.Info("[模型回退] 请求模型 %s 已由回退模型 %s 完成", requestedModel, modelName)
+			}
+			return nil
+		}
+
+		reason, ok := fallbackReason(err)
+		if !ok || i == len(chain)-1 || ctx.Err() != nil {
+			return err
+		}
+		next := chain[i+1]
+		logger.Warn("[模型回退] 模型 %s 不可用 (%s)，回退到 %s", modelName, reason, next)
+		s.metrics.RecordFallback(modelName, next, reason)
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFallbackChain(t *testing.T) {
+	s := newTestGenAIService(t)
+	s.configManager = newTestConfigManager(t, "MODEL_FALLBACKS", "pro -> flash -> pro -> lite ; flash->lite;;  solo  ")
+	tests := map[string][]string{
+		"pro":     {"pro", "flash", "lite"}, // 链中重复的模型 (包括请求模型自身) 只尝试一次
+		"flash":   {"flash", "lite"},
+		"solo":    {"solo"},
+		"unknown": {"unknown"},
+	}
+	for requested, want := range tests {
+		if got := s.fallbackChain(requested); !reflect.DeepEqual(got, want) {
+			t.Errorf("fallbackChain(%s) = %v, want %v", requested, got, want)
+		}
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	unavailable := &UpstreamError{StatusCode: http.StatusServiceUnavailable, Body: []byte("overloaded")}
+	badRequest := &UpstreamError{StatusCode: http.StatusBadRequest, Body: []byte("bad")}
+	circuitOpen := &CircuitOpenError{Model: "pro", RetryAfter: time.Second}
+
+	tests := []struct {
+		name      string
+		errs      map[string]error // 每个模型的调用结果，没有列出的模型调用成功
+		wantCalls []string
+		wantErr   error
+		served    string
+		fallbacks []string // 按切换顺序记录的回退原因
+	}{
+		{name: "first model succeeds", wantCalls: []string{"pro"}, served: "pro"},
+		{
+			name:      "rate limited falls back",
+			errs:      map[string]error{"pro": ErrAllKeysRateLimited},
+			wantCalls: []string{"pro", "flash"},
+			served:    "flash",
+			fallbacks: []string{"rate_limited"},
+		},
+		{
+			name:      "503 and open circuit fall back down the chain",
+			errs:      map[string]error{"pro": unavailable, "flash": circuitOpen},
+			wantCalls: []string{"pro", "flash", "lite"},
+			served:    "lite",
+			fallbacks: []string{"unavailable", "circuit_open"},
+		},
+		{
+			name:      "client errors do not fall back",
+			errs:      map[string]error{"pro": badRequest},
+			wantCalls: []string{"pro"},
+			wantErr:   badRequest,
+			served:    "pro",
+		},
+		{
+			name:      "last model's error is returned",
+			errs:      map[string]error{"pro": unavailable, "flash": unavailable, "lite": ErrAllKeysRateLimited},
+			wantCalls: []string{"pro", "flash", "lite"},
+			wantErr:   ErrAllKeysRateLimited,
+			served:    "lite",
+			fallbacks: []string{"unavailable", "unavailable"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestGenAIService(t)
+			s.configManager = newTestConfigManager(t, "MODEL_FALLBACKS", "pro->flash->lite")
+			ctx, meta := WithResponseMeta(context.Background())
+
+			var calls []string
+			err := s.withFallback(ctx, "pro", func(ctx context.Context, modelName string) error {
+				calls = append(calls, modelName)
+				return tt.errs[modelName]
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if meta.RequestedModel != "pro" || meta.ServedModel != tt.served {
+				t.Errorf("meta = %+v, want served %s", meta, tt.served)
+			}
+
+			h := http.Header{}
+			meta.ApplyHeaders(h)
+			wantFrom := ""
+			if tt.served != "pro" {
+				wantFrom = "pro"
+			}
+			if h.Get(HeaderServedModel) != tt.served || h.Get(HeaderFallbackFrom) != wantFrom {
+				t.Errorf("headers = %v", h)
+			}
+
+			snapshot := s.metrics.Snapshot()
+			var reasons []string
+			for i, from := range tt.wantCalls[:len(tt.fallbacks)] {
+				for _, edge := range snapshot.Fallbacks {
+					if edge.From == from && edge.To == tt.wantCalls[i+1] && edge.Count == 1 {
+						for reason := range edge.Reasons {
+							reasons = append(reasons, reason)
+						}
+					}
+				}
+			}
+			if len(snapshot.Fallbacks) != len(tt.fallbacks) || !reflect.DeepEqual(reasons, tt.fallbacks) {
+				t.Errorf("fallback metrics = %+v, want reasons %v", snapshot.Fallbacks, tt.fallbacks)
+			}
+			downgraded := int64(0)
+			if tt.wantErr == nil && tt.served != "pro" {
+				downgraded = 1
+			}
+			if len(snapshot.Models) != 1 || snapshot.Models[0].Requests != 1 || snapshot.Models[0].Downgraded != downgraded {
+				t.Errorf("model metrics = %+v, want 1 request and %d downgraded", snapshot.Models, downgraded)
+			}
+		})
+	}
+
+	t.Run("cancelled context stops the chain", func(t *testing.T) {
+		s := newTestGenAIService(t)
+		s.configManager = newTestConfigManager(t, "MODEL_FALLBACKS", "pro->flash")
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls []string
+		err := s.withFallback(ctx, "pro", func(ctx context.Context, modelName string) error {
+			calls = append(calls, modelName)
+			cancel()
+			return unavailable
+		})
+		if !errors.Is(err, unavailable) || len(calls) != 1 {
+			t.Errorf("err = %v, calls = %v", err, calls)
+		}
+	})
+}
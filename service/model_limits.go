@@ -0,0 +1,89 @@
+// service/model_limits.go
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ModelLimits 是模型的输入/输出 token 上限，0 表示未知
+type ModelLimits struct {
+	Input  int
+	Output int
+}
+
+// TokenLimitSource 提供模型的 token 上限，由 ModelRegistry 实现
+type TokenLimitSource interface {
+	TokenLimits(modelName string) ModelLimits
+}
+
+// knownModelLimits 是内置的已知模型上限，按模型名前缀匹配 (最长的前缀优先)，
+// 在模型目录和上游模型列表都没有该模型的上限时使用
+var knownModelLimits = map[string]ModelLimits{
+	"gemini-3-pro":             {Input: 1048576, Output: 65536},
+	"gemini-2.5-pro":           {Input: 1048576, Output: 65536},
+	"gemini-2.5-flash":         {Input: 1048576, Output: 65536},
+	"gemini-2.5-flash-lite":    {Input: 1048576, Output: 65536},
+	"gemini-2.5-flash-image":   {Input: 32768, Output: 32768},
+	"gemini-2.0-flash":         {Input: 1048576, Output: 8192},
+	"gemini-2.0-flash-lite":    {Input: 1048576, Output: 8192},
+	"gemini-1.5-pro":           {Input: 2097152, Output: 8192},
+	"gemini-1.5-flash":         {Input: 1048576, Output: 8192},
+	"gemini-pro-latest":        {Input: 1048576, Output: 65536},
+	"gemini-flash-latest":      {Input: 1048576, Output: 65536},
+	"gemini-flash-lite-latest": {Input: 1048576, Output: 65536},
+}
+
+// knownLimits 返回内置表中与模型名前缀最长匹配的上限
+func knownLimits(modelName string) ModelLimits {
+	var (
+		best    ModelLimits
+		bestLen int
+	)
+	for prefix, limits := range knownModelLimits {
+		if len(prefix) > bestLen && strings.HasPrefix(modelName, prefix) {
+			best, bestLen = limits, len(prefix)
+		}
+	}
+	return best
+}
+
+// fill 用 other 补上 l 中未知的上限
+func (l *ModelLimits) fill(other ModelLimits) {
+	if l.Input <= 0 {
+		l.Input = other.Input
+	}
+	if l.Output <= 0 {
+		l.Output = other.Output
+	}
+}
+
+// TokenLimits 返回模型的输入/输出 token 上限，依次使用模型目录条目中的设置、
+// 已缓存的上游模型列表中的 inputTokenLimit/outputTokenLimit 和内置的已知模型表。
+// 只读取已有的缓存，不会为此请求上游。
+func (r *ModelRegistry) TokenLimits(modelName string) ModelLimits {
+	modelName = strings.TrimPrefix(modelName, "models/")
+
+	var limits ModelLimits
+	r.mu.RLock()
+	if entry, ok := r.entries[modelName]; ok {
+		limits = ModelLimits{Input: entry.InputTokenLimit, Output: entry.OutputTokenLimit}
+	}
+	r.mu.RUnlock()
+
+	r.catalogueMu.Lock()
+	upstream := r.upstream
+	r.catalogueMu.Unlock()
+	for _, m := range upstream {
+		if strings.TrimPrefix(fmt.Sprint(m["name"]), "models/") != modelName {
+			continue
+		}
+		input, _ := m["inputTokenLimit"].(float64)
+		output, _ := m["outputTokenLimit"].(float64)
+		limits.fill(ModelLimits{Input: int(input), Output: int(output)})
+		break
+	}
+
+	limits.fill(knownLimits(modelName))
+	return limits
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"gemini_polling/model"
+	"testing"
+)
+
+func TestModelTokenLimits(t *testing.T) {
+	r := newTestModelRegistry(t, []model.ModelEntry{
+		{Name: "in-house", InputTokenLimit: 8192, OutputTokenLimit: 1024},
+		{Name: "gemini-2.5-flash-custom", InputTokenLimit: 4096},
+	})
+	// 上游列表中的 gemini-2.5-pro 只有输入上限，输出上限来自内置表
+	r.upstream = []map[string]interface{}{
+		{"name": "models/gemini-2.5-pro", "inputTokenLimit": float64(2000000)},
+		{"name": "models/gemini-2.5-flash-custom", "inputTokenLimit": float64(9999), "outputTokenLimit": float64(2048)},
+	}
+
+	tests := []struct {
+		model string
+		want  ModelLimits
+	}{
+		{model: "in-house", want: ModelLimits{Input: 8192, Output: 1024}},                  // 模型目录
+		{model: "gemini-2.5-flash-custom", want: ModelLimits{Input: 4096, Output: 2048}},   // 目录优先，缺少的输出上限来自上游列表
+		{model: "models/gemini-2.5-pro", want: ModelLimits{Input: 2000000, Output: 65536}}, // 上游列表 + 内置表
+		{model: "gemini-2.5-flash-lite-preview", want: ModelLimits{Input: 1048576, Output: 65536}},
+		{model: "gemini-2.5-flash-image-preview", want: ModelLimits{Input: 32768, Output: 32768}}, // 最长前缀优先
+		{model: "gemini-2.0-flash-001", want: ModelLimits{Input: 1048576, Output: 8192}},
+		{model: "unknown-model", want: ModelLimits{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := r.TokenLimits(tt.model); got != tt.want {
+				t.Errorf("TokenLimits(%s) = %+v, want %+v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
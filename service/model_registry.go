@@ -0,0 +1,434 @@
+// service/model_registry.go
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAliasDepth 限制别名链的解析深度，防止配置成环
+const maxAliasDepth = 8
+
+// ErrModelNotFound 表示请求的模型被隐藏或不存在
+var ErrModelNotFound = errors.New("模型不存在")
+
+// ModelNotAllowedError 表示客户端无权使用请求的模型
+type ModelNotAllowedError struct {
+	Client string
+	Model  string
+}
+
+func (e *ModelNotAllowedError) Error() string {
+	return fmt.Sprintf("客户端 %s 无权使用模型 %s", e.Client, e.Model)
+}
+
+// CatalogueModel 是合并后的模型列表中的一项
+type CatalogueModel struct {
+	ID      string                 // 不带 "models/" 前缀的模型名
+	OwnedBy string                 // "google" 表示来自上游，"custom" 表示来自模型目录
+	Gemini  map[string]interface{} // Gemini 原生格式的模型描述
+}
+
+// CatalogueStatus 用于向管理后台展示上游模型列表缓存的状态
+type CatalogueStatus struct {
+	UpstreamModels int       `json:"upstream_models"`
+	FetchedAt      time.Time `json:"fetched_at"`
+	Refreshing     bool      `json:"refreshing"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// ModelRegistry 维护管理员定义的模型目录 (别名、隐藏模型、自定义模型)、
+// 客户端凭据及其模型白名单，并缓存上游的模型列表。
+// 模型列表接口只读缓存，缓存过期时在后台刷新，上游不可用时继续返回旧数据。
+type ModelRegistry struct {
+	configManager *config.Manager
+	store         *storage.RegistryStore
+	genaiService  *GenAIService
+
+	mu      sync.RWMutex
+	entries map[string]model.ModelEntry // name -> entry
+	clients map[string]model.Client     // key -> 已启用的客户端
+
+	catalogueMu sync.Mutex
+	upstream    []map[string]interface{}
+	fetchedAt   time.Time
+	refreshing  bool
+	lastErr     error
+}
+
+// NewModelRegistry creates a model registry backed by the given store.
+func NewModelRegistry(manager *config.Manager, store *storage.RegistryStore, genaiService *GenAIService) *ModelRegistry {
+	return &ModelRegistry{
+		configManager: manager,
+		store:         store,
+		genaiService:  genaiService,
+		entries:       make(map[string]model.ModelEntry),
+		clients:       make(map[string]model.Client),
+	}
+}
+
+// Start 从数据库加载模型目录和客户端，并在后台预热上游模型列表
+func (r *ModelRegistry) Start() error {
+	if err := r.Reload(); err != nil {
+		return err
+	}
+	go r.refreshCatalogue(context.Background())
+	return nil
+}
+
+// Reload 从数据库重新加载模型目录和客户端凭据
+func (r *ModelRegistry) Reload() error {
+	entries, err := r.store.ListModelEntries()
+	if err != nil {
+		return fmt.Errorf("加载模型目录失败: %w", err)
+	}
+	clients, err := r.store.ListClients()
+	if err != nil {
+		return fmt.Errorf("加载客户端失败: %w", err)
+	}
+
+	entryMap := make(map[string]model.ModelEntry, len(entries))
+	for _, e := range entries {
+		entryMap[e.Name] = e
+	}
+	clientMap := make(map[string]model.Client, len(clients))
+	for _, c := range clients {
+		if c.Enabled {
+			clientMap[c.Key] = c
+		}
+	}
+
+	r.mu.Lock()
+	r.entries = entryMap
+	r.clients = clientMap
+	r.mu.Unlock()
+	logger.Info("模型目录已加载: %d 个条目, %d 个已启用的客户端", len(entryMap), len(clientMap))
+	return nil
+}
+
+// FindClient 根据客户端密钥查找已启用的客户端
+func (r *ModelRegistry) FindClient(key string) (*model.Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.clients[key]
+	if !ok {
+		return nil, false
+	}
+	return &c, true
+}
+
+// FindClientByID 根据 ID 查找已启用的客户端，用于在后台任务中恢复请求所属的客户端
+func (r *ModelRegistry) FindClientByID(id uint) (*model.Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, c := range r.clients {
+		if c.ID == id {
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// HasClients 判断是否配置了任何已启用的客户端
+func (r *ModelRegistry) HasClients() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients) > 0
+}
+
+// Resolve 检查客户端是否可以使用 requested 模型，并将别名解析为上游模型名。
+// client 为 nil 表示使用全局公共密钥 (或未开启认证) 的请求，不受白名单限制。
+func (r *ModelRegistry) Resolve(client *model.Client, requested string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	resolved := requested
+	for depth := 0; depth < maxAliasDepth; depth++ {
+		entry, ok := r.entries[resolved]
+		if !ok || !entry.IsAlias() {
+			break
+		}
+		resolved = entry.Target
+	}
+
+	// 直接请求被隐藏的模型视为模型不存在；通过别名访问被隐藏的模型是允许的
+	if entry, ok := r.entries[requested]; ok && entry.Hidden && !entry.IsAlias() {
+		return "", ErrModelNotFound
+	}
+	if !clientAllows(client, requested) && !clientAllows(client, resolved) {
+		return "", &ModelNotAllowedError{Client: client.Name, Model: requested}
+	}
+	if resolved != requested {
+		logger.Debug("[模型目录] 别名 %s 解析为 %s", requested, resolved)
+	}
+	return resolved, nil
+}
+
+// clientAllows 判断客户端白名单是否包含指定模型
+func clientAllows(client *model.Client, modelName string) bool {
+	if client == nil || strings.TrimSpace(client.AllowedModels) == "" {
+		return true
+	}
+	for _, pattern := range strings.Split(client.AllowedModels, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if matched, err := path.Match(pattern, modelName); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ListModels 返回对指定客户端可见的合并模型列表:
+// 上游模型 (去掉隐藏模型) + 自定义模型 + 别名，并按客户端白名单过滤。
+func (r *ModelRegistry) ListModels(ctx context.Context, client *model.Client) ([]CatalogueModel, error) {
+	upstream, err := r.catalogue(ctx)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	byID := make(map[string]map[string]interface{}, len(upstream))
+	for _, m := range upstream {
+		if name, _ := m["name"].(string); name != "" {
+			byID[strings.TrimPrefix(name, "models/")] = m
+		}
+	}
+
+	var models []CatalogueModel
+	seen := make(map[string]bool)
+	for _, m := range upstream {
+		id := strings.TrimPrefix(fmt.Sprint(m["name"]), "models/")
+		if entry, ok := r.entries[id]; ok && (entry.Hidden || entry.IsAlias()) {
+			continue
+		}
+		seen[id] = true
+		if clientAllows(client, id) {
+			models = append(models, CatalogueModel{ID: id, OwnedBy: "google", Gemini: r.describe(id, byID[id])})
+		}
+	}
+
+	for name, entry := range r.entries {
+		if entry.Hidden || seen[name] {
+			continue
+		}
+		target := name
+		if entry.IsAlias() {
+			target = entry.Target
+			for depth := 0; depth < maxAliasDepth; depth++ {
+				next, ok := r.entries[target]
+				if !ok || !next.IsAlias() {
+					break
+				}
+				target = next.Target
+			}
+		}
+		if !clientAllows(client, name) && !clientAllows(client, target) {
+			continue
+		}
+		models = append(models, CatalogueModel{ID: name, OwnedBy: "custom", Gemini: r.describe(name, byID[target])})
+	}
+
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	if len(upstream) == 0 && err != nil {
+		return models, err
+	}
+	return models, nil
+}
+
+// describe 生成 Gemini 原生格式的模型描述，别名会复用目标模型的能力信息。
+// 调用方需持有 r.mu 读锁。
+func (r *ModelRegistry) describe(name string, base map[string]interface{}) map[string]interface{} {
+	desc := make(map[string]interface{}, len(base)+3)
+	for k, v := range base {
+		desc[k] = v
+	}
+	desc["name"] = "models/" + name
+	if base == nil {
+		desc["displayName"] = name
+		desc["supportedGenerationMethods"] = []string{"generateContent", "countTokens"}
+	}
+	if entry, ok := r.entries[name]; ok {
+		if entry.IsAlias() {
+			desc["displayName"] = name
+		}
+		if entry.Description != "" {
+			desc["description"] = entry.Description
+		}
+		if entry.InputTokenLimit > 0 {
+			desc["inputTokenLimit"] = entry.InputTokenLimit
+		}
+		if entry.OutputTokenLimit > 0 {
+			desc["outputTokenLimit"] = entry.OutputTokenLimit
+		}
+	}
+	return desc
+}
+
+// catalogue 返回缓存的上游模型列表。缓存过期时在后台刷新；
+// 从未成功拉取过时才会同步等待上游。
+func (r *ModelRegistry) catalogue(ctx context.Context) ([]map[string]interface{}, error) {
+	ttl := r.configManager.Get().ModelCatalogueTTL
+
+	r.catalogueMu.Lock()
+	upstream, fetchedAt := r.upstream, r.fetchedAt
+	stale := time.Since(fetchedAt) > ttl
+	startRefresh := stale && !r.refreshing && upstream != nil
+	if startRefresh {
+		r.refreshing = true
+	}
+	r.catalogueMu.Unlock()
+
+	if upstream != nil {
+		if startRefresh {
+			go r.doRefresh(context.Background())
+		}
+		return upstream, nil
+	}
+
+	if _, err := r.refreshCatalogue(ctx); err != nil {
+		return nil, err
+	}
+	r.catalogueMu.Lock()
+	defer r.catalogueMu.Unlock()
+	return r.upstream, nil
+}
+
+// RefreshCatalogue 立即从上游重新拉取模型列表，返回上游模型数量
+func (r *ModelRegistry) RefreshCatalogue(ctx context.Context) (int, error) {
+	return r.refreshCatalogue(ctx)
+}
+
+func (r *ModelRegistry) refreshCatalogue(ctx context.Context) (int, error) {
+	r.catalogueMu.Lock()
+	if r.refreshing {
+		r.catalogueMu.Unlock()
+		return 0, errors.New("模型列表正在刷新中，请稍后再试")
+	}
+	r.refreshing = true
+	r.catalogueMu.Unlock()
+	return r.doRefresh(ctx)
+}
+
+// doRefresh 执行一次拉取。调用方需已将 refreshing 置为 true。
+func (r *ModelRegistry) doRefresh(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	models, err := r.genaiService.FetchUpstreamModels(ctx)
+
+	r.catalogueMu.Lock()
+	defer r.catalogueMu.Unlock()
+	r.refreshing = false
+	r.lastErr = err
+	if err != nil {
+		logger.Warn("[模型目录] 刷新上游模型列表失败，继续使用缓存 (%d 个模型): %v", len(r.upstream), err)
+		return 0, err
+	}
+	r.upstream = models
+	r.fetchedAt = time.Now()
+	logger.Info("[模型目录] 已从上游刷新模型列表，共 %d 个模型", len(models))
+	return len(models), nil
+}
+
+// Status 返回上游模型列表缓存的状态
+func (r *ModelRegistry) Status() CatalogueStatus {
+	r.catalogueMu.Lock()
+	defer r.catalogueMu.Unlock()
+	status := CatalogueStatus{
+		UpstreamModels: len(r.upstream),
+		FetchedAt:      r.fetchedAt,
+		Refreshing:     r.refreshing,
+	}
+	if r.lastErr != nil {
+		status.LastError = r.lastErr.Error()
+	}
+	return status
+}
+
+// ListEntries 返回所有模型目录条目
+func (r *ModelRegistry) ListEntries() ([]model.ModelEntry, error) {
+	return r.store.ListModelEntries()
+}
+
+// SaveEntry 校验并保存模型目录条目，然后刷新内存中的目录
+func (r *ModelRegistry) SaveEntry(entry *model.ModelEntry) error {
+	entry.Name = strings.TrimPrefix(strings.TrimSpace(entry.Name), "models/")
+	entry.Target = strings.TrimPrefix(strings.TrimSpace(entry.Target), "models/")
+	if entry.Name == "" {
+		return errors.New("模型名不能为空")
+	}
+	if entry.Target == entry.Name {
+		return errors.New("别名不能指向自身")
+	}
+	if entry.InputTokenLimit < 0 || entry.OutputTokenLimit < 0 {
+		return errors.New("token 上限不能为负数")
+	}
+	if err := r.store.SaveModelEntry(entry); err != nil {
+		return err
+	}
+	return r.Reload()
+}
+
+// DeleteEntry 删除模型目录条目，然后刷新内存中的目录
+func (r *ModelRegistry) DeleteEntry(id uint) error {
+	if err := r.store.DeleteModelEntry(id); err != nil {
+		return err
+	}
+	return r.Reload()
+}
+
+// ListClients 返回所有客户端凭据
+func (r *ModelRegistry) ListClients() ([]model.Client, error) {
+	return r.store.ListClients()
+}
+
+// SaveClient 校验并保存客户端凭据，未指定密钥时自动生成
+func (r *ModelRegistry) SaveClient(client *model.Client) error {
+	client.Name = strings.TrimSpace(client.Name)
+	client.Key = strings.TrimSpace(client.Key)
+	if client.Name == "" {
+		return errors.New("客户端名称不能为空")
+	}
+	if client.Key == "" {
+		key, err := generateClientKey()
+		if err != nil {
+			return err
+		}
+		client.Key = key
+	}
+	if err := r.store.SaveClient(client); err != nil {
+		return err
+	}
+	return r.Reload()
+}
+
+// DeleteClient 删除客户端凭据
+func (r *ModelRegistry) DeleteClient(id uint) error {
+	if err := r.store.DeleteClient(id); err != nil {
+		return err
+	}
+	return r.Reload()
+}
+
+// generateClientKey 生成一个随机的客户端密钥
+func generateClientKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("生成客户端密钥失败: %w", err)
+	}
+	return "sk-" + hex.EncodeToString(buf), nil
+}
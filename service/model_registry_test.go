@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gemini_polling/model"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestModelRegistry 创建一个目录为 entries、上游模型列表已缓存为 upstream 的 ModelRegistry
+func newTestModelRegistry(t *testing.T, entries []model.ModelEntry, upstream ...string) *ModelRegistry {
+	t.Helper()
+	r := NewModelRegistry(newTestConfigManager(t), nil, nil)
+	r.entries = make(map[string]model.ModelEntry)
+	for _, e := range entries {
+		r.entries[e.Name] = e
+	}
+	r.upstream = []map[string]interface{}{}
+	for _, name := range upstream {
+		r.upstream = append(r.upstream, map[string]interface{}{"name": "models/" + name, "inputTokenLimit": 1048576})
+	}
+	r.fetchedAt = time.Now()
+	return r
+}
+
+func TestModelRegistryResolve(t *testing.T) {
+	r := newTestModelRegistry(t, []model.ModelEntry{
+		{Name: "fast", Target: "flash-alias"},
+		{Name: "flash-alias", Target: "gemini-2.5-flash"},
+		{Name: "gemini-exp", Hidden: true},
+		{Name: "exp", Target: "gemini-exp"},
+		{Name: "loop-a", Target: "loop-b"},
+		{Name: "loop-b", Target: "loop-a"},
+	})
+	restricted := &model.Client{Name: "team", AllowedModels: "gemini-2.5-*, exp"}
+
+	tests := []struct {
+		name      string
+		client    *model.Client
+		requested string
+		want      string
+		wantErr   string // "not_found" 或 "not_allowed"
+	}{
+		{name: "plain model", requested: "gemini-2.5-pro", want: "gemini-2.5-pro"},
+		{name: "alias chain", requested: "fast", want: "gemini-2.5-flash"},
+		{name: "hidden model requested directly", requested: "gemini-exp", wantErr: "not_found"},
+		{name: "hidden model through an alias", requested: "exp", want: "gemini-exp"},
+		{name: "alias cycle stops at the depth limit", requested: "loop-a", want: "loop-a"},
+		{name: "allowlist wildcard", client: restricted, requested: "gemini-2.5-pro", want: "gemini-2.5-pro"},
+		{name: "allowlist matches the alias target", client: restricted, requested: "fast", want: "gemini-2.5-flash"},
+		{name: "allowlist matches the alias name", client: restricted, requested: "exp", want: "gemini-exp"},
+		{name: "outside the allowlist", client: restricted, requested: "gemini-1.5-pro", wantErr: "not_allowed"},
+		{name: "empty allowlist allows everything", client: &model.Client{Name: "open"}, requested: "gemini-1.5-pro", want: "gemini-1.5-pro"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(tt.client, tt.requested)
+			var notAllowed *ModelNotAllowedError
+			switch tt.wantErr {
+			case "not_found":
+				if !errors.Is(err, ErrModelNotFound) {
+					t.Fatalf("err = %v, want ErrModelNotFound", err)
+				}
+			case "not_allowed":
+				if !errors.As(err, &notAllowed) || notAllowed.Model != tt.requested {
+					t.Fatalf("err = %v, want ModelNotAllowedError", err)
+				}
+			default:
+				if err != nil || got != tt.want {
+					t.Fatalf("Resolve = %q, %v, want %q", got, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestModelRegistryListModels(t *testing.T) {
+	r := newTestModelRegistry(t, []model.ModelEntry{
+		{Name: "fast", Target: "gemini-2.5-flash"},
+		{Name: "gemini-exp", Hidden: true},
+		{Name: "in-house", Description: "自定义模型", InputTokenLimit: 8192},
+	}, "gemini-2.5-flash", "gemini-2.5-pro", "gemini-exp")
+
+	tests := []struct {
+		name   string
+		client *model.Client
+		want   []string
+	}{
+		{name: "global key", want: []string{"fast", "gemini-2.5-flash", "gemini-2.5-pro", "in-house"}},
+		{name: "allowlisted target exposes its alias", client: &model.Client{AllowedModels: "gemini-2.5-flash"}, want: []string{"fast", "gemini-2.5-flash"}},
+		{name: "allowlisted alias only", client: &model.Client{AllowedModels: "fast"}, want: []string{"fast"}},
+		{name: "custom model", client: &model.Client{AllowedModels: "in-*"}, want: []string{"in-house"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			models, err := r.ListModels(context.Background(), tt.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, m := range models {
+				ids = append(ids, m.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("ListModels = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	models, _ := r.ListModels(context.Background(), nil)
+	byID := make(map[string]CatalogueModel)
+	for _, m := range models {
+		byID[m.ID] = m
+	}
+	// 别名复用目标模型的能力信息，自定义模型使用目录中配置的描述和上限
+	if alias := byID["fast"]; alias.OwnedBy != "custom" || alias.Gemini["inputTokenLimit"] != 1048576 || alias.Gemini["name"] != "models/fast" {
+		t.Errorf("alias = %+v", alias)
+	}
+	if custom := byID["in-house"]; custom.Gemini["description"] != "自定义模型" || custom.Gemini["inputTokenLimit"] != 8192 {
+		t.Errorf("custom model = %+v", custom)
+	}
+}
@@ -0,0 +1,450 @@
+// service/ollama_service.go
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxEmbedBatch 是 batchEmbedContents 单次请求最多包含的文本数
+const maxEmbedBatch = 100
+
+// OllamaRequestError 表示 Ollama 请求的参数无效
+type OllamaRequestError struct {
+	Message string
+}
+
+func (e *OllamaRequestError) Error() string {
+	return e.Message
+}
+
+// OllamaService 将 Ollama API 的请求转换为 OpenAI 兼容的聊天请求 (/api/chat、/api/generate)
+// 和 Gemini 原生的 batchEmbedContents 请求 (/api/embed)，复用 GenAIService 的重试、回退和缓存。
+// 转换后的聊天请求与 /v1/chat/completions 一样经过 PolicyEngine。
+type OllamaService struct {
+	genai  *GenAIService
+	policy *PolicyEngine
+}
+
+func NewOllamaService(genai *GenAIService, policy *PolicyEngine) *OllamaService {
+	return &OllamaService{genai: genai, policy: policy}
+}
+
+// ollamaResult 汇总一次对话的结果和耗时
+type ollamaResult struct {
+	content      string
+	toolCalls    []model.ToolCall
+	finishReason string
+	usage        model.Usage
+	start        time.Time
+	firstToken   time.Time // 收到第一段内容的时间，用于区分 prompt 和生成的耗时
+}
+
+func (r *ollamaResult) doneReason() string {
+	if r.finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+func (r *ollamaResult) metrics() model.OllamaMetrics {
+	end := time.Now()
+	first := r.firstToken
+	if first.IsZero() {
+		first = end
+	}
+	return model.OllamaMetrics{
+		TotalDuration:      end.Sub(r.start).Nanoseconds(),
+		PromptEvalCount:    r.usage.PromptTokens,
+		PromptEvalDuration: first.Sub(r.start).Nanoseconds(),
+		EvalCount:          r.usage.CompletionTokens,
+		EvalDuration:       end.Sub(first).Nanoseconds(),
+	}
+}
+
+// Chat 处理 /api/chat。流式请求每收到一段内容调用一次 emit，最后以 done=true 的响应结束；
+// 非流式请求只调用一次 emit。
+func (s *OllamaService) Chat(ctx context.Context, client *model.Client, req *model.OllamaChatRequest, emit func(*model.OllamaChatResponse) error) error {
+	stream := req.Stream == nil || *req.Stream
+	if len(req.Messages) == 0 {
+		// 空消息列表是 Ollama 客户端用来预加载模型的请求
+		return emit(&model.OllamaChatResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    model.OllamaMessage{Role: "assistant"},
+			Done:       true,
+			DoneReason: "load",
+		})
+	}
+
+	chatReq, err := ollamaChatRequest(req.Model, req.Options, req.Format, stream)
+	if err != nil {
+		return err
+	}
+	if chatReq.Messages, err = ollamaMessages(req.Messages); err != nil {
+		return err
+	}
+	chatReq.Tools = req.Tools
+
+	res, err := s.complete(ctx, client, chatReq, func(delta string) error {
+		return emit(&model.OllamaChatResponse{
+			Model:     req.Model,
+			CreatedAt: time.Now().UTC(),
+			Message:   model.OllamaMessage{Role: "assistant", Content: delta},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	final := &model.OllamaChatResponse{
+		Model:         req.Model,
+		CreatedAt:     time.Now().UTC(),
+		Message:       model.OllamaMessage{Role: "assistant", ToolCalls: ollamaToolCalls(res.toolCalls)},
+		Done:          true,
+		DoneReason:    res.doneReason(),
+		OllamaMetrics: res.metrics(),
+	}
+	if !stream {
+		final.Message.Content = res.content
+	} else if len(final.Message.ToolCalls) > 0 {
+		// 与 Ollama 一致，流式响应的工具调用在结束前单独的一行中返回
+		if err := emit(&model.OllamaChatResponse{Model: req.Model, CreatedAt: final.CreatedAt, Message: final.Message}); err != nil {
+			return err
+		}
+		final.Message.ToolCalls = nil
+	}
+	return emit(final)
+}
+
+// Generate 处理 /api/generate，emit 的调用方式与 Chat 相同。
+// 设置了 suffix 的请求按代码补全处理，只返回 prompt 和 suffix 之间的内容。
+func (s *OllamaService) Generate(ctx context.Context, client *model.Client, req *model.OllamaGenerateRequest, emit func(*model.OllamaGenerateResponse) error) error {
+	stream := req.Stream == nil || *req.Stream
+	if req.Prompt == "" && req.Suffix == "" && len(req.Images) == 0 {
+		return emit(&model.OllamaGenerateResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Done:       true,
+			DoneReason: "load",
+		})
+	}
+
+	chatReq, err := ollamaChatRequest(req.Model, req.Options, req.Format, stream)
+	if err != nil {
+		return err
+	}
+	if req.System != "" {
+		chatReq.Messages = append(chatReq.Messages, model.Message{Role: "system", Content: req.System})
+	}
+	prompt := req.Prompt
+	if req.Suffix != "" {
+		prompt = fillInMiddlePrompt(req.Prompt, req.Suffix)
+	}
+	content, err := ollamaUserContent(prompt, req.Images)
+	if err != nil {
+		return err
+	}
+	chatReq.Messages = append(chatReq.Messages, model.Message{Role: "user", Content: content})
+
+	res, err := s.complete(ctx, client, chatReq, func(delta string) error {
+		return emit(&model.OllamaGenerateResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Response: delta})
+	})
+	if err != nil {
+		return err
+	}
+
+	final := &model.OllamaGenerateResponse{
+		Model:         req.Model,
+		CreatedAt:     time.Now().UTC(),
+		Done:          true,
+		DoneReason:    res.doneReason(),
+		OllamaMetrics: res.metrics(),
+	}
+	if !stream {
+		final.Response = res.content
+	}
+	return emit(final)
+}
+
+// complete 对转换后的聊天请求应用客户端的请求策略后执行。流式请求把每段内容交给 onDelta，非流式请求返回完整内容。
+func (s *OllamaService) complete(ctx context.Context, client *model.Client, req *model.ChatCompletionRequest, onDelta func(string) error) (*ollamaResult, error) {
+	s.policy.ApplyChat(client, req)
+	res := &ollamaResult{start: time.Now()}
+	if !req.Stream {
+		resp, err := s.genai.NonStreamChat(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		completion, ok := resp.(*model.OpenAICompletionResponse)
+		if !ok {
+			return nil, fmt.Errorf("未知的响应类型 %T", resp)
+		}
+		res.firstToken = time.Now()
+		res.usage = completion.Usage
+		if len(completion.Choices) > 0 {
+			choice := completion.Choices[0]
+			res.content, _ = choice.Message.Content.(string)
+			res.toolCalls = choice.Message.ToolCalls
+			res.finishReason = choice.FinishReason
+		}
+		return res, nil
+	}
+
+	w := &sseDataWriter{onData: func(data []byte) error {
+		var chunk chatStreamChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			logger.Warn("忽略无法解析的流式 chunk: %v", err)
+			return nil
+		}
+		if chunk.Usage != nil {
+			res.usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if reason := finishReasonOf(choice); reason != "" {
+				res.finishReason = reason
+			}
+			res.toolCalls = mergeToolCallDeltas(res.toolCalls, choice.Delta.ToolCalls)
+			if choice.Delta.Content == "" {
+				continue
+			}
+			if res.firstToken.IsZero() {
+				res.firstToken = time.Now()
+			}
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	if err := s.genai.StreamChat(ctx, w, req); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Embed 处理 /api/embed，使用 Gemini 的 batchEmbedContents 计算向量。
+// 与 Ollama 一致，返回的向量经过 L2 归一化。
+func (s *OllamaService) Embed(ctx context.Context, req *model.OllamaEmbedRequest) (*model.OllamaEmbedResponse, error) {
+	start := time.Now()
+	inputs, err := embedInputs(req.Input)
+	if err != nil {
+		return nil, err
+	}
+	responseMetaFrom(ctx).ServedModel = req.Model
+
+	resp := &model.OllamaEmbedResponse{Model: req.Model, Embeddings: make([][]float64, 0, len(inputs))}
+	for offset := 0; offset < len(inputs); offset += maxEmbedBatch {
+		batch := inputs[offset:min(offset+maxEmbedBatch, len(inputs))]
+		requests := make([]map[string]interface{}, len(batch))
+		for i, text := range batch {
+			r := map[string]interface{}{
+				"model":   "models/" + req.Model,
+				"content": map[string]interface{}{"parts": []map[string]string{{"text": text}}},
+			}
+			if req.Dimensions > 0 {
+				r["outputDimensionality"] = req.Dimensions
+			}
+			requests[i] = r
+		}
+		body, err := json.Marshal(map[string]interface{}{"requests": requests})
+		if err != nil {
+			return nil, fmt.Errorf("序列化请求体失败: %w", err)
+		}
+
+		respBody, _, err := s.genai.geminiUnary(ctx, "Gemini BatchEmbedContents", req.Model, "batchEmbedContents", body)
+		if err != nil {
+			return nil, err
+		}
+		var parsed struct {
+			Embeddings []struct {
+				Values []float64 `json:"values"`
+			} `json:"embeddings"`
+		}
+		if err := json.Unmarshal(respBody, &parsed); err != nil {
+			return nil, fmt.Errorf("解析 batchEmbedContents 响应失败: %w", err)
+		}
+		if len(parsed.Embeddings) != len(batch) {
+			return nil, fmt.Errorf("batchEmbedContents 返回了 %d 个向量，期望 %d 个", len(parsed.Embeddings), len(batch))
+		}
+		for _, e := range parsed.Embeddings {
+			resp.Embeddings = append(resp.Embeddings, normalizeVector(e.Values))
+		}
+	}
+	resp.TotalDuration = time.Since(start).Nanoseconds()
+	return resp, nil
+}
+
+// ollamaChatRequest 根据 Ollama 的 options 和 format 构造 OpenAI 兼容的聊天请求 (不含消息)
+func ollamaChatRequest(modelName string, opts model.OllamaOptions, format json.RawMessage, stream bool) (*model.ChatCompletionRequest, error) {
+	req := &model.ChatCompletionRequest{Model: modelName, Stream: stream}
+	if opts.Temperature != nil {
+		req.Temperature = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		req.TopP = *opts.TopP
+	}
+	if opts.NumPredict > 0 {
+		req.MaxTokens = opts.NumPredict
+	}
+	if len(opts.Stop) > 0 {
+		req.Stop = opts.Stop
+	}
+
+	trimmed := strings.TrimSpace(string(format))
+	switch {
+	case trimmed == "" || trimmed == "null" || trimmed == `""`:
+	case trimmed == `"json"`:
+		req.ResponseFormat = map[string]string{"type": "json_object"}
+	case strings.HasPrefix(trimmed, "{"):
+		req.ResponseFormat = map[string]interface{}{
+			"type":        "json_schema",
+			"json_schema": map[string]interface{}{"name": "response", "schema": format},
+		}
+	default:
+		return nil, &OllamaRequestError{Message: "format 必须是 \"json\" 或 JSON Schema 对象"}
+	}
+	return req, nil
+}
+
+// ollamaMessages 将 Ollama 的消息转换为 OpenAI 格式。
+// Ollama 的工具调用没有 id，这里按顺序生成 id，并按函数名把 tool 消息对应到之前的调用。
+func ollamaMessages(messages []model.OllamaMessage) ([]model.Message, error) {
+	out := make([]model.Message, 0, len(messages))
+	var pending []model.ToolCall // 还没有收到结果的工具调用
+	calls := 0
+	for _, m := range messages {
+		msg := model.Message{Role: m.Role, Content: m.Content}
+		switch m.Role {
+		case "assistant":
+			for _, call := range m.ToolCalls {
+				args := string(call.Function.Arguments)
+				if args == "" {
+					args = "{}"
+				}
+				calls++
+				tc := model.ToolCall{
+					ID:       fmt.Sprintf("call_%d", calls),
+					Type:     "function",
+					Function: model.FunctionCall{Name: call.Function.Name, Arguments: args},
+				}
+				msg.ToolCalls = append(msg.ToolCalls, tc)
+				pending = append(pending, tc)
+			}
+			if len(msg.ToolCalls) > 0 && m.Content == "" {
+				msg.Content = nil
+			}
+		case "tool":
+			for i, call := range pending {
+				if m.ToolName == "" || call.Function.Name == m.ToolName {
+					msg.ToolCallID = call.ID
+					pending = append(pending[:i:i], pending[i+1:]...)
+					break
+				}
+			}
+		}
+		if len(m.Images) > 0 {
+			content, err := ollamaUserContent(m.Content, m.Images)
+			if err != nil {
+				return nil, err
+			}
+			msg.Content = content
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// ollamaUserContent 把文本和 base64 图片组合成 OpenAI 格式的多模态内容，没有图片时直接返回文本
+func ollamaUserContent(text string, images []string) (interface{}, error) {
+	if len(images) == 0 {
+		return text, nil
+	}
+	parts := make([]interface{}, 0, len(images)+1)
+	if text != "" {
+		parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+	}
+	for i, img := range images {
+		url := img
+		if !strings.HasPrefix(img, "data:") {
+			data, err := base64.StdEncoding.DecodeString(img)
+			if err != nil {
+				return nil, &OllamaRequestError{Message: fmt.Sprintf("第 %d 张图片不是有效的 base64 数据", i+1)}
+			}
+			mimeType := http.DetectContentType(data)
+			if !strings.HasPrefix(mimeType, "image/") {
+				return nil, &OllamaRequestError{Message: fmt.Sprintf("第 %d 张图片的格式无法识别 (%s)", i+1, mimeType)}
+			}
+			url = dataURL(mimeType, data)
+		}
+		parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": url}})
+	}
+	return parts, nil
+}
+
+// ollamaToolCalls 将 OpenAI 格式的工具调用转换为 Ollama 格式 (arguments 为 JSON 对象)
+func ollamaToolCalls(calls []model.ToolCall) []model.OllamaToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	out := make([]model.OllamaToolCall, 0, len(calls))
+	for _, call := range calls {
+		args := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(args) {
+			args = json.RawMessage("{}")
+		}
+		out = append(out, model.OllamaToolCall{Function: model.OllamaFunctionCall{Name: call.Function.Name, Arguments: args}})
+	}
+	return out
+}
+
+// fillInMiddlePrompt 把代码补全 (fill-in-the-middle) 请求转换为对话模型能理解的提示词
+func fillInMiddlePrompt(prefix, suffix string) string {
+	return "Complete the missing code between <prefix> and <suffix>. " +
+		"Reply with only the missing middle part, without explanations, code fences or repeating the prefix or suffix.\n\n" +
+		"<prefix>" + prefix + "</prefix>\n<suffix>" + suffix + "</suffix>"
+}
+
+// embedInputs 解析 /api/embed 的 input (字符串或字符串数组)
+func embedInputs(raw json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if single == "" {
+			return nil, &OllamaRequestError{Message: "input 不能为空"}
+		}
+		return []string{single}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, &OllamaRequestError{Message: "input 必须是字符串或字符串数组"}
+	}
+	if len(list) == 0 {
+		return nil, &OllamaRequestError{Message: "input 不能为空"}
+	}
+	return list, nil
+}
+
+// normalizeVector 返回 L2 归一化后的向量
+func normalizeVector(v []float64) []float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := math.Sqrt(sum)
+	out := make([]float64, len(v))
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
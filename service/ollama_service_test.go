@@ -0,0 +1,346 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/model"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestOllamaService 创建 OllamaService，上游是一个 OpenAI 兼容的替身: 流式请求依次返回 events 中的 SSE data，
+// 非流式请求返回 completion
+func newTestOllamaService(t *testing.T, events []string, completion string) (*OllamaService, func() []recordedRequest) {
+	t.Helper()
+	upstream, requests := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req model.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream {
+			w.Write([]byte(completion))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range events {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	key := model.APIKey{ID: 1, Provider: model.ProviderOpenAI, Key: "sk-upstream", BaseURL: upstream.URL, Models: "gemini-*"}
+	genai := newTestGenAIService(t, key)
+	return NewOllamaService(genai, NewPolicyEngine(genai.configManager)), requests
+}
+
+func TestOllamaChatRequest(t *testing.T) {
+	temperature, topP := 0.2, 0.9
+	tests := []struct {
+		name    string
+		opts    model.OllamaOptions
+		format  string
+		want    model.ChatCompletionRequest
+		wantErr bool
+	}{
+		{name: "no options", want: model.ChatCompletionRequest{Model: "m", Stream: true}},
+		{
+			name: "sampling options",
+			opts: model.OllamaOptions{Temperature: &temperature, TopP: &topP, NumPredict: 64, Stop: []string{"\n\n"}},
+			want: model.ChatCompletionRequest{Model: "m", Stream: true, Temperature: 0.2, TopP: 0.9, MaxTokens: 64, Stop: []string{"\n\n"}},
+		},
+		{name: "unlimited num_predict", opts: model.OllamaOptions{NumPredict: -1}, want: model.ChatCompletionRequest{Model: "m", Stream: true}},
+		{name: "empty format", format: `""`, want: model.ChatCompletionRequest{Model: "m", Stream: true}},
+		{name: "json format", format: `"json"`, want: model.ChatCompletionRequest{Model: "m", Stream: true, ResponseFormat: map[string]string{"type": "json_object"}}},
+		{
+			name:   "schema format",
+			format: `{"type":"object"}`,
+			want: model.ChatCompletionRequest{Model: "m", Stream: true, ResponseFormat: map[string]interface{}{
+				"type":        "json_schema",
+				"json_schema": map[string]interface{}{"name": "response", "schema": json.RawMessage(`{"type":"object"}`)},
+			}},
+		},
+		{name: "unknown format", format: `"yaml"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ollamaChatRequest("m", tt.opts, json.RawMessage(tt.format), true)
+			if tt.wantErr {
+				var reqErr *OllamaRequestError
+				if !errors.As(err, &reqErr) {
+					t.Fatalf("error = %v, want an OllamaRequestError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOllamaMessages(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	messages := []model.OllamaMessage{
+		{Role: "user", Content: "weather in Paris and Rome?", Images: []string{png}},
+		{Role: "assistant", ToolCalls: []model.OllamaToolCall{
+			{Function: model.OllamaFunctionCall{Name: "weather", Arguments: json.RawMessage(`{"city":"Paris"}`)}},
+			{Function: model.OllamaFunctionCall{Name: "time"}},
+		}},
+		// 按函数名对应到调用，而不是按顺序
+		{Role: "tool", ToolName: "time", Content: "12:00"},
+		{Role: "tool", Content: "sunny"},
+	}
+	got, err := ollamaMessages(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts, ok := got[0].Content.([]interface{})
+	if !ok || len(parts) != 2 {
+		t.Fatalf("user content = %#v, want a text part and an image part", got[0].Content)
+	}
+	image := parts[1].(map[string]interface{})["image_url"].(map[string]string)["url"]
+	if !strings.HasPrefix(image, "data:image/png;base64,") {
+		t.Errorf("image url = %q, want a PNG data URL", image)
+	}
+
+	wantCalls := []model.ToolCall{
+		{ID: "call_1", Type: "function", Function: model.FunctionCall{Name: "weather", Arguments: `{"city":"Paris"}`}},
+		{ID: "call_2", Type: "function", Function: model.FunctionCall{Name: "time", Arguments: "{}"}},
+	}
+	if !reflect.DeepEqual(got[1].ToolCalls, wantCalls) || got[1].Content != nil {
+		t.Errorf("assistant message = %+v, want tool calls %+v and null content", got[1], wantCalls)
+	}
+	if got[2].ToolCallID != "call_2" || got[3].ToolCallID != "call_1" {
+		t.Errorf("tool call ids = %q, %q; want call_2, call_1", got[2].ToolCallID, got[3].ToolCallID)
+	}
+
+	for _, images := range [][]string{{"not base64!"}, {base64.StdEncoding.EncodeToString([]byte("plain text"))}} {
+		var reqErr *OllamaRequestError
+		if _, err := ollamaMessages([]model.OllamaMessage{{Role: "user", Images: images}}); !errors.As(err, &reqErr) {
+			t.Errorf("images %v: error = %v, want an OllamaRequestError", images, err)
+		}
+	}
+}
+
+func TestOllamaToolCalls(t *testing.T) {
+	got := ollamaToolCalls([]model.ToolCall{
+		{ID: "call_1", Type: "function", Function: model.FunctionCall{Name: "weather", Arguments: `{"city":"Paris"}`}},
+		{ID: "call_2", Type: "function", Function: model.FunctionCall{Name: "broken", Arguments: `{"city":`}},
+	})
+	want := []model.OllamaToolCall{
+		{Function: model.OllamaFunctionCall{Name: "weather", Arguments: json.RawMessage(`{"city":"Paris"}`)}},
+		{Function: model.OllamaFunctionCall{Name: "broken", Arguments: json.RawMessage(`{}`)}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if ollamaToolCalls(nil) != nil {
+		t.Error("no tool calls should stay nil so the field is omitted")
+	}
+}
+
+func TestEmbedInputs(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{raw: `"hello"`, want: []string{"hello"}},
+		{raw: `["a","b"]`, want: []string{"a", "b"}},
+		{raw: `""`, wantErr: true},
+		{raw: `[]`, wantErr: true},
+		{raw: `42`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := embedInputs(json.RawMessage(tt.raw))
+		if tt.wantErr {
+			var reqErr *OllamaRequestError
+			if !errors.As(err, &reqErr) {
+				t.Errorf("embedInputs(%s) error = %v, want an OllamaRequestError", tt.raw, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("embedInputs(%s) = %v, %v; want %v", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestOllamaChatStream(t *testing.T) {
+	s, requests := newTestOllamaService(t, []string{
+		`{"id":"c","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		`{"id":"c","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`{"id":"c","choices":[{"index":0,"delta":{"tool_calls":[{"id":"call_a","type":"function","function":{"name":"weather","arguments":"{\"city\":"}}]}}]}`,
+		`{"id":"c","choices":[{"index":0,"delta":{"tool_calls":[{"function":{"arguments":"\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`,
+		`{"id":"c","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":5,"total_tokens":12}}`,
+	}, "")
+
+	var lines []*model.OllamaChatResponse
+	err := s.Chat(context.Background(), nil, &model.OllamaChatRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []model.OllamaMessage{{Role: "user", Content: "hi"}},
+		Options:  model.OllamaOptions{NumPredict: 32},
+	}, func(resp *model.OllamaChatResponse) error {
+		lines = append(lines, resp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].body["stream"] != true || sent[0].body["max_tokens"] != float64(32) {
+		t.Fatalf("upstream requests = %+v, want one streaming request with max_tokens 32", sent)
+	}
+	// 每段内容一行，工具调用单独一行，最后是 done=true 且不带内容的统计行
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4: %+v", len(lines), lines)
+	}
+	if lines[0].Message.Content != "Hel" || lines[1].Message.Content != "lo" || lines[0].Done || lines[1].Done {
+		t.Errorf("content lines = %+v, %+v", lines[0], lines[1])
+	}
+	wantCalls := []model.OllamaToolCall{{Function: model.OllamaFunctionCall{Name: "weather", Arguments: json.RawMessage(`{"city":"Paris"}`)}}}
+	if lines[2].Done || !reflect.DeepEqual(lines[2].Message.ToolCalls, wantCalls) {
+		t.Errorf("tool call line = %+v, want %+v", lines[2], wantCalls)
+	}
+	final := lines[3]
+	if !final.Done || final.DoneReason != "stop" || final.Message.Content != "" || final.Message.ToolCalls != nil {
+		t.Errorf("final line = %+v, want done with reason stop and no content", final)
+	}
+	if final.PromptEvalCount != 7 || final.EvalCount != 5 || final.TotalDuration <= 0 {
+		t.Errorf("final metrics = %+v", final.OllamaMetrics)
+	}
+	for _, line := range lines {
+		if line.Model != "gemini-2.5-flash" || line.Message.Role != "assistant" {
+			t.Errorf("line = %+v, want the requested model and the assistant role", line)
+		}
+	}
+}
+
+func TestOllamaGenerate(t *testing.T) {
+	stream := false
+	completion := `{"id":"c","choices":[{"index":0,"message":{"role":"assistant","content":"return a + b"},"finish_reason":"length"}],"usage":{"prompt_tokens":20,"completion_tokens":4,"total_tokens":24}}`
+	s, requests := newTestOllamaService(t, nil, completion)
+
+	var lines []*model.OllamaGenerateResponse
+	err := s.Generate(context.Background(), nil, &model.OllamaGenerateRequest{
+		Model:  "gemini-2.5-flash",
+		Prompt: "def add(a, b):\n    ",
+		Suffix: "\n\nprint(add(1, 2))",
+		System: "You write Python.",
+		Format: json.RawMessage(`"json"`),
+		Stream: &stream,
+	}, func(resp *model.OllamaGenerateResponse) error {
+		lines = append(lines, resp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 1 || !lines[0].Done || lines[0].Response != "return a + b" || lines[0].DoneReason != "length" || lines[0].EvalCount != 4 {
+		t.Fatalf("responses = %+v, want a single done response with the full text", lines)
+	}
+	sent := requests()
+	if len(sent) != 1 {
+		t.Fatalf("upstream received %d requests, want 1", len(sent))
+	}
+	body := sent[0].body
+	messages, _ := body["messages"].([]interface{})
+	if body["stream"] != false || len(messages) != 2 {
+		t.Fatalf("request = %v, want a non-streaming request with a system and a user message", body)
+	}
+	system, user := messages[0].(map[string]interface{}), messages[1].(map[string]interface{})
+	if system["role"] != "system" || system["content"] != "You write Python." {
+		t.Errorf("system message = %v", system)
+	}
+	if content, _ := user["content"].(string); !strings.Contains(content, "<prefix>def add(a, b):\n    </prefix>") || !strings.Contains(content, "<suffix>\n\nprint(add(1, 2))</suffix>") {
+		t.Errorf("user message = %v, want a fill-in-the-middle prompt", user)
+	}
+	if format, _ := body["response_format"].(map[string]interface{}); format["type"] != "json_object" {
+		t.Errorf("response_format = %v, want json_object", body["response_format"])
+	}
+}
+
+func TestOllamaLoadRequests(t *testing.T) {
+	s, requests := newTestOllamaService(t, nil, "")
+	var chat []*model.OllamaChatResponse
+	if err := s.Chat(context.Background(), nil, &model.OllamaChatRequest{Model: "gemini-2.5-flash"}, func(resp *model.OllamaChatResponse) error {
+		chat = append(chat, resp)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var generate []*model.OllamaGenerateResponse
+	if err := s.Generate(context.Background(), nil, &model.OllamaGenerateRequest{Model: "gemini-2.5-flash"}, func(resp *model.OllamaGenerateResponse) error {
+		generate = append(generate, resp)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(chat) != 1 || !chat[0].Done || chat[0].DoneReason != "load" || len(generate) != 1 || !generate[0].Done || generate[0].DoneReason != "load" {
+		t.Errorf("load responses = %+v, %+v; want a single done line with reason load", chat, generate)
+	}
+	if n := len(requests()); n != 0 {
+		t.Errorf("load requests reached the upstream %d times", n)
+	}
+}
+
+func TestOllamaEmbed(t *testing.T) {
+	genai, requests := newAIStudioTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Requests []json.RawMessage `json:"requests"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		embeddings := make([]map[string][]float64, len(req.Requests))
+		for i := range embeddings {
+			embeddings[i] = map[string][]float64{"values": {3, 4}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"embeddings": embeddings})
+	})
+	s := NewOllamaService(genai, NewPolicyEngine(genai.configManager))
+
+	inputs := make([]string, maxEmbedBatch+1)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("text %d", i)
+	}
+	raw, _ := json.Marshal(inputs)
+	resp, err := s.Embed(context.Background(), &model.OllamaEmbedRequest{Model: "gemini-embedding-001", Input: raw, Dimensions: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过单次上限的输入拆分为多个 batchEmbedContents 请求
+	sent := requests()
+	if len(sent) != 2 {
+		t.Fatalf("upstream received %d requests, want 2", len(sent))
+	}
+	if sent[0].path != "/v1beta/models/gemini-embedding-001:batchEmbedContents" {
+		t.Errorf("path = %s", sent[0].path)
+	}
+	first := sent[0].body["requests"].([]interface{})
+	if len(first) != maxEmbedBatch || len(sent[1].body["requests"].([]interface{})) != 1 {
+		t.Errorf("batch sizes = %d, %d; want %d, 1", len(first), len(sent[1].body["requests"].([]interface{})), maxEmbedBatch)
+	}
+	if r := first[0].(map[string]interface{}); r["model"] != "models/gemini-embedding-001" || r["outputDimensionality"] != float64(256) {
+		t.Errorf("embed request = %v", r)
+	}
+
+	// 向量按 Ollama 的方式做 L2 归一化
+	if resp.Model != "gemini-embedding-001" || len(resp.Embeddings) != len(inputs) {
+		t.Fatalf("got %d embeddings for model %s, want %d", len(resp.Embeddings), resp.Model, len(inputs))
+	}
+	if v := resp.Embeddings[0]; math.Abs(v[0]-0.6) > 1e-9 || math.Abs(v[1]-0.8) > 1e-9 {
+		t.Errorf("embedding = %v, want [0.6 0.8]", v)
+	}
+	if got := normalizeVector([]float64{0, 0}); !reflect.DeepEqual(got, []float64{0, 0}) {
+		t.Errorf("zero vector normalized to %v", got)
+	}
+}
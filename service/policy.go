@@ -0,0 +1,341 @@
+// service/policy.go
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"strings"
+)
+
+// PolicyEngine 在请求转发到上游之前应用管理员在设置页面配置的请求策略:
+// 注入默认 safetySettings、在系统提示词前加上全局或客户端的提示词、限制 max_tokens 和 temperature、移除不允许的工具。
+// 策略每次都从 config.Manager 读取，修改设置后立即对新请求生效。请求体大小上限由 middleware.BodyLimitMiddleware 执行。
+type PolicyEngine struct {
+	configManager *config.Manager
+}
+
+func NewPolicyEngine(manager *config.Manager) *PolicyEngine {
+	return &PolicyEngine{configManager: manager}
+}
+
+// ApplyChat 对 OpenAI chat/completions 请求应用策略。
+// OpenAI 兼容的上游不接受 safetySettings，默认安全设置只作用于 Gemini 原生接口。
+func (p *PolicyEngine) ApplyChat(client *model.Client, req *model.ChatCompletionRequest) {
+	cfg := p.configManager.Get()
+	if prompt := policySystemPrompt(cfg, client); prompt != "" {
+		req.Messages = append([]model.Message{{Role: "system", Content: prompt}}, req.Messages...)
+	}
+	if limit := cfg.PolicyMaxOutputTokens; limit > 0 && (req.MaxTokens <= 0 || req.MaxTokens > limit) {
+		req.MaxTokens = limit
+	}
+	if limit := cfg.PolicyMaxTemperature; limit >= 0 && req.Temperature > limit {
+		req.Temperature = limit
+	}
+
+	disallowed := disallowedTools(cfg)
+	if req.WebSearchOptions != nil && disallowed["googlesearch"] {
+		logger.Info("[请求策略] 移除不允许的工具: web_search_options")
+		req.WebSearchOptions = nil
+	}
+	if len(disallowed) == 0 || len(req.Tools) == 0 {
+		return
+	}
+	tools := req.Tools[:0:0]
+	for _, tool := range req.Tools {
+		if disallowed[normalizeToolName(tool.Type)] {
+			logger.Info("[请求策略] 移除不允许的工具: %s", tool.Type)
+			continue
+		}
+		tools = append(tools, tool)
+	}
+	req.Tools = tools
+	if len(tools) == 0 {
+		req.Tools, req.ToolChoice = nil, nil
+	}
+}
+
+// ApplyCompletion 对旧版 /v1/completions 请求应用策略: 系统提示词 (放在补全请求的 systemInstruction 中) 和参数上限
+func (p *PolicyEngine) ApplyCompletion(client *model.Client, req *model.CompletionRequest) {
+	cfg := p.configManager.Get()
+	req.SystemPrompt = policySystemPrompt(cfg, client)
+	if limit := cfg.PolicyMaxOutputTokens; limit > 0 && (req.MaxTokens <= 0 || req.MaxTokens > limit) {
+		req.MaxTokens = limit
+	}
+	if limit := cfg.PolicyMaxTemperature; limit >= 0 && req.Temperature != nil && *req.Temperature > limit {
+		req.Temperature = &limit
+	}
+}
+
+// ApplyGemini 对发往 modelName 的 Gemini 原生 generateContent 请求体应用策略，返回改写后的请求体。
+// 除请求策略外还执行该模型的思考预算 (THINKING_BUDGETS)，与 OpenAI 兼容接口一致。
+// 请求体不是合法的 JSON 对象时原样返回，由上游报告错误。
+func (p *PolicyEngine) ApplyGemini(client *model.Client, modelName string, body []byte) []byte {
+	cfg := p.configManager.Get()
+	if !geminiPolicyActive(cfg, client, modelName, true) {
+		return body
+	}
+
+	var payload map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil || payload == nil {
+		return body
+	}
+	applyGeminiPolicy(cfg, client, modelName, payload, true)
+
+	rewritten, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn("[请求策略] 序列化请求体失败，按原样转发: %v", err)
+		return body
+	}
+	return rewritten
+}
+
+// ApplyLiveSetup 对 Live API 的 setup 消息 ({"setup": {...}}) 应用策略。
+// setup 没有 safetySettings 字段，其余规则与 ApplyGemini 相同；消息无法解析时原样返回。
+func (p *PolicyEngine) ApplyLiveSetup(client *model.Client, modelName string, msg []byte) []byte {
+	cfg := p.configManager.Get()
+	if !geminiPolicyActive(cfg, client, modelName, false) {
+		return msg
+	}
+
+	var payload map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return msg
+	}
+	setup, ok := payload["setup"].(map[string]interface{})
+	if !ok {
+		return msg
+	}
+	applyGeminiPolicy(cfg, client, modelName, setup, false)
+
+	rewritten, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn("[请求策略] 序列化 Live setup 消息失败，按原样转发: %v", err)
+		return msg
+	}
+	return rewritten
+}
+
+// geminiPolicyActive 判断是否有需要应用到 Gemini 原生请求的策略，没有时可以跳过解析请求体
+func geminiPolicyActive(cfg *config.Config, client *model.Client, modelName string, safety bool) bool {
+	_, budgeted := cfg.ThinkingBudgets[modelName]
+	return (safety && len(cfg.PolicySafetySettings) > 0) || policySystemPrompt(cfg, client) != "" || budgeted ||
+		cfg.PolicyMaxOutputTokens > 0 || cfg.PolicyMaxTemperature >= 0 || len(disallowedTools(cfg)) > 0
+}
+
+// applyGeminiPolicy 在解析后的发往 modelName 的 Gemini 原生请求 (或 Live setup) 上应用策略，safety 为 false 时不注入 safetySettings
+func applyGeminiPolicy(cfg *config.Config, client *model.Client, modelName string, payload map[string]interface{}, safety bool) {
+	prompt := policySystemPrompt(cfg, client)
+	disallowed := disallowedTools(cfg)
+	budget, budgeted := cfg.ThinkingBudgets[modelName]
+
+	if safety && len(cfg.PolicySafetySettings) > 0 {
+		key := fieldName(payload, "safetySettings", "safety_settings")
+		settings, _ := payload[key].([]interface{})
+		present := make(map[string]bool)
+		for _, s := range settings {
+			if m, ok := s.(map[string]interface{}); ok {
+				category, _ := m["category"].(string)
+				present[category] = true
+			}
+		}
+		for _, d := range cfg.PolicySafetySettings {
+			if !present[d.Category] {
+				settings = append(settings, map[string]interface{}{"category": d.Category, "threshold": d.Threshold})
+			}
+		}
+		payload[key] = settings
+	}
+
+	if prompt != "" {
+		key := fieldName(payload, "systemInstruction", "system_instruction")
+		instruction, _ := payload[key].(map[string]interface{})
+		if instruction == nil {
+			instruction = make(map[string]interface{})
+		}
+		parts, _ := instruction["parts"].([]interface{})
+		instruction["parts"] = append([]interface{}{map[string]interface{}{"text": prompt}}, parts...)
+		payload[key] = instruction
+	}
+
+	if cfg.PolicyMaxOutputTokens > 0 || cfg.PolicyMaxTemperature >= 0 || budgeted {
+		key := fieldName(payload, "generationConfig", "generation_config")
+		generation, _ := payload[key].(map[string]interface{})
+		if generation == nil {
+			generation = make(map[string]interface{})
+		}
+		if limit := cfg.PolicyMaxOutputTokens; limit > 0 {
+			tokensKey := fieldName(generation, "maxOutputTokens", "max_output_tokens")
+			if current, ok := jsonNumber(generation[tokensKey]); !ok || current <= 0 || current > float64(limit) {
+				generation[tokensKey] = limit
+			}
+		}
+		if limit := cfg.PolicyMaxTemperature; limit >= 0 {
+			if current, ok := jsonNumber(generation["temperature"]); ok && current > limit {
+				generation["temperature"] = limit
+			}
+		}
+		if budgeted {
+			applyThinkingBudget(generation, budget)
+		}
+		payload[key] = generation
+	}
+
+	if len(disallowed) > 0 {
+		tools, _ := payload["tools"].([]interface{})
+		kept := tools[:0:0]
+		for _, t := range tools {
+			tool, ok := t.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for name := range tool {
+				if disallowed[normalizeToolName(name)] {
+					logger.Info("[请求策略] 移除不允许的工具: %s", name)
+					delete(tool, name)
+				}
+			}
+			if len(tool) > 0 {
+				kept = append(kept, tool)
+			}
+		}
+		if len(kept) > 0 {
+			payload["tools"] = kept
+		} else if len(tools) > 0 {
+			delete(payload, "tools")
+			delete(payload, fieldName(payload, "toolConfig", "tool_config"))
+		}
+	}
+}
+
+// applyThinkingBudget 在 generationConfig 上执行模型的思考预算，规则与 thinkingRequest 相同:
+// 请求没有指定预算时使用配置的默认预算，limit 不为 -1 时把动态预算 (-1) 或超过 limit 的预算降到 limit。
+// 请求使用 thinkingLevel 时上游不允许同时设置 thinkingBudget，不注入默认预算。
+func applyThinkingBudget(generation map[string]interface{}, limit int) {
+	key := fieldName(generation, "thinkingConfig", "thinking_config")
+	thinking, _ := generation[key].(map[string]interface{})
+	if thinking == nil {
+		thinking = make(map[string]interface{})
+	}
+	budgetKey := fieldName(thinking, "thinkingBudget", "thinking_budget")
+	current, ok := jsonNumber(thinking[budgetKey])
+	switch {
+	case !ok:
+		if thinking[fieldName(thinking, "thinkingLevel", "thinking_level")] != nil {
+			return
+		}
+	case limit < 0 || (current >= 0 && current <= float64(limit)):
+		return
+	}
+	thinking[budgetKey] = limit
+	generation[key] = thinking
+}
+
+// ApplyGeminiBatch 对 Gemini 原生 batchGenerateContent 请求体中内联的每个 generateContent 请求
+// (batch.inputConfig.requests.requests[].request) 应用 ApplyGemini，返回改写后的请求体。
+// 通过 fileName 引用的输入文件不经过本服务，无法应用策略；请求体无法解析时原样返回，由上游报告错误。
+func (p *PolicyEngine) ApplyGeminiBatch(client *model.Client, modelName string, body []byte) []byte {
+	var payload map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil || payload == nil {
+		return body
+	}
+	batch, _ := payload["batch"].(map[string]interface{})
+	if batch == nil {
+		return body
+	}
+	input, _ := batch[fieldName(batch, "inputConfig", "input_config")].(map[string]interface{})
+	if input == nil {
+		return body
+	}
+	requests, _ := input["requests"].(map[string]interface{})
+	if requests == nil {
+		return body
+	}
+	items, _ := requests["requests"].([]interface{})
+	if len(items) == 0 {
+		return body
+	}
+
+	for _, item := range items {
+		entry, ok := item.(map[string]interface{})
+		if !ok || entry["request"] == nil {
+			continue
+		}
+		request, err := json.Marshal(entry["request"])
+		if err != nil {
+			return body
+		}
+		entry["request"] = json.RawMessage(p.ApplyGemini(client, modelName, request))
+	}
+
+	rewritten, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn("[请求策略] 序列化批处理请求体失败，按原样转发: %v", err)
+		return body
+	}
+	return rewritten
+}
+
+// policySystemPrompt 返回应加在请求前面的系统提示词: 客户端配置了自己的提示词时使用客户端的，否则使用全局提示词。
+// 设置页面只能输入单行文本，提示词中的 "\n" 被转换为换行。
+func policySystemPrompt(cfg *config.Config, client *model.Client) string {
+	prompt := cfg.PolicySystemPrompt
+	if client != nil && strings.TrimSpace(client.SystemPrompt) != "" {
+		prompt = client.SystemPrompt
+	}
+	return strings.TrimSpace(strings.ReplaceAll(prompt, `\n`, "\n"))
+}
+
+// disallowedTools 返回规范化后的不允许工具集合
+func disallowedTools(cfg *config.Config) map[string]bool {
+	tools := make(map[string]bool)
+	for _, name := range strings.Split(cfg.PolicyDisallowedTools, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			tools[normalizeToolName(name)] = true
+		}
+	}
+	return tools
+}
+
+// normalizeToolName 统一工具名的写法，使 code_execution 与 codeExecution、function 与 functionDeclarations 视为同一种工具，
+// OpenAI 的 web_search、code_interpreter 视为对应的 Gemini 内置工具
+func normalizeToolName(name string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(name, "_", ""))
+	switch normalized {
+	case "function", "functions":
+		return "functiondeclarations"
+	case "websearch", "websearchpreview":
+		return "googlesearch"
+	case "codeinterpreter":
+		return "codeexecution"
+	}
+	return normalized
+}
+
+// fieldName 返回请求体中实际使用的字段名: Gemini 同时接受 camelCase 和 snake_case，请求只使用 snake_case 时沿用它
+func fieldName(m map[string]interface{}, camel, snake string) string {
+	if _, ok := m[camel]; !ok {
+		if _, ok := m[snake]; ok {
+			return snake
+		}
+	}
+	return camel
+}
+
+// jsonNumber 读取以 UseNumber 解码的数值
+func jsonNumber(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
@@ -0,0 +1,221 @@
+// service/prompt_template.go
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// HeaderPromptTemplate 告知客户端请求使用的模板和版本，格式为 "名称@版本"
+const HeaderPromptTemplate = "X-Prompt-Template"
+
+// templateVariablePattern 匹配模板中的 {{变量名}}，花括号内可以有空格
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// TemplateValidationError 表示管理员保存的模板内容无效
+type TemplateValidationError struct {
+	Message string
+}
+
+func (e *TemplateValidationError) Error() string {
+	return e.Message
+}
+
+// templateMessage 是模板中的一条消息
+type templateMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// PromptTemplates 管理数据库中带版本的提示词模板，并在聊天请求使用 template_id 时渲染出消息。
+// 修改模板只会新增版本，客户端不固定版本时总是使用最新版本，因此更新提示词不需要重新部署调用方。
+type PromptTemplates struct {
+	store *storage.TemplateStore
+}
+
+func NewPromptTemplates(store *storage.TemplateStore) *PromptTemplates {
+	return &PromptTemplates{store: store}
+}
+
+// List 返回每个模板的最新版本
+func (p *PromptTemplates) List() ([]model.PromptTemplate, error) {
+	return p.store.ListLatestTemplates()
+}
+
+// Versions 返回一个模板的所有版本，最新的在前
+func (p *PromptTemplates) Versions(name string) ([]model.PromptTemplate, error) {
+	return p.store.ListTemplateVersions(name)
+}
+
+// Save 校验模板并保存为新版本
+func (p *PromptTemplates) Save(template *model.PromptTemplate) error {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" {
+		return &TemplateValidationError{Message: "模板名称不能为空"}
+	}
+	messages, err := parseTemplateMessages(template.Messages)
+	if err != nil {
+		return err
+	}
+	defaults, err := parseTemplateDefaults(template.Variables)
+	if err != nil {
+		return err
+	}
+	for name := range defaults {
+		if !templateUsesVariable(messages, name) {
+			return &TemplateValidationError{Message: fmt.Sprintf("变量 %s 设置了默认值，但没有在消息中使用", name)}
+		}
+	}
+	if err := p.store.CreateTemplateVersion(template); err != nil {
+		return err
+	}
+	logger.Info("[提示词模板] 模板 %s 已保存为版本 %d", template.Name, template.Version)
+	return nil
+}
+
+// Delete 删除一个模板的所有版本
+func (p *PromptTemplates) Delete(name string) error {
+	return p.store.DeleteTemplate(name)
+}
+
+// Apply 在请求指定了 template_id 时渲染模板: 模板消息放在请求的 messages 之前，请求没有指定 model 时使用模板的模型。
+// 模板相关的字段随后被清空，不会转发到上游。没有使用模板时返回 nil。
+func (p *PromptTemplates) Apply(req *model.ChatCompletionRequest) (*model.PromptTemplate, error) {
+	if req.TemplateID == "" {
+		if req.TemplateVersion != 0 || req.Variables != nil {
+			return nil, &ChatRequestError{Param: "template_id", Message: "使用 template_version 或 variables 时必须指定 template_id"}
+		}
+		return nil, nil
+	}
+	template, err := p.store.GetTemplate(req.TemplateID, req.TemplateVersion)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if req.TemplateVersion > 0 {
+			return nil, &ChatRequestError{Param: "template_version", Message: fmt.Sprintf("模板 %s 没有版本 %d", req.TemplateID, req.TemplateVersion)}
+		}
+		return nil, &ChatRequestError{Param: "template_id", Message: fmt.Sprintf("模板 %s 不存在", req.TemplateID)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取提示词模板失败: %w", err)
+	}
+
+	messages, err := renderTemplate(template, req.Variables)
+	if err != nil {
+		return nil, err
+	}
+	req.Messages = append(messages, req.Messages...)
+	if req.Model == "" {
+		req.Model = template.Model
+	}
+	req.TemplateID, req.TemplateVersion, req.Variables = "", 0, nil
+	logger.Info("[提示词模板] 请求使用模板 %s 版本 %d", template.Name, template.Version)
+	return template, nil
+}
+
+// renderTemplate 用请求提供的变量和模板的默认值替换模板消息中的变量
+func renderTemplate(template *model.PromptTemplate, variables map[string]interface{}) ([]model.Message, error) {
+	messages, err := parseTemplateMessages(template.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("模板 %s 版本 %d 无效: %w", template.Name, template.Version, err)
+	}
+	defaults, err := parseTemplateDefaults(template.Variables)
+	if err != nil {
+		return nil, fmt.Errorf("模板 %s 版本 %d 无效: %w", template.Name, template.Version, err)
+	}
+
+	values := make(map[string]string, len(defaults)+len(variables))
+	for name, value := range defaults {
+		values[name] = value
+	}
+	var unknown []string
+	for name, value := range variables {
+		if !templateUsesVariable(messages, name) {
+			unknown = append(unknown, name)
+			continue
+		}
+		if s, ok := value.(string); ok {
+			values[name] = s
+		} else {
+			encoded, _ := json.Marshal(value)
+			values[name] = string(encoded)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, &ChatRequestError{Param: "variables", Message: fmt.Sprintf("模板 %s 没有变量: %s", template.Name, strings.Join(unknown, ", "))}
+	}
+
+	missing := make(map[string]bool)
+	rendered := make([]model.Message, len(messages))
+	for i, msg := range messages {
+		content := templateVariablePattern.ReplaceAllStringFunc(msg.Content, func(match string) string {
+			name := templateVariablePattern.FindStringSubmatch(match)[1]
+			value, ok := values[name]
+			if !ok {
+				missing[name] = true
+			}
+			return value
+		})
+		rendered[i] = model.Message{Role: msg.Role, Content: content}
+	}
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, &ChatRequestError{Param: "variables", Message: fmt.Sprintf("缺少模板变量: %s", strings.Join(names, ", "))}
+	}
+	return rendered, nil
+}
+
+// parseTemplateMessages 解析模板的消息数组
+func parseTemplateMessages(raw string) ([]templateMessage, error) {
+	var messages []templateMessage
+	if err := json.Unmarshal([]byte(raw), &messages); err != nil {
+		return nil, &TemplateValidationError{Message: "messages 必须是 JSON 消息数组: " + err.Error()}
+	}
+	if len(messages) == 0 {
+		return nil, &TemplateValidationError{Message: "模板至少需要一条消息"}
+	}
+	for i, msg := range messages {
+		switch msg.Role {
+		case "system", "developer", "user", "assistant":
+		default:
+			return nil, &TemplateValidationError{Message: fmt.Sprintf("第 %d 条消息的 role 必须是 system、developer、user 或 assistant", i+1)}
+		}
+	}
+	return messages, nil
+}
+
+// parseTemplateDefaults 解析变量默认值，raw 为空表示所有变量都没有默认值
+func parseTemplateDefaults(raw string) (map[string]string, error) {
+	defaults := make(map[string]string)
+	if strings.TrimSpace(raw) == "" {
+		return defaults, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &defaults); err != nil {
+		return nil, &TemplateValidationError{Message: "variables 必须是变量名到默认值 (字符串) 的 JSON 对象: " + err.Error()}
+	}
+	return defaults, nil
+}
+
+// templateUsesVariable 判断模板消息中是否使用了变量
+func templateUsesVariable(messages []templateMessage, name string) bool {
+	for _, msg := range messages {
+		for _, match := range templateVariablePattern.FindAllStringSubmatch(msg.Content, -1) {
+			if match[1] == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	template := &model.PromptTemplate{
+		Name:      "support",
+		Version:   3,
+		Messages:  `[{"role":"system","content":"You are {{ persona }} for {{product}}."},{"role":"user","content":"Context: {{context}}"}]`,
+		Variables: `{"persona":"a helpful agent"}`,
+	}
+	tests := []struct {
+		name      string
+		template  *model.PromptTemplate
+		variables map[string]interface{}
+		want      []string
+		wantParam string
+	}{
+		{
+			name:      "defaults and request values",
+			template:  template,
+			variables: map[string]interface{}{"product": "Acme", "context": "none"},
+			want:      []string{"You are a helpful agent for Acme.", "Context: none"},
+		},
+		{
+			name:      "request overrides default",
+			template:  template,
+			variables: map[string]interface{}{"persona": "a pirate", "product": "Acme", "context": "none"},
+			want:      []string{"You are a pirate for Acme.", "Context: none"},
+		},
+		{
+			name:      "non-string values are JSON encoded",
+			template:  template,
+			variables: map[string]interface{}{"product": 42, "context": map[string]interface{}{"plan": "pro"}},
+			want:      []string{"You are a helpful agent for 42.", `Context: {"plan":"pro"}`},
+		},
+		{
+			name:      "missing variable",
+			template:  template,
+			variables: map[string]interface{}{"product": "Acme"},
+			wantParam: "variables",
+		},
+		{
+			name:      "unknown variable",
+			template:  template,
+			variables: map[string]interface{}{"product": "Acme", "context": "none", "extra": "x"},
+			wantParam: "variables",
+		},
+		{
+			name:     "no variables",
+			template: &model.PromptTemplate{Name: "plain", Messages: `[{"role":"system","content":"Be brief. {not a variable}"}]`},
+			want:     []string{"Be brief. {not a variable}"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := renderTemplate(tt.template, tt.variables)
+			if tt.wantParam != "" {
+				var reqErr *ChatRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+					t.Fatalf("err = %v, want ChatRequestError on %s", err, tt.wantParam)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, msg := range messages {
+				got = append(got, msg.Content.(string))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rendered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestPromptTemplates 创建使用临时 SQLite 数据库的 PromptTemplates
+func newTestPromptTemplates(t *testing.T) *PromptTemplates {
+	t.Helper()
+	manager := newTestConfigManager(t, "DB_DRIVER", "sqlite3", "SQLITE_PATH", filepath.Join(t.TempDir(), "data.db"))
+	db, err := storage.InitDB(manager.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return NewPromptTemplates(storage.NewTemplateStore(db))
+}
+
+func TestPromptTemplatesApply(t *testing.T) {
+	templates := newTestPromptTemplates(t)
+	for _, content := range []string{"v1 {{topic}}", "v2 {{topic}}"} {
+		if err := templates.Save(&model.PromptTemplate{Name: "summary", Model: "gemini-2.5-flash", Messages: `[{"role":"system","content":"` + content + `"}]`}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := templates.Save(&model.PromptTemplate{Name: "bad", Messages: `[{"role":"system","content":"hi"}]`, Variables: `{"unused":"x"}`}); err == nil {
+		t.Error("saved a template whose default is never used")
+	}
+
+	tests := []struct {
+		name      string
+		req       model.ChatCompletionRequest
+		want      string // 第一条消息
+		version   int
+		wantParam string
+	}{
+		{name: "latest version", req: model.ChatCompletionRequest{TemplateID: "summary", Variables: map[string]interface{}{"topic": "go"}}, want: "v2 go", version: 2},
+		{name: "pinned version", req: model.ChatCompletionRequest{TemplateID: "summary", TemplateVersion: 1, Variables: map[string]interface{}{"topic": "go"}}, want: "v1 go", version: 1},
+		{name: "unknown version", req: model.ChatCompletionRequest{TemplateID: "summary", TemplateVersion: 9}, wantParam: "template_version"},
+		{name: "unknown template", req: model.ChatCompletionRequest{TemplateID: "missing"}, wantParam: "template_id"},
+		{name: "variables without template", req: model.ChatCompletionRequest{Variables: map[string]interface{}{"topic": "go"}}, wantParam: "template_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.Messages = []model.Message{{Role: "user", Content: "hello"}}
+			template, err := templates.Apply(&req)
+			if tt.wantParam != "" {
+				var reqErr *ChatRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+					t.Fatalf("err = %v, want ChatRequestError on %s", err, tt.wantParam)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if template.Version != tt.version || len(req.Messages) != 2 || req.Messages[0].Content != tt.want || req.Messages[1].Content != "hello" {
+				t.Errorf("template v%d, messages %+v", template.Version, req.Messages)
+			}
+			if req.Model != "gemini-2.5-flash" || req.TemplateID != "" || req.TemplateVersion != 0 || req.Variables != nil {
+				t.Errorf("template fields left on the request: %+v", req)
+			}
+		})
+	}
+	t.Run("no template", func(t *testing.T) {
+		req := model.ChatCompletionRequest{Model: "m"}
+		if template, err := templates.Apply(&req); template != nil || err != nil {
+			t.Errorf("Apply = %v, %v", template, err)
+		}
+	})
+}
+
+// 模板变量的值会被代入消息，必须与消息文本一样经过内容脱敏 (在线请求的 RedactionMiddleware 和批处理的 Filter 都使用 Inspect)
+func TestTemplateVariablesAreRedacted(t *testing.T) {
+	templates := newTestPromptTemplates(t)
+	if err := templates.Save(&model.PromptTemplate{Name: "reply", Messages: `[{"role":"user","content":"Reply to {{customer}} about {{order}}"}]`}); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"model":"m","template_id":"reply","variables":{"customer":"bob@example.com","order":{"id":"A1","phone":["13812345678"]}}}`
+
+	redactor := NewRedactor(newTestConfigManager(t, "REDACTION_MODE", "redact"))
+	filtered, err := redactor.Filter([]byte(body), "测试请求")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req model.ChatCompletionRequest
+	if err := json.Unmarshal(filtered, &req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := templates.Apply(&req); err != nil {
+		t.Fatal(err)
+	}
+	want := `Reply to [REDACTED:EMAIL] about {"id":"A1","phone":["[REDACTED:PHONE]"]}`
+	if got := req.Messages[0].Content; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+
+	blocking := NewRedactor(newTestConfigManager(t, "REDACTION_MODE", "block"))
+	var blocked *SensitiveContentError
+	if _, err := blocking.Filter([]byte(body), "测试请求"); !errors.As(err, &blocked) || !strings.Contains(blocked.Summary, "email×1") {
+		t.Errorf("block mode Filter error = %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+// service/provider.go
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// upstreamAPI 是一次上游调用使用的接口类型，决定哪些提供方的凭据可以处理它
+type upstreamAPI int
+
+const (
+	// apiAIStudio 是只有 Gemini API (AI Studio) 提供的接口，如模型列表、cachedContents、批处理、嵌入、Live API
+	apiAIStudio upstreamAPI = iota
+	// apiGeminiNative 是 generateContent / streamGenerateContent / countTokens，AI Studio 和 Vertex AI 都支持
+	apiGeminiNative
+	// apiOpenAIChat 是 OpenAI 兼容的 chat/completions，所有提供方都支持
+	apiOpenAIChat
+)
+
+// defaultVertexRegion 是没有指定区域的 Vertex AI 凭据使用的区域
+const defaultVertexRegion = "us-central1"
+
+// supportsAPI 判断提供方是否支持 api
+func supportsAPI(provider string, api upstreamAPI) bool {
+	switch provider {
+	case model.ProviderAIStudio:
+		return true
+	case model.ProviderVertex:
+		return api == apiGeminiNative || api == apiOpenAIChat
+	case model.ProviderOpenAI:
+		return api == apiOpenAIChat
+	}
+	return false
+}
+
+// geminiNativeAPI 返回 Gemini 原生 action 对应的接口类型
+func geminiNativeAPI(action string) upstreamAPI {
+	switch action {
+	case "generateContent", "streamGenerateContent", "countTokens":
+		return apiGeminiNative
+	}
+	return apiAIStudio
+}
+
+// servesModel 判断凭据的 Models 是否认领了 modelName，Models 为逗号分隔的模型名，支持 '*' 通配符
+func servesModel(key *model.APIKey, modelName string) bool {
+	modelName = strings.TrimPrefix(modelName, "models/")
+	for _, pattern := range strings.Split(key.Models, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if matched, err := path.Match(pattern, modelName); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// vertexBaseURL 返回 Vertex AI 凭据的接口地址，BaseURL 为空时按区域推导
+func vertexBaseURL(key *model.APIKey) string {
+	if key.BaseURL != "" {
+		return key.BaseURL
+	}
+	if key.Region == "global" {
+		return "https://aiplatform.googleapis.com"
+	}
+	return fmt.Sprintf("https://%s-aiplatform.googleapis.com", key.Region)
+}
+
+// vertexLocationURL 返回 Vertex AI 凭据所在项目和区域的资源地址
+func vertexLocationURL(key *model.APIKey) string {
+	return fmt.Sprintf("%s/v1/projects/%s/locations/%s", vertexBaseURL(key), key.Project, key.Region)
+}
+
+// authorize 按提供方为请求设置认证头，Vertex AI 凭据会在需要时换取 access token
+func (s *GenAIService) authorize(req *http.Request, key *model.APIKey) error {
+	switch key.ProviderName() {
+	case model.ProviderVertex:
+		token, err := s.vertexAccessToken(req.Context(), key)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case model.ProviderOpenAI:
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+	default:
+		req.Header.Set("X-Goog-Api-Key", key.Key)
+	}
+	return nil
+}
+
+// newOpenAIChatRequest 为凭据构造 OpenAI 兼容的 chat/completions 请求。
+// Vertex AI 的模型名需要带 "google/" 前缀；其他 OpenAI 兼容接口不认识 Gemini 专有的 extra_body，会被去掉。
+func (s *GenAIService) newOpenAIChatRequest(ctx context.Context, key *model.APIKey, body []byte) (*http.Request, error) {
+	var urlStr string
+	switch key.ProviderName() {
+	case model.ProviderVertex:
+		urlStr = vertexLocationURL(key) + "/endpoints/openapi/chat/completions"
+		rewritten, err := rewriteChatBody(body, func(req map[string]json.RawMessage) {
+			var name string
+			if json.Unmarshal(req["model"], &name) == nil && !strings.Contains(name, "/") {
+				req["model"], _ = json.Marshal("google/" + name)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		body = rewritten
+	case model.ProviderOpenAI:
+		urlStr = key.BaseURL + "/chat/completions"
+		rewritten, err := rewriteChatBody(body, func(req map[string]json.RawMessage) {
+			delete(req, "extra_body")
+		})
+		if err != nil {
+			return nil, err
+		}
+		body = rewritten
+	default:
+		urlStr = openAIChatCompletionsURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if key.ProviderName() == model.ProviderAIStudio {
+		// Google 的 OpenAI 兼容接口使用 Bearer 形式的 API Key
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+	} else if err := s.authorize(req, key); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// rewriteChatBody 在保留其他字段原样的前提下修改 chat/completions 请求体的顶层字段
+func rewriteChatBody(body []byte, edit func(map[string]json.RawMessage)) ([]byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("解析请求体失败: %w", err)
+	}
+	edit(req)
+	return json.Marshal(req)
+}
+
+// newGeminiRequest 为凭据构造 Gemini 原生的 models/{model}:{action} 请求，query 为空或以 "?" 开头
+func (s *GenAIService) newGeminiRequest(ctx context.Context, key *model.APIKey, modelName, action, query string, body []byte) (*http.Request, error) {
+	var urlStr string
+	switch key.ProviderName() {
+	case model.ProviderVertex:
+		urlStr = fmt.Sprintf("%s/publishers/google/models/%s:%s%s", vertexLocationURL(key), modelName, action, query)
+	case model.ProviderAIStudio:
+		urlStr = fmt.Sprintf("%s/models/%s:%s%s", geminiAPIBase, modelName, action, query)
+	default:
+		return nil, fmt.Errorf("%s 凭据不支持 Gemini 原生接口", key.ProviderName())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(req, key); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// NormalizeCredential 检查新凭据的字段并补全默认值:
+// Vertex AI 凭据的项目默认取服务账号的 project_id，区域默认 us-central1，Key 设为 "vertex:<client_email>/<project>/<region>"；
+// OpenAI 兼容凭据必须提供 base URL、API Key 和服务的模型。
+func NormalizeCredential(key *model.APIKey) error {
+	key.Provider = key.ProviderName()
+	key.Key = strings.TrimSpace(key.Key)
+	key.BaseURL = strings.TrimRight(strings.TrimSpace(key.BaseURL), "/")
+	key.Models = strings.TrimSpace(key.Models)
+	for _, pattern := range strings.Split(key.Models, ",") {
+		if _, err := path.Match(strings.TrimSpace(pattern), ""); err != nil {
+			return fmt.Errorf("模型匹配规则 %q 无效: %w", pattern, err)
+		}
+	}
+
+	switch key.Provider {
+	case model.ProviderAIStudio:
+		if key.Key == "" {
+			return errors.New("AI Studio 凭据需要提供 API Key")
+		}
+		key.BaseURL, key.Project, key.Region, key.Credential = "", "", "", ""
+	case model.ProviderVertex:
+		sa, _, err := parseServiceAccount(key.Credential)
+		if err != nil {
+			return err
+		}
+		if key.Project = strings.TrimSpace(key.Project); key.Project == "" {
+			key.Project = sa.ProjectID
+		}
+		if key.Project == "" {
+			return errors.New("Vertex AI 凭据需要提供项目 ID")
+		}
+		if key.Region = strings.TrimSpace(key.Region); key.Region == "" {
+			key.Region = defaultVertexRegion
+		}
+		key.Key = fmt.Sprintf("vertex:%s/%s/%s", sa.ClientEmail, key.Project, key.Region)
+	case model.ProviderOpenAI:
+		if !strings.HasPrefix(key.BaseURL, "http://") && !strings.HasPrefix(key.BaseURL, "https://") {
+			return errors.New("OpenAI 兼容凭据需要提供 http(s) 开头的 base URL")
+		}
+		if key.Key == "" {
+			return errors.New("OpenAI 兼容凭据需要提供 API Key")
+		}
+		if key.Models == "" {
+			return errors.New("OpenAI 兼容凭据需要指定服务的模型")
+		}
+		key.Project, key.Region, key.Credential = "", "", ""
+	default:
+		return fmt.Errorf("不支持的提供方 %q", key.Provider)
+	}
+	return nil
+}
+
+// ValidateCredential 检查凭据是否可用: AI Studio Key 列出 OpenAI 兼容模型，Vertex AI 换取一次 access token，
+// OpenAI 兼容接口请求 {base}/models
+func (s *GenAIService) ValidateCredential(key *model.APIKey) (bool, string) {
+	switch key.ProviderName() {
+	case model.ProviderVertex:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, _, err := s.mintVertexToken(ctx, key.Credential); err != nil {
+			return false, "Invalid: " + err.Error()
+		}
+		return true, "Valid"
+	case model.ProviderOpenAI:
+		req, err := http.NewRequest("GET", key.BaseURL+"/models", nil)
+		if err != nil {
+			return false, "Failed to create request: " + err.Error()
+		}
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, "Request failed: " + err.Error()
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return true, "Valid"
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Sprintf("Invalid (HTTP %d): %s", resp.StatusCode, string(body))
+	default:
+		return s.ValidateAPIKey(key.Key)
+	}
+}
@@ -0,0 +1,541 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestGenAIService 创建一个只使用内存缓存、池中只有 keys 的 GenAIService
+func newTestGenAIService(t *testing.T, keys ...model.APIKey) *GenAIService {
+	t.Helper()
+	manager, err := config.InitConfigManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewResponseCache(manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewKeyPool(nil, manager)
+	pool.SetKeys(keys)
+	return NewGenAIService(manager, nil, pool, cache)
+}
+
+// tokenStandIn 是 Vertex AI 服务账号 token_uri 的本地替身，用 publicKey 校验 JWT 签名后签发 access token
+type tokenStandIn struct {
+	*httptest.Server
+	publicKey *rsa.PublicKey
+	expiresIn int
+	minted    atomic.Int32
+
+	mu     sync.Mutex
+	claims map[string]interface{}
+	header map[string]string
+}
+
+func newTokenStandIn(t *testing.T, expiresIn int) *tokenStandIn {
+	ts := &tokenStandIn{expiresIn: expiresIn}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(ts.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusUnauthorized)
+			return
+		}
+		var header map[string]string
+		var claims map[string]interface{}
+		headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if json.Unmarshal(headerJSON, &header) != nil || json.Unmarshal(claimsJSON, &claims) != nil {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		ts.mu.Lock()
+		ts.header, ts.claims = header, claims
+		ts.mu.Unlock()
+		n := ts.minted.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("ya29.token-%d", n),
+			"expires_in":   ts.expiresIn,
+			"token_type":   "Bearer",
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// newServiceAccount 生成一个 token_uri 指向 tokenURI 的服务账号 JSON
+func newServiceAccount(t *testing.T, tokenURI string) (string, *rsa.PrivateKey) {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "demo-project",
+		"private_key_id": "kid-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "proxy@demo-project.iam.gserviceaccount.com",
+		"token_uri":      tokenURI,
+	})
+	return string(sa), privateKey
+}
+
+// recordedRequest 是替身服务器收到的一次请求
+type recordedRequest struct {
+	method, path, rawQuery string
+	header                 http.Header
+	body                   map[string]interface{}
+}
+
+// newRecordingServer 创建一个记录每次请求并返回 respond 结果的替身服务器，respond 仍然可以读取请求体
+func newRecordingServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, func() []recordedRequest) {
+	var mu sync.Mutex
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		rec := recordedRequest{method: r.Method, path: r.URL.Path, rawQuery: r.URL.RawQuery, header: r.Header.Clone()}
+		json.Unmarshal(raw, &rec.body)
+		mu.Lock()
+		requests = append(requests, rec)
+		mu.Unlock()
+		respond(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []recordedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]recordedRequest(nil), requests...)
+	}
+}
+
+// newVertexTestService 创建只有一个 Vertex AI 凭据的 GenAIService，Gemini 原生请求由 respond 应答
+func newVertexTestService(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) (*GenAIService, func() []recordedRequest) {
+	t.Helper()
+	tokenServer := newTokenStandIn(t, 3600)
+	credential, privateKey := newServiceAccount(t, tokenServer.URL+"/token")
+	tokenServer.publicKey = &privateKey.PublicKey
+	vertex, requests := newRecordingServer(t, respond)
+	key := model.APIKey{ID: 1, Provider: model.ProviderVertex, Credential: credential, BaseURL: vertex.URL}
+	if err := NormalizeCredential(&key); err != nil {
+		t.Fatal(err)
+	}
+	return newTestGenAIService(t, key), requests
+}
+
+// redirectTransport 把发往 Google Generative Language API 的请求转发到本地替身服务器
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = rt.target.Scheme, rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newAIStudioTestService 创建使用 AI Studio Key 的 GenAIService，发往 geminiAPIBase 的请求由 respond 应答
+func newAIStudioTestService(t *testing.T, respond func(w http.ResponseWriter, r *http.Request), keys ...model.APIKey) (*GenAIService, func() []recordedRequest) {
+	t.Helper()
+	upstream, requests := newRecordingServer(t, respond)
+	target, _ := url.Parse(upstream.URL)
+	if len(keys) == 0 {
+		keys = []model.APIKey{{ID: 1, Provider: model.ProviderAIStudio, Key: "AIza-test"}}
+	}
+	s := newTestGenAIService(t, keys...)
+	s.httpClient = &http.Client{Transport: redirectTransport{target: target}}
+	return s, requests
+}
+
+func TestMintVertexToken(t *testing.T) {
+	tokenServer := newTokenStandIn(t, 3600)
+	credential, privateKey := newServiceAccount(t, tokenServer.URL+"/token")
+	tokenServer.publicKey = &privateKey.PublicKey
+	s := newTestGenAIService(t)
+
+	token, expiresIn, err := s.mintVertexToken(context.Background(), credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "ya29.token-1" || expiresIn != time.Hour {
+		t.Fatalf("got token %q expiring in %v", token, expiresIn)
+	}
+	tokenServer.mu.Lock()
+	defer tokenServer.mu.Unlock()
+	if tokenServer.header["alg"] != "RS256" || tokenServer.header["kid"] != "kid-1" {
+		t.Errorf("JWT header = %v", tokenServer.header)
+	}
+	if tokenServer.claims["iss"] != "proxy@demo-project.iam.gserviceaccount.com" ||
+		tokenServer.claims["aud"] != tokenServer.URL+"/token" || tokenServer.claims["scope"] != vertexTokenScope {
+		t.Errorf("JWT claims = %v", tokenServer.claims)
+	}
+	iat, _ := tokenServer.claims["iat"].(float64)
+	exp, _ := tokenServer.claims["exp"].(float64)
+	if exp-iat != 3600 {
+		t.Errorf("JWT lifetime = %vs, want 3600s", exp-iat)
+	}
+}
+
+func TestMintVertexTokenErrors(t *testing.T) {
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	credential, _ := newServiceAccount(t, rejecting.URL)
+	s := newTestGenAIService(t)
+
+	_, _, err := s.mintVertexToken(context.Background(), credential)
+	upstreamErr, ok := err.(*UpstreamError)
+	if !ok || upstreamErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("rejected grant: got %v, want UpstreamError 400", err)
+	}
+
+	for name, credential := range map[string]string{
+		"not json":       "{",
+		"wrong type":     `{"type":"authorized_user","client_email":"a@b","private_key":"x"}`,
+		"missing key":    `{"type":"service_account","client_email":"a@b"}`,
+		"non-PEM secret": `{"type":"service_account","client_email":"a@b","private_key":"secret"}`,
+	} {
+		if _, _, err := s.mintVertexToken(context.Background(), credential); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestVertexAccessTokenCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiresIn  int
+		editKey    func(key *model.APIKey, other string)
+		wantMinted int32
+	}{
+		{name: "cached until expiry", expiresIn: 3600, wantMinted: 1},
+		// 有效期短于提前刷新的余量时每次都重新换取
+		{name: "expiring token", expiresIn: 60, wantMinted: 2},
+		{name: "credential replaced", expiresIn: 3600, editKey: func(key *model.APIKey, other string) { key.Credential = other }, wantMinted: 2},
+		{name: "different credential ID", expiresIn: 3600, editKey: func(key *model.APIKey, _ string) { key.ID++ }, wantMinted: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenServer := newTokenStandIn(t, tt.expiresIn)
+			credential, privateKey := newServiceAccount(t, tokenServer.URL)
+			tokenServer.publicKey = &privateKey.PublicKey
+			s := newTestGenAIService(t)
+			key := &model.APIKey{ID: 7, Provider: model.ProviderVertex, Credential: credential}
+
+			first, err := s.vertexAccessToken(context.Background(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.editKey != nil {
+				// 替换后的凭据使用同一个私钥，只是内容不同
+				var sa map[string]string
+				json.Unmarshal([]byte(credential), &sa)
+				sa["private_key_id"] = "kid-2"
+				other, _ := json.Marshal(sa)
+				tt.editKey(key, string(other))
+			}
+			second, err := s.vertexAccessToken(context.Background(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tokenServer.minted.Load(); got != tt.wantMinted {
+				t.Fatalf("minted %d tokens, want %d", got, tt.wantMinted)
+			}
+			if (first == second) != (tt.wantMinted == 1) {
+				t.Fatalf("tokens %q and %q", first, second)
+			}
+		})
+	}
+}
+
+func TestVertexUpstreamRequests(t *testing.T) {
+	tokenServer := newTokenStandIn(t, 3600)
+	credential, privateKey := newServiceAccount(t, tokenServer.URL+"/token")
+	tokenServer.publicKey = &privateKey.PublicKey
+	vertex, requests := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/chat/completions") {
+			w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"google/gemini-2.5-flash","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`))
+			return
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"hi"}]}}]}`))
+	})
+
+	key := model.APIKey{ID: 1, Provider: model.ProviderVertex, Credential: credential, BaseURL: vertex.URL, Region: " europe-west4 "}
+	if err := NormalizeCredential(&key); err != nil {
+		t.Fatal(err)
+	}
+	if key.Project != "demo-project" || key.Region != "europe-west4" || key.Key != "vertex:proxy@demo-project.iam.gserviceaccount.com/demo-project/europe-west4" {
+		t.Fatalf("normalized key = %+v", key)
+	}
+	s := newTestGenAIService(t, key)
+
+	if _, _, err := s.GenerateContent(context.Background(), "gemini-2.5-flash", []byte(`{"contents":[{"role":"user","parts":[{"text":"hello"}]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	chat := &model.ChatCompletionRequest{Model: "gemini-2.5-flash", Messages: []model.Message{{Role: "user", Content: "hello"}}}
+	if _, err := s.NonStreamChat(context.Background(), chat); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 2 {
+		t.Fatalf("vertex stand-in received %d requests, want 2", len(got))
+	}
+	if want := "/v1/projects/demo-project/locations/europe-west4/publishers/google/models/gemini-2.5-flash:generateContent"; got[0].path != want {
+		t.Errorf("generateContent path = %s, want %s", got[0].path, want)
+	}
+	if want := "/v1/projects/demo-project/locations/europe-west4/endpoints/openapi/chat/completions"; got[1].path != want {
+		t.Errorf("chat path = %s, want %s", got[1].path, want)
+	}
+	if got[1].body["model"] != "google/gemini-2.5-flash" {
+		t.Errorf("chat model = %v, want google/gemini-2.5-flash", got[1].body["model"])
+	}
+	for i, req := range got {
+		if auth := req.header.Get("Authorization"); auth != "Bearer ya29.token-1" {
+			t.Errorf("request %d Authorization = %q", i, auth)
+		}
+		if req.header.Get("X-Goog-Api-Key") != "" {
+			t.Errorf("request %d leaked X-Goog-Api-Key", i)
+		}
+	}
+	if n := tokenServer.minted.Load(); n != 1 {
+		t.Errorf("minted %d tokens for two requests, want 1", n)
+	}
+
+	if ok, msg := s.ValidateCredential(&key); !ok {
+		t.Errorf("ValidateCredential = %v, %s", ok, msg)
+	}
+}
+
+func TestOpenAICompatibleUpstream(t *testing.T) {
+	upstream, requests := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			http.Error(w, `{"error":{"message":"bad key"}}`, http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/models":
+			w.Write([]byte(`{"object":"list","data":[{"id":"gpt-4o","object":"model"}]}`))
+		case "/v1/chat/completions":
+			w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	key := model.APIKey{ID: 2, Provider: model.ProviderOpenAI, Key: " sk-test ", BaseURL: upstream.URL + "/v1/", Models: "gpt-*"}
+	if err := NormalizeCredential(&key); err != nil {
+		t.Fatal(err)
+	}
+	if key.Key != "sk-test" || key.BaseURL != upstream.URL+"/v1" {
+		t.Fatalf("normalized key = %+v", key)
+	}
+	s := newTestGenAIService(t, key)
+
+	if ok, msg := s.ValidateCredential(&key); !ok {
+		t.Fatalf("ValidateCredential = %v, %s", ok, msg)
+	}
+	bad := key
+	bad.Key = "sk-wrong"
+	if ok, msg := s.ValidateCredential(&bad); ok || !strings.Contains(msg, "401") {
+		t.Errorf("ValidateCredential with a wrong key = %v, %s", ok, msg)
+	}
+
+	raw := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hello"}],"extra_body":{"google":{"thinking_config":{"thinking_budget":0}}}}`)
+	httpReq, err := s.newOpenAIChatRequest(context.Background(), &key, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat/completions status = %d", resp.StatusCode)
+	}
+
+	got := requests()
+	if len(got) != 3 {
+		t.Fatalf("stand-in received %d requests, want 3", len(got))
+	}
+	chat := got[2]
+	if chat.method != "POST" || chat.path != "/v1/chat/completions" {
+		t.Errorf("chat request = %s %s", chat.method, chat.path)
+	}
+	if _, ok := chat.body["extra_body"]; ok {
+		t.Errorf("extra_body was forwarded: %v", chat.body)
+	}
+	if chat.body["model"] != "gpt-4o" || chat.header.Get("Content-Type") != "application/json" {
+		t.Errorf("chat body = %v, headers = %v", chat.body, chat.header)
+	}
+
+	if _, err := s.newGeminiRequest(context.Background(), &key, "gpt-4o", "generateContent", "", nil); err == nil {
+		t.Error("OpenAI-compatible credential accepted a Gemini native request")
+	}
+}
+
+func TestAIStudioRequests(t *testing.T) {
+	s := newTestGenAIService(t)
+	key := &model.APIKey{ID: 3, Key: "AIza-test"}
+
+	req, err := s.newGeminiRequest(context.Background(), key, "gemini-2.5-flash", "streamGenerateContent", "?alt=sse", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := geminiAPIBase + "/models/gemini-2.5-flash:streamGenerateContent?alt=sse"; req.URL.String() != want {
+		t.Errorf("URL = %s, want %s", req.URL, want)
+	}
+	if req.Header.Get("X-Goog-Api-Key") != "AIza-test" || req.Header.Get("Authorization") != "" {
+		t.Errorf("headers = %v", req.Header)
+	}
+
+	raw := `{"model":"gemini-2.5-flash","extra_body":{"google":{}}}`
+	req, err = s.newOpenAIChatRequest(context.Background(), key, []byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if req.URL.String() != openAIChatCompletionsURL || req.Header.Get("Authorization") != "Bearer AIza-test" || string(body) != raw {
+		t.Errorf("AI Studio chat request = %s %v %s", req.URL, req.Header, body)
+	}
+}
+
+func TestNormalizeCredential(t *testing.T) {
+	credential, _ := newServiceAccount(t, "https://oauth2.example.com/token")
+	tests := []struct {
+		name    string
+		key     model.APIKey
+		wantErr string
+		check   func(t *testing.T, key model.APIKey)
+	}{
+		{
+			name: "legacy AI Studio key",
+			key:  model.APIKey{Key: " AIza ", BaseURL: "https://ignored", Project: "p", Region: "r"},
+			check: func(t *testing.T, key model.APIKey) {
+				if key.Provider != model.ProviderAIStudio || key.Key != "AIza" || key.BaseURL != "" || key.Project != "" || key.Region != "" {
+					t.Errorf("key = %+v", key)
+				}
+			},
+		},
+		{name: "AI Studio without key", key: model.APIKey{Provider: model.ProviderAIStudio}, wantErr: "API Key"},
+		{
+			name: "Vertex defaults",
+			key:  model.APIKey{Provider: model.ProviderVertex, Credential: credential},
+			check: func(t *testing.T, key model.APIKey) {
+				if key.Project != "demo-project" || key.Region != defaultVertexRegion ||
+					key.Key != "vertex:proxy@demo-project.iam.gserviceaccount.com/demo-project/"+defaultVertexRegion {
+					t.Errorf("key = %+v", key)
+				}
+			},
+		},
+		{
+			name: "Vertex explicit project",
+			key:  model.APIKey{Provider: model.ProviderVertex, Credential: credential, Project: "other", Region: "global"},
+			check: func(t *testing.T, key model.APIKey) {
+				if key.Key != "vertex:proxy@demo-project.iam.gserviceaccount.com/other/global" {
+					t.Errorf("key = %+v", key)
+				}
+				if got := vertexBaseURL(&key); got != "https://aiplatform.googleapis.com" {
+					t.Errorf("global base URL = %s", got)
+				}
+			},
+		},
+		{name: "Vertex bad credential", key: model.APIKey{Provider: model.ProviderVertex, Credential: "{}"}, wantErr: "client_email"},
+		{name: "OpenAI without base URL", key: model.APIKey{Provider: model.ProviderOpenAI, Key: "sk", Models: "gpt-*"}, wantErr: "base URL"},
+		{name: "OpenAI without key", key: model.APIKey{Provider: model.ProviderOpenAI, BaseURL: "https://x/v1", Models: "gpt-*"}, wantErr: "API Key"},
+		{name: "OpenAI without models", key: model.APIKey{Provider: model.ProviderOpenAI, Key: "sk", BaseURL: "https://x/v1"}, wantErr: "模型"},
+		{name: "bad pattern", key: model.APIKey{Key: "AIza", Models: "gpt-["}, wantErr: "无效"},
+		{name: "unknown provider", key: model.APIKey{Provider: "azure", Key: "k"}, wantErr: "azure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			err := NormalizeCredential(&key)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, key)
+		})
+	}
+}
+
+func TestServesModel(t *testing.T) {
+	tests := []struct {
+		models, model string
+		want          bool
+	}{
+		{"gpt-*", "gpt-4o", true},
+		{"gpt-*", "models/gpt-4o", true},
+		{"gpt-*", "gemini-2.5-flash", false},
+		{"claude-3, gpt-4o ", "gpt-4o", true},
+		{"", "gpt-4o", false},
+		{"gpt-[", "gpt-4o", false},
+	}
+	for _, tt := range tests {
+		if got := servesModel(&model.APIKey{Models: tt.models}, tt.model); got != tt.want {
+			t.Errorf("servesModel(%q, %q) = %v, want %v", tt.models, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestSupportsAPI(t *testing.T) {
+	want := map[string][3]bool{
+		model.ProviderAIStudio: {true, true, true},
+		model.ProviderVertex:   {false, true, true},
+		model.ProviderOpenAI:   {false, false, true},
+		"unknown":              {false, false, false},
+	}
+	for provider, apis := range want {
+		for api, ok := range apis {
+			if got := supportsAPI(provider, upstreamAPI(api)); got != ok {
+				t.Errorf("supportsAPI(%s, %d) = %v, want %v", provider, api, got, ok)
+			}
+		}
+	}
+	if got, want := vertexLocationURL(&model.APIKey{Project: "p", Region: "us-east1"}), "https://us-east1-aiplatform.googleapis.com/v1/projects/p/locations/us-east1"; got != want {
+		t.Errorf("vertexLocationURL = %s, want %s", got, want)
+	}
+}
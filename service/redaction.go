@@ -0,0 +1,310 @@
+// service/redaction.go
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 内容脱敏模式
+const (
+	RedactionOff     = "off"
+	RedactionLogOnly = "log_only"
+	RedactionRedact  = "redact"
+	RedactionBlock   = "block"
+)
+
+// redactionDetector 是一个敏感信息检测器，valid 不为空时只有通过校验的匹配才算命中
+type redactionDetector struct {
+	name    string
+	pattern *regexp.Regexp
+	valid   func(match string) bool
+}
+
+// builtinDetectors 是内置检测器，按这个顺序依次应用: API Key 和卡号中的数字不应先被电话号码规则匹配
+var builtinDetectors = []redactionDetector{
+	{name: "api_key", pattern: regexp.MustCompile(`\b(?:sk-[A-Za-z0-9_-]{20,}|AIza[0-9A-Za-z_-]{35}|gh[pousr]_[A-Za-z0-9]{36,}|xox[abprs]-[A-Za-z0-9-]{10,}|AKIA[0-9A-Z]{16})`)},
+	{name: "email", pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{name: "credit_card", pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+	{name: "phone", pattern: regexp.MustCompile(`\+\d{1,3}[ .-]?\d{1,4}(?:[ .-]?\d{2,4}){2,4}\b|\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b|\b1[3-9]\d{9}\b`)},
+}
+
+// redactionTextFields 是请求体中被视为消息文本的字段。嵌套的对象 (如 content 中的 image_url) 按自己的字段名判断，
+// 因此 base64 数据、URL、模型名等不会被修改。
+var redactionTextFields = map[string]bool{
+	"content":      true,
+	"text":         true,
+	"prompt":       true,
+	"suffix":       true,
+	"input":        true,
+	"system":       true,
+	"instructions": true,
+	"arguments":    true,
+}
+
+// redactionVariableFields 是其中所有字符串 (包括嵌套的值) 都会被渲染进消息的字段: 提示词模板的 variables
+// 的值会被代入模板消息，变量名任意，不能按字段名判断
+var redactionVariableFields = map[string]bool{
+	"variables": true,
+}
+
+// redactionRules 是根据当前配置编译好的规则
+type redactionRules struct {
+	mode      string
+	detectors []redactionDetector
+	spec      string // 生成规则的配置，用于判断配置是否变化
+	version   uint64 // 生成规则时的配置版本
+}
+
+// RedactionResult 是对一个请求体的检测结果
+type RedactionResult struct {
+	Mode string
+	Body []byte         // redact 模式下替换后的请求体，其他模式下为原请求体
+	Hits map[string]int // 每个检测器的命中次数
+}
+
+// Summary 返回按检测器名排序的命中摘要，如 "email×2, phone×1"
+func (r *RedactionResult) Summary() string {
+	names := make([]string, 0, len(r.Hits))
+	for name := range r.Hits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "×" + strconv.Itoa(r.Hits[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Redactor 在请求转发前检查消息文本中的敏感信息 (邮箱、电话号码、信用卡号、API Key 以及自定义正则)，
+// 并为 logger 提供同样规则的日志脱敏函数。
+// 规则在配置版本变化后重新编译，请求和日志 (包括后台任务的日志) 都使用最新的规则。
+type Redactor struct {
+	configManager *config.Manager
+	mu            sync.Mutex // 保护规则的重新编译
+	rules         atomic.Pointer[redactionRules]
+}
+
+func NewRedactor(manager *config.Manager) *Redactor {
+	r := &Redactor{configManager: manager}
+	r.current()
+	return r
+}
+
+// current 返回与当前配置一致的规则。配置版本变化后比较脱敏相关的配置，只有它们变化时才重新编译。
+// 编译过程中的警告在释放锁之后输出，因为输出日志会调用 ScrubLog。
+func (r *Redactor) current() *redactionRules {
+	version := r.configManager.Version()
+	if rules := r.rules.Load(); rules != nil && rules.version == version {
+		return rules
+	}
+
+	var warnings []string
+	defer func() {
+		for _, w := range warnings {
+			logger.Warn("%s", w)
+		}
+	}()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rules := r.rules.Load(); rules != nil && rules.version == version {
+		return rules
+	}
+	cfg := r.configManager.Get()
+	spec := cfg.RedactionMode + "\x00" + cfg.RedactionDetectors + "\x00" + cfg.RedactionPatterns
+	if rules := r.rules.Load(); rules != nil && rules.spec == spec {
+		unchanged := *rules
+		unchanged.version = version
+		r.rules.Store(&unchanged)
+		return &unchanged
+	}
+	rules := &redactionRules{mode: strings.ToLower(strings.TrimSpace(cfg.RedactionMode)), spec: spec, version: version}
+	switch rules.mode {
+	case RedactionLogOnly, RedactionRedact, RedactionBlock:
+	case "", RedactionOff:
+		rules.mode = RedactionOff
+	default:
+		warnings = append(warnings, fmt.Sprintf("[内容脱敏] 未知的 REDACTION_MODE: %s，按 off 处理", cfg.RedactionMode))
+		rules.mode = RedactionOff
+	}
+	if rules.mode != RedactionOff {
+		enabled := make(map[string]bool)
+		for _, name := range strings.Split(cfg.RedactionDetectors, ",") {
+			enabled[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+		for _, d := range builtinDetectors {
+			if enabled[d.name] {
+				rules.detectors = append(rules.detectors, d)
+			}
+		}
+		for _, expr := range strings.Split(cfg.RedactionPatterns, ";;") {
+			if expr = strings.TrimSpace(expr); expr == "" {
+				continue
+			}
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("[内容脱敏] 忽略无效的正则表达式 %q: %v", expr, err))
+				continue
+			}
+			rules.detectors = append(rules.detectors, redactionDetector{name: "custom", pattern: pattern})
+		}
+	}
+	r.rules.Store(rules)
+	return rules
+}
+
+// Mode 返回当前的脱敏模式
+func (r *Redactor) Mode() string {
+	return r.current().mode
+}
+
+// ScrubLog 替换一条日志中的敏感内容，供 logger.SetScrubber 使用
+func (r *Redactor) ScrubLog(msg string) string {
+	rules := r.current()
+	if rules.mode == RedactionOff {
+		return msg
+	}
+	return rules.scrub(msg, nil)
+}
+
+// Inspect 检查 JSON 请求体中的消息文本。关闭时返回 nil；请求体不是合法 JSON 时按普通文本检查，
+// 但 redact 模式下不改写，由上游报告错误。
+func (r *Redactor) Inspect(body []byte) *RedactionResult {
+	rules := r.current()
+	if rules.mode == RedactionOff || len(rules.detectors) == 0 || len(body) == 0 {
+		return nil
+	}
+	result := &RedactionResult{Mode: rules.mode, Body: body, Hits: make(map[string]int)}
+
+	var payload interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		rules.scrub(string(body), result.Hits)
+		return result
+	}
+	payload = rules.scrubJSON(payload, false, result.Hits)
+	if rules.mode == RedactionRedact && len(result.Hits) > 0 {
+		if rewritten, err := json.Marshal(payload); err == nil {
+			result.Body = rewritten
+		} else {
+			logger.Warn("[内容脱敏] 序列化请求体失败: %v", err)
+		}
+	}
+	return result
+}
+
+// SensitiveContentError 表示 block 模式下请求中检测到了敏感信息
+type SensitiveContentError struct {
+	Summary string
+}
+
+func (e *SensitiveContentError) Error() string {
+	return "Request blocked: the prompt contains sensitive information (" + e.Summary + ")."
+}
+
+// Filter 对不经过 RedactionMiddleware 的请求 (批处理输入文件中的请求、Live 会话的消息) 应用同样的脱敏规则，
+// 返回应当转发的请求体；block 模式下检测到敏感信息时返回 SensitiveContentError。source 用于日志。
+func (r *Redactor) Filter(body []byte, source string) ([]byte, error) {
+	result := r.Inspect(body)
+	if result == nil || len(result.Hits) == 0 {
+		return body, nil
+	}
+	switch result.Mode {
+	case RedactionBlock:
+		logger.Warn("[内容脱敏] 拒绝%s: 检测到敏感信息 (%s)", source, result.Summary())
+		return nil, &SensitiveContentError{Summary: result.Summary()}
+	case RedactionRedact:
+		logger.Info("[内容脱敏] %s中的敏感信息已替换 (%s)", source, result.Summary())
+	default:
+		logger.Warn("[内容脱敏] %s中检测到敏感信息 (%s)，按原样转发", source, result.Summary())
+	}
+	return result.Body, nil
+}
+
+// scrubJSON 递归替换消息文本字段中的敏感内容。textual 表示当前值属于消息文本字段。
+func (rules *redactionRules) scrubJSON(v interface{}, textual bool, hits map[string]int) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if redactionVariableFields[k] {
+				val[k] = rules.scrubValues(child, hits)
+				continue
+			}
+			val[k] = rules.scrubJSON(child, redactionTextFields[k], hits)
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = rules.scrubJSON(child, textual, hits)
+		}
+	case string:
+		if textual {
+			return rules.scrub(val, hits)
+		}
+	}
+	return v
+}
+
+// scrubValues 递归替换 v 中所有字符串值的敏感内容，对象的键保持不变
+func (rules *redactionRules) scrubValues(v interface{}, hits map[string]int) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			val[k] = rules.scrubValues(child, hits)
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = rules.scrubValues(child, hits)
+		}
+	case string:
+		return rules.scrub(val, hits)
+	}
+	return v
+}
+
+// scrub 把文本中所有检测器命中的内容替换为 [REDACTED:检测器名]，hits 不为空时累计命中次数
+func (rules *redactionRules) scrub(text string, hits map[string]int) string {
+	for _, d := range rules.detectors {
+		placeholder := "[REDACTED:" + strings.ToUpper(d.name) + "]"
+		text = d.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			if hits != nil {
+				hits[d.name]++
+			}
+			return placeholder
+		})
+	}
+	return text
+}
+
+// luhnValid 用 Luhn 校验和判断一串数字是否可能是信用卡号
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
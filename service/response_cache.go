@@ -0,0 +1,468 @@
+// service/response_cache.go
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// 缓存命中状态，通过 X-Cache 响应头告知客户端
+const (
+	CacheHit    = "HIT"
+	CacheMiss   = "MISS"
+	CacheBypass = "BYPASS"
+)
+
+// HeaderCacheStatus 告知客户端响应是否来自缓存
+const HeaderCacheStatus = "X-Cache"
+
+// CachedResponse 是一条缓存的上游响应。流式响应保存的是完整的 SSE 文本，命中时原样回放。
+type CachedResponse struct {
+	Body        []byte
+	ServedModel string
+	ExpiresAt   time.Time
+}
+
+// CacheBackend 是响应缓存的存储后端
+type CacheBackend interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, entry *CachedResponse)
+	Purge() int
+	Len() int
+}
+
+// CachePolicy 是单个请求对缓存的要求，由客户端的 Cache-Control 请求头决定
+type CachePolicy struct {
+	NoRead  bool // no-cache: 不读缓存，但会用新的响应刷新缓存
+	NoWrite bool // no-store: 既不读也不写缓存
+}
+
+type cachePolicyKey struct{}
+
+// ParseCachePolicy 解析 Cache-Control 请求头
+func ParseCachePolicy(cacheControl string) CachePolicy {
+	var p CachePolicy
+	for _, directive := range strings.Split(strings.ToLower(cacheControl), ",") {
+		switch strings.TrimSpace(directive) {
+		case "no-cache":
+			p.NoRead = true
+		case "no-store":
+			p.NoRead = true
+			p.NoWrite = true
+		}
+	}
+	return p
+}
+
+// WithCachePolicy 将请求的缓存策略放入 context
+func WithCachePolicy(ctx context.Context, p CachePolicy) context.Context {
+	return context.WithValue(ctx, cachePolicyKey{}, p)
+}
+
+func cachePolicyFrom(ctx context.Context) CachePolicy {
+	p, _ := ctx.Value(cachePolicyKey{}).(CachePolicy)
+	return p
+}
+
+// CacheStats 用于向管理后台展示响应缓存的命中情况
+type CacheStats struct {
+	Enabled  bool    `json:"enabled"`
+	Backend  string  `json:"backend"`
+	Entries  int     `json:"entries"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Bypassed int64   `json:"bypassed"`
+	Stored   int64   `json:"stored"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+// ResponseCache 是按 "模型 + 规范化请求体" 精确匹配的响应缓存。
+// 是否启用、TTL 和大小限制都支持热重载；存储后端在启动时确定。
+type ResponseCache struct {
+	configManager *config.Manager
+	backend       CacheBackend
+	backendName   string
+
+	hits, misses, bypassed, stored atomic.Int64
+}
+
+// NewResponseCache 根据配置创建响应缓存及其存储后端
+func NewResponseCache(manager *config.Manager) (*ResponseCache, error) {
+	cfg := manager.Get()
+	c := &ResponseCache{configManager: manager, backendName: cfg.ResponseCacheBackend}
+	switch cfg.ResponseCacheBackend {
+	case "sqlite":
+		backend, err := newSQLiteCacheBackend(manager, cfg.ResponseCacheSQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		c.backend = backend
+	case "memory", "":
+		c.backendName = "memory"
+		c.backend = newMemoryCacheBackend(manager)
+	default:
+		return nil, fmt.Errorf("不支持的响应缓存后端: %s", cfg.ResponseCacheBackend)
+	}
+	return c, nil
+}
+
+// cacheKey 计算缓存键。请求体会先被规范化 (对象键排序、去除空白)，
+// 这样字段顺序不同但语义相同的请求可以命中同一条缓存。
+func cacheKey(kind, modelName string, body []byte) string {
+	canonical := body
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // 保留数字的原始精度，避免大整数被折叠
+	var v interface{}
+	if err := dec.Decode(&v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			canonical = b
+		}
+	}
+
+	h := sha256.New()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(modelName))
+	h.Write([]byte{0})
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookup 查询缓存，并在 ResponseMeta 中记录命中状态
+func (c *ResponseCache) lookup(ctx context.Context, key string) (*CachedResponse, bool) {
+	if !c.configManager.Get().ResponseCacheEnabled {
+		return nil, false
+	}
+	meta := responseMetaFrom(ctx)
+	if cachePolicyFrom(ctx).NoRead {
+		c.bypassed.Add(1)
+		meta.CacheStatus = CacheBypass
+		return nil, false
+	}
+
+	entry, ok := c.backend.Get(key)
+	if !ok {
+		c.misses.Add(1)
+		meta.CacheStatus = CacheMiss
+		return nil, false
+	}
+	c.hits.Add(1)
+	meta.CacheStatus = CacheHit
+	logger.Info("[响应缓存] 命中缓存 (%s)", key[:12])
+	return entry, true
+}
+
+// store 写入缓存。超过单条大小限制或客户端要求 no-store 时不会写入。
+func (c *ResponseCache) store(ctx context.Context, key string, body []byte, servedModel string) {
+	cfg := c.configManager.Get()
+	if !cfg.ResponseCacheEnabled || cachePolicyFrom(ctx).NoWrite {
+		return
+	}
+	if len(body) == 0 || len(body) > cfg.ResponseCacheMaxEntryBytes {
+		return
+	}
+	c.backend.Set(key, &CachedResponse{
+		Body:        body,
+		ServedModel: servedModel,
+		ExpiresAt:   time.Now().Add(cfg.ResponseCacheTTL),
+	})
+	c.stored.Add(1)
+}
+
+// Purge 清空缓存，返回删除的条目数
+func (c *ResponseCache) Purge() int {
+	return c.backend.Purge()
+}
+
+// Stats 返回缓存的命中统计
+func (c *ResponseCache) Stats() CacheStats {
+	stats := CacheStats{
+		Enabled:  c.configManager.Get().ResponseCacheEnabled,
+		Backend:  c.backendName,
+		Entries:  c.backend.Len(),
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Bypassed: c.bypassed.Load(),
+		Stored:   c.stored.Load(),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// cacheRecorder 在转发流式响应的同时记录内容，超过大小限制后停止记录
+type cacheRecorder struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (r *cacheRecorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if r.buf.Len()+len(p) > r.limit {
+			r.overflow = true
+			r.buf.Reset()
+		} else {
+			r.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// =================================================================
+// 内存后端
+// =================================================================
+
+type memoryCacheItem struct {
+	key   string
+	entry *CachedResponse
+}
+
+// memoryCacheBackend 是带条目数和总字节数上限的 LRU 缓存
+type memoryCacheBackend struct {
+	configManager *config.Manager
+
+	mu    sync.Mutex
+	lru   *list.List // 队首为最近使用
+	items map[string]*list.Element
+	bytes int
+}
+
+func newMemoryCacheBackend(manager *config.Manager) *memoryCacheBackend {
+	return &memoryCacheBackend{
+		configManager: manager,
+		lru:           list.New(),
+		items:         make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryCacheBackend) Get(key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryCacheItem)
+	if time.Now().After(item.entry.ExpiresAt) {
+		m.removeLocked(elem)
+		return nil, false
+	}
+	m.lru.MoveToFront(elem)
+	return item.entry, true
+}
+
+func (m *memoryCacheBackend) Set(key string, entry *CachedResponse) {
+	cfg := m.configManager.Get()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.items[key]; ok {
+		m.removeLocked(elem)
+	}
+	m.items[key] = m.lru.PushFront(&memoryCacheItem{key: key, entry: entry})
+	m.bytes += len(entry.Body)
+
+	for m.lru.Len() > 0 && (m.lru.Len() > cfg.ResponseCacheMaxEntries || m.bytes > cfg.ResponseCacheMaxBytes) {
+		m.removeLocked(m.lru.Back())
+	}
+}
+
+func (m *memoryCacheBackend) removeLocked(elem *list.Element) {
+	item := m.lru.Remove(elem).(*memoryCacheItem)
+	delete(m.items, item.key)
+	m.bytes -= len(item.entry.Body)
+}
+
+func (m *memoryCacheBackend) Purge() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.lru.Len()
+	m.lru.Init()
+	m.items = make(map[string]*list.Element)
+	m.bytes = 0
+	return n
+}
+
+func (m *memoryCacheBackend) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// =================================================================
+// SQLite 后端
+// =================================================================
+
+// sqliteCacheBackend 将缓存保存在独立的 SQLite 文件中，进程重启后仍然有效。
+// 过期清理和容量控制由后台协程定期执行。
+type sqliteCacheBackend struct {
+	configManager *config.Manager
+	db            *gorm.DB
+}
+
+func newSQLiteCacheBackend(manager *config.Manager, path string) (*sqliteCacheBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("创建响应缓存目录失败: %w", err)
+	}
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: gormlogger.Default.LogMode(gormlogger.Silent)})
+	if err != nil {
+		return nil, fmt.Errorf("打开响应缓存数据库失败: %w", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.SetMaxOpenConns(1)
+		sqlDB.Exec("PRAGMA journal_mode = WAL")
+		sqlDB.Exec("PRAGMA busy_timeout = 5000")
+	}
+	if err := db.AutoMigrate(&model.ResponseCacheEntry{}); err != nil {
+		return nil, fmt.Errorf("响应缓存表迁移失败: %w", err)
+	}
+
+	b := &sqliteCacheBackend{configManager: manager, db: db}
+	go b.janitor(time.Minute)
+	logger.Info("响应缓存使用 SQLite 后端: %s", path)
+	return b, nil
+}
+
+func (b *sqliteCacheBackend) Get(key string) (*CachedResponse, bool) {
+	var row model.ResponseCacheEntry
+	err := b.db.Where("`key` = ? AND expires_at > ?", key, time.Now()).First(&row).Error
+	if err != nil {
+		return nil, false
+	}
+	return &CachedResponse{Body: row.Body, ServedModel: row.ServedModel, ExpiresAt: row.ExpiresAt}, true
+}
+
+func (b *sqliteCacheBackend) Set(key string, entry *CachedResponse) {
+	row := model.ResponseCacheEntry{
+		Key:         key,
+		Body:        entry.Body,
+		ServedModel: entry.ServedModel,
+		Size:        len(entry.Body),
+		ExpiresAt:   entry.ExpiresAt,
+	}
+	if err := b.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error; err != nil {
+		logger.Warn("[响应缓存] 写入 SQLite 失败: %v", err)
+	}
+}
+
+func (b *sqliteCacheBackend) Purge() int {
+	result := b.db.Where("1 = 1").Delete(&model.ResponseCacheEntry{})
+	return int(result.RowsAffected)
+}
+
+func (b *sqliteCacheBackend) Len() int {
+	var count int64
+	b.db.Model(&model.ResponseCacheEntry{}).Count(&count)
+	return int(count)
+}
+
+// janitor 定期删除过期条目，并在超出条目数或总字节数上限时删除最旧的条目
+func (b *sqliteCacheBackend) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cfg := b.configManager.Get()
+		b.db.Where("expires_at <= ?", time.Now()).Delete(&model.ResponseCacheEntry{})
+
+		var stats struct {
+			Count int64
+			Bytes int64
+		}
+		b.db.Model(&model.ResponseCacheEntry{}).Select("COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes").Scan(&stats)
+		for stats.Count > int64(cfg.ResponseCacheMaxEntries) || stats.Bytes > int64(cfg.ResponseCacheMaxBytes) {
+			var oldest []model.ResponseCacheEntry
+			b.db.Select("`key`, size").Order("created_at ASC").Limit(100).Find(&oldest)
+			if len(oldest) == 0 {
+				break
+			}
+			keys := make([]string, 0, len(oldest))
+			for _, row := range oldest {
+				keys = append(keys, row.Key)
+				stats.Count--
+				stats.Bytes -= int64(row.Size)
+			}
+			b.db.Where("`key` IN ?", keys).Delete(&model.ResponseCacheEntry{})
+		}
+	}
+}
+
+// =================================================================
+// GenAIService 集成
+// =================================================================
+
+// cachedUnary 先查询缓存，未命中时执行 run 并将成功的响应写入缓存
+func (s *GenAIService) cachedUnary(ctx context.Context, kind, requestedModel string, reqBody []byte, run func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	ctx, meta := ensureResponseMeta(ctx)
+	key := cacheKey(kind, requestedModel, reqBody)
+	if hit, ok := s.cache.lookup(ctx, key); ok {
+		meta.RequestedModel = requestedModel
+		meta.ServedModel = hit.ServedModel
+		return hit.Body, nil
+	}
+
+	body, err := run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.store(ctx, key, body, meta.ServedModel)
+	return body, nil
+}
+
+// cachedStream 命中缓存时原样回放之前记录的 SSE 流；未命中时执行 run，
+// 并在流完整结束后将其写入缓存。run 需要把流写入 out，响应头仍通过 w 设置。
+func (s *GenAIService) cachedStream(ctx context.Context, w io.Writer, flusher http.Flusher, kind, requestedModel string, reqBody []byte, run func(ctx context.Context, out io.Writer) error) error {
+	ctx, meta := ensureResponseMeta(ctx)
+	key := cacheKey(kind, requestedModel, reqBody)
+	if hit, ok := s.cache.lookup(ctx, key); ok {
+		meta.RequestedModel = requestedModel
+		meta.ServedModel = hit.ServedModel
+		applyStreamHeaders(ctx, w)
+		if _, err := w.Write(hit.Body); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	cfg := s.configManager.Get()
+	if !cfg.ResponseCacheEnabled || cachePolicyFrom(ctx).NoWrite {
+		return run(ctx, w)
+	}
+	recorder := &cacheRecorder{limit: cfg.ResponseCacheMaxEntryBytes}
+	if err := run(ctx, io.MultiWriter(w, recorder)); err != nil {
+		return err
+	}
+	if !recorder.overflow && streamComplete(recorder.buf.Bytes()) {
+		s.cache.store(ctx, key, recorder.buf.Bytes(), meta.ServedModel)
+	}
+	return nil
+}
+
+// streamComplete 判断记录的 SSE 流是否完整: OpenAI 格式的流以 [DONE] 结束，
+// Gemini 原生流没有 [DONE]，最后一个 chunk 带有 finishReason。上游正常关闭但内容不完整的流不写入缓存。
+func streamComplete(body []byte) bool {
+	return bytes.Contains(body, []byte("data: [DONE]")) || bytes.Contains(body, []byte(`"finishReason"`))
+}
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	base := cacheKey("chat", "gemini-2.5-flash", []byte(`{"messages":[{"role":"user","content":"hi"}],"temperature":0.2}`))
+	tests := []struct {
+		name      string
+		kind      string
+		model     string
+		body      string
+		wantEqual bool
+	}{
+		{name: "same request", kind: "chat", model: "gemini-2.5-flash", body: `{"messages":[{"role":"user","content":"hi"}],"temperature":0.2}`, wantEqual: true},
+		{name: "key order", kind: "chat", model: "gemini-2.5-flash", body: `{"temperature":0.2,"messages":[{"content":"hi","role":"user"}]}`, wantEqual: true},
+		{name: "whitespace", kind: "chat", model: "gemini-2.5-flash", body: "{\n  \"messages\": [ {\"role\": \"user\", \"content\": \"hi\"} ],\n  \"temperature\": 0.2\n}", wantEqual: true},
+		{name: "different kind", kind: "chat_stream", model: "gemini-2.5-flash", body: `{"messages":[{"role":"user","content":"hi"}],"temperature":0.2}`},
+		{name: "different model", kind: "chat", model: "gemini-2.5-pro", body: `{"messages":[{"role":"user","content":"hi"}],"temperature":0.2}`},
+		{name: "different value", kind: "chat", model: "gemini-2.5-flash", body: `{"messages":[{"role":"user","content":"hi"}],"temperature":0.3}`},
+		{name: "message order matters", kind: "chat", model: "gemini-2.5-flash", body: `{"messages":[{"role":"user","content":"hi"},{"role":"user","content":"hi"}],"temperature":0.2}`},
+		{name: "kind and model do not run together", kind: "chatg", model: "emini-2.5-flash", body: `{"messages":[{"role":"user","content":"hi"}],"temperature":0.2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheKey(tt.kind, tt.model, []byte(tt.body)); (got == base) != tt.wantEqual {
+				t.Errorf("cacheKey equal = %v, want %v", got == base, tt.wantEqual)
+			}
+		})
+	}
+
+	// 大整数超出 float64 精度，规范化后仍需区分
+	if cacheKey("chat", "m", []byte(`{"seed":9007199254740993}`)) == cacheKey("chat", "m", []byte(`{"seed":9007199254740992}`)) {
+		t.Error("large integers collapsed to the same key")
+	}
+	// 无法解析的请求体按原样参与计算
+	if cacheKey("chat", "m", []byte(`not json`)) == cacheKey("chat", "m", []byte(`not  json`)) {
+		t.Error("invalid bodies should be hashed verbatim")
+	}
+}
+
+func TestParseCachePolicy(t *testing.T) {
+	tests := map[string]CachePolicy{
+		"":                        {},
+		"max-age=0":               {},
+		"no-cache":                {NoRead: true},
+		"No-Cache":                {NoRead: true},
+		"no-store":                {NoRead: true, NoWrite: true},
+		"max-age=0, no-store":     {NoRead: true, NoWrite: true},
+		" no-cache ,  no-store  ": {NoRead: true, NoWrite: true},
+	}
+	for header, want := range tests {
+		if got := ParseCachePolicy(header); got != want {
+			t.Errorf("ParseCachePolicy(%q) = %+v, want %+v", header, got, want)
+		}
+	}
+}
+
+// newTestResponseCache 创建启用的内存响应缓存，env 可覆盖默认配置
+func newTestResponseCache(t *testing.T, env ...string) *ResponseCache {
+	t.Helper()
+	c, err := NewResponseCache(newTestConfigManager(t, append([]string{"RESPONSE_CACHE_ENABLED", "true", "RESPONSE_CACHE_BACKEND", "memory"}, env...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestResponseCacheLookupAndStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        []string
+		policy     CachePolicy
+		body       string
+		wantStatus []string // 写入前、写入后两次查询的 X-Cache
+		wantStored bool
+	}{
+		{name: "miss then hit", body: "data", wantStatus: []string{CacheMiss, CacheHit}, wantStored: true},
+		{name: "disabled", env: []string{"RESPONSE_CACHE_ENABLED", "false"}, body: "data", wantStatus: []string{"", ""}},
+		{name: "no-cache refreshes without reading", policy: CachePolicy{NoRead: true}, body: "data", wantStatus: []string{CacheBypass, CacheBypass}, wantStored: true},
+		{name: "no-store neither reads nor writes", policy: CachePolicy{NoRead: true, NoWrite: true}, body: "data", wantStatus: []string{CacheBypass, CacheBypass}},
+		{name: "empty body is not stored", body: "", wantStatus: []string{CacheMiss, CacheMiss}},
+		{name: "oversized entry is not stored", env: []string{"RESPONSE_CACHE_MAX_ENTRY_KB", "1"}, body: strings.Repeat("x", 1025), wantStatus: []string{CacheMiss, CacheMiss}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestResponseCache(t, tt.env...)
+			key := cacheKey("chat", "m", []byte(`{}`))
+
+			var statuses []string
+			for i := 0; i < 2; i++ {
+				ctx, meta := WithResponseMeta(WithCachePolicy(context.Background(), tt.policy))
+				if _, ok := c.lookup(ctx, key); ok != (meta.CacheStatus == CacheHit) {
+					t.Fatalf("lookup hit = %v with status %q", ok, meta.CacheStatus)
+				}
+				statuses = append(statuses, meta.CacheStatus)
+				if i == 0 {
+					c.store(ctx, key, []byte(tt.body), "m-served")
+				}
+			}
+			if statuses[0] != tt.wantStatus[0] || statuses[1] != tt.wantStatus[1] {
+				t.Errorf("statuses = %v, want %v", statuses, tt.wantStatus)
+			}
+
+			// 绕过读取的请求依然会刷新缓存，之后的普通请求可以命中
+			entry, ok := c.lookup(context.Background(), key)
+			if ok != (tt.wantStored && c.configManager.Get().ResponseCacheEnabled) {
+				t.Fatalf("stored = %v, want %v", ok, tt.wantStored)
+			}
+			if ok && (string(entry.Body) != tt.body || entry.ServedModel != "m-served") {
+				t.Errorf("entry = %+v", entry)
+			}
+		})
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		c := newTestResponseCache(t)
+		ctx, key := context.Background(), cacheKey("chat", "m", []byte(`{}`))
+		c.lookup(ctx, key)
+		c.store(ctx, key, []byte("data"), "m")
+		c.lookup(ctx, key)
+		c.lookup(ctx, key)
+		c.lookup(WithCachePolicy(ctx, CachePolicy{NoRead: true}), key)
+		stats := c.Stats()
+		if !stats.Enabled || stats.Backend != "memory" || stats.Entries != 1 || stats.Hits != 2 || stats.Misses != 1 || stats.Bypassed != 1 || stats.Stored != 1 {
+			t.Errorf("Stats = %+v", stats)
+		}
+		if stats.HitRate < 0.66 || stats.HitRate > 0.67 {
+			t.Errorf("HitRate = %v, want 2/3", stats.HitRate)
+		}
+		if n := c.Purge(); n != 1 || c.Stats().Entries != 0 {
+			t.Errorf("Purge = %d", n)
+		}
+	})
+}
+
+func TestCacheBackendExpiry(t *testing.T) {
+	backends := map[string]func(t *testing.T) CacheBackend{
+		"memory": func(t *testing.T) CacheBackend {
+			return newMemoryCacheBackend(newTestConfigManager(t))
+		},
+		"sqlite": func(t *testing.T) CacheBackend {
+			b, err := newSQLiteCacheBackend(newTestConfigManager(t), filepath.Join(t.TempDir(), "cache.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if sqlDB, err := b.db.DB(); err == nil {
+					sqlDB.Close()
+				}
+			})
+			return b
+		},
+	}
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			b := newBackend(t)
+			now := time.Now()
+			b.Set("fresh", &CachedResponse{Body: []byte("fresh"), ServedModel: "m", ExpiresAt: now.Add(time.Hour)})
+			b.Set("expired", &CachedResponse{Body: []byte("expired"), ExpiresAt: now.Add(-time.Second)})
+			b.Set("replaced", &CachedResponse{Body: []byte("old"), ExpiresAt: now.Add(-time.Second)})
+			b.Set("replaced", &CachedResponse{Body: []byte("new"), ExpiresAt: now.Add(time.Hour)})
+
+			tests := map[string]string{"fresh": "fresh", "expired": "", "replaced": "new", "missing": ""}
+			for key, want := range tests {
+				entry, ok := b.Get(key)
+				if ok != (want != "") || (ok && string(entry.Body) != want) {
+					t.Errorf("Get(%s) = %+v, %v, want %q", key, entry, ok, want)
+				}
+			}
+			if entry, _ := b.Get("fresh"); entry == nil || entry.ServedModel != "m" {
+				t.Errorf("served model not kept: %+v", entry)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheBackendEviction(t *testing.T) {
+	const kb = 1024
+	expires := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		env  []string
+		sets []struct {
+			key  string
+			size int
+		}
+		touch []string // 在最后一次写入前访问，使其成为最近使用
+		want  []string
+	}{
+		{
+			name: "entry limit evicts least recently used",
+			env:  []string{"RESPONSE_CACHE_MAX_ENTRIES", "2"},
+			sets: []struct {
+				key  string
+				size int
+			}{{"a", 1}, {"b", 1}, {"c", 1}},
+			want: []string{"b", "c"},
+		},
+		{
+			name: "a read keeps an entry alive",
+			env:  []string{"RESPONSE_CACHE_MAX_ENTRIES", "2"},
+			sets: []struct {
+				key  string
+				size int
+			}{{"a", 1}, {"b", 1}, {"c", 1}},
+			touch: []string{"a"},
+			want:  []string{"a", "c"},
+		},
+		{
+			name: "byte limit evicts until the total fits",
+			env:  []string{"RESPONSE_CACHE_MAX_SIZE_MB", "1"},
+			sets: []struct {
+				key  string
+				size int
+			}{{"a", 400 * kb}, {"b", 400 * kb}, {"c", 700 * kb}},
+			want: []string{"c"},
+		},
+		{
+			name: "overwriting does not double count",
+			env:  []string{"RESPONSE_CACHE_MAX_SIZE_MB", "1"},
+			sets: []struct {
+				key  string
+				size int
+			}{{"a", 400 * kb}, {"b", 400 * kb}, {"b", 400 * kb}},
+			want: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newMemoryCacheBackend(newTestConfigManager(t, append([]string{"RESPONSE_CACHE_MAX_ENTRIES", "100", "RESPONSE_CACHE_MAX_SIZE_MB", "256"}, tt.env...)...))
+			for i, set := range tt.sets {
+				if i == len(tt.sets)-1 {
+					for _, key := range tt.touch {
+						b.Get(key)
+					}
+				}
+				b.Set(set.key, &CachedResponse{Body: make([]byte, set.size), ExpiresAt: expires})
+			}
+			var got []string
+			for _, key := range []string{"a", "b", "c"} {
+				if _, ok := b.Get(key); ok {
+					got = append(got, key)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || b.Len() != len(tt.want) {
+				t.Errorf("kept %v (Len %d), want %v", got, b.Len(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheRecorder(t *testing.T) {
+	r := &cacheRecorder{limit: 8}
+	for _, chunk := range []string{"data", ": x\n"} {
+		if n, _ := r.Write([]byte(chunk)); n != len(chunk) {
+			t.Fatalf("Write returned %d", n)
+		}
+	}
+	if r.overflow || r.buf.String() != "data: x\n" {
+		t.Fatalf("recorded %q, overflow %v", r.buf.String(), r.overflow)
+	}
+	// 超过上限后丢弃已记录的内容，但仍然报告写入成功，不影响向客户端转发
+	if n, _ := r.Write([]byte("more")); n != 4 || !r.overflow || r.buf.Len() != 0 {
+		t.Errorf("after overflow: n=%d overflow=%v buf=%q", n, r.overflow, r.buf.String())
+	}
+}
@@ -0,0 +1,197 @@
+// service/thinking.go
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// reasoningEffortBudgets 是 OpenAI reasoning_effort 对应的 Gemini 思考预算
+var reasoningEffortBudgets = map[string]int{
+	"none":    0,
+	"minimal": 512,
+	"low":     1024,
+	"medium":  8192,
+	"high":    24576,
+}
+
+// Gemini OpenAI 兼容接口在 include_thoughts 为 true 时把思考摘要包在这对标签中放在正文前面
+const (
+	thoughtOpenTag  = "<thought>"
+	thoughtCloseTag = "</thought>"
+)
+
+// requestedThinking 解析客户端通过 thinking 扩展、reasoning_effort 或 extra_body 请求的思考预算
+// 和是否返回思考摘要；客户端没有指定预算时 budget 为 nil
+func requestedThinking(req *model.ChatCompletionRequest) (budget *int, include bool, err error) {
+	if req.ExtraBody != nil && req.ExtraBody.Google != nil && req.ExtraBody.Google.ThinkingConfig != nil {
+		budget = req.ExtraBody.Google.ThinkingConfig.ThinkingBudget
+		include = req.ExtraBody.Google.ThinkingConfig.IncludeThoughts
+	}
+	if t := req.Thinking; t != nil {
+		include = t.IncludeThoughts == nil || *t.IncludeThoughts
+		switch t.Type {
+		case "", "enabled":
+			if t.BudgetTokens != nil {
+				budget = t.BudgetTokens
+			}
+		case "disabled":
+			zero := 0
+			budget, include = &zero, false
+		default:
+			return nil, false, &ChatRequestError{Param: "thinking.type", Message: "thinking.type 必须是 enabled 或 disabled"}
+		}
+	}
+	if req.ReasoningEffort != "" && (req.Thinking == nil || req.Thinking.BudgetTokens == nil) {
+		effort, ok := reasoningEffortBudgets[strings.ToLower(req.ReasoningEffort)]
+		if !ok {
+			return nil, false, &ChatRequestError{Param: "reasoning_effort", Message: "reasoning_effort 必须是 none、minimal、low、medium 或 high"}
+		}
+		budget = &effort
+	}
+	if budget != nil && *budget < -1 {
+		return nil, false, &ChatRequestError{Param: "thinking.budget_tokens", Message: "思考预算必须大于等于 -1"}
+	}
+	return budget, include, nil
+}
+
+// thinkingRequest 返回发往 modelName 的请求: 客户端请求的预算与管理员为该模型配置的默认预算 (THINKING_BUDGETS)
+// 合并后写入 extra_body.google.thinking_config，同时移除上游不允许与其同时出现的 reasoning_effort。
+// 第二个返回值表示是否需要从响应中拆分思考摘要。调用前应已经通过 requestedThinking 校验请求。
+func thinkingRequest(req *model.ChatCompletionRequest, modelName string, budgets map[string]int) (*model.ChatCompletionRequest, bool) {
+	budget, include, _ := requestedThinking(req)
+	if limit, ok := budgets[modelName]; ok {
+		if budget == nil || (limit >= 0 && (*budget < 0 || *budget > limit)) {
+			budget = &limit
+		}
+	}
+
+	out := *req
+	out.Thinking = nil
+	out.ReasoningEffort = ""
+	if budget == nil && !include {
+		return &out, false
+	}
+	include = include && (budget == nil || *budget != 0)
+
+	var google model.GoogleExtraBody
+	if req.ExtraBody != nil && req.ExtraBody.Google != nil {
+		google = *req.ExtraBody.Google
+	}
+	google.ThinkingConfig = &model.GoogleThinkingConfig{ThinkingBudget: budget, IncludeThoughts: include}
+	out.ExtraBody = &model.ExtraBody{Google: &google}
+	return &out, include
+}
+
+// thoughtSplitter 把包在 <thought> 标签中的思考摘要从正文中拆分出来，标签可能被拆分到多个流式 chunk 中
+type thoughtSplitter struct {
+	inThought bool
+	pending   string // 可能是标签开头、需要等待后续文本才能判断的尾部
+}
+
+// feed 处理一段文本，返回其中可以确定的正文和思考摘要
+func (t *thoughtSplitter) feed(text string) (content, reasoning string) {
+	text = t.pending + text
+	t.pending = ""
+	var c, r strings.Builder
+	for text != "" {
+		tag, dst := thoughtOpenTag, &c
+		if t.inThought {
+			tag, dst = thoughtCloseTag, &r
+		}
+		if i := strings.Index(text, tag); i >= 0 {
+			dst.WriteString(text[:i])
+			text = text[i+len(tag):]
+			t.inThought = !t.inThought
+			continue
+		}
+		keep := partialTagSuffix(text, tag)
+		dst.WriteString(text[:len(text)-keep])
+		t.pending = text[len(text)-keep:]
+		break
+	}
+	return c.String(), r.String()
+}
+
+// flush 在文本结束时输出剩余的内容
+func (t *thoughtSplitter) flush() (content, reasoning string) {
+	pending := t.pending
+	t.pending = ""
+	if t.inThought {
+		return "", pending
+	}
+	return pending, ""
+}
+
+// partialTagSuffix 返回 text 末尾可能是 tag 开头部分的长度
+func partialTagSuffix(text, tag string) int {
+	for n := min(len(text), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// splitThoughts 把非流式响应中 choice 正文里的思考摘要移到 reasoning_content
+func splitThoughts(resp *model.OpenAICompletionResponse) {
+	for i := range resp.Choices {
+		msg := &resp.Choices[i].Message
+		text, ok := msg.Content.(string)
+		if !ok {
+			continue
+		}
+		var splitter thoughtSplitter
+		content, reasoning := splitter.feed(text)
+		restContent, restReasoning := splitter.flush()
+		msg.Content = content + restContent
+		msg.ReasoningContent += reasoning + restReasoning
+	}
+}
+
+// thoughtStreamWriter 返回一个写入器: 解析上游 SSE 流中的每个 chunk，把 delta 中的思考摘要移到 reasoning_content 后写到 out。
+// 上游的 [DONE] 会被丢弃，调用方需要在流正常结束后自行发送。
+func thoughtStreamWriter(out io.Writer, flusher http.Flusher) *sseDataWriter {
+	splitters := make(map[int]*thoughtSplitter)
+	return &sseDataWriter{onData: func(data []byte) error {
+		var chunk chatStreamChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			logger.Warn("忽略无法解析的流式 chunk: %v", err)
+			return nil
+		}
+		for i := range chunk.Choices {
+			choice := &chunk.Choices[i]
+			splitter, ok := splitters[choice.Index]
+			if !ok {
+				splitter = &thoughtSplitter{}
+				splitters[choice.Index] = splitter
+			}
+			content, reasoning := splitter.feed(choice.Delta.Content)
+			if finishReasonOf(*choice) != "" {
+				restContent, restReasoning := splitter.flush()
+				content, reasoning = content+restContent, reasoning+restReasoning
+			}
+			choice.Delta.Content = content
+			choice.Delta.ReasoningContent += reasoning
+		}
+		return writeSSEData(out, flusher, chunk)
+	}}
+}
+
+// relayThoughtSSE 转发上游 SSE 流，同时拆分其中的思考摘要
+func relayThoughtSSE(out io.Writer, flusher http.Flusher, resp *http.Response, key *model.APIKey) error {
+	w := thoughtStreamWriter(out, flusher)
+	if err := relaySSE(w, w, resp, key, true); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(out, "data: [DONE]\n\n"); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"encoding/json"
+	"gemini_polling/model"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestThoughtSplitter(t *testing.T) {
+	tests := []struct {
+		name          string
+		chunks        []string
+		content       string
+		reasoning     string
+		contentChunks []string // 每个 chunk 处理后立即可以输出的正文，nil 表示不检查
+	}{
+		{
+			name:      "no thoughts",
+			chunks:    []string{"Hello, ", "world"},
+			content:   "Hello, world",
+			reasoning: "",
+		},
+		{
+			name:      "thought in one chunk",
+			chunks:    []string{"<thought>plan</thought>answer"},
+			content:   "answer",
+			reasoning: "plan",
+		},
+		{
+			name:          "open tag split across chunks",
+			chunks:        []string{"<tho", "ught>plan", "</thought>answer"},
+			content:       "answer",
+			reasoning:     "plan",
+			contentChunks: []string{"", "", "answer"},
+		},
+		{
+			name:      "close tag split character by character",
+			chunks:    []string{"<thought>pl", "an<", "/", "th", "ought", ">", "answer"},
+			content:   "answer",
+			reasoning: "plan",
+		},
+		{
+			name:          "text that only looks like a tag prefix",
+			chunks:        []string{"a <", "b"},
+			content:       "a <b",
+			reasoning:     "",
+			contentChunks: []string{"a ", "<b"},
+		},
+		{
+			name:      "unterminated thought is flushed as reasoning",
+			chunks:    []string{"<thought>still thinking</th"},
+			content:   "",
+			reasoning: "still thinking</th",
+		},
+		{
+			name:      "trailing partial open tag is flushed as content",
+			chunks:    []string{"answer <tho"},
+			content:   "answer <tho",
+			reasoning: "",
+		},
+		{
+			name:      "multiple thoughts",
+			chunks:    []string{"<thought>a</thought>x", "<thought>b</thought>y"},
+			content:   "xy",
+			reasoning: "ab",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var splitter thoughtSplitter
+			var content, reasoning strings.Builder
+			for i, chunk := range tt.chunks {
+				c, r := splitter.feed(chunk)
+				if tt.contentChunks != nil && c != tt.contentChunks[i] {
+					t.Errorf("chunk %d content = %q, want %q", i, c, tt.contentChunks[i])
+				}
+				content.WriteString(c)
+				reasoning.WriteString(r)
+			}
+			c, r := splitter.flush()
+			content.WriteString(c)
+			reasoning.WriteString(r)
+			if content.String() != tt.content || reasoning.String() != tt.reasoning {
+				t.Errorf("got content %q reasoning %q, want %q %q", content.String(), reasoning.String(), tt.content, tt.reasoning)
+			}
+		})
+	}
+}
+
+func TestSplitThoughts(t *testing.T) {
+	resp := &model.OpenAICompletionResponse{Choices: []model.CompletionChoice{
+		{Message: model.Message{Content: "<thought>plan</thought>answer"}},
+		{Message: model.Message{Content: "plain"}},
+	}}
+	splitThoughts(resp)
+	if got := resp.Choices[0].Message; got.Content != "answer" || got.ReasoningContent != "plan" {
+		t.Errorf("choice 0 = %+v", got)
+	}
+	if got := resp.Choices[1].Message; got.Content != "plain" || got.ReasoningContent != "" {
+		t.Errorf("choice 1 = %+v", got)
+	}
+}
+
+func TestGeminiThinkingBudgets(t *testing.T) {
+	policy := NewPolicyEngine(newTestConfigManager(t, "THINKING_BUDGETS", "capped=1024, dynamic=-1"))
+	tests := []struct {
+		name  string
+		model string
+		body  string
+		want  string // generationConfig 的期望值，空表示请求体原样转发
+	}{
+		{name: "default budget is injected", model: "capped", body: `{"contents":[]}`, want: `{"thinkingConfig":{"thinkingBudget":1024}}`},
+		{name: "budget above the limit is clamped", model: "capped", body: `{"generationConfig":{"thinkingConfig":{"thinkingBudget":32768,"includeThoughts":true}}}`, want: `{"thinkingConfig":{"includeThoughts":true,"thinkingBudget":1024}}`},
+		{name: "dynamic budget is clamped", model: "capped", body: `{"generationConfig":{"thinkingConfig":{"thinkingBudget":-1}}}`, want: `{"thinkingConfig":{"thinkingBudget":1024}}`},
+		{name: "budget within the limit is kept", model: "capped", body: `{"generationConfig":{"thinkingConfig":{"thinkingBudget":0}}}`, want: `{"thinkingConfig":{"thinkingBudget":0}}`},
+		{name: "snake_case fields are reused", model: "capped", body: `{"generation_config":{"thinking_config":{"thinking_budget":4096}}}`, want: `{"thinking_config":{"thinking_budget":1024}}`},
+		{name: "thinkingLevel gets no default budget", model: "capped", body: `{"generationConfig":{"thinkingConfig":{"thinkingLevel":"low"}}}`, want: `{"thinkingConfig":{"thinkingLevel":"low"}}`},
+		{name: "dynamic limit keeps any budget", model: "dynamic", body: `{"generationConfig":{"thinkingConfig":{"thinkingBudget":32768}}}`, want: `{"thinkingConfig":{"thinkingBudget":32768}}`},
+		{name: "dynamic limit is the default", model: "dynamic", body: `{}`, want: `{"thinkingConfig":{"thinkingBudget":-1}}`},
+		{name: "unconfigured model is untouched", model: "other", body: `{"generationConfig":{"thinkingConfig":{"thinkingBudget":32768}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := policy.ApplyGemini(nil, tt.model, []byte(tt.body))
+			if tt.want == "" {
+				if string(out) != tt.body {
+					t.Errorf("body rewritten to %s", out)
+				}
+				return
+			}
+			var payload map[string]json.RawMessage
+			if err := json.Unmarshal(out, &payload); err != nil {
+				t.Fatal(err)
+			}
+			generation := payload["generationConfig"]
+			if generation == nil {
+				generation = payload["generation_config"]
+			}
+			assertJSONEqual(t, generation, tt.want)
+		})
+	}
+
+	t.Run("batch", func(t *testing.T) {
+		body := `{"batch":{"inputConfig":{"requests":{"requests":[` +
+			`{"request":{"generationConfig":{"thinkingConfig":{"thinkingBudget":32768}}}},` +
+			`{"request":{"contents":[]}}]}}}}`
+		var payload struct {
+			Batch struct {
+				InputConfig struct {
+					Requests struct {
+						Requests []struct {
+							Request struct {
+								GenerationConfig json.RawMessage `json:"generationConfig"`
+							} `json:"request"`
+						} `json:"requests"`
+					} `json:"requests"`
+				} `json:"inputConfig"`
+			} `json:"batch"`
+		}
+		if err := json.Unmarshal(policy.ApplyGeminiBatch(nil, "capped", []byte(body)), &payload); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range payload.Batch.InputConfig.Requests.Requests {
+			assertJSONEqual(t, item.Request.GenerationConfig, `{"thinkingConfig":{"thinkingBudget":1024}}`)
+		}
+	})
+
+	t.Run("live setup", func(t *testing.T) {
+		out := policy.ApplyLiveSetup(nil, "capped", []byte(`{"setup":{"model":"models/capped","generationConfig":{"thinkingConfig":{"thinkingBudget":-1}}}}`))
+		var payload struct {
+			Setup struct {
+				GenerationConfig json.RawMessage `json:"generationConfig"`
+			} `json:"setup"`
+		}
+		if err := json.Unmarshal(out, &payload); err != nil {
+			t.Fatal(err)
+		}
+		assertJSONEqual(t, payload.Setup.GenerationConfig, `{"thinkingConfig":{"thinkingBudget":1024}}`)
+	})
+}
+
+// assertJSONEqual 比较两个 JSON 值，忽略字段顺序和空白
+func assertJSONEqual(t *testing.T, got json.RawMessage, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
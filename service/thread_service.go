@@ -0,0 +1,409 @@
+// service/thread_service.go
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini_polling/config"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// 线程历史超出上下文上限时的处理方式
+const (
+	ThreadOverflowSummarize = "summarize"
+	ThreadOverflowTruncate  = "truncate"
+)
+
+// defaultThreadContextTokens 是模型的输入上限未知且没有配置上限时使用的上下文上限
+const defaultThreadContextTokens = 32768
+
+// threadSummaryPrompt 是生成线程摘要时使用的系统提示词
+const threadSummaryPrompt = "You maintain the running summary of a conversation. Merge the existing summary (if any) and the messages below into one concise summary that can replace them as context for the rest of the conversation. Keep facts, decisions, names, numbers, user preferences and open questions, and write in the language of the conversation. Reply with the summary only."
+
+var ErrThreadNotFound = errors.New("thread 不存在")
+
+// ThreadService 管理服务端保存的会话线程: 客户端每次只发送新消息，服务把线程的历史拼接在前面调用 GenAIService，
+// 并保存助手的回复。历史的估算 token 数超过上下文上限时，较早的消息被归档，并按配置合并为摘要或直接丢弃。
+type ThreadService struct {
+	configManager *config.Manager
+	store         *storage.ThreadStore
+	genai         *GenAIService
+	registry      *ModelRegistry
+	policy        *PolicyEngine
+	locks         sync.Map // 线程 ID -> *sync.Mutex，同一线程的请求依次执行，避免历史交错
+}
+
+func NewThreadService(manager *config.Manager, store *storage.ThreadStore, genai *GenAIService, registry *ModelRegistry, policy *PolicyEngine) *ThreadService {
+	return &ThreadService{configManager: manager, store: store, genai: genai, registry: registry, policy: policy}
+}
+
+// Create 创建线程并保存初始消息，初始消息不会发送给模型
+func (s *ThreadService) Create(clientID uint, req *model.CreateThreadRequest) (*model.Thread, error) {
+	rows, err := threadMessageRows(req.Messages)
+	if err != nil {
+		return nil, err
+	}
+	thread := &model.Thread{
+		ID:           newObjectID("thread_"),
+		ClientID:     clientID,
+		Model:        req.Model,
+		Instructions: req.Instructions,
+	}
+	if req.Metadata != nil {
+		metadata, _ := json.Marshal(req.Metadata)
+		thread.Metadata = string(metadata)
+	}
+	if err := s.store.CreateThread(thread, rows); err != nil {
+		return nil, fmt.Errorf("保存线程失败: %w", err)
+	}
+	return thread, nil
+}
+
+// Get 返回客户端的线程
+func (s *ThreadService) Get(clientID uint, id string) (*model.Thread, error) {
+	thread, err := s.store.GetThread(id, &clientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrThreadNotFound
+	}
+	return thread, err
+}
+
+// Delete 删除客户端的线程及其消息
+func (s *ThreadService) Delete(clientID uint, id string) error {
+	if _, err := s.Get(clientID, id); err != nil {
+		return err
+	}
+	unlock := s.lock(id)
+	defer unlock()
+	if err := s.store.DeleteThread(id); err != nil {
+		return err
+	}
+	s.locks.Delete(id)
+	return nil
+}
+
+// Messages 返回线程的完整历史，包括已归档的消息
+func (s *ThreadService) Messages(clientID uint, id string) ([]model.ThreadMessage, error) {
+	if _, err := s.Get(clientID, id); err != nil {
+		return nil, err
+	}
+	return s.store.ListMessages(id, false)
+}
+
+// Complete 把请求中的新消息追加到线程并返回非流式响应，成功后新消息和助手的回复一起保存
+func (s *ThreadService) Complete(ctx context.Context, client *model.Client, thread *model.Thread, req *model.ChatCompletionRequest) (*model.OpenAICompletionResponse, error) {
+	unlock := s.lock(thread.ID)
+	defer unlock()
+
+	chatReq, rows, err := s.prepare(ctx, client, thread, req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.genai.NonStreamChat(ctx, chatReq)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := response.(*model.OpenAICompletionResponse)
+	if !ok || len(resp.Choices) == 0 {
+		return nil, errors.New("上游响应中没有选项")
+	}
+	reply := resp.Choices[0].Message
+	if err := s.save(thread.ID, rows, model.Message{Role: "assistant", Content: reply.Content, ToolCalls: reply.ToolCalls}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Stream 把请求中的新消息追加到线程并以 SSE 流返回响应，流正常结束后保存新消息和拼接出的助手回复
+func (s *ThreadService) Stream(ctx context.Context, w http.ResponseWriter, client *model.Client, thread *model.Thread, req *model.ChatCompletionRequest) error {
+	unlock := s.lock(thread.ID)
+	defer unlock()
+
+	chatReq, rows, err := s.prepare(ctx, client, thread, req)
+	if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	var toolCalls []model.ToolCall
+	finished := false
+	capture := &sseDataWriter{onData: func(data []byte) error {
+		var chunk chatStreamChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return nil
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			content.WriteString(choice.Delta.Content)
+			toolCalls = mergeToolCallDeltas(toolCalls, choice.Delta.ToolCalls)
+			if finishReasonOf(choice) != "" {
+				finished = true
+			}
+		}
+		return nil
+	}}
+	if err := s.genai.StreamChat(ctx, &threadStreamWriter{ResponseWriter: w, capture: capture}, chatReq); err != nil {
+		return err
+	}
+	if !finished {
+		return fmt.Errorf("线程 %s 的流式响应没有正常结束，本轮消息未保存", thread.ID)
+	}
+
+	reply := model.Message{Role: "assistant", ToolCalls: toolCalls}
+	if content.Len() > 0 || len(toolCalls) == 0 {
+		reply.Content = content.String()
+	}
+	return s.save(thread.ID, rows, reply)
+}
+
+// lock 获取线程的互斥锁，返回解锁函数
+func (s *ThreadService) lock(id string) func() {
+	v, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// prepare 校验新消息，必要时归档早期历史，并生成发往模型的完整请求。
+// 新消息在媒体内联之前编码，因此保存的是客户端发送的原始内容。
+func (s *ThreadService) prepare(ctx context.Context, client *model.Client, thread *model.Thread, req *model.ChatCompletionRequest) (*model.ChatCompletionRequest, []model.ThreadMessage, error) {
+	if req.N > 1 {
+		return nil, nil, &ChatRequestError{Param: "n", Message: "线程中的请求只支持 n = 1"}
+	}
+	if len(req.Messages) == 0 {
+		return nil, nil, &ChatRequestError{Param: "messages", Message: "messages 至少需要包含一条新消息"}
+	}
+	rows, err := threadMessageRows(req.Messages)
+	if err != nil {
+		return nil, nil, err
+	}
+	history, err := s.store.ListMessages(thread.ID, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取线程历史失败: %w", err)
+	}
+	history, err = s.fitContext(ctx, thread, history, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messages := make([]model.Message, 0, len(history)+len(req.Messages)+2)
+	if thread.Instructions != "" {
+		messages = append(messages, model.Message{Role: "system", Content: thread.Instructions})
+	}
+	if thread.Summary != "" {
+		messages = append(messages, model.Message{Role: "system", Content: "Summary of the earlier conversation:\n" + thread.Summary})
+	}
+	for _, row := range history {
+		messages = append(messages, rowMessage(row))
+	}
+	messages = append(messages, req.Messages...)
+
+	chatReq := *req
+	chatReq.Messages = messages
+	s.policy.ApplyChat(client, &chatReq)
+	return &chatReq, rows, nil
+}
+
+// fitContext 在历史加新消息的估算 token 数超过上限时归档较早的消息，返回仍需发送的历史。
+// 归档后保留的历史和新消息约占上限的一半，为之后的对话留出空间。
+func (s *ThreadService) fitContext(ctx context.Context, thread *model.Thread, history []model.ThreadMessage, req *model.ChatCompletionRequest) ([]model.ThreadMessage, error) {
+	budget := s.contextBudget(req.Model)
+	fixed := estimateTokens(thread.Instructions) + estimateMessagesTokens(req.Messages)
+	if fixed > budget {
+		return nil, &ChatRequestError{Param: "messages", Message: fmt.Sprintf("新消息约 %d 个 token，超过了模型 %s 的上下文上限 %d", fixed, req.Model, budget)}
+	}
+
+	sizes := make([]int, len(history))
+	total := fixed + estimateTokens(thread.Summary)
+	for i, row := range history {
+		sizes[i] = estimateMessagesTokens([]model.Message{rowMessage(row)})
+		total += sizes[i]
+	}
+	if total <= budget {
+		return history, nil
+	}
+
+	cut, kept := len(history), fixed
+	for cut > 0 && kept+sizes[cut-1] <= budget/2 {
+		cut--
+		kept += sizes[cut]
+	}
+	// 保留的历史不能以工具结果开头，否则对应的 tool_calls 已被归档
+	for cut < len(history) && history[cut].Role == "tool" {
+		cut++
+	}
+	if cut == 0 {
+		return history, nil
+	}
+	archived := history[:cut]
+
+	summary := thread.Summary
+	strategy := strings.ToLower(strings.TrimSpace(s.configManager.Get().ThreadOverflowStrategy))
+	if strategy != ThreadOverflowTruncate {
+		if strategy != ThreadOverflowSummarize {
+			logger.Warn("[会话线程] 未知的 THREAD_OVERFLOW_STRATEGY: %s，按 summarize 处理", strategy)
+		}
+		merged, err := s.summarize(ctx, req.Model, thread.Summary, archived)
+		if err != nil {
+			logger.Warn("[会话线程] 线程 %s 生成摘要失败，直接丢弃早期消息: %v", thread.ID, err)
+		} else {
+			summary = merged
+		}
+	}
+	if err := s.store.ArchiveMessages(thread.ID, archived[len(archived)-1].ID, summary); err != nil {
+		return nil, fmt.Errorf("归档线程历史失败: %w", err)
+	}
+	thread.Summary = summary
+	logger.Info("[会话线程] 线程 %s 的历史约 %d 个 token，超过上限 %d，已归档 %d 条早期消息", thread.ID, total, budget, len(archived))
+	return history[cut:], nil
+}
+
+// contextBudget 返回发送给模型的历史的 token 上限: 模型的输入上限和 THREAD_CONTEXT_TOKENS 中较小的一个。
+// 估算并不精确，模型的上限只使用 90%。
+func (s *ThreadService) contextBudget(modelName string) int {
+	limit := s.registry.TokenLimits(modelName).Input * 9 / 10
+	if configured := s.configManager.Get().ThreadContextTokens; configured > 0 && (limit <= 0 || configured < limit) {
+		limit = configured
+	}
+	if limit <= 0 {
+		limit = defaultThreadContextTokens
+	}
+	return limit
+}
+
+// summarize 把已有摘要和将被归档的消息合并为新的摘要
+func (s *ThreadService) summarize(ctx context.Context, modelName, previous string, rows []model.ThreadMessage) (string, error) {
+	if name := s.configManager.Get().ThreadSummaryModel; name != "" {
+		resolved, err := s.registry.Resolve(nil, name)
+		if err != nil {
+			return "", err
+		}
+		modelName = resolved
+	}
+
+	var transcript strings.Builder
+	if previous != "" {
+		transcript.WriteString("Existing summary:\n" + previous + "\n\n")
+	}
+	transcript.WriteString("Messages:\n")
+	for _, row := range rows {
+		fmt.Fprintf(&transcript, "%s: %s\n", row.Role, messageText(rowMessage(row)))
+	}
+
+	response, err := s.genai.NonStreamChat(ctx, &model.ChatCompletionRequest{
+		Model: modelName,
+		Messages: []model.Message{
+			{Role: "system", Content: threadSummaryPrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, ok := response.(*model.OpenAICompletionResponse)
+	if !ok || len(resp.Choices) == 0 {
+		return "", errors.New("上游响应中没有选项")
+	}
+	summary := strings.TrimSpace(messageText(resp.Choices[0].Message))
+	if summary == "" {
+		return "", errors.New("模型返回了空摘要")
+	}
+	return summary, nil
+}
+
+// save 保存本轮的新消息和助手的回复
+func (s *ThreadService) save(threadID string, rows []model.ThreadMessage, reply model.Message) error {
+	replyRows, err := threadMessageRows([]model.Message{reply})
+	if err != nil {
+		return err
+	}
+	if err := s.store.AppendMessages(threadID, append(rows, replyRows...)); err != nil {
+		return fmt.Errorf("保存线程消息失败: %w", err)
+	}
+	return nil
+}
+
+// threadStreamWriter 把 StreamChat 的输出写给客户端，同时交给 capture 解析出助手的回复
+type threadStreamWriter struct {
+	http.ResponseWriter
+	capture *sseDataWriter
+}
+
+func (w *threadStreamWriter) Write(p []byte) (int, error) {
+	w.capture.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *threadStreamWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// threadMessageRows 校验消息的 role 并编码为数据库记录
+func threadMessageRows(messages []model.Message) ([]model.ThreadMessage, error) {
+	rows := make([]model.ThreadMessage, 0, len(messages))
+	for i, msg := range messages {
+		switch msg.Role {
+		case "system", "developer", "user", "assistant", "tool":
+		default:
+			return nil, &ChatRequestError{Param: fmt.Sprintf("messages[%d].role", i), Message: fmt.Sprintf("不支持的 role: %s", msg.Role)}
+		}
+		content, err := json.Marshal(msg.Content)
+		if err != nil {
+			return nil, &ChatRequestError{Param: fmt.Sprintf("messages[%d].content", i), Message: "content 无法编码: " + err.Error()}
+		}
+		row := model.ThreadMessage{Role: msg.Role, Content: string(content), ToolCallID: msg.ToolCallID}
+		if len(msg.ToolCalls) > 0 {
+			toolCalls, _ := json.Marshal(msg.ToolCalls)
+			row.ToolCalls = string(toolCalls)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// rowMessage 把数据库记录还原为 OpenAI 消息
+func rowMessage(row model.ThreadMessage) model.Message {
+	msg := model.Message{Role: row.Role, ToolCallID: row.ToolCallID}
+	if err := json.Unmarshal([]byte(row.Content), &msg.Content); err != nil {
+		msg.Content = row.Content
+	}
+	if row.ToolCalls != "" {
+		json.Unmarshal([]byte(row.ToolCalls), &msg.ToolCalls)
+	}
+	return msg
+}
+
+// messageText 返回消息的纯文本形式，非文本内容和工具调用以占位符表示，用于生成摘要
+func messageText(msg model.Message) string {
+	var b strings.Builder
+	switch v := msg.Content.(type) {
+	case string:
+		b.WriteString(v)
+	case []interface{}:
+		for _, item := range v {
+			part, _ := item.(map[string]interface{})
+			if text, ok := part["text"].(string); ok && part["type"] == "text" {
+				b.WriteString(text)
+			} else {
+				fmt.Fprintf(&b, "[%v]", part["type"])
+			}
+		}
+	}
+	for _, call := range msg.ToolCalls {
+		fmt.Fprintf(&b, "[tool call %s(%s)]", call.Function.Name, call.Function.Arguments)
+	}
+	return b.String()
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gemini_polling/model"
+	"gemini_polling/storage"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestThreadService 创建使用临时 SQLite 数据库的 ThreadService，不生成摘要时 genai 保持为 nil
+func newTestThreadService(t *testing.T, env ...string) *ThreadService {
+	t.Helper()
+	manager := newTestConfigManager(t, append([]string{"DB_DRIVER", "sqlite3", "SQLITE_PATH", filepath.Join(t.TempDir(), "data.db")}, env...)...)
+	db, err := storage.InitDB(manager.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return NewThreadService(manager, storage.NewThreadStore(db), nil, newTestModelRegistry(t, nil), nil)
+}
+
+// threadText 返回估算为 tokens 个 token 的消息内容 (不含每条消息 4 个 token 的格式开销)
+func threadText(label string, tokens int) string {
+	return label + strings.Repeat(".", tokens*4-len(label))
+}
+
+func TestThreadFitContext(t *testing.T) {
+	// 每条历史消息估算为 100 个 token，新消息约 5 个 token
+	msg := func(role, label string) model.Message {
+		return model.Message{Role: role, Content: threadText(label, 96)}
+	}
+	toolCall := model.Message{Role: "assistant", Content: threadText("m3", 96), ToolCalls: []model.ToolCall{{ID: "call_1", Type: "function", Function: model.FunctionCall{Name: "f", Arguments: "{}"}}}}
+	toolResult := model.Message{Role: "tool", Content: threadText("m4", 96), ToolCallID: "call_1"}
+
+	tests := []struct {
+		name         string
+		instructions string
+		summary      string
+		history      []model.Message
+		newMessage   string
+		want         []string // 保留的历史消息的标签
+		wantSummary  string
+		wantParam    string
+	}{
+		{
+			name:    "history within the budget is kept",
+			history: []model.Message{msg("user", "m0"), msg("assistant", "m1"), msg("user", "m2"), msg("assistant", "m3")},
+			want:    []string{"m0", "m1", "m2", "m3"},
+		},
+		{
+			name:    "overflow keeps the newest messages within half the budget",
+			history: []model.Message{msg("user", "m0"), msg("assistant", "m1"), msg("user", "m2"), msg("assistant", "m3"), msg("user", "m4"), msg("assistant", "m5")},
+			want:    []string{"m4", "m5"},
+		},
+		{
+			name:         "instructions count towards the budget",
+			instructions: threadText("sys", 100),
+			history:      []model.Message{msg("user", "m0"), msg("assistant", "m1"), msg("user", "m2"), msg("assistant", "m3")},
+			want:         []string{"m3"},
+		},
+		{
+			name:        "existing summary counts towards the budget and is kept",
+			summary:     threadText("old", 100),
+			history:     []model.Message{msg("user", "m0"), msg("assistant", "m1"), msg("user", "m2"), msg("assistant", "m3")},
+			want:        []string{"m2", "m3"},
+			wantSummary: threadText("old", 100),
+		},
+		{
+			name:    "kept history does not start with a tool result",
+			history: []model.Message{msg("user", "m0"), msg("assistant", "m1"), msg("user", "m2"), toolCall, toolResult, msg("user", "m5")},
+			want:    []string{"m5"},
+		},
+		{
+			name:        "nothing to archive when only the summary is too large",
+			summary:     threadText("old", 600),
+			history:     []model.Message{msg("user", "m0")},
+			want:        []string{"m0"},
+			wantSummary: threadText("old", 600),
+		},
+		{
+			name:       "new messages alone exceed the budget",
+			history:    []model.Message{msg("user", "m0")},
+			newMessage: threadText("q", 600),
+			wantParam:  "messages",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestThreadService(t, "THREAD_CONTEXT_TOKENS", "500", "THREAD_OVERFLOW_STRATEGY", "truncate")
+			thread, err := s.Create(1, &model.CreateThreadRequest{Model: "gemini-2.5-flash", Instructions: tt.instructions, Messages: tt.history})
+			if err != nil {
+				t.Fatal(err)
+			}
+			thread.Summary = tt.summary
+			history, err := s.store.ListMessages(thread.ID, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newMessage := tt.newMessage
+			if newMessage == "" {
+				newMessage = "q"
+			}
+			req := &model.ChatCompletionRequest{Model: "gemini-2.5-flash", Messages: []model.Message{{Role: "user", Content: newMessage}}}
+
+			kept, err := s.fitContext(context.Background(), thread, history, req)
+			if tt.wantParam != "" {
+				var reqErr *ChatRequestError
+				if !errors.As(err, &reqErr) || reqErr.Param != tt.wantParam {
+					t.Fatalf("err = %v, want ChatRequestError on %s", err, tt.wantParam)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := threadLabels(kept); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+			if thread.Summary != tt.wantSummary {
+				t.Errorf("summary = %.20q, want %.20q", thread.Summary, tt.wantSummary)
+			}
+
+			// 被丢弃的消息在数据库中标记为已归档，下一次请求不再读取
+			active, err := s.store.ListMessages(thread.ID, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := threadLabels(active); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("active messages after fitContext = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// threadLabels 返回消息内容开头的标签 (threadText 的 label)
+func threadLabels(rows []model.ThreadMessage) []string {
+	var labels []string
+	for _, row := range rows {
+		text := messageText(rowMessage(row))
+		labels = append(labels, strings.TrimRight(text, "."))
+	}
+	return labels
+}
+
+func TestThreadFitContextSummarize(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		wantSummary string
+	}{
+		{name: "archived messages are merged into the summary", status: http.StatusOK, wantSummary: "merged summary"},
+		{name: "summary failure falls back to dropping", status: http.StatusServiceUnavailable, wantSummary: "previous summary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, requests := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"summarizer","choices":[{"index":0,"message":{"role":"assistant","content":" merged summary "},"finish_reason":"stop"}]}`))
+			})
+			key := model.APIKey{ID: 1, Provider: model.ProviderOpenAI, Key: "sk-test", BaseURL: upstream.URL + "/v1", Models: "summarizer"}
+			s := newTestThreadService(t, "THREAD_CONTEXT_TOKENS", "500", "THREAD_OVERFLOW_STRATEGY", "summarize", "THREAD_SUMMARY_MODEL", "summarizer")
+			s.genai = newTestGenAIService(t, key)
+
+			var history []model.Message
+			for _, label := range []string{"m0", "m1", "m2", "m3", "m4", "m5"} {
+				history = append(history, model.Message{Role: "user", Content: threadText(label, 96)})
+			}
+			thread, err := s.Create(1, &model.CreateThreadRequest{Model: "gemini-2.5-flash", Messages: history})
+			if err != nil {
+				t.Fatal(err)
+			}
+			thread.Summary = "previous summary"
+			rows, _ := s.store.ListMessages(thread.ID, true)
+			req := &model.ChatCompletionRequest{Model: "gemini-2.5-flash", Messages: []model.Message{{Role: "user", Content: "q"}}}
+
+			kept, err := s.fitContext(context.Background(), thread, rows, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := threadLabels(kept); !reflect.DeepEqual(got, []string{"m4", "m5"}) {
+				t.Errorf("kept %v", got)
+			}
+			stored, err := s.store.GetThread(thread.ID, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thread.Summary != tt.wantSummary || stored.Summary != tt.wantSummary {
+				t.Errorf("summary = %q (stored %q), want %q", thread.Summary, stored.Summary, tt.wantSummary)
+			}
+
+			// 摘要请求使用 THREAD_SUMMARY_MODEL，包含已有摘要和被归档的消息
+			got := requests()
+			if len(got) == 0 {
+				t.Fatal("no summary request was sent")
+			}
+			body := got[len(got)-1].body
+			if body["model"] != "summarizer" {
+				t.Errorf("summary model = %v", body["model"])
+			}
+			messages, _ := body["messages"].([]interface{})
+			var transcript string
+			if len(messages) == 2 {
+				transcript, _ = messages[1].(map[string]interface{})["content"].(string)
+			}
+			if !strings.Contains(transcript, "Existing summary:\nprevious summary") || !strings.Contains(transcript, "user: m3") || strings.Contains(transcript, "m4") {
+				t.Errorf("summary transcript = %.200q", transcript)
+			}
+		})
+	}
+}
+
+func TestThreadContextBudget(t *testing.T) {
+	registry := newTestModelRegistry(t, []model.ModelEntry{{Name: "small", InputTokenLimit: 1000}})
+	tests := []struct {
+		name       string
+		configured string
+		model      string
+		want       int
+	}{
+		{name: "90% of the model limit", configured: "0", model: "small", want: 900},
+		{name: "configured limit is lower", configured: "500", model: "small", want: 500},
+		{name: "model limit is lower", configured: "5000", model: "small", want: 900},
+		{name: "unknown model uses the configured limit", configured: "500", model: "in-house", want: 500},
+		{name: "unknown model without a configured limit", configured: "0", model: "in-house", want: defaultThreadContextTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ThreadService{configManager: newTestConfigManager(t, "THREAD_CONTEXT_TOKENS", tt.configured), registry: registry}
+			if got := s.contextBudget(tt.model); got != tt.want {
+				t.Errorf("contextBudget(%s) = %d, want %d", tt.model, got, tt.want)
+			}
+		})
+	}
+}
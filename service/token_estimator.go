@@ -0,0 +1,266 @@
+// service/token_estimator.go
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gemini_polling/model"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// HeaderTokenEstimate 请求头为 "local" 时 countTokens 直接返回本地估算的结果，不调用上游
+const HeaderTokenEstimate = "X-Token-Estimate"
+
+// mediaPartTokens 是估算时每个图片、音频或文件内容计入的 token 数
+const mediaPartTokens = 258
+
+// TokenLimitError 表示请求明显超出了模型的 token 上限，请求不会发送到上游
+type TokenLimitError struct {
+	Model     string
+	Param     string // 超出上限的请求参数
+	Output    bool   // true 表示请求的输出上限超过了模型的输出上限，否则是估算的输入超过了上下文窗口
+	Requested int
+	Limit     int
+}
+
+func (e *TokenLimitError) Error() string {
+	if e.Output {
+		return fmt.Sprintf("%s 为 %d，超过了模型 %s 的输出上限 %d", e.Param, e.Requested, e.Model, e.Limit)
+	}
+	return fmt.Sprintf("请求估算约 %d 个 token，超过了模型 %s 的上下文窗口 %d", e.Requested, e.Model, e.Limit)
+}
+
+// checkTokenLimits 在请求上游之前检查估算的输入 token 数和请求的输出上限。
+// 估算并不精确，输入超过上限的 (100 + TOKEN_LIMIT_TOLERANCE_PERCENT)% 才拒绝；模型的上限未知时不检查。
+func (s *GenAIService) checkTokenLimits(modelName string, promptTokens int, promptParam string, maxTokens int, maxTokensParam string) error {
+	cfg := s.configManager.Get()
+	if !cfg.TokenLimitCheckEnabled || s.tokenLimits == nil {
+		return nil
+	}
+	limits := s.tokenLimits.TokenLimits(modelName)
+	if limits.Input > 0 && promptTokens > limits.Input*(100+max(cfg.TokenLimitTolerance, 0))/100 {
+		return &TokenLimitError{Model: modelName, Param: promptParam, Requested: promptTokens, Limit: limits.Input}
+	}
+	if limits.Output > 0 && maxTokens > limits.Output {
+		return &TokenLimitError{Model: modelName, Param: maxTokensParam, Output: true, Requested: maxTokens, Limit: limits.Output}
+	}
+	return nil
+}
+
+// checkGeminiTokenLimits 对 Gemini 原生请求体做 checkTokenLimits 检查，请求体无法解析时交给上游报错
+func (s *GenAIService) checkGeminiTokenLimits(modelName string, reqBody []byte) error {
+	if !s.configManager.Get().TokenLimitCheckEnabled {
+		return nil
+	}
+	promptTokens, err := estimateGeminiRequestTokens(reqBody)
+	if err != nil {
+		return nil
+	}
+	var req struct {
+		GenerationConfig struct {
+			MaxOutputTokens int `json:"maxOutputTokens"`
+		} `json:"generationConfig"`
+	}
+	json.Unmarshal(reqBody, &req)
+	return s.checkTokenLimits(modelName, promptTokens, "contents", req.GenerationConfig.MaxOutputTokens, "generationConfig.maxOutputTokens")
+}
+
+// EstimateTokens 在本地估算 Gemini countTokens 请求的 token 数，返回与上游相同格式的响应体
+func (s *GenAIService) EstimateTokens(reqBody []byte) ([]byte, error) {
+	tokens, err := estimateGeminiRequestTokens(reqBody)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]int{"totalTokens": tokens})
+}
+
+// estimateChatRequestTokens 粗略估算 chat/completions 请求的输入 token 数 (消息和工具定义)
+func estimateChatRequestTokens(req *model.ChatCompletionRequest) int {
+	total := estimateMessagesTokens(req.Messages)
+	if len(req.Tools) > 0 {
+		if tools, err := json.Marshal(req.Tools); err == nil {
+			total += estimateTokens(string(tools))
+		}
+	}
+	return total
+}
+
+// estimateGeminiRequestTokens 粗略估算 Gemini 原生请求 (generateContent 或 countTokens) 的输入 token 数。
+// countTokens 的请求体可以把完整请求包装在 generateContentRequest 中。
+func estimateGeminiRequestTokens(reqBody []byte) (int, error) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(reqBody, &req); err != nil {
+		return 0, fmt.Errorf("解析请求体失败: %w", err)
+	}
+	if inner, ok := req["generateContentRequest"].(map[string]interface{}); ok && req["contents"] == nil {
+		req = inner
+	}
+	total := 0
+	if contents, ok := req["contents"].([]interface{}); ok {
+		total += 4 * len(contents)
+	}
+	for _, field := range []string{"contents", "systemInstruction", "tools"} {
+		total += estimateValueTokens(req[field])
+	}
+	return total, nil
+}
+
+// estimateValueTokens 递归估算 JSON 值中文本的 token 数，inlineData 和 fileData 按 mediaPartTokens 计算，
+// thoughtSignature 不计入
+func estimateValueTokens(v interface{}) int {
+	switch v := v.(type) {
+	case string:
+		return estimateTokens(v)
+	case []interface{}:
+		total := 0
+		for _, item := range v {
+			total += estimateValueTokens(item)
+		}
+		return total
+	case map[string]interface{}:
+		if v["inlineData"] != nil || v["fileData"] != nil {
+			return mediaPartTokens
+		}
+		total := 0
+		for key, item := range v {
+			if key != "thoughtSignature" {
+				total += estimateValueTokens(item)
+			}
+		}
+		return total
+	}
+	return 0
+}
+
+// estimateMessagesTokens 粗略估算消息的 token 数，每条消息另计 4 个 token 的格式开销
+func estimateMessagesTokens(messages []model.Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += 4
+		switch v := msg.Content.(type) {
+		case string:
+			total += estimateTokens(v)
+		case []interface{}:
+			for _, item := range v {
+				part, _ := item.(map[string]interface{})
+				if text, ok := part["text"].(string); ok && part["type"] == "text" {
+					total += estimateTokens(text)
+				} else {
+					total += mediaPartTokens
+				}
+			}
+		}
+		for _, call := range msg.ToolCalls {
+			total += estimateTokens(call.Function.Name) + estimateTokens(call.Function.Arguments)
+		}
+	}
+	return total
+}
+
+// estimateTokens 粗略估算文本的 token 数: ASCII 字符约 4 个一个 token，其他字符 (如中文) 约 1 个一个 token
+func estimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// streamUsageWriter 转发 chat/completions 的流式响应。上游的 usage 没有 prompt_tokens 时用本地估算值补上；
+// 整个流都没有 usage 时在 [DONE] 之前补发一个只包含 usage 的 chunk，completion_tokens 按输出的内容估算。
+type streamUsageWriter struct {
+	out          io.Writer
+	promptTokens int
+	buf          []byte
+
+	sawUsage bool
+	last     model.ChatCompletionStreamResponse // 最近一个 chunk 的 id、created 和 model
+	output   strings.Builder
+}
+
+func (w *streamUsageWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.rewrite(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+		if _, err := w.out.Write(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// rewrite 处理一行 SSE 数据，记录输出的内容并在需要时改写或补充 usage
+func (w *streamUsageWriter) rewrite(line []byte) []byte {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return line
+	}
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("[DONE]")) {
+		if w.sawUsage || w.last.ID == "" {
+			return line
+		}
+		w.sawUsage = true
+		completion := estimateTokens(w.output.String())
+		usageChunk, err := json.Marshal(chatStreamChunk{
+			ChatCompletionStreamResponse: model.ChatCompletionStreamResponse{
+				ID: w.last.ID, Object: "chat.completion.chunk", Created: w.last.Created, Model: w.last.Model, Choices: []model.Choice{},
+			},
+			Usage: &model.Usage{PromptTokens: w.promptTokens, CompletionTokens: completion, TotalTokens: w.promptTokens + completion},
+		})
+		if err != nil {
+			return line
+		}
+		return append(append(append([]byte("data: "), usageChunk...), "\n\n"...), line...)
+	}
+
+	var chunk chatStreamChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return line
+	}
+	w.last = chunk.ChatCompletionStreamResponse
+	for _, choice := range chunk.Choices {
+		w.output.WriteString(choice.Delta.Content)
+		w.output.WriteString(choice.Delta.ReasoningContent)
+		for _, call := range choice.Delta.ToolCalls {
+			w.output.WriteString(call.Function.Name)
+			w.output.WriteString(call.Function.Arguments)
+		}
+	}
+	if chunk.Usage == nil {
+		return line
+	}
+	w.sawUsage = true
+	if chunk.Usage.PromptTokens > 0 {
+		return line
+	}
+
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return line
+	}
+	usage, ok := raw["usage"].(map[string]interface{})
+	if !ok {
+		return line
+	}
+	usage["prompt_tokens"] = w.promptTokens
+	usage["total_tokens"] = w.promptTokens + chunk.Usage.CompletionTokens
+	rewritten, err := json.Marshal(raw)
+	if err != nil {
+		return line
+	}
+	return append(append([]byte("data: "), rewritten...), '\n')
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"errors"
+	"gemini_polling/model"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := map[string]int{
+		"":                       0,
+		"a":                      1,
+		"abcd":                   1,
+		"abcde":                  2,
+		"hello world!":           3,
+		"你好":                     2,
+		"你好 world":               4, // 6 个 ASCII 字符 2 个 token，2 个中文字符各 1 个
+		"😀😀":                     2,
+		strings.Repeat("x", 400): 100,
+	}
+	for text, want := range tests {
+		if got := estimateTokens(text); got != want {
+			t.Errorf("estimateTokens(%.20q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestEstimateChatRequestTokens(t *testing.T) {
+	text := strings.Repeat("x", 40) // 10 个 token
+	tests := []struct {
+		name string
+		req  model.ChatCompletionRequest
+		want int
+	}{
+		{
+			name: "each message adds 4 tokens of overhead",
+			req:  model.ChatCompletionRequest{Messages: []model.Message{{Role: "system", Content: text}, {Role: "user", Content: text}}},
+			want: 28,
+		},
+		{
+			name: "text parts count and media parts use a fixed size",
+			req: model.ChatCompletionRequest{Messages: []model.Message{{Role: "user", Content: []interface{}{
+				map[string]interface{}{"type": "text", "text": text},
+				map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "https://example.com/a.png"}},
+				map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"data": strings.Repeat("A", 4000)}},
+			}}}},
+			want: 4 + 10 + 2*mediaPartTokens,
+		},
+		{
+			name: "tool calls count their name and arguments",
+			req: model.ChatCompletionRequest{Messages: []model.Message{{Role: "assistant", ToolCalls: []model.ToolCall{
+				{ID: "call_1", Type: "function", Function: model.FunctionCall{Name: "lookup", Arguments: `{"q":"abcd"}`}},
+			}}}},
+			want: 4 + 2 + 3,
+		},
+		{
+			name: "tool definitions are counted",
+			req: model.ChatCompletionRequest{
+				Messages: []model.Message{{Role: "user", Content: text}},
+				Tools:    []model.Tool{{Type: "function", Function: &model.FunctionDefinition{Name: "lookup"}}},
+			},
+			want: 14 + estimateTokens(`[{"type":"function","function":{"name":"lookup","parameters":null}}]`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateChatRequestTokens(&tt.req); got != tt.want {
+				t.Errorf("estimateChatRequestTokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateGeminiRequestTokens(t *testing.T) {
+	text := strings.Repeat("x", 40) // 10 个 token
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr bool
+	}{
+		{name: "each content adds 4 tokens", body: `{"contents":[{"role":"user","parts":[{"text":"` + text + `"}]},{"role":"model","parts":[{"text":"` + text + `"}]}]}`, want: 8 + (10 + 1) + (10 + 2)}, // role 也是文本
+		{name: "system instruction and tools", body: `{"systemInstruction":{"parts":[{"text":"` + text + `"}]},"tools":[{"functionDeclarations":[{"name":"abcd"}]}]}`, want: 10 + 1},
+		{name: "inline and file data use a fixed size", body: `{"contents":[{"parts":[{"inlineData":{"mimeType":"image/png","data":"` + strings.Repeat("A", 4000) + `"}},{"fileData":{"fileUri":"gs://b/f"}}]}]}`, want: 4 + 2*mediaPartTokens},
+		{name: "thought signatures are skipped", body: `{"contents":[{"parts":[{"text":"abcd","thoughtSignature":"` + strings.Repeat("S", 4000) + `"}]}]}`, want: 4 + 1},
+		{name: "other fields are ignored", body: `{"contents":[],"generationConfig":{"stopSequences":["` + text + `"]}}`, want: 0},
+		{name: "countTokens wrapper", body: `{"generateContentRequest":{"model":"models/m","contents":[{"parts":[{"text":"abcd"}]}]}}`, want: 4 + 1},
+		{name: "invalid JSON", body: `{"contents":`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := estimateGeminiRequestTokens([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("estimateGeminiRequestTokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// fixedTokenLimits 是返回固定上限的 TokenLimitSource
+type fixedTokenLimits map[string]ModelLimits
+
+func (f fixedTokenLimits) TokenLimits(modelName string) ModelLimits { return f[modelName] }
+
+func TestCheckTokenLimits(t *testing.T) {
+	limits := fixedTokenLimits{"m": {Input: 1000, Output: 100}, "input-only": {Input: 1000}}
+	tests := []struct {
+		name      string
+		env       []string
+		model     string
+		prompt    int
+		maxTokens int
+		wantParam string
+		wantOut   bool
+	}{
+		{name: "within the limits", model: "m", prompt: 1000, maxTokens: 100},
+		{name: "estimate within the tolerance", model: "m", prompt: 1200},
+		{name: "estimate beyond the tolerance", model: "m", prompt: 1201, wantParam: "messages"},
+		{name: "custom tolerance", env: []string{"TOKEN_LIMIT_TOLERANCE_PERCENT", "0"}, model: "m", prompt: 1001, wantParam: "messages"},
+		{name: "negative tolerance is treated as zero", env: []string{"TOKEN_LIMIT_TOLERANCE_PERCENT", "-50"}, model: "m", prompt: 1000},
+		{name: "output above the model limit", model: "m", prompt: 10, maxTokens: 101, wantParam: "max_tokens", wantOut: true},
+		{name: "unknown output limit", model: "input-only", maxTokens: 1 << 20},
+		{name: "unknown model", model: "other", prompt: 1 << 30, maxTokens: 1 << 30},
+		{name: "check disabled", env: []string{"TOKEN_LIMIT_CHECK_ENABLED", "false"}, model: "m", prompt: 1 << 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestGenAIService(t)
+			s.configManager = newTestConfigManager(t, append([]string{"TOKEN_LIMIT_CHECK_ENABLED", "true", "TOKEN_LIMIT_TOLERANCE_PERCENT", "20"}, tt.env...)...)
+			s.SetTokenLimitSource(limits)
+
+			err := s.checkTokenLimits(tt.model, tt.prompt, "messages", tt.maxTokens, "max_tokens")
+			if tt.wantParam == "" {
+				if err != nil {
+					t.Fatalf("checkTokenLimits = %v", err)
+				}
+				return
+			}
+			var limitErr *TokenLimitError
+			if !errors.As(err, &limitErr) || limitErr.Param != tt.wantParam || limitErr.Output != tt.wantOut || limitErr.Model != tt.model {
+				t.Fatalf("checkTokenLimits = %v, want TokenLimitError on %s", err, tt.wantParam)
+			}
+		})
+	}
+
+	t.Run("no limit source", func(t *testing.T) {
+		s := newTestGenAIService(t)
+		if err := s.checkTokenLimits("m", 1<<30, "messages", 1<<30, "max_tokens"); err != nil {
+			t.Errorf("checkTokenLimits without a limit source = %v", err)
+		}
+	})
+}
+
+func TestCheckGeminiTokenLimits(t *testing.T) {
+	s := newTestGenAIService(t)
+	s.configManager = newTestConfigManager(t, "TOKEN_LIMIT_CHECK_ENABLED", "true", "TOKEN_LIMIT_TOLERANCE_PERCENT", "0")
+	s.SetTokenLimitSource(fixedTokenLimits{"m": {Input: 100, Output: 50}})
+
+	long := strings.Repeat("x", 400)
+	tests := []struct {
+		name      string
+		body      string
+		wantParam string
+	}{
+		{name: "within the limits", body: `{"contents":[{"parts":[{"text":"hi"}]}],"generationConfig":{"maxOutputTokens":50}}`},
+		{name: "contents too long", body: `{"contents":[{"parts":[{"text":"` + long + `"}]}]}`, wantParam: "contents"},
+		{name: "output too large", body: `{"contents":[],"generationConfig":{"maxOutputTokens":51}}`, wantParam: "generationConfig.maxOutputTokens"},
+		{name: "unparseable body is left to the upstream", body: `{"contents":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.checkGeminiTokenLimits("m", []byte(tt.body))
+			var limitErr *TokenLimitError
+			if tt.wantParam == "" {
+				if err != nil {
+					t.Errorf("checkGeminiTokenLimits = %v", err)
+				}
+			} else if !errors.As(err, &limitErr) || limitErr.Param != tt.wantParam {
+				t.Errorf("checkGeminiTokenLimits = %v, want TokenLimitError on %s", err, tt.wantParam)
+			}
+		})
+	}
+}
+
+func TestStreamUsageWriter(t *testing.T) {
+	chunk := `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"abcdefgh"}}]}` + "\n\n"
+	tests := []struct {
+		name string
+		in   []string // 分多次写入，检查跨写入的行拼接
+		want string
+	}{
+		{
+			name: "usage is added before DONE when the stream has none",
+			in:   []string{chunk[:30], chunk[30:], "data: [DONE]\n\n"},
+			want: chunk + `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}` + "\n\n" + "data: [DONE]\n\n",
+		},
+		{
+			name: "missing prompt tokens are filled in",
+			in:   []string{`data: {"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":0,"completion_tokens":3,"total_tokens":3}}` + "\n\n", "data: [DONE]\n\n"},
+			want: `data: {"choices":[],"id":"chatcmpl-1","usage":{"completion_tokens":3,"prompt_tokens":7,"total_tokens":10}}` + "\n\n" + "data: [DONE]\n\n",
+		},
+		{
+			name: "upstream usage is kept",
+			in:   []string{`data: {"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}` + "\n\n", "data: [DONE]\n\n"},
+			want: `data: {"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}` + "\n\n" + "data: [DONE]\n\n",
+		},
+		{
+			name: "empty stream gets no usage",
+			in:   []string{"data: [DONE]\n\n"},
+			want: "data: [DONE]\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			w := &streamUsageWriter{out: &out, promptTokens: 7}
+			for _, p := range tt.in {
+				if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+					t.Fatalf("Write = %d, %v", n, err)
+				}
+			}
+			if out.String() != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
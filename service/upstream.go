@@ -0,0 +1,285 @@
+// service/upstream.go
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"gemini_polling/logger"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// geminiAPIBase 是 Google Generative Language API 的基础地址
+	geminiAPIBase = "https://generativelanguage.googleapis.com/v1beta"
+	// openAIChatCompletionsURL 是 Google 提供的 OpenAI 兼容聊天接口
+	openAIChatCompletionsURL = geminiAPIBase + "/openai/chat/completions"
+)
+
+// UpstreamError 表示上游返回了非 200 的响应
+type UpstreamError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("上游API错误 (HTTP %d): %s", e.StatusCode, string(e.Body))
+}
+
+// ErrAllKeysRateLimited 表示本次请求的所有尝试都遇到了 429 或没有可用 Key
+var ErrAllKeysRateLimited = errors.New("所有 API Key 均被限流")
+
+// ErrStreamTruncated 表示 OpenAI 兼容的上游流在发送 [DONE] 之前就已关闭
+var ErrStreamTruncated = errors.New("上游流未发送 [DONE] 即关闭")
+
+// retryableError 标记可以换一个 Key 重试的错误
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+func retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+func isRetryable(err error) bool {
+	var re *retryableError
+	return errors.As(err, &re)
+}
+
+// upstreamCall 描述一次可以在多个 Key 之间重试的上游调用
+type upstreamCall struct {
+	label string      // 日志中的调用类型
+	model string      // 目标模型，同时用作熔断器的维度和凭据路由的依据
+	api   upstreamAPI // 调用的接口类型，只会选择支持该接口的凭据
+
+	// newRequest 使用给定的 Key 构造上游请求
+	newRequest func(ctx context.Context, key *model.APIKey) (*http.Request, error)
+	// onSuccess 处理 200 响应。返回 retryable 包装的错误时会换 Key 重试，
+	// 其他错误会直接返回给调用方。
+	onSuccess func(resp *http.Response, key *model.APIKey) error
+
+	// keyID 不为 0 时只使用这个 Key (访问该 Key 创建的上游资源)，Key 不可用时直接返回错误
+	keyID uint
+	// keepKeyOn4xx 表示上游的 4xx 错误 (429 除外) 与 Key 无关 (如上游资源已过期)，不禁用 Key，直接返回错误
+	keepKeyOn4xx bool
+}
+
+// doWithRetry 从 Key 池中依次取 Key 执行 call，直到成功、遇到不可重试的错误、
+// 模型熔断或用尽 MaxRetries 次尝试。
+func (s *GenAIService) doWithRetry(ctx context.Context, call upstreamCall) error {
+	maxRetries := s.configManager.Get().MaxRetries
+	var lastErr error
+	allRateLimited := true // 每次尝试都因 429 或无可用 Key 而失败
+
+	for i := 0; i < maxRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.breakers.Allow(call.model); err != nil {
+			logger.Warn("%s 请求被熔断器拒绝: %v", call.label, err)
+			return err
+		}
+
+		if call.keyID != 0 {
+			activeKey, err := s.keyPool.GetKeyByID(call.keyID)
+			if err != nil {
+				s.breakers.Record(call.model, outcomeIgnored)
+				return fmt.Errorf("Key ID %d 当前不可用: %w", call.keyID, err)
+			}
+			logger.Info("第 %d 次尝试 (%s), 使用固定的 Key ID: %d, 模型: %s", i+1, call.label, activeKey.ID, call.model)
+			if err = s.attempt(ctx, call, activeKey); err == nil || !isRetryable(err) {
+				return err
+			}
+			lastErr = err
+			allRateLimited = false
+			continue
+		}
+
+		activeKey, err := s.keyPool.GetKeyFor(call.model, func(provider string) bool {
+			return supportsAPI(provider, call.api)
+		})
+		if errors.Is(err, ErrNoMatchingKeys) {
+			s.breakers.Record(call.model, outcomeIgnored)
+			return fmt.Errorf("模型 %s 没有可用于 %s 的上游凭据: %w", call.model, call.label, err)
+		}
+		if err != nil {
+			s.breakers.Record(call.model, outcomeIgnored)
+			lastErr = err
+			if errors.Is(err, ErrNoAvailableKeys) {
+				logger.Infoln("无可用 Key，等待 Key 池释放...")
+				time.Sleep(2 * time.Second) // Wait a bit before retrying
+			}
+			continue
+		}
+
+		logger.Info("第 %d 次尝试 (%s), 使用 Key ID: %d, 模型: %s", i+1, call.label, activeKey.ID, call.model)
+		err = s.attempt(ctx, call, activeKey)
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		lastErr = err
+		var upstreamErr *UpstreamError
+		if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusTooManyRequests {
+			allRateLimited = false
+		}
+	}
+
+	logger.Error("所有 %d 次重试均失败。", maxRetries)
+	if lastErr != nil && allRateLimited {
+		return fmt.Errorf("%w，最后一次错误: %w", ErrAllKeysRateLimited, lastErr)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("所有 API Key 均尝试失败，最后一次错误: %w", lastErr)
+	}
+	return errors.New("所有 API Key 均尝试失败，但未捕获到具体错误")
+}
+
+// attempt 使用单个 Key 执行一次上游调用，并负责归还 Key 和记录熔断结果
+func (s *GenAIService) attempt(ctx context.Context, call upstreamCall, key *model.APIKey) error {
+	httpReq, err := call.newRequest(ctx, key)
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		// Vertex AI 换取 access token 被拒绝，与上游请求失败同样处理
+		logger.Error("Key ID %d 获取访问令牌失败: %s", key.ID, upstreamErr.Error())
+		s.handleUpstreamError(call.model, key, upstreamErr)
+		return retryable(upstreamErr)
+	}
+	if err != nil {
+		s.keyPool.ReleaseKey(key)
+		s.breakers.Record(call.model, outcomeIgnored)
+		err = fmt.Errorf("创建 HTTP 请求失败: %w", err)
+		logger.Errorln(err)
+		return retryable(err)
+	}
+
+	resp, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		s.keyPool.ReleaseKey(key)
+		if ctx.Err() != nil {
+			// 客户端已断开，不是上游的问题
+			s.breakers.Record(call.model, outcomeIgnored)
+			return ctx.Err()
+		}
+		// 网络错误和超时视为上游故障，计入熔断统计但不惩罚 Key
+		s.breakers.Record(call.model, outcomeFailure)
+		err = fmt.Errorf("请求 Google API 失败 (Key ID: %d): %w", key.ID, err)
+		logger.Errorln(err)
+		return retryable(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		upstreamErr = &UpstreamError{StatusCode: resp.StatusCode, Body: body}
+		logger.Error("Key ID %d 请求失败: %s", key.ID, upstreamErr.Error())
+		if call.keepKeyOn4xx && resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			s.keyPool.ReleaseKey(key)
+			s.breakers.Record(call.model, outcomeIgnored)
+			return upstreamErr
+		}
+		s.handleUpstreamError(call.model, key, upstreamErr)
+		return retryable(upstreamErr)
+	}
+
+	if err := call.onSuccess(resp, key); err != nil {
+		if isRetryable(err) {
+			// 读取上游响应中途失败
+			s.keyPool.ReleaseKey(key)
+			s.breakers.Record(call.model, outcomeFailure)
+			return err
+		}
+		s.keyPool.ReturnKey(key, false)
+		s.breakers.Record(call.model, outcomeSuccess)
+		return err
+	}
+
+	s.keyPool.ReturnKey(key, false)
+	s.breakers.Record(call.model, outcomeSuccess)
+	return nil
+}
+
+// handleUpstreamError 根据上游状态码决定如何处理 Key:
+// 429 进入冷却，5xx 计入模型熔断而不影响 Key 健康分数，其他 4xx 永久禁用 Key。
+func (s *GenAIService) handleUpstreamError(modelName string, key *model.APIKey, upstreamErr *UpstreamError) {
+	switch status := upstreamErr.StatusCode; {
+	case status == http.StatusTooManyRequests:
+		s.keyPool.ReturnKey(key, true) // Cooldown
+		s.breakers.Record(modelName, outcomeIgnored)
+	case status >= 500:
+		s.keyPool.ReleaseKey(key)
+		s.breakers.Record(modelName, outcomeFailure)
+	case status >= 400:
+		s.disableKey(key, upstreamErr.Error())
+		s.keyPool.ReleaseKey(key)
+		s.breakers.Record(modelName, outcomeIgnored)
+	default:
+		s.keyPool.ReleaseKey(key)
+		s.breakers.Record(modelName, outcomeIgnored)
+	}
+}
+
+// relaySSE 将上游的 SSE 流逐行转发给客户端。
+// 写客户端失败返回普通错误；读上游失败时，如果还没有向客户端写出任何数据则返回可重试错误，
+// 否则重试会导致客户端收到重复内容，只能返回普通错误。
+// stopAtDone 为 true 时上游流必须以 [DONE] 结束，提前关闭按读取失败处理，避免不完整的流被当作成功 (例如写入响应缓存)。
+func relaySSE(w io.Writer, flusher http.Flusher, resp *http.Response, key *model.APIKey, stopAtDone bool) error {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	wrote := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\n\n", line); err != nil {
+			logger.Warn("写入响应流失败: %v (客户端可能已断开连接)", err)
+			return err
+		}
+		wrote = true
+		flusher.Flush()
+		if stopAtDone && strings.HasSuffix(line, "[DONE]") {
+			logger.Info("请求处理成功 (Key ID: %d), 流已结束。", key.ID)
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		logger.Error("读取上游流时发生错误 (Key ID: %d): %v", key.ID, err)
+		if wrote {
+			return fmt.Errorf("上游流在传输中断开: %w", err)
+		}
+		return retryable(err)
+	}
+
+	if stopAtDone {
+		logger.Error("上游流未发送 [DONE] 即关闭 (Key ID: %d)", key.ID)
+		if wrote {
+			return ErrStreamTruncated
+		}
+		return retryable(ErrStreamTruncated)
+	}
+
+	logger.Info("请求处理成功 (Key ID: %d), 上游流正常关闭。", key.ID)
+	return nil
+}
+
+// readBody 读取完整的上游响应体，读取失败时返回可重试错误
+func readBody(resp *http.Response, dst *[]byte) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return retryable(fmt.Errorf("读取上游响应体失败: %w", err))
+	}
+	*dst = body
+	return nil
+}
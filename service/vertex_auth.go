@@ -0,0 +1,225 @@
+// service/vertex_auth.go
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gemini_polling/model"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vertexTokenScope 是 Vertex AI 需要的 OAuth scope
+	vertexTokenScope = "https://www.googleapis.com/auth/cloud-platform"
+	// defaultTokenURI 是服务账号 JSON 中没有 token_uri 时使用的 Google OAuth 地址
+	defaultTokenURI = "https://oauth2.googleapis.com/token"
+	// vertexTokenMargin 是 access token 到期前提前刷新的时间
+	vertexTokenMargin = 5 * time.Minute
+)
+
+// serviceAccount 是服务账号 JSON 中换取 access token 需要的字段
+type serviceAccount struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// parseServiceAccount 解析并检查服务账号 JSON
+func parseServiceAccount(credential string) (*serviceAccount, *rsa.PrivateKey, error) {
+	var sa serviceAccount
+	if err := json.Unmarshal([]byte(credential), &sa); err != nil {
+		return nil, nil, fmt.Errorf("解析服务账号 JSON 失败: %w", err)
+	}
+	if sa.Type != "" && sa.Type != "service_account" {
+		return nil, nil, fmt.Errorf("不支持的凭据类型 %q，需要 service_account", sa.Type)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, nil, errors.New("服务账号 JSON 缺少 client_email 或 private_key")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = defaultTokenURI
+	}
+
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, nil, errors.New("服务账号的 private_key 不是 PEM 格式")
+	}
+	var privateKey *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("服务账号的 private_key 不是 RSA 私钥")
+		}
+		privateKey = rsaKey
+	} else if rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		privateKey = rsaKey
+	} else {
+		return nil, nil, fmt.Errorf("解析服务账号的 private_key 失败: %w", err)
+	}
+	return &sa, privateKey, nil
+}
+
+// vertexToken 是缓存的 access token
+type vertexToken struct {
+	fingerprint [32]byte // 凭据内容的摘要，凭据被修改后缓存失效
+	value       string
+	expiresAt   time.Time
+}
+
+// vertexTokens 按凭据 ID 缓存服务账号换取的 access token
+type vertexTokens struct {
+	mu     sync.Mutex
+	tokens map[uint]*vertexToken
+	// minting 保证同一个凭据同时只有一个换取请求，其他请求等待其结果
+	minting map[uint]*sync.Mutex
+}
+
+func newVertexTokens() *vertexTokens {
+	return &vertexTokens{
+		tokens:  make(map[uint]*vertexToken),
+		minting: make(map[uint]*sync.Mutex),
+	}
+}
+
+// cached 返回仍然有效的缓存 token
+func (t *vertexTokens) cached(keyID uint, fingerprint [32]byte, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tok, ok := t.tokens[keyID]; ok && tok.fingerprint == fingerprint && now.Before(tok.expiresAt) {
+		return tok.value, true
+	}
+	return "", false
+}
+
+// lock 返回凭据对应的换取锁
+func (t *vertexTokens) lock(keyID uint) *sync.Mutex {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.minting[keyID]
+	if !ok {
+		m = &sync.Mutex{}
+		t.minting[keyID] = m
+	}
+	return m
+}
+
+// vertexAccessToken 返回 Vertex AI 凭据的 access token，没有有效的缓存时用服务账号签名的 JWT 向 token_uri 换取。
+// token 接口返回的非 200 响应以 UpstreamError 返回，由调用方按普通的上游错误处理 (如 4xx 禁用凭据)。
+func (s *GenAIService) vertexAccessToken(ctx context.Context, key *model.APIKey) (string, error) {
+	fingerprint := sha256.Sum256([]byte(key.Credential))
+	if token, ok := s.vertexTokens.cached(key.ID, fingerprint, time.Now()); ok {
+		return token, nil
+	}
+
+	m := s.vertexTokens.lock(key.ID)
+	m.Lock()
+	defer m.Unlock()
+	if token, ok := s.vertexTokens.cached(key.ID, fingerprint, time.Now()); ok {
+		return token, nil
+	}
+
+	token, expiresIn, err := s.mintVertexToken(ctx, key.Credential)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(expiresIn - vertexTokenMargin)
+	s.vertexTokens.mu.Lock()
+	s.vertexTokens.tokens[key.ID] = &vertexToken{fingerprint: fingerprint, value: token, expiresAt: expiresAt}
+	s.vertexTokens.mu.Unlock()
+	return token, nil
+}
+
+// mintVertexToken 使用 JWT Bearer 授权 (RFC 7523) 换取 access token
+func (s *GenAIService) mintVertexToken(ctx context.Context, credential string) (string, time.Duration, error) {
+	sa, privateKey, err := parseServiceAccount(credential)
+	if err != nil {
+		return "", 0, err
+	}
+	assertion, err := signServiceAccountJWT(sa, privateKey, time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sa.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("创建 token 请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("请求 token 接口失败: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("读取 token 响应失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, &UpstreamError{StatusCode: resp.StatusCode, Body: body}
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil || tok.AccessToken == "" {
+		return "", 0, fmt.Errorf("token 响应中没有 access_token: %s", string(body))
+	}
+	if tok.ExpiresIn <= 0 {
+		tok.ExpiresIn = 3600
+	}
+	return tok.AccessToken, time.Duration(tok.ExpiresIn) * time.Second, nil
+}
+
+// signServiceAccountJWT 生成 RS256 签名的授权 JWT，有效期一小时
+func signServiceAccountJWT(sa *serviceAccount, privateKey *rsa.PrivateKey, now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if sa.PrivateKeyID != "" {
+		header["kid"] = sa.PrivateKeyID
+	}
+	claims := map[string]interface{}{
+		"iss":   sa.ClientEmail,
+		"scope": vertexTokenScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("签名 JWT 失败: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
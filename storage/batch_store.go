@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"gemini_polling/model"
+
+	"gorm.io/gorm"
+)
+
+// BatchStore 持久化批处理任务及其输入/输出文件的元信息
+type BatchStore struct {
+	db *gorm.DB
+}
+
+func NewBatchStore(db *gorm.DB) *BatchStore {
+	return &BatchStore{db: db}
+}
+
+// activeBatchStatuses 是尚未结束、需要由后台执行器继续处理的批处理状态
+var activeBatchStatuses = []string{
+	model.BatchStatusValidating,
+	model.BatchStatusInProgress,
+	model.BatchStatusFinalizing,
+	model.BatchStatusCancelling,
+}
+
+func (s *BatchStore) CreateFile(file *model.BatchFile) error {
+	return s.db.Create(file).Error
+}
+
+// GetFile 按 ID 查询文件。clientID 为 nil 时不限制创建者
+func (s *BatchStore) GetFile(id string, clientID *uint) (*model.BatchFile, error) {
+	var file model.BatchFile
+	query := s.db.Where("id = ?", id)
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	if err := query.First(&file).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// ListFiles 返回客户端的文件，按创建时间倒序。purpose 为空时不过滤
+func (s *BatchStore) ListFiles(clientID uint, purpose string) ([]model.BatchFile, error) {
+	var files []model.BatchFile
+	query := s.db.Where("client_id = ?", clientID)
+	if purpose != "" {
+		query = query.Where("purpose = ?", purpose)
+	}
+	err := query.Order("created_at DESC").Find(&files).Error
+	return files, err
+}
+
+func (s *BatchStore) DeleteFile(id string) error {
+	result := s.db.Delete(&model.BatchFile{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// FileInUse 判断文件是否仍被未结束的批处理作为输入使用
+func (s *BatchStore) FileInUse(fileID string) (bool, error) {
+	var count int64
+	err := s.db.Model(&model.Batch{}).
+		Where("input_file_id = ? AND status IN ?", fileID, activeBatchStatuses).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (s *BatchStore) CreateBatch(batch *model.Batch) error {
+	return s.db.Create(batch).Error
+}
+
+// GetBatch 按 ID 查询批处理。clientID 为 nil 时不限制创建者
+func (s *BatchStore) GetBatch(id string, clientID *uint) (*model.Batch, error) {
+	var batch model.Batch
+	query := s.db.Where("id = ?", id)
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	if err := query.First(&batch).Error; err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// ListBatches 按创建时间倒序分页返回批处理。
+// clientID 为 nil 时返回所有客户端的批处理；after 为上一页最后一个批处理的 ID。
+func (s *BatchStore) ListBatches(clientID *uint, after string, limit int) ([]model.Batch, error) {
+	query := s.db.Model(&model.Batch{})
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	if after != "" {
+		var cursor model.Batch
+		if err := s.db.Select("created_at").Where("id = ?", after).First(&cursor).Error; err != nil {
+			return nil, err
+		}
+		query = query.Where("created_at < ?", cursor.CreatedAt)
+	}
+	var batches []model.Batch
+	err := query.Order("created_at DESC").Limit(limit).Find(&batches).Error
+	return batches, err
+}
+
+// NextActiveBatch 返回最早创建的未结束批处理，没有时返回 nil
+func (s *BatchStore) NextActiveBatch() (*model.Batch, error) {
+	var batches []model.Batch
+	err := s.db.Where("status IN ?", activeBatchStatuses).Order("created_at ASC").Limit(1).Find(&batches).Error
+	if err != nil || len(batches) == 0 {
+		return nil, err
+	}
+	return &batches[0], nil
+}
+
+// CountActiveBatches 返回未结束的批处理数量
+func (s *BatchStore) CountActiveBatches() (int64, error) {
+	var count int64
+	err := s.db.Model(&model.Batch{}).Where("status IN ?", activeBatchStatuses).Count(&count).Error
+	return count, err
+}
+
+// TransitionBatch 仅当批处理当前处于 from 中的某个状态时才更新它，返回是否更新成功。
+// 用于避免后台执行器与取消请求之间互相覆盖状态。
+func (s *BatchStore) TransitionBatch(id string, from []string, updates map[string]interface{}) (bool, error) {
+	result := s.db.Model(&model.Batch{}).Where("id = ? AND status IN ?", id, from).Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// UpdateBatchCounts 更新批处理的请求计数
+func (s *BatchStore) UpdateBatchCounts(id string, completed, failed int) error {
+	return s.db.Model(&model.Batch{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"completed_count": completed,
+		"failed_count":    failed,
+	}).Error
+}
+
+// FinalizeBatch 在同一个事务中登记批处理生成的文件并更新批处理状态
+func (s *BatchStore) FinalizeBatch(id string, files []*model.BatchFile, updates map[string]interface{}) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, f := range files {
+			if err := tx.Create(f).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&model.Batch{}).Where("id = ?", id).Updates(updates).Error
+	})
+}
+
+func (s *BatchStore) CreateGeminiBatch(batch *model.GeminiBatch) error {
+	return s.db.Create(batch).Error
+}
+
+// GetGeminiBatch 按上游资源名查询 Gemini 批处理。clientID 为 nil 时不限制创建者
+func (s *BatchStore) GetGeminiBatch(name string, clientID *uint) (*model.GeminiBatch, error) {
+	var batch model.GeminiBatch
+	query := s.db.Where("name = ?", name)
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	if err := query.First(&batch).Error; err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// FindGeminiBatchByResponsesFile 按结果文件名查询 Gemini 批处理。clientID 为 nil 时不限制创建者
+func (s *BatchStore) FindGeminiBatchByResponsesFile(file string, clientID *uint) (*model.GeminiBatch, error) {
+	var batch model.GeminiBatch
+	query := s.db.Where("responses_file = ?", file)
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	if err := query.First(&batch).Error; err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// ListGeminiBatches 按创建时间倒序返回 Gemini 批处理。clientID 为 nil 时返回所有客户端的批处理
+func (s *BatchStore) ListGeminiBatches(clientID *uint) ([]model.GeminiBatch, error) {
+	var batches []model.GeminiBatch
+	query := s.db.Order("created_at DESC")
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	err := query.Find(&batches).Error
+	return batches, err
+}
+
+// UpdateGeminiBatch 保存从上游获取的最新状态
+func (s *BatchStore) UpdateGeminiBatch(batch *model.GeminiBatch) error {
+	return s.db.Model(&model.GeminiBatch{}).Where("id = ?", batch.ID).Updates(map[string]interface{}{
+		"display_name":   batch.DisplayName,
+		"state":          batch.State,
+		"responses_file": batch.ResponsesFile,
+		"operation":      batch.Operation,
+		"last_polled_at": batch.LastPolledAt,
+	}).Error
+}
+
+func (s *BatchStore) DeleteGeminiBatch(id uint) error {
+	return s.db.Delete(&model.GeminiBatch{}, id).Error
+}
@@ -76,10 +76,10 @@ func InitDB(cfg *config.Config) (*gorm.DB, error) {
 	}
 
 	logger.Infoln("正在进行数据库迁移 (AutoMigrate)...")
-	if err := db.AutoMigrate(&model.APIKey{}); err != nil {
+	if err := db.AutoMigrate(&model.APIKey{}, &model.ModelEntry{}, &model.Client{}, &model.BatchFile{}, &model.Batch{}, &model.GeminiBatch{}, &model.PromptTemplate{}, &model.Thread{}, &model.ThreadMessage{}); err != nil {
 		return nil, fmt.Errorf("GORM 自动迁移失败: %w", err)
 	}
-	logger.Infoln("api_keys 表已成功初始化/迁移。")
+	logger.Infoln("api_keys、model_entries、clients、batch_files、batches、gemini_batches、prompt_templates、threads、thread_messages 表已成功初始化/迁移。")
 	
 	// 检查是否需要添加新字段的默认值
 	if err := updateExistingKeys(db); err != nil {
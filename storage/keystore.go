@@ -25,6 +25,24 @@ func (s *KeyStore) Add(apiKeyVal string) (*model.APIKey, error) {
 	return key, nil
 }
 
+// AddCredential 添加一个已经检查过字段的上游凭据 (AI Studio Key、Vertex AI 服务账号或 OpenAI 兼容接口)
+func (s *KeyStore) AddCredential(key *model.APIKey) error {
+	key.Enabled = true
+	return s.db.Create(key).Error
+}
+
+// UpdateModels 修改凭据服务的模型
+func (s *KeyStore) UpdateModels(id uint, models string) error {
+	result := s.db.Model(&model.APIKey{}).Where("id = ?", id).Update("models", models)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
 // FindByKey 仅用于用户鉴权，检查用户提供的key是否存在且有效
 func (s *KeyStore) FindByKey(apiKeyVal string) (*model.APIKey, error) {
 	var key model.APIKey
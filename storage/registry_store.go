@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"gemini_polling/model"
+
+	"gorm.io/gorm"
+)
+
+// RegistryStore 持久化模型目录条目和客户端凭据
+type RegistryStore struct {
+	db *gorm.DB
+}
+
+func NewRegistryStore(db *gorm.DB) *RegistryStore {
+	return &RegistryStore{db: db}
+}
+
+// ListModelEntries 返回所有模型目录条目，按名称排序
+func (s *RegistryStore) ListModelEntries() ([]model.ModelEntry, error) {
+	var entries []model.ModelEntry
+	err := s.db.Order("name ASC").Find(&entries).Error
+	return entries, err
+}
+
+// SaveModelEntry 创建 (ID 为 0) 或更新一个模型目录条目
+func (s *RegistryStore) SaveModelEntry(entry *model.ModelEntry) error {
+	if entry.ID == 0 {
+		return s.db.Create(entry).Error
+	}
+	result := s.db.Model(&model.ModelEntry{}).Where("id = ?", entry.ID).Updates(map[string]interface{}{
+		"name":               entry.Name,
+		"target":             entry.Target,
+		"hidden":             entry.Hidden,
+		"description":        entry.Description,
+		"input_token_limit":  entry.InputTokenLimit,
+		"output_token_limit": entry.OutputTokenLimit,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *RegistryStore) DeleteModelEntry(id uint) error {
+	result := s.db.Delete(&model.ModelEntry{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// ListClients 返回所有客户端凭据，按 ID 排序
+func (s *RegistryStore) ListClients() ([]model.Client, error) {
+	var clients []model.Client
+	err := s.db.Order("id ASC").Find(&clients).Error
+	return clients, err
+}
+
+// SaveClient 创建 (ID 为 0) 或更新一个客户端凭据
+func (s *RegistryStore) SaveClient(client *model.Client) error {
+	if client.ID == 0 {
+		return s.db.Create(client).Error
+	}
+	result := s.db.Model(&model.Client{}).Where("id = ?", client.ID).Updates(map[string]interface{}{
+		"name":           client.Name,
+		"key":            client.Key,
+		"allowed_models": client.AllowedModels,
+		"system_prompt":  client.SystemPrompt,
+		"enabled":        client.Enabled,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *RegistryStore) DeleteClient(id uint) error {
+	result := s.db.Delete(&model.Client{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
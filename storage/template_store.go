@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"gemini_polling/model"
+
+	"gorm.io/gorm"
+)
+
+// TemplateStore 持久化提示词模板的各个版本
+type TemplateStore struct {
+	db *gorm.DB
+}
+
+func NewTemplateStore(db *gorm.DB) *TemplateStore {
+	return &TemplateStore{db: db}
+}
+
+// ListLatestTemplates 返回每个模板的最新版本，按名称排序
+func (s *TemplateStore) ListLatestTemplates() ([]model.PromptTemplate, error) {
+	var templates []model.PromptTemplate
+	latest := s.db.Model(&model.PromptTemplate{}).Select("name, MAX(version) AS version").Group("name")
+	err := s.db.Joins("JOIN (?) AS latest ON latest.name = prompt_templates.name AND latest.version = prompt_templates.version", latest).
+		Order("prompt_templates.name ASC").Find(&templates).Error
+	return templates, err
+}
+
+// ListTemplateVersions 返回一个模板的所有版本，最新的在前
+func (s *TemplateStore) ListTemplateVersions(name string) ([]model.PromptTemplate, error) {
+	var templates []model.PromptTemplate
+	err := s.db.Where("name = ?", name).Order("version DESC").Find(&templates).Error
+	return templates, err
+}
+
+// GetTemplate 返回模板的指定版本，version 为 0 时返回最新版本。不存在时返回 gorm.ErrRecordNotFound。
+func (s *TemplateStore) GetTemplate(name string, version int) (*model.PromptTemplate, error) {
+	var template model.PromptTemplate
+	query := s.db.Where("name = ?", name)
+	if version > 0 {
+		query = query.Where("version = ?", version)
+	}
+	if err := query.Order("version DESC").First(&template).Error; err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// CreateTemplateVersion 把模板保存为该名称的下一个版本，并回填 ID 和 Version
+func (s *TemplateStore) CreateTemplateVersion(template *model.PromptTemplate) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var latest int
+		if err := tx.Model(&model.PromptTemplate{}).Where("name = ?", template.Name).
+			Select("COALESCE(MAX(version), 0)").Scan(&latest).Error; err != nil {
+			return err
+		}
+		template.ID = 0
+		template.Version = latest + 1
+		return tx.Create(template).Error
+	})
+}
+
+// DeleteTemplate 删除一个模板的所有版本
+func (s *TemplateStore) DeleteTemplate(name string) error {
+	result := s.db.Where("name = ?", name).Delete(&model.PromptTemplate{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"gemini_polling/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ThreadStore 持久化会话线程及其消息
+type ThreadStore struct {
+	db *gorm.DB
+}
+
+func NewThreadStore(db *gorm.DB) *ThreadStore {
+	return &ThreadStore{db: db}
+}
+
+// CreateThread 在一个事务中保存线程和它的初始消息
+func (s *ThreadStore) CreateThread(thread *model.Thread, messages []model.ThreadMessage) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(thread).Error; err != nil {
+			return err
+		}
+		for i := range messages {
+			messages[i].ThreadID = thread.ID
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		return tx.Create(&messages).Error
+	})
+}
+
+// GetThread 返回线程，clientID 不为空时只返回该客户端的线程。不存在时返回 gorm.ErrRecordNotFound。
+func (s *ThreadStore) GetThread(id string, clientID *uint) (*model.Thread, error) {
+	var thread model.Thread
+	query := s.db.Where("id = ?", id)
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	if err := query.First(&thread).Error; err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// DeleteThread 删除线程及其所有消息
+func (s *ThreadStore) DeleteThread(id string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("thread_id = ?", id).Delete(&model.ThreadMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&model.Thread{}).Error
+	})
+}
+
+// ListMessages 按顺序返回线程的消息，activeOnly 为 true 时不包括已归档的消息
+func (s *ThreadStore) ListMessages(threadID string, activeOnly bool) ([]model.ThreadMessage, error) {
+	var messages []model.ThreadMessage
+	query := s.db.Where("thread_id = ?", threadID)
+	if activeOnly {
+		query = query.Where("archived = ?", false)
+	}
+	err := query.Order("id ASC").Find(&messages).Error
+	return messages, err
+}
+
+// AppendMessages 在一个事务中追加消息并更新线程的修改时间
+func (s *ThreadStore) AppendMessages(threadID string, messages []model.ThreadMessage) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for i := range messages {
+			messages[i].ThreadID = threadID
+		}
+		if err := tx.Create(&messages).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.Thread{}).Where("id = ?", threadID).Update("updated_at", time.Now()).Error
+	})
+}
+
+// ArchiveMessages 把 ID 不超过 lastID 的消息标记为已归档，并保存新的摘要
+func (s *ThreadStore) ArchiveMessages(threadID string, lastID uint, summary string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.ThreadMessage{}).Where("thread_id = ? AND id <= ?", threadID, lastID).
+			Update("archived", true).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.Thread{}).Where("id = ?", threadID).Update("summary", summary).Error
+	})
+}